@@ -15,17 +15,35 @@
 package backend
 
 import (
+	"math"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/XiaoMi/Gaea/core/errors"
+	"github.com/XiaoMi/Gaea/models"
 )
 
+// 延迟和等待时间EWMA的衰减时间常数
+const ewmaDecay = 10 * time.Second
+
 type balancer struct {
+	// 保护按负载选择时修改的lastIndex, rand和等待时间的采样, 不需要持有Slice的锁
+	mu sync.Mutex
+
 	total       int
 	lastIndex   int
 	roundRobinQ []int
 	nodeWeights []int
+
+	strategy      string
+	weights       []int       // 按最大公约数约分后的权重
+	selected      []int64     // 上次获取后每个节点被选中的次数, 用于监控
+	waits         []*peakEWMA // 从连接池WaitCount和WaitTime采样的平均等待时间
+	lastWaitCount []int64
+	lastWaitTime  []time.Duration
+	rand          *rand.Rand
 }
 
 // calculate gcd ?
@@ -70,11 +88,19 @@ func newBalancer(nodeWeights []int, total int) *balancer {
 	}
 
 	s.roundRobinQ = make([]int, 0, sum)
+	s.weights = make([]int, len(nodeWeights))
+	s.selected = make([]int64, len(nodeWeights))
+	s.waits = make([]*peakEWMA, len(nodeWeights))
+	s.lastWaitCount = make([]int64, len(nodeWeights))
+	s.lastWaitTime = make([]time.Duration, len(nodeWeights))
 	for index, weight := range nodeWeights {
+		s.weights[index] = weight / gcd
+		s.waits[index] = newPeakEWMA(ewmaDecay)
 		for j := 0; j < weight/gcd; j++ {
 			s.roundRobinQ = append(s.roundRobinQ, index)
 		}
 	}
+	s.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 
 	//random order
 	if 1 < len(s.nodeWeights) {
@@ -110,3 +136,184 @@ func (b *balancer) next() (int, error) {
 	b.lastIndex = b.lastIndex % queueLen
 	return index, nil
 }
+
+// weight 返回节点的权重, 权重已经按最大公约数约分
+func (b *balancer) weight(index int) int {
+	if index < 0 || index >= len(b.weights) {
+		return 0
+	}
+	return b.weights[index]
+}
+
+// setStrategy 设置选择从库的策略, 为空时使用按权重轮询
+func (b *balancer) setStrategy(strategy string) {
+	b.strategy = strategy
+}
+
+// isLoadAware 是否按从库的负载选择节点
+func (b *balancer) isLoadAware() bool {
+	if b == nil {
+		return false
+	}
+	switch b.strategy {
+	case models.BalanceLeastOutstanding, models.BalancePeakEWMA, models.BalanceP2C:
+		return true
+	}
+	return false
+}
+
+func (b *balancer) markSelected(index int) {
+	if index >= 0 && index < len(b.selected) {
+		atomic.AddInt64(&b.selected[index], 1)
+	}
+}
+
+// takeSelected 返回上次调用后节点被选中的次数并清零
+func (b *balancer) takeSelected(index int) int64 {
+	if index < 0 || index >= len(b.selected) {
+		return 0
+	}
+	return atomic.SwapInt64(&b.selected[index], 0)
+}
+
+// pick 按负载从candidates中选择节点, candidates为可用节点的下标并且不为空
+func (b *balancer) pick(candidates []int, pools []ConnectionPool) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	candidates = b.weighted(candidates)
+	if len(candidates) == 1 {
+		return candidates[0]
+	}
+
+	if b.strategy == models.BalanceP2C {
+		first := b.randomPick(candidates, -1)
+		second := b.randomPick(candidates, first)
+		if b.cost(second, pools[second]) < b.cost(first, pools[first]) {
+			return second
+		}
+		return first
+	}
+
+	// 代价相同时从上次选择的下一个节点开始, 避免空闲时总是选择第一个节点
+	b.lastIndex = (b.lastIndex + 1) % len(candidates)
+	best, bestCost := -1, math.MaxFloat64
+	for i := 0; i < len(candidates); i++ {
+		index := candidates[(b.lastIndex+i)%len(candidates)]
+		if c := b.cost(index, pools[index]); c < bestCost {
+			best, bestCost = index, c
+		}
+	}
+	return best
+}
+
+// weighted 去掉权重为0的节点, 全部为0时不过滤
+func (b *balancer) weighted(candidates []int) []int {
+	result := make([]int, 0, len(candidates))
+	for _, index := range candidates {
+		if b.weight(index) > 0 {
+			result = append(result, index)
+		}
+	}
+	if len(result) == 0 {
+		return candidates
+	}
+	return result
+}
+
+// randomPick 按权重随机选择一个节点, 跳过exclude
+func (b *balancer) randomPick(candidates []int, exclude int) int {
+	sum := 0
+	for _, index := range candidates {
+		if index != exclude {
+			sum += b.weight(index)
+		}
+	}
+	if sum <= 0 {
+		for _, index := range candidates {
+			if index != exclude {
+				return index
+			}
+		}
+		return candidates[0]
+	}
+	r := b.rand.Intn(sum)
+	for _, index := range candidates {
+		if index == exclude {
+			continue
+		}
+		if r -= b.weight(index); r < 0 {
+			return index
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// cost 节点的负载代价, 越小越优先:
+// least_outstanding: (正在使用的连接数+1)/权重
+// peak_ewma, p2c: (延迟EWMA+获取连接的平均等待时间)*(正在使用的连接数+1)/权重
+func (b *balancer) cost(index int, cp ConnectionPool) float64 {
+	outstanding := float64(cp.InUse() + 1)
+	weight := float64(b.weight(index))
+	if weight <= 0 {
+		weight = 1
+	}
+	if b.strategy == models.BalanceLeastOutstanding {
+		return outstanding / weight
+	}
+	// 加1ns避免没有请求的节点代价都为0
+	latency := float64(cp.Latency()+b.sampleWait(index, cp)) + 1
+	return latency * outstanding / weight
+}
+
+// sampleWait 根据上次采样后WaitCount和WaitTime的增量计算获取连接的平均等待时间
+func (b *balancer) sampleWait(index int, cp ConnectionPool) time.Duration {
+	count, waitTime := cp.WaitCount(), cp.WaitTime()
+	if delta := count - b.lastWaitCount[index]; delta > 0 {
+		b.waits[index].observe((waitTime - b.lastWaitTime[index]) / time.Duration(delta))
+	}
+	b.lastWaitCount[index], b.lastWaitTime[index] = count, waitTime
+	return b.waits[index].get()
+}
+
+// peakEWMA 延迟的指数加权移动平均, 新的延迟大于当前值时直接取新值, 使变慢的节点立即被降低优先级
+type peakEWMA struct {
+	mu    sync.Mutex
+	decay float64 // 衰减时间常数, 单位ns
+	value float64 // 单位ns
+	stamp time.Time
+}
+
+func newPeakEWMA(decay time.Duration) *peakEWMA {
+	return &peakEWMA{decay: float64(decay)}
+}
+
+func (e *peakEWMA) observe(rtt time.Duration) {
+	e.observeAt(rtt, time.Now())
+}
+
+func (e *peakEWMA) observeAt(rtt time.Duration, now time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if v := float64(rtt); v > e.value || e.stamp.IsZero() {
+		e.value = v
+	} else {
+		w := math.Exp(-float64(now.Sub(e.stamp)) / e.decay)
+		e.value = e.value*w + v*(1-w)
+	}
+	e.stamp = now
+}
+
+func (e *peakEWMA) get() time.Duration {
+	return e.getAt(time.Now())
+}
+
+// getAt 按距离上次观测的时间向0衰减, 长时间没有请求的节点会重新被选中
+func (e *peakEWMA) getAt(now time.Time) time.Duration {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.stamp.IsZero() {
+		return 0
+	}
+	w := math.Exp(-float64(now.Sub(e.stamp)) / e.decay)
+	return time.Duration(e.value * w)
+}
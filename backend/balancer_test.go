@@ -15,8 +15,13 @@
 package backend
 
 import (
+	"context"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -78,3 +83,155 @@ func TestBalancerB(t *testing.T) {
 		assert.Equal(t, (i+1)%len(b.roundRobinQ), b.lastIndex)
 	}
 }
+
+type loadStat struct {
+	dc      string
+	inUse   int64
+	latency time.Duration
+}
+
+func generateLoadDBInfo(mockCtl *gomock.Controller, strategy string, weights []int, stats []loadStat) *DBInfo {
+	connPool := make([]ConnectionPool, 0, len(stats))
+	statusMap := &sync.Map{}
+	for i, stat := range stats {
+		pc := NewMockPooledConnect(mockCtl)
+		pc.EXPECT().GetAddr().Return(stat.dc).AnyTimes()
+		cp := NewMockConnectionPool(mockCtl)
+		cp.EXPECT().Datacenter().Return(stat.dc).AnyTimes()
+		cp.EXPECT().InUse().Return(stat.inUse).AnyTimes()
+		cp.EXPECT().Latency().Return(stat.latency).AnyTimes()
+		cp.EXPECT().WaitCount().Return(int64(0)).AnyTimes()
+		cp.EXPECT().WaitTime().Return(time.Duration(0)).AnyTimes()
+		cp.EXPECT().Get(context.TODO()).Return(pc, nil).AnyTimes()
+		connPool = append(connPool, cp)
+		statusMap.Store(i, StatusUp)
+	}
+	b := newBalancer(weights, len(connPool))
+	b.setStrategy(strategy)
+	return &DBInfo{ConnPool: connPool, Balancer: b, StatusMap: statusMap}
+}
+
+func TestBalancerPickByLoad(t *testing.T) {
+	testCases := []struct {
+		name     string
+		strategy string
+		weights  []int
+		stats    []loadStat
+		expect   int
+	}{
+		{
+			name:     "least outstanding",
+			strategy: models.BalanceLeastOutstanding,
+			weights:  []int{1, 1, 1},
+			stats:    []loadStat{{inUse: 5}, {inUse: 1}, {inUse: 3}},
+			expect:   1,
+		},
+		{
+			name:     "least outstanding respect weight",
+			strategy: models.BalanceLeastOutstanding,
+			weights:  []int{4, 1},
+			stats:    []loadStat{{inUse: 3}, {inUse: 1}},
+			expect:   0,
+		},
+		{
+			name:     "peak ewma avoid slow slave",
+			strategy: models.BalancePeakEWMA,
+			weights:  []int{1, 1},
+			stats:    []loadStat{{inUse: 1, latency: 100 * time.Millisecond}, {inUse: 3, latency: time.Millisecond}},
+			expect:   1,
+		},
+		{
+			name:     "p2c",
+			strategy: models.BalanceP2C,
+			weights:  []int{1, 1},
+			stats:    []loadStat{{inUse: 10, latency: 50 * time.Millisecond}, {latency: time.Millisecond}},
+			expect:   1,
+		},
+	}
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			dbInfo := generateLoadDBInfo(mockCtl, tt.strategy, tt.weights, tt.stats)
+			candidates := make([]int, len(tt.stats))
+			for i := range candidates {
+				candidates[i] = i
+			}
+			for i := 0; i < 10; i++ {
+				assert.Equal(t, tt.expect, dbInfo.Balancer.pick(candidates, dbInfo.ConnPool))
+			}
+		})
+	}
+}
+
+func TestGetSlaveConnByLoad(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	dbInfo := generateLoadDBInfo(mockCtl, models.BalanceLeastOutstanding, []int{1, 1, 1}, []loadStat{{dc: "c3", inUse: 8}, {dc: "c3", inUse: 4}, {dc: "c4"}})
+	s := &Slice{Slave: dbInfo, ProxyDatacenter: "c3"}
+
+	// 开启本机房优先时只在本机房的从库中选择
+	pc, err := s.GetSlaveConn(dbInfo, LocalSlaveReadPreferred)
+	assert.Nil(t, err)
+	assert.Equal(t, "c3", pc.GetAddr())
+	assert.Equal(t, int64(1), dbInfo.TakeSelectedCount(1))
+
+	pc, err = s.GetSlaveConn(dbInfo, LocalSlaveReadClosed)
+	assert.Nil(t, err)
+	assert.Equal(t, "c4", pc.GetAddr())
+	assert.Equal(t, int64(1), dbInfo.TakeSelectedCount(2))
+
+	dbInfo.SetStatus(0, StatusDown)
+	dbInfo.SetStatus(1, StatusDown)
+	pc, err = s.GetSlaveConn(dbInfo, LocalSlaveReadPreferred)
+	assert.Nil(t, err)
+	assert.Equal(t, "c4", pc.GetAddr())
+	_, err = s.GetSlaveConn(dbInfo, LocalSlaveReadForce)
+	assert.NotNil(t, err)
+}
+
+func TestGetSlaveConnByLoadConcurrent(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	dbInfo := generateLoadDBInfo(mockCtl, models.BalanceP2C, []int{1, 2}, []loadStat{{dc: "c3"}, {dc: "c4"}})
+	s := &Slice{Slave: dbInfo}
+
+	// balancer自己加锁, 不需要持有Slice的锁
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := s.GetSlaveConn(dbInfo, LocalSlaveReadClosed)
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// 被选中的次数在获取后清零
+	assert.Equal(t, int64(800), dbInfo.TakeSelectedCount(0)+dbInfo.TakeSelectedCount(1))
+	assert.Equal(t, int64(0), dbInfo.TakeSelectedCount(0)+dbInfo.TakeSelectedCount(1))
+}
+
+func TestPeakEWMA(t *testing.T) {
+	e := newPeakEWMA(10 * time.Second)
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), e.getAt(now))
+
+	e.observeAt(10*time.Millisecond, now)
+	assert.Equal(t, 10*time.Millisecond, e.getAt(now))
+
+	// 延迟变大时直接取峰值
+	e.observeAt(100*time.Millisecond, now.Add(time.Second))
+	assert.Equal(t, 100*time.Millisecond, e.getAt(now.Add(time.Second)))
+
+	// 延迟变小时按时间衰减
+	e.observeAt(10*time.Millisecond, now.Add(2*time.Second))
+	v := e.getAt(now.Add(2 * time.Second))
+	assert.True(t, v > 10*time.Millisecond && v < 100*time.Millisecond, v)
+
+	// 没有请求时逐渐衰减到0
+	assert.True(t, e.getAt(now.Add(time.Minute)) < time.Millisecond)
+}
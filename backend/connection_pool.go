@@ -60,10 +60,12 @@ type connectionPoolImpl struct {
 	clientCapability uint32
 	initConnect      string
 	lastChecked      int64
+	tlsConfig        *TLSConfig
+	latency          *peakEWMA // 执行SQL的延迟, 用于按延迟选择从库
 }
 
 // NewConnectionPool create connection pool
-func NewConnectionPool(addr, user, password, db string, capacity, maxCapacity int, idleTimeout time.Duration, charset string, collationID mysql.CollationID, clientCapability uint32, initConnect string, dc string) ConnectionPool {
+func NewConnectionPool(addr, user, password, db string, capacity, maxCapacity int, idleTimeout time.Duration, charset string, collationID mysql.CollationID, clientCapability uint32, initConnect string, dc string, tlsConfig *TLSConfig) ConnectionPool {
 	return &connectionPoolImpl{
 		addr:             addr,
 		datacenter:       dc,
@@ -78,6 +80,8 @@ func NewConnectionPool(addr, user, password, db string, capacity, maxCapacity in
 		clientCapability: clientCapability,
 		initConnect:      strings.Trim(strings.TrimSpace(initConnect), ";"),
 		lastChecked:      time.Now().Unix(),
+		tlsConfig:        tlsConfig,
+		latency:          newPeakEWMA(ewmaDecay),
 	}
 }
 
@@ -106,7 +110,7 @@ func (cp *connectionPoolImpl) Open() error {
 
 // connect is used by the resource pool to create new resource.It's factory method
 func (cp *connectionPoolImpl) connect() (util.Resource, error) {
-	c, err := NewDirectConnection(cp.addr, cp.user, cp.password, cp.db, cp.charset, cp.collationID, cp.clientCapability)
+	c, err := NewDirectConnection(cp.addr, cp.user, cp.password, cp.db, cp.charset, cp.collationID, cp.clientCapability, cp.tlsConfig)
 	if err != nil {
 		return nil, err
 	}
@@ -330,6 +334,11 @@ func (cp *connectionPoolImpl) WaitTime() time.Duration {
 	return p.WaitTime()
 }
 
+// Latency returns the peak EWMA of sql execution latency
+func (cp *connectionPoolImpl) Latency() time.Duration {
+	return cp.latency.get()
+}
+
 // IdleTimeout returns the idle timeout for the pool
 func (cp *connectionPoolImpl) IdleTimeout() time.Duration {
 	p := cp.pool()
@@ -38,6 +38,10 @@ import (
 
 var ErrExecuteTimeout = errors.New("execute timeout")
 
+// defaultCapability 没有配置slice的capability时, 连接后端MySQL使用的客户端能力
+const defaultCapability = mysql.ClientProtocol41 | mysql.ClientSecureConnection |
+	mysql.ClientLongPassword | mysql.ClientTransactions | mysql.ClientLongFlag
+
 // DirectConnection means connection to backend mysql
 type DirectConnection struct {
 	conn *mysql.Conn
@@ -66,10 +70,12 @@ type DirectConnection struct {
 	closed                   sync2.AtomicBool
 	capabilityConnectToMySQL uint32
 	moreRowExists            bool
+	gtids                    []string   // 开启会话状态跟踪时, OK包中返回的本连接提交的事务的GTID
+	tlsConfig                *TLSConfig // 为nil时不使用TLS
 }
 
 // NewDirectConnection return direct and authorised connection to mysql with real net connection
-func NewDirectConnection(addr string, user string, password string, db string, charset string, collationID mysql.CollationID, clientCapability uint32) (*DirectConnection, error) {
+func NewDirectConnection(addr string, user string, password string, db string, charset string, collationID mysql.CollationID, clientCapability uint32, tlsConfig *TLSConfig) (*DirectConnection, error) {
 	dc := &DirectConnection{
 		addr:                     addr,
 		user:                     user,
@@ -83,6 +89,7 @@ func NewDirectConnection(addr string, user string, password string, db string, c
 		sessionVariables:         mysql.NewSessionVariables(),
 		capabilityConnectToMySQL: clientCapability,
 		moreRowExists:            false,
+		tlsConfig:                tlsConfig,
 	}
 	err := dc.connect()
 	return dc, err
@@ -122,7 +129,13 @@ func (dc *DirectConnection) connect() error {
 		return err
 	}
 
-	// step2: write handshake response
+	// step2: send SSLRequest and upgrade to TLS if configured
+	if err := dc.startTLS(); err != nil {
+		dc.conn.Close()
+		return err
+	}
+
+	// step3: write handshake response
 	if err := dc.writeHandshakeResponse41(); err != nil {
 		dc.conn.Close()
 		return err
@@ -150,6 +163,17 @@ func (dc *DirectConnection) connect() error {
 		}
 	}
 
+	// 开启会话状态跟踪后, 让MySQL在提交事务的OK包中返回该事务的GTID, 不支持时由调用方查询gtid_executed
+	if dc.capability&mysql.ClientSessionTrack > 0 {
+		if _, err := dc.exec("SET SESSION session_track_gtids = OWN_GTID", 0); err != nil {
+			if _, ok := err.(*mysql.SQLError); !ok {
+				dc.conn.Close()
+				return err
+			}
+			log.Debug("enable session_track_gtids failed, addr: %s, err: %v", dc.addr, err)
+		}
+	}
+
 	return nil
 }
 
@@ -290,8 +314,10 @@ func (dc *DirectConnection) readAuth() ([]byte, string, error) {
 		return nil, "", err
 	}
 	switch data[0] {
-	case mysql.OKHeader, mysql.ErrHeader:
+	case mysql.OKHeader:
 		return nil, "", nil
+	case mysql.ErrHeader:
+		return nil, "", dc.handleErrorPacket(data)
 	case mysql.AuthMoreDataHeader:
 		return data[1:], "", nil
 	case mysql.EOFHeader:
@@ -329,8 +355,13 @@ func (dc *DirectConnection) authResponse(cipher []byte, newPlugin string) error
 	case mysql.CachingSHA2Password:
 		scrPasswd = mysql.CalcCachingSha2Password(adjustCipher, dc.password)
 	case mysql.Sha256Password:
-		// request public key from server
-		scrPasswd = []byte{1}
+		if dc.conn.IsTLS() {
+			// TLS连接中直接发送明文密码
+			scrPasswd = dc.cleartextPassword()
+		} else {
+			// request public key from server
+			scrPasswd = []byte{1}
+		}
 	case mysql.MysqlNativePassword:
 		if strings.HasPrefix(dc.password, "**") && len(dc.password) == 42 {
 			scrPasswd = mysql.CalcPasswordSHA1(adjustCipher, []byte(dc.password)[2:])
@@ -367,6 +398,14 @@ func (dc *DirectConnection) authResponse(cipher []byte, newPlugin string) error
 					return err
 				}
 			case mysql.CachingSha2PasswordPerformFullAuthentication:
+				if dc.conn.IsTLS() {
+					// TLS连接中直接发送明文密码, 不需要RSA公钥
+					if err = dc.writePacket(dc.cleartextPassword()); err != nil {
+						return err
+					}
+					_, _, err = dc.readAuth()
+					return err
+				}
 				// request public key
 				data := make([]byte, 1)
 				data[0] = byte(mysql.CachingSha2PasswordRequestPublicKey)
@@ -406,6 +445,13 @@ func (dc *DirectConnection) authResponse(cipher []byte, newPlugin string) error
 	return nil
 }
 
+// cleartextPassword 以0结尾的明文密码, 只能在TLS连接中发送
+func (dc *DirectConnection) cleartextPassword() []byte {
+	data := make([]byte, len(dc.password)+1)
+	copy(data, dc.password)
+	return data
+}
+
 // http://dev.mysql.com/doc/internals/en/connection-phase-packets.html#packet-Protocol::AuthSwitchResponse
 func (dc *DirectConnection) writeAuthSwitchPacket(scrPasswd []byte) error {
 	data := make([]byte, len(scrPasswd))
@@ -434,20 +480,60 @@ func (dc *DirectConnection) writePublicKeyAuthPacketSha256(authData []byte, scra
 	return dc.writePacket(data)
 }
 
-// writeHandshakeResponse41 writes the handshake response.
-func (dc *DirectConnection) writeHandshakeResponse41() error {
-	// Adjust client capability flags based on server support
-
+// clientCapability adjust client capability flags based on server support
+func (dc *DirectConnection) clientCapability() uint32 {
 	var capability uint32
 	if dc.capabilityConnectToMySQL == 0 {
-		capability = mysql.ClientProtocol41 | mysql.ClientSecureConnection |
-			mysql.ClientLongPassword | mysql.ClientTransactions | mysql.ClientLongFlag
+		capability = defaultCapability
 	} else {
 		capability = dc.capabilityConnectToMySQL
 	}
 
 	capability &= dc.capability
 	capability |= mysql.ClientPluginAuth
+	// CLIENT_SSL只在升级为TLS后设置, 不能由slice的capability配置
+	capability &^= mysql.ClientSSL
+	if dc.conn.IsTLS() {
+		capability |= mysql.ClientSSL
+	}
+	return capability
+}
+
+// startTLS 发送SSLRequest后升级为TLS连接, SSLRequest为握手响应的前32字节
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_connection_phase_packets_protocol_ssl_request.html
+func (dc *DirectConnection) startTLS() error {
+	if dc.tlsConfig == nil {
+		return nil
+	}
+	if dc.capability&mysql.ClientSSL == 0 {
+		if dc.tlsConfig.IsRequired() {
+			return fmt.Errorf("mysql %s does not support SSL", dc.addr)
+		}
+		return nil
+	}
+
+	capability := dc.clientCapability() | mysql.ClientSSL
+	if len(dc.db) > 0 {
+		capability |= mysql.ClientConnectWithDB
+	}
+	data := make([]byte, 4+4+1+23)
+	pos := mysql.WriteUint32(data, 0, capability)
+	pos = mysql.WriteZeroes(data, pos, 4)
+	pos = mysql.WriteByte(data, pos, byte(dc.collation))
+	mysql.WriteZeroes(data, pos, 23)
+	if err := dc.conn.WritePacket(data); err != nil {
+		return err
+	}
+
+	if err := dc.conn.UpgradeToClientTLS(dc.tlsConfig.clientConfig(dc.addr)); err != nil {
+		return fmt.Errorf("connect to mysql %s error: %v", dc.addr, err)
+	}
+	return nil
+}
+
+// writeHandshakeResponse41 writes the handshake response.
+func (dc *DirectConnection) writeHandshakeResponse41() error {
+	capability := dc.clientCapability()
 
 	//we only support secure connection
 	auth := mysql.CalcPassword(dc.salt, []byte(dc.password))
@@ -621,6 +707,16 @@ func (dc *DirectConnection) Execute(sql string, maxRows int) (*mysql.Result, err
 	return dc.exec(sql, maxRows)
 }
 
+// ExecuteWithFetchSize send ComQuery to backend mysql, read at most fetchSize bytes of rows,
+// the rest rows should be read by FetchMoreRows
+func (dc *DirectConnection) ExecuteWithFetchSize(sql string, maxRows, fetchSize int) (*mysql.Result, error) {
+	if err := dc.writeComQuery(sql); err != nil {
+		return nil, err
+	}
+
+	return dc.readResult(false, maxRows, fetchSize)
+}
+
 func (dc *DirectConnection) ExecuteWithTimeout(sql string, maxRows int, timeout time.Duration) (*mysql.Result, error) {
 	errChan := make(chan error, 1)
 	var res *mysql.Result
@@ -821,11 +917,11 @@ func (dc *DirectConnection) exec(query string, maxRows int) (*mysql.Result, erro
 		return nil, err
 	}
 
-	return dc.readResult(false, maxRows)
+	return dc.readResult(false, maxRows, mysql.MaxPayloadLen)
 }
 
 // read resultset from mysql
-func (dc *DirectConnection) readResultSet(data []byte, binary bool, maxRows int) (*mysql.Result, error) {
+func (dc *DirectConnection) readResultSet(data []byte, binary bool, maxRows, fetchSize int) (*mysql.Result, error) {
 	result := mysql.ResultPool.Get()
 
 	// column count
@@ -843,7 +939,7 @@ func (dc *DirectConnection) readResultSet(data []byte, binary bool, maxRows int)
 		return nil, err
 	}
 
-	if err := dc.readResultRows(result, binary, maxRows); err != nil {
+	if err := dc.readResultRows(result, binary, maxRows, fetchSize); err != nil {
 		return nil, err
 	}
 
@@ -892,8 +988,8 @@ func (dc *DirectConnection) readResultColumns(result *mysql.Result) (err error)
 	}
 }
 
-// readResultRows read result rows
-func (dc *DirectConnection) readResultRows(result *mysql.Result, isBinary bool, maxRows int) (err error) {
+// readResultRows read result rows, stop reading when the size of rows exceeds fetchSize
+func (dc *DirectConnection) readResultRows(result *mysql.Result, isBinary bool, maxRows, fetchSize int) (err error) {
 	var data []byte
 	var bufLength int
 	dc.moreRowExists = false
@@ -929,7 +1025,7 @@ func (dc *DirectConnection) readResultRows(result *mysql.Result, isBinary bool,
 			return fmt.Errorf("%v %d", sqlerr.ErrRowsLimitExceeded, maxRows)
 		}
 
-		if bufLength > mysql.MaxPayloadLen {
+		if bufLength > fetchSize {
 			dc.moreRowExists = true
 			break
 		} else {
@@ -995,11 +1091,39 @@ func (dc *DirectConnection) handleOKPacket(data []byte) (*mysql.Result, error) {
 		pos += 2
 	}
 
+	if dc.capability&mysql.ClientSessionTrack > 0 {
+		// 协商了CLIENT_SESSION_TRACK时, info为长度编码的字符串, 之后是会话状态的变化, 没有info时可以省略
+		if pos < len(data) {
+			info, next, _, ok := mysql.ReadLenEncStringAsBytes(data, pos)
+			if ok {
+				r.Info = string(info)
+				if r.Status&mysql.ServerSessionStateChanged > 0 {
+					if state, _, _, ok := mysql.ReadLenEncStringAsBytes(data, next); ok {
+						if gtids := mysql.ReadSessionTrackGtids(state); gtids != "" {
+							dc.gtids = append(dc.gtids, gtids)
+						}
+					}
+				}
+			}
+		}
+		// 后端的会话状态变化不返回给客户端
+		r.Status &^= mysql.ServerSessionStateChanged
+		return r, nil
+	}
+
 	//info
 	r.Info = string(data[pos:])
 	return r, nil
 }
 
+// TakeGTIDs return gtids of transactions committed by this connection since last call, separated by comma.
+// Only available when session_track_gtids is enabled on backend.
+func (dc *DirectConnection) TakeGTIDs() string {
+	gtids := strings.Join(dc.gtids, ",")
+	dc.gtids = nil
+	return gtids
+}
+
 func (dc *DirectConnection) handleErrorPacket(data []byte) error {
 	e := new(mysql.SQLError)
 
@@ -1020,7 +1144,7 @@ func (dc *DirectConnection) handleErrorPacket(data []byte) error {
 	return e
 }
 
-func (dc *DirectConnection) readResult(binary bool, maxRows int) (*mysql.Result, error) {
+func (dc *DirectConnection) readResult(binary bool, maxRows, fetchSize int) (*mysql.Result, error) {
 	data, err := dc.readPacket()
 	if err != nil {
 		return nil, err
@@ -1035,7 +1159,7 @@ func (dc *DirectConnection) readResult(binary bool, maxRows int) (*mysql.Result,
 		return nil, mysql.ErrMalformPacket
 	}
 
-	return dc.readResultSet(data, binary, maxRows)
+	return dc.readResultSet(data, binary, maxRows, fetchSize)
 }
 
 // IsAutoCommit check if autocommit
@@ -185,3 +185,37 @@ func TestDirectConnWithoutDB(t *testing.T) {
 
 	})
 }
+
+func TestHandleOKPacketWithSessionTrack(t *testing.T) {
+	gtids := "3e11fa47-71ca-11e1-9e33-c80aa9429562:23"
+	var state []byte
+	state = append(state, mysql.SessionTrackGtids)
+	state = mysql.AppendLenEncStringBytes(state, mysql.AppendLenEncStringBytes([]byte{0x00}, []byte(gtids)))
+
+	status := mysql.ServerStatusAutocommit | mysql.ServerSessionStateChanged
+	data := []byte{mysql.OKHeader}
+	data = mysql.AppendLenEncInt(data, 1) // affected rows
+	data = mysql.AppendLenEncInt(data, 0) // last insert id
+	data = mysql.AppendUint16(data, status)
+	data = mysql.AppendUint16(data, 0) // warnings
+	data = mysql.AppendLenEncStringBytes(data, []byte("Rows matched: 1  Changed: 1  Warnings: 0"))
+	data = mysql.AppendLenEncStringBytes(data, state)
+
+	dc := &DirectConnection{capability: mysql.ClientProtocol41 | mysql.ClientSessionTrack}
+	r, err := dc.handleOKPacket(data)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1), r.AffectedRows)
+	require.Equal(t, "Rows matched: 1  Changed: 1  Warnings: 0", r.Info)
+	require.Equal(t, mysql.ServerStatusAutocommit, r.Status)
+	require.Equal(t, gtids, dc.TakeGTIDs())
+	require.Equal(t, "", dc.TakeGTIDs())
+
+	// 没有info和会话状态变化时可以省略
+	data = []byte{mysql.OKHeader, 0x00, 0x00}
+	data = mysql.AppendUint16(data, mysql.ServerStatusAutocommit)
+	data = mysql.AppendUint16(data, 0)
+	r, err = dc.handleOKPacket(data)
+	require.Nil(t, err)
+	require.Equal(t, "", r.Info)
+	require.Equal(t, "", dc.TakeGTIDs())
+}
@@ -0,0 +1,438 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/XiaoMi/Gaea/log"
+	"github.com/XiaoMi/Gaea/mysql"
+)
+
+const (
+	// 提升从库前等待其应用完relay log的最长时间
+	failoverApplyTimeout  = 30 * time.Second
+	failoverApplyInterval = 500 * time.Millisecond
+)
+
+// FailoverCoordinator 协调多个proxy对同一个slice的主库切换, 由proxy基于配置中心实现
+type FailoverCoordinator interface {
+	// Vote 记录当前proxy探测到master不可用, 所有proxy都探测到master不可用并且当前proxy取得租约时返回true
+	Vote(namespace, slice, master string) (bool, error)
+	// Revoke 撤销当前proxy的投票并释放持有的租约, master恢复或者切换失败时调用
+	Revoke(namespace, slice string) error
+	// GetCandidate 返回之前持有租约的proxy选择的新master, 用于切换中断后识别已经提升的从库, 没有时返回空字符串
+	GetCandidate(namespace, slice string) (string, error)
+	// SetCandidate 持有租约的proxy在提升从库前记录选择的新master
+	SetCandidate(namespace, slice, master string) error
+	// Commit 切换完成后通过gaea-cc写回新的拓扑
+	Commit(namespace, slice, oldMaster, newMaster string) error
+}
+
+// ReplicaInfo 切换主库时探测到的从库状态
+type ReplicaInfo struct {
+	Addr      string
+	ReadOnly  bool
+	IsReplica bool // show slave status不为空
+	Status    SlaveStatus
+}
+
+// tryFailover master不可用超过downAfterNoAlive后调用, 所有proxy达成一致时提升从库
+func (s *Slice) tryFailover(name, oldMaster string) {
+	ok, err := s.Failover.Vote(name, s.Cfg.Name, oldMaster)
+	if err != nil {
+		log.Warn("[ns:%s, %s:%s] vote master down error: %v", name, s.Cfg.Name, oldMaster, err)
+		return
+	}
+	s.failoverVoted = true
+	if !ok {
+		log.Debug("[ns:%s, %s:%s] wait for other proxies to agree on master down", name, s.Cfg.Name, oldMaster)
+		return
+	}
+
+	newMaster, err := s.promoteSlave(name, oldMaster)
+	if err != nil {
+		log.Warn("[ns:%s, %s:%s] failover error: %v", name, s.Cfg.Name, oldMaster, err)
+		s.revokeFailoverVote(name)
+		return
+	}
+	log.Notice("[ns:%s, %s] failover master from %s to %s", name, s.Cfg.Name, oldMaster, newMaster)
+
+	// 写回失败时保留租约, 避免租约过期前其他proxy再次切换
+	if err := s.Failover.Commit(name, s.Cfg.Name, oldMaster, newMaster); err != nil {
+		log.Warn("[ns:%s, %s] write back new master %s error: %v", name, s.Cfg.Name, newMaster, err)
+	}
+	s.failoverVoted = false
+}
+
+func (s *Slice) revokeFailoverVote(name string) {
+	if err := s.Failover.Revoke(name, s.Cfg.Name); err != nil {
+		log.Warn("[ns:%s, %s] revoke master down vote error: %v", name, s.Cfg.Name, err)
+		return
+	}
+	s.failoverVoted = false
+}
+
+// promoteSlave 探测拓扑并提升复制进度最新的从库, 返回新master的地址
+func (s *Slice) promoteSlave(name, oldMaster string) (string, error) {
+	recorded, err := s.Failover.GetCandidate(name, s.Cfg.Name)
+	if err != nil {
+		return "", fmt.Errorf("get failover candidate error: %v", err)
+	}
+	replicas := s.DiscoverTopology(name)
+	candidate, err := pickFailoverCandidate(replicas, oldMaster, recorded)
+	if err != nil {
+		return "", err
+	}
+
+	if candidate.Addr != recorded {
+		if err := s.Failover.SetCandidate(name, s.Cfg.Name, candidate.Addr); err != nil {
+			return "", fmt.Errorf("record failover candidate %s error: %v", candidate.Addr, err)
+		}
+	}
+	if candidate.IsReplica {
+		if err := s.stopReplica(candidate); err != nil {
+			return "", fmt.Errorf("promote %s error: %v", candidate.Addr, err)
+		}
+	}
+	if err := s.swapMaster(candidate.Addr); err != nil {
+		return "", err
+	}
+	s.repointReplicas(name, replicas, candidate.Addr, oldMaster)
+	return candidate.Addr, nil
+}
+
+// DiscoverTopology 查询所有从库的复制状态和read_only, 无法连接的从库不会返回
+func (s *Slice) DiscoverTopology(name string) []*ReplicaInfo {
+	slaves := s.GetSlave()
+	replicas := make([]*ReplicaInfo, 0, len(slaves.ConnPool))
+	for _, cp := range slaves.ConnPool {
+		replica, err := discoverReplica(cp)
+		if err != nil {
+			log.Warn("[ns:%s, %s:%s] discover slave topology error: %v", name, s.Cfg.Name, cp.Addr(), err)
+			continue
+		}
+		replicas = append(replicas, replica)
+	}
+	return replicas
+}
+
+func discoverReplica(cp ConnectionPool) (*ReplicaInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), GetConnTimeout)
+	defer cancel()
+	pc, err := cp.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Recycle()
+
+	replica := &ReplicaInfo{Addr: cp.Addr()}
+	if replica.ReadOnly, err = queryReadOnly(pc); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	status, err := querySlaveStatus(pc)
+	if err != nil {
+		pc.Close()
+		return nil, err
+	}
+	if status != nil {
+		replica.IsReplica = true
+		replica.Status = *status
+	}
+	return replica, nil
+}
+
+// pickFailoverCandidate 选择新的master:
+// 1. 配置中心中记录的新master已经停止复制并且可写, 说明之前持有租约的proxy提升后没有完成切换, 直接使用
+// 2. 否则在从oldMaster复制的从库中选择复制进度最新的. 没有记录的可写从库可能是网络分区或者人工修改的实例, 不会选择
+func pickFailoverCandidate(replicas []*ReplicaInfo, oldMaster, recorded string) (*ReplicaInfo, error) {
+	var best *ReplicaInfo
+	for _, r := range replicas {
+		if !r.IsReplica {
+			if r.Addr == recorded && !r.ReadOnly {
+				return r, nil
+			}
+			log.Warn("slave %s does not replicate and is not promoted by failover, skip it", r.Addr)
+			continue
+		}
+		if source := replicaSource(r); source != oldMaster {
+			log.Warn("slave %s replicates from %s, not master %s, skip it", r.Addr, source, oldMaster)
+			continue
+		}
+		if best == nil || compareReplicaPosition(r.Status, best.Status) > 0 {
+			best = r
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no available slave replicates from master %s", oldMaster)
+	}
+	return best, nil
+}
+
+// repointReplicas 将其他从oldMaster复制的从库切换到新master, 使用GTID自动定位复制位置.
+// 失败时只记录日志, 没有开启GTID的从库需要人工切换复制源
+func (s *Slice) repointReplicas(name string, replicas []*ReplicaInfo, newMaster, oldMaster string) {
+	host, port, err := net.SplitHostPort(newMaster)
+	if err != nil {
+		log.Warn("[ns:%s, %s] invalid address of new master %s: %v", name, s.Cfg.Name, newMaster, err)
+		return
+	}
+	sql := fmt.Sprintf("CHANGE MASTER TO MASTER_HOST='%s', MASTER_PORT=%s, MASTER_AUTO_POSITION=1", mysql.Escape(host), port)
+	for _, r := range replicas {
+		if r.Addr == newMaster || !r.IsReplica || replicaSource(r) != oldMaster {
+			continue
+		}
+		if err := s.changeReplicaSource(r.Addr, sql); err != nil {
+			log.Warn("[ns:%s, %s] change master of slave %s to %s error, need to change it manually: %v", name, s.Cfg.Name, r.Addr, newMaster, err)
+			continue
+		}
+		log.Notice("[ns:%s, %s] change master of slave %s from %s to %s", name, s.Cfg.Name, r.Addr, oldMaster, newMaster)
+	}
+}
+
+func (s *Slice) changeReplicaSource(addr, sql string) error {
+	cp, err := s.getSlaveConnPool(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GetConnTimeout)
+	defer cancel()
+	pc, err := cp.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer pc.Recycle()
+
+	for _, stmt := range []string{"STOP SLAVE", sql, "START SLAVE"} {
+		if _, err := pc.Execute(stmt, 0); err != nil {
+			pc.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+func replicaSource(r *ReplicaInfo) string {
+	return net.JoinHostPort(r.Status.MasterHost, strconv.FormatUint(r.Status.MasterPort, 10))
+}
+
+// compareReplicaPosition 先比较接收到的binlog位置, 再比较已执行的位置
+func compareReplicaPosition(a, b SlaveStatus) int {
+	if c := compareBinlogPosition(a.MasterLogFile, a.ReadMasterLogPos, b.MasterLogFile, b.ReadMasterLogPos); c != 0 {
+		return c
+	}
+	return compareBinlogPosition(a.RelayMasterLogFile, a.ExecMasterLogPos, b.RelayMasterLogFile, b.ExecMasterLogPos)
+}
+
+// compareBinlogPosition 按binlog文件序号和位置比较, 如mysql-bin.000012:154
+func compareBinlogPosition(fileA string, posA uint64, fileB string, posB uint64) int {
+	if fileA != fileB {
+		seqA, errA := binlogFileSeq(fileA)
+		seqB, errB := binlogFileSeq(fileB)
+		if errA != nil || errB != nil {
+			return strings.Compare(fileA, fileB)
+		}
+		if seqA != seqB {
+			if seqA > seqB {
+				return 1
+			}
+			return -1
+		}
+	}
+	switch {
+	case posA > posB:
+		return 1
+	case posA < posB:
+		return -1
+	}
+	return 0
+}
+
+func binlogFileSeq(file string) (uint64, error) {
+	return strconv.ParseUint(file[strings.LastIndex(file, ".")+1:], 10, 64)
+}
+
+// stopReplica 等待从库应用完relay log后停止复制, 并关闭read_only
+func (s *Slice) stopReplica(replica *ReplicaInfo) error {
+	cp, err := s.getSlaveConnPool(replica.Addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), GetConnTimeout)
+	defer cancel()
+	pc, err := cp.Get(ctx)
+	if err != nil {
+		return err
+	}
+	defer pc.Recycle()
+
+	if err := waitForRelayLogApplied(pc, failoverApplyTimeout); err != nil {
+		pc.Close()
+		return err
+	}
+	if _, err := pc.Execute("STOP SLAVE", 0); err != nil {
+		pc.Close()
+		return err
+	}
+	if replica.ReadOnly {
+		if _, err := pc.Execute("SET GLOBAL read_only = 0", 0); err != nil {
+			pc.Close()
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForRelayLogApplied 等待sql线程执行到io线程接收的位置
+func waitForRelayLogApplied(pc PooledConnect, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := querySlaveStatus(pc)
+		if err != nil {
+			return err
+		}
+		if status == nil {
+			return fmt.Errorf("slave status of %s is empty", pc.GetAddr())
+		}
+		if status.RelayMasterLogFile == status.MasterLogFile && status.ExecMasterLogPos >= status.ReadMasterLogPos {
+			return nil
+		}
+		if status.SlaveSQLRunning != "Yes" {
+			return fmt.Errorf("sql thread of %s not running, executed %s:%d, read %s:%d", pc.GetAddr(),
+				status.RelayMasterLogFile, status.ExecMasterLogPos, status.MasterLogFile, status.ReadMasterLogPos)
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("wait for relay log applied on %s timeout", pc.GetAddr())
+		}
+		time.Sleep(failoverApplyInterval)
+	}
+}
+
+func (s *Slice) getSlaveConnPool(addr string) (ConnectionPool, error) {
+	slaves := s.GetSlave()
+	for _, cp := range slaves.ConnPool {
+		if cp.Addr() == addr {
+			return cp, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is not a slave of slice %s", addr, s.Cfg.Name)
+}
+
+// swapMaster 将从库addr替换为master并关闭原master的连接池.
+// Cfg在gaea-cc写回新的拓扑并重建namespace后更新
+func (s *Slice) swapMaster(addr string) error {
+	s.Lock()
+	index := -1
+	for i, cp := range s.Slave.ConnPool {
+		if cp.Addr() == addr {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		s.Unlock()
+		return fmt.Errorf("%s is not a slave of slice %s", addr, s.Cfg.Name)
+	}
+
+	var dc string
+	if index < len(s.Slave.Datacenter) {
+		dc = s.Slave.Datacenter[index]
+	}
+	status := &sync.Map{}
+	status.Store(0, StatusUp)
+	oldMaster := s.Master
+	s.Master = &DBInfo{[]ConnectionPool{s.Slave.ConnPool[index]}, nil, status, []string{dc}}
+	s.Slave = s.Slave.remove(index)
+	s.Unlock()
+
+	for _, cp := range oldMaster.ConnPool {
+		cp.Close()
+	}
+	return nil
+}
+
+// remove 返回去掉第index个节点后的DBInfo, 其他节点的权重和状态不变
+func (dbi *DBInfo) remove(index int) *DBInfo {
+	count := len(dbi.ConnPool) - 1
+	if count <= 0 {
+		return &DBInfo{}
+	}
+	connPool := make([]ConnectionPool, 0, count)
+	weights := make([]int, 0, count)
+	datacenter := make([]string, 0, count)
+	status := &sync.Map{}
+	for i, cp := range dbi.ConnPool {
+		if i == index {
+			continue
+		}
+		if v, ok := dbi.StatusMap.Load(i); ok {
+			status.Store(len(connPool), v)
+		}
+		weight := 1
+		if dbi.Balancer != nil {
+			weight = dbi.Balancer.weight(i)
+		}
+		connPool = append(connPool, cp)
+		weights = append(weights, weight)
+		if i < len(dbi.Datacenter) {
+			datacenter = append(datacenter, dbi.Datacenter[i])
+		}
+	}
+	balancer := newBalancer(weights, len(connPool))
+	if dbi.Balancer != nil {
+		balancer.setStrategy(dbi.Balancer.strategy)
+	}
+	return &DBInfo{connPool, balancer, status, datacenter}
+}
+
+// queryReadOnly return @@global.read_only of instance
+func queryReadOnly(pc PooledConnect) (bool, error) {
+	r, err := pc.Execute("SELECT @@global.read_only", 0)
+	if err != nil {
+		return false, err
+	}
+	if r.Resultset == nil || r.RowNumber() == 0 {
+		return false, fmt.Errorf("empty result of read_only")
+	}
+	v, err := r.GetInt(0, 0)
+	if err != nil {
+		return false, err
+	}
+	return v != 0, nil
+}
+
+// querySlaveStatus 返回nil表示实例没有配置复制
+func querySlaveStatus(pc PooledConnect) (*SlaveStatus, error) {
+	r, err := pc.Execute("show slave status;", 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.Resultset == nil || r.RowNumber() == 0 {
+		return nil, nil
+	}
+	status, err := parseSlaveStatus(r)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
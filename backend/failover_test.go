@@ -0,0 +1,276 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newReadOnlyResult(readOnly int64) *mysql.Result {
+	return &mysql.Result{
+		Resultset: &mysql.Resultset{
+			Fields:     []*mysql.Field{{Name: []byte("@@global.read_only")}},
+			FieldNames: map[string]int{"@@global.read_only": 0},
+			Values:     [][]any{{readOnly}},
+		},
+	}
+}
+
+func newSlaveStatusResult(status *SlaveStatus) *mysql.Result {
+	names := []string{"Master_Host", "Master_Port", "Slave_SQL_Running", "Master_Log_File", "Read_Master_Log_Pos", "Relay_Master_Log_File", "Exec_Master_Log_Pos"}
+	rs := &mysql.Resultset{FieldNames: make(map[string]int, len(names))}
+	for i, name := range names {
+		rs.Fields = append(rs.Fields, &mysql.Field{Name: []byte(name)})
+		rs.FieldNames[name] = i
+	}
+	if status != nil {
+		rs.Values = [][]any{{status.MasterHost, int64(status.MasterPort), status.SlaveSQLRunning, status.MasterLogFile,
+			status.ReadMasterLogPos, status.RelayMasterLogFile, status.ExecMasterLogPos}}
+	}
+	return &mysql.Result{Resultset: rs}
+}
+
+type fakeFailoverCoordinator struct {
+	agree     bool
+	votes     []string
+	revoked   int
+	candidate string
+	committed []string
+}
+
+func (f *fakeFailoverCoordinator) Vote(namespace, slice, master string) (bool, error) {
+	f.votes = append(f.votes, master)
+	return f.agree, nil
+}
+
+func (f *fakeFailoverCoordinator) Revoke(namespace, slice string) error {
+	f.revoked++
+	return nil
+}
+
+func (f *fakeFailoverCoordinator) GetCandidate(namespace, slice string) (string, error) {
+	return f.candidate, nil
+}
+
+func (f *fakeFailoverCoordinator) SetCandidate(namespace, slice, master string) error {
+	f.candidate = master
+	return nil
+}
+
+func (f *fakeFailoverCoordinator) Commit(namespace, slice, oldMaster, newMaster string) error {
+	f.committed = append(f.committed, oldMaster, newMaster)
+	return nil
+}
+
+func TestPickFailoverCandidate(t *testing.T) {
+	const master = "10.0.0.1:3306"
+	replica := func(addr, file string, read, exec uint64) *ReplicaInfo {
+		return &ReplicaInfo{Addr: addr, ReadOnly: true, IsReplica: true, Status: SlaveStatus{
+			MasterHost: "10.0.0.1", MasterPort: 3306, MasterLogFile: file, ReadMasterLogPos: read, RelayMasterLogFile: file, ExecMasterLogPos: exec,
+		}}
+	}
+	testCases := []struct {
+		name     string
+		replicas []*ReplicaInfo
+		recorded string
+		expect   string
+		hasErr   bool
+	}{
+		{
+			name:     "most caught up by read position",
+			replicas: []*ReplicaInfo{replica("s1:3306", "mysql-bin.000009", 900, 900), replica("s2:3306", "mysql-bin.000010", 100, 50), replica("s3:3306", "mysql-bin.000010", 80, 80)},
+			expect:   "s2:3306",
+		},
+		{
+			name:     "same read position compare exec position",
+			replicas: []*ReplicaInfo{replica("s1:3306", "mysql-bin.000010", 100, 50), replica("s2:3306", "mysql-bin.000010", 100, 90)},
+			expect:   "s2:3306",
+		},
+		{
+			name: "skip slave of other master",
+			replicas: []*ReplicaInfo{
+				{Addr: "s1:3306", ReadOnly: true, IsReplica: true, Status: SlaveStatus{MasterHost: "10.0.0.2", MasterPort: 3306, MasterLogFile: "mysql-bin.000011", ReadMasterLogPos: 1}},
+				replica("s2:3306", "mysql-bin.000010", 100, 100),
+			},
+			expect: "s2:3306",
+		},
+		{
+			name:     "slave promoted by interrupted failover",
+			replicas: []*ReplicaInfo{replica("s1:3306", "mysql-bin.000010", 100, 100), {Addr: "s2:3306"}},
+			recorded: "s2:3306",
+			expect:   "s2:3306",
+		},
+		{
+			name:     "skip writable slave not recorded",
+			replicas: []*ReplicaInfo{replica("s1:3306", "mysql-bin.000010", 100, 100), {Addr: "s2:3306"}},
+			recorded: "s3:3306",
+			expect:   "s1:3306",
+		},
+		{
+			name:     "read only slave without replication",
+			replicas: []*ReplicaInfo{{Addr: "s1:3306", ReadOnly: true}},
+			hasErr:   true,
+		},
+		{
+			name:     "more than one writable slave",
+			replicas: []*ReplicaInfo{{Addr: "s1:3306"}, {Addr: "s2:3306"}},
+			hasErr:   true,
+		},
+	}
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := pickFailoverCandidate(tt.replicas, master, tt.recorded)
+			if tt.hasErr {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expect, r.Addr)
+		})
+	}
+}
+
+func TestDBInfoRemove(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	dbInfo := generateDBInfo(mockCtl, []string{"c3-mysql-test00:3306", "c3-mysql-test01:3306", "c4-mysql-test02:3306"}, []StatusCode{StatusUp, StatusDown, StatusUp})
+	dbInfo.Balancer = newBalancer([]int{2, 4, 6}, 3)
+
+	removed := dbInfo.remove(0)
+	assert.Equal(t, 2, len(removed.ConnPool))
+	assert.Equal(t, "c3-mysql-test01:3306", removed.ConnPool[0].Addr())
+	assert.Equal(t, []string{"c3", "c4"}, removed.Datacenter)
+	status, _ := removed.GetStatus(0)
+	assert.Equal(t, StatusDown, status)
+	assert.Equal(t, 2, removed.Balancer.weight(0))
+	assert.Equal(t, 3, removed.Balancer.weight(1))
+
+	assert.Equal(t, 0, len(removed.remove(0).remove(0).ConnPool))
+}
+
+func TestTryFailover(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+
+	masterPool := NewMockConnectionPool(mockCtl)
+	masterPool.EXPECT().Addr().Return("10.0.0.1:3306").AnyTimes()
+	masterStatus := &sync.Map{}
+	masterStatus.Store(0, StatusDown)
+
+	newSlavePool := func(addr string, status *SlaveStatus, promote, repoint bool) *MockConnectionPool {
+		pc := NewMockPooledConnect(mockCtl)
+		pc.EXPECT().GetAddr().Return(addr).AnyTimes()
+		pc.EXPECT().Recycle().AnyTimes()
+		pc.EXPECT().Execute("SELECT @@global.read_only", 0).Return(newReadOnlyResult(1), nil)
+		pc.EXPECT().Execute("show slave status;", 0).Return(newSlaveStatusResult(status), nil).MinTimes(1)
+		if promote {
+			pc.EXPECT().Execute("STOP SLAVE", 0).Return(&mysql.Result{}, nil)
+			pc.EXPECT().Execute("SET GLOBAL read_only = 0", 0).Return(&mysql.Result{}, nil)
+		}
+		if repoint {
+			gomock.InOrder(
+				pc.EXPECT().Execute("STOP SLAVE", 0).Return(&mysql.Result{}, nil),
+				pc.EXPECT().Execute("CHANGE MASTER TO MASTER_HOST='10.0.0.2', MASTER_PORT=3306, MASTER_AUTO_POSITION=1", 0).Return(&mysql.Result{}, nil),
+				pc.EXPECT().Execute("START SLAVE", 0).Return(&mysql.Result{}, nil),
+			)
+		}
+		cp := NewMockConnectionPool(mockCtl)
+		cp.EXPECT().Addr().Return(addr).AnyTimes()
+		cp.EXPECT().Get(gomock.Any()).Return(pc, nil).AnyTimes()
+		return cp
+	}
+	slave1 := newSlavePool("10.0.0.2:3306", &SlaveStatus{MasterHost: "10.0.0.1", MasterPort: 3306, SlaveSQLRunning: "Yes",
+		MasterLogFile: "mysql-bin.000003", ReadMasterLogPos: 200, RelayMasterLogFile: "mysql-bin.000003", ExecMasterLogPos: 200}, true, false)
+	slave2 := newSlavePool("10.0.0.3:3306", &SlaveStatus{MasterHost: "10.0.0.1", MasterPort: 3306, SlaveSQLRunning: "Yes",
+		MasterLogFile: "mysql-bin.000003", ReadMasterLogPos: 100, RelayMasterLogFile: "mysql-bin.000003", ExecMasterLogPos: 100}, false, true)
+	slaveStatus := &sync.Map{}
+	slaveStatus.Store(0, StatusUp)
+	slaveStatus.Store(1, StatusUp)
+
+	coordinator := &fakeFailoverCoordinator{}
+	s := &Slice{
+		Master:   &DBInfo{ConnPool: []ConnectionPool{masterPool}, StatusMap: masterStatus},
+		Slave:    &DBInfo{ConnPool: []ConnectionPool{slave1, slave2}, Balancer: newBalancer([]int{1, 1}, 2), StatusMap: slaveStatus, Datacenter: []string{"c3", "c4"}},
+		Failover: coordinator,
+	}
+	s.Cfg.Name = "slice-0"
+
+	// 其他proxy还没有确认master不可用时不切换
+	s.tryFailover("ns", "10.0.0.1:3306")
+	assert.True(t, s.failoverVoted)
+	assert.Equal(t, masterPool, s.GetMaster().ConnPool[0])
+
+	coordinator.agree = true
+	masterPool.EXPECT().Close()
+	s.tryFailover("ns", "10.0.0.1:3306")
+	assert.False(t, s.failoverVoted)
+	assert.Equal(t, []string{"10.0.0.1:3306", "10.0.0.1:3306"}, coordinator.votes)
+	assert.Equal(t, "10.0.0.2:3306", coordinator.candidate)
+	assert.Equal(t, []string{"10.0.0.1:3306", "10.0.0.2:3306"}, coordinator.committed)
+	assert.Equal(t, "10.0.0.2:3306", s.GetMaster().ConnPool[0].Addr())
+	assert.Equal(t, []string{"c3"}, s.GetMaster().Datacenter)
+	status, _ := s.GetMasterStatus()
+	assert.Equal(t, StatusUp, status)
+	assert.Equal(t, 1, len(s.GetSlave().ConnPool))
+	assert.Equal(t, "10.0.0.3:3306", s.GetSlave().ConnPool[0].Addr())
+
+	// 错误信息中是当前master的地址, Cfg在重新加载namespace后更新
+	s.SetMasterStatus(StatusDown)
+	_, err := s.GetMasterConn()
+	assert.EqualError(t, err, "master:10.0.0.2:3306 is Down")
+}
+
+func TestTryFailoverWithoutCandidate(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+
+	masterPool := NewMockConnectionPool(mockCtl)
+	masterStatus := &sync.Map{}
+	masterStatus.Store(0, StatusDown)
+
+	pc := NewMockPooledConnect(mockCtl)
+	pc.EXPECT().Recycle().AnyTimes()
+	pc.EXPECT().Execute("SELECT @@global.read_only", 0).Return(newReadOnlyResult(1), nil)
+	pc.EXPECT().Execute("show slave status;", 0).Return(newSlaveStatusResult(nil), nil)
+	slavePool := NewMockConnectionPool(mockCtl)
+	slavePool.EXPECT().Addr().Return("10.0.0.2:3306").AnyTimes()
+	slavePool.EXPECT().Get(gomock.Any()).Return(pc, nil)
+	slaveStatus := &sync.Map{}
+	slaveStatus.Store(0, StatusUp)
+
+	coordinator := &fakeFailoverCoordinator{agree: true}
+	s := &Slice{
+		Master:   &DBInfo{ConnPool: []ConnectionPool{masterPool}, StatusMap: masterStatus},
+		Slave:    &DBInfo{ConnPool: []ConnectionPool{slavePool}, Balancer: newBalancer([]int{1}, 1), StatusMap: slaveStatus},
+		Failover: coordinator,
+	}
+	s.tryFailover("ns", "10.0.0.1:3306")
+	assert.Equal(t, 1, coordinator.revoked)
+	assert.False(t, s.failoverVoted)
+	assert.Nil(t, coordinator.committed)
+	assert.Equal(t, masterPool, s.GetMaster().ConnPool[0])
+}
+
+func TestCompareBinlogPosition(t *testing.T) {
+	assert.Equal(t, 1, compareBinlogPosition("mysql-bin.000010", 4, "mysql-bin.000009", 1000))
+	assert.Equal(t, -1, compareBinlogPosition("mysql-bin.000010", 4, "mysql-bin.000010", 1000))
+	assert.Equal(t, 0, compareBinlogPosition("mysql-bin.000010", 4, "mysql-bin.000010", 4))
+	assert.Equal(t, 1, compareBinlogPosition("mysql-bin.1000000", 4, "mysql-bin.999999", 4))
+}
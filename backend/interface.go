@@ -28,6 +28,7 @@ type PooledConnect interface {
 	IsClosed() bool
 	UseDB(db string) error
 	Execute(sql string, maxRows int) (*mysql.Result, error)
+	ExecuteWithFetchSize(sql string, maxRows, fetchSize int) (*mysql.Result, error)
 	ExecuteWithTimeout(sql string, maxRows int, timeout time.Duration) (*mysql.Result, error)
 	SetAutoCommit(v uint8) error
 	Begin() error
@@ -46,7 +47,9 @@ type PooledConnect interface {
 	MoreRowsExist() bool
 	MoreResultsExist() bool
 	FetchMoreRows(result *mysql.Result, maxRows int) error
+	FetchMoreRowsWithFetchSize(result *mysql.Result, maxRows, fetchSize int) error
 	ReadMoreResult(maxRows int) (*mysql.Result, error)
+	TakeGTIDs() string
 }
 
 type ConnectionPool interface {
@@ -68,6 +71,7 @@ type ConnectionPool interface {
 	MaxCap() int64
 	WaitCount() int64
 	WaitTime() time.Duration
+	Latency() time.Duration
 	IdleTimeout() time.Duration
 	IdleClosed() int64
 	SetLastChecked()
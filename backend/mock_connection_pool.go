@@ -174,6 +174,20 @@ func (mr *MockConnectionPoolMockRecorder) IdleClosed() *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IdleClosed", reflect.TypeOf((*MockConnectionPool)(nil).IdleClosed))
 }
 
+// Latency mocks base method
+func (m *MockConnectionPool) Latency() time.Duration {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Latency")
+	ret0, _ := ret[0].(time.Duration)
+	return ret0
+}
+
+// Latency indicates an expected call of Latency
+func (mr *MockConnectionPoolMockRecorder) Latency() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Latency", reflect.TypeOf((*MockConnectionPool)(nil).Latency))
+}
+
 // IdleTimeout mocks base method
 func (m *MockConnectionPool) IdleTimeout() time.Duration {
 	m.ctrl.T.Helper()
@@ -105,6 +105,21 @@ func (mr *MockPooledConnectMockRecorder) ExecuteWithTimeout(arg0, arg1, arg2 any
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExecuteWithTimeout", reflect.TypeOf((*MockPooledConnect)(nil).ExecuteWithTimeout), arg0, arg1, arg2)
 }
 
+// ExecuteWithFetchSize mocks base method
+func (m *MockPooledConnect) ExecuteWithFetchSize(arg0 string, arg1, arg2 int) (*mysql.Result, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ExecuteWithFetchSize", arg0, arg1, arg2)
+	ret0, _ := ret[0].(*mysql.Result)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ExecuteWithFetchSize indicates an expected call of ExecuteWithFetchSize
+func (mr *MockPooledConnectMockRecorder) ExecuteWithFetchSize(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ExecuteWithFetchSize", reflect.TypeOf((*MockPooledConnect)(nil).ExecuteWithFetchSize), arg0, arg1, arg2)
+}
+
 // FetchMoreRows mocks base method
 func (m *MockPooledConnect) FetchMoreRows(arg0 *mysql.Result, arg1 int) error {
 	m.ctrl.T.Helper()
@@ -119,6 +134,20 @@ func (mr *MockPooledConnectMockRecorder) FetchMoreRows(arg0, arg1 any) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchMoreRows", reflect.TypeOf((*MockPooledConnect)(nil).FetchMoreRows), arg0, arg1)
 }
 
+// FetchMoreRowsWithFetchSize mocks base method
+func (m *MockPooledConnect) FetchMoreRowsWithFetchSize(arg0 *mysql.Result, arg1, arg2 int) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "FetchMoreRowsWithFetchSize", arg0, arg1, arg2)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// FetchMoreRowsWithFetchSize indicates an expected call of FetchMoreRowsWithFetchSize
+func (mr *MockPooledConnectMockRecorder) FetchMoreRowsWithFetchSize(arg0, arg1, arg2 any) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FetchMoreRowsWithFetchSize", reflect.TypeOf((*MockPooledConnect)(nil).FetchMoreRowsWithFetchSize), arg0, arg1, arg2)
+}
+
 // FieldList mocks base method
 func (m *MockPooledConnect) FieldList(arg0, arg1 string) ([]*mysql.Field, error) {
 	m.ctrl.T.Helper()
@@ -353,6 +382,20 @@ func (mr *MockPooledConnectMockRecorder) SetSessionVariables(arg0 any) *gomock.C
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetSessionVariables", reflect.TypeOf((*MockPooledConnect)(nil).SetSessionVariables), arg0)
 }
 
+// TakeGTIDs mocks base method
+func (m *MockPooledConnect) TakeGTIDs() string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "TakeGTIDs")
+	ret0, _ := ret[0].(string)
+	return ret0
+}
+
+// TakeGTIDs indicates an expected call of TakeGTIDs
+func (mr *MockPooledConnectMockRecorder) TakeGTIDs() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "TakeGTIDs", reflect.TypeOf((*MockPooledConnect)(nil).TakeGTIDs))
+}
+
 // UseDB mocks base method
 func (m *MockPooledConnect) UseDB(arg0 string) error {
 	m.ctrl.T.Helper()
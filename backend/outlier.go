@@ -0,0 +1,502 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/XiaoMi/Gaea/log"
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/mysql"
+)
+
+const (
+	// 统计错误率和p99延迟的窗口
+	outlierWindow = 10 * time.Second
+	// 每个窗口最多保留的延迟样本数, 超过后覆盖最早的样本
+	outlierLatencySamples = 1000
+	// 半开状态下同时允许的探测请求数, 全部完成后根据错误率和延迟分位数决定恢复还是再次摘除
+	outlierHalfOpenProbes = 10
+	// 半开状态下用于和outlier_p99_latency比较的延迟分位数, 避免单个慢请求导致再次摘除
+	outlierHalfOpenPercentile = 0.9
+
+	defaultOutlierErrorRate       = 50
+	defaultOutlierMinRequests     = 20
+	defaultOutlierEjectionTime    = 30 * time.Second
+	defaultOutlierMaxEjectionTime = 300 * time.Second
+
+	// ER_QUERY_TIMEOUT, 执行时间超过max_execution_time
+	errQueryTimeout uint16 = 3024
+)
+
+// BreakerState 熔断器状态
+type BreakerState int
+
+const (
+	// BreakerClosed 正常访问, 统计错误率和延迟
+	BreakerClosed BreakerState = iota
+	// BreakerOpen 从库被摘除, 摘除时间结束后进入半开状态
+	BreakerOpen
+	// BreakerHalfOpen 只允许outlierHalfOpenProbes个探测请求, 错误率和延迟正常时关闭, 否则再次摘除
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// MarshalText 在json中输出状态名称
+func (s BreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// OutlierStatus 从库的被动健康检查状态
+type OutlierStatus struct {
+	Addr         string       `json:"addr"`
+	State        BreakerState `json:"state"`
+	Ejections    int64        `json:"ejections"`     // 累计摘除次数
+	EjectedUntil string       `json:"ejected_until"` // 摘除结束时间, 没有被摘除时为空
+	ErrorRate    float64      `json:"error_rate"`    // 上一个统计窗口的错误率百分比
+	P99          float64      `json:"p99_ms"`        // 上一个统计窗口的p99延迟, 单位ms
+}
+
+// OutlierDetector 根据执行SQL的结果对从库做被动健康检查, 错误率或者p99延迟过高的从库按指数退避临时摘除
+type OutlierDetector struct {
+	namespace string
+	slice     string
+
+	errorRate       int
+	p99Latency      time.Duration
+	minRequests     int64
+	ejectionTime    time.Duration
+	maxEjectionTime time.Duration
+
+	breakers map[string]*circuitBreaker // key: 从库地址, 创建后不再修改
+}
+
+// NewOutlierDetector 没有开启outlier_detection时返回nil
+func NewOutlierDetector(namespace string, cfg *models.Slice) *OutlierDetector {
+	if !cfg.OutlierDetection {
+		return nil
+	}
+	d := &OutlierDetector{
+		namespace:       namespace,
+		slice:           cfg.Name,
+		errorRate:       cfg.OutlierErrorRate,
+		p99Latency:      time.Duration(cfg.OutlierP99Latency) * time.Millisecond,
+		minRequests:     int64(cfg.OutlierMinRequests),
+		ejectionTime:    time.Duration(cfg.OutlierEjectionTime) * time.Second,
+		maxEjectionTime: time.Duration(cfg.OutlierMaxEjectionTime) * time.Second,
+		breakers:        make(map[string]*circuitBreaker),
+	}
+	if d.errorRate == 0 {
+		d.errorRate = defaultOutlierErrorRate
+	}
+	if d.minRequests == 0 {
+		d.minRequests = defaultOutlierMinRequests
+	}
+	if d.ejectionTime == 0 {
+		d.ejectionTime = defaultOutlierEjectionTime
+	}
+	if d.maxEjectionTime == 0 {
+		d.maxEjectionTime = defaultOutlierMaxEjectionTime
+	}
+	if d.maxEjectionTime < d.ejectionTime {
+		d.maxEjectionTime = d.ejectionTime
+	}
+
+	now := time.Now()
+	for _, slaves := range [][]string{cfg.Slaves, cfg.StatisticSlaves} {
+		for _, slave := range slaves {
+			addr := models.SlaveAddr(slave)
+			if _, ok := d.breakers[addr]; !ok {
+				d.breakers[addr] = &circuitBreaker{addr: addr, windowStart: now}
+			}
+		}
+	}
+	return d
+}
+
+// Report 记录一次SQL执行的结果, 只统计从库, 其他地址直接忽略
+func (d *OutlierDetector) Report(addr string, latency time.Duration, err error) {
+	if d == nil {
+		return
+	}
+	b, ok := d.breakers[addr]
+	if !ok {
+		return
+	}
+	b.report(d, time.Now(), latency, isBackendFailure(err))
+}
+
+// IsEjected 从库是否被摘除
+func (d *OutlierDetector) IsEjected(addr string) bool {
+	if d == nil {
+		return false
+	}
+	b, ok := d.breakers[addr]
+	if !ok {
+		return false
+	}
+	return !b.available(time.Now())
+}
+
+// admit 选中从库后调用, 半开状态的从库探测名额用完时返回false, 其他地址总是返回true
+func (d *OutlierDetector) admit(addr string) bool {
+	if d == nil {
+		return true
+	}
+	b, ok := d.breakers[addr]
+	if !ok {
+		return true
+	}
+	return b.admit(time.Now())
+}
+
+// ejectedSlaves 返回每个从库是否被摘除. 没有从库被摘除, 或者所有可用的从库都被摘除时返回nil, 避免摘除后没有从库可以访问
+func (d *OutlierDetector) ejectedSlaves(slavesInfo *DBInfo) []bool {
+	if d == nil {
+		return nil
+	}
+	now := time.Now()
+	var ejected []bool
+	available := false
+	for index, cp := range slavesInfo.ConnPool {
+		if status, err := slavesInfo.GetStatus(index); err != nil || status == StatusDown {
+			continue
+		}
+		b, ok := d.breakers[cp.Addr()]
+		if !ok || b.available(now) {
+			available = true
+			continue
+		}
+		if ejected == nil {
+			ejected = make([]bool, len(slavesInfo.ConnPool))
+		}
+		ejected[index] = true
+	}
+	if ejected != nil && !available {
+		log.Debug("[ns:%s, %s] all slaves are ejected, ignore ejection", d.namespace, d.slice)
+		return nil
+	}
+	return ejected
+}
+
+// Status 返回所有从库的状态, 按地址排序
+func (d *OutlierDetector) Status() []OutlierStatus {
+	if d == nil {
+		return nil
+	}
+	now := time.Now()
+	ret := make([]OutlierStatus, 0, len(d.breakers))
+	for _, b := range d.breakers {
+		ret = append(ret, b.status(now))
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Addr < ret[j].Addr
+	})
+	return ret
+}
+
+// GetStatus 返回从库的状态, 不是从库时返回false
+func (d *OutlierDetector) GetStatus(addr string) (OutlierStatus, bool) {
+	if d == nil {
+		return OutlierStatus{}, false
+	}
+	b, ok := d.breakers[addr]
+	if !ok {
+		return OutlierStatus{}, false
+	}
+	return b.status(time.Now()), true
+}
+
+// TakeEjections 返回上次调用后从库被摘除的次数, 用于累加到监控的计数器
+func (d *OutlierDetector) TakeEjections(addr string) int64 {
+	if d == nil {
+		return 0
+	}
+	b, ok := d.breakers[addr]
+	if !ok {
+		return 0
+	}
+	b.Lock()
+	defer b.Unlock()
+	n := b.newEjections
+	b.newEjections = 0
+	return n
+}
+
+// ejectionDuration 第n次连续摘除的时间: ejectionTime * 2^(n-1), 不超过maxEjectionTime
+func (d *OutlierDetector) ejectionDuration(n int) time.Duration {
+	duration := d.ejectionTime
+	for i := 1; i < n && duration < d.maxEjectionTime; i++ {
+		duration *= 2
+	}
+	if duration > d.maxEjectionTime {
+		duration = d.maxEjectionTime
+	}
+	return duration
+}
+
+// isBackendFailure 只统计实例异常导致的错误, 语法错误、主键冲突等SQL本身的错误不计入
+func isBackendFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var sqlErr *mysql.SQLError
+	if !errors.As(err, &sqlErr) {
+		// 网络错误、读写超时等
+		return true
+	}
+	switch sqlErr.SQLCode() {
+	case mysql.ErrConCount, mysql.ErrServerShutdown, errQueryTimeout:
+		return true
+	}
+	return false
+}
+
+type circuitBreaker struct {
+	sync.Mutex
+	addr  string
+	state BreakerState
+
+	// 当前统计窗口, 半开状态下统计探测请求
+	windowStart time.Time
+	requests    int64
+	failures    int64
+	latencies   []time.Duration
+
+	// 上一个统计窗口的结果
+	lastErrorRate float64
+	lastP99       time.Duration
+
+	ejections      int   // 连续摘除次数, 用于计算退避时间, 每个正常的窗口减1
+	totalEjections int64 // 累计摘除次数
+	newEjections   int64 // 上次TakeEjections后的摘除次数
+	ejectedUntil   time.Time
+	probes         int64     // 半开状态下已经放行的探测请求数
+	lastProbe      time.Time // 最近一次放行探测请求的时间
+}
+
+func (b *circuitBreaker) report(d *OutlierDetector, now time.Time, latency time.Duration, failed bool) {
+	b.Lock()
+	b.refresh(now)
+	var ejected, recovered bool
+	var reason string
+	switch b.state {
+	case BreakerOpen:
+		// 摘除前已经开始执行的请求不计入
+	case BreakerHalfOpen:
+		b.add(latency, failed)
+		if reason = b.evaluateProbes(d); reason != "" {
+			b.eject(d, now)
+			ejected = true
+			break
+		}
+		if b.requests >= outlierHalfOpenProbes {
+			b.state = BreakerClosed
+			b.resetWindow(now)
+			recovered = true
+		}
+	default:
+		if now.Sub(b.windowStart) >= outlierWindow {
+			if reason = b.evaluate(d, true); reason != "" {
+				b.eject(d, now)
+				ejected = true
+				break
+			}
+			if b.ejections > 0 {
+				b.ejections--
+			}
+			b.resetWindow(now)
+		}
+		b.add(latency, failed)
+		// 错误率不需要等到窗口结束, 请求数足够时立即检查
+		if reason = b.evaluate(d, false); reason != "" {
+			b.eject(d, now)
+			ejected = true
+		}
+	}
+	ejectedUntil := b.ejectedUntil
+	b.Unlock()
+
+	if ejected {
+		log.Warn("[ns:%s, %s:%s] eject slave until %s, %s", d.namespace, d.slice, b.addr, ejectedUntil.Format(time.RFC3339), reason)
+	}
+	if recovered {
+		log.Notice("[ns:%s, %s:%s] slave recovered from ejection", d.namespace, d.slice, b.addr)
+	}
+}
+
+func (b *circuitBreaker) add(latency time.Duration, failed bool) {
+	if len(b.latencies) < outlierLatencySamples {
+		b.latencies = append(b.latencies, latency)
+	} else {
+		b.latencies[b.requests%outlierLatencySamples] = latency
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+}
+
+// evaluate 返回摘除的原因, 不需要摘除时返回空. windowEnd为false时只检查错误率
+func (b *circuitBreaker) evaluate(d *OutlierDetector, windowEnd bool) string {
+	if b.requests < d.minRequests {
+		if windowEnd {
+			b.lastErrorRate, b.lastP99 = 0, 0
+		}
+		return ""
+	}
+	errorRate := float64(b.failures) * 100 / float64(b.requests)
+	if errorRate >= float64(d.errorRate) {
+		b.lastErrorRate = errorRate
+		return fmt.Sprintf("error rate: %.2f%%, requests: %d", errorRate, b.requests)
+	}
+	if !windowEnd {
+		return ""
+	}
+	p99 := percentile(b.latencies, 0.99)
+	b.lastErrorRate, b.lastP99 = errorRate, p99
+	if d.p99Latency > 0 && p99 > d.p99Latency {
+		return fmt.Sprintf("p99 latency: %v, requests: %d", p99, b.requests)
+	}
+	return ""
+}
+
+// evaluateProbes 返回半开状态下再次摘除的原因. 失败的探测请求已经足够达到错误率时立即摘除,
+// 否则等所有探测请求完成后再比较延迟分位数
+func (b *circuitBreaker) evaluateProbes(d *OutlierDetector) string {
+	if b.failures*100 >= int64(d.errorRate)*outlierHalfOpenProbes {
+		b.lastErrorRate = float64(b.failures) * 100 / float64(b.requests)
+		return fmt.Sprintf("probe error rate: %.2f%%, probes: %d", b.lastErrorRate, b.requests)
+	}
+	if b.requests < outlierHalfOpenProbes {
+		return ""
+	}
+	b.lastErrorRate = float64(b.failures) * 100 / float64(b.requests)
+	b.lastP99 = percentile(b.latencies, 0.99)
+	if p := percentile(b.latencies, outlierHalfOpenPercentile); d.p99Latency > 0 && p > d.p99Latency {
+		return fmt.Sprintf("probe p90 latency: %v, probes: %d", p, b.requests)
+	}
+	return ""
+}
+
+func (b *circuitBreaker) eject(d *OutlierDetector, now time.Time) {
+	b.ejections++
+	b.totalEjections++
+	b.newEjections++
+	b.state = BreakerOpen
+	b.ejectedUntil = now.Add(d.ejectionDuration(b.ejections))
+	b.resetWindow(now)
+}
+
+// refresh 摘除时间结束后进入半开状态. 放行后一个窗口内都没有返回结果的探测请求不再占用名额
+func (b *circuitBreaker) refresh(now time.Time) {
+	if b.state == BreakerOpen && !now.Before(b.ejectedUntil) {
+		b.state = BreakerHalfOpen
+		b.probes = 0
+		b.resetWindow(now)
+	}
+	if b.state == BreakerHalfOpen && b.probes > b.requests && now.Sub(b.lastProbe) >= outlierWindow {
+		b.probes = b.requests
+	}
+}
+
+func (b *circuitBreaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.requests = 0
+	b.failures = 0
+	b.latencies = b.latencies[:0]
+}
+
+// available 从库是否可以被选中, 半开状态下探测名额用完时不可选
+func (b *circuitBreaker) available(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refresh(now)
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		return b.probes < outlierHalfOpenProbes
+	}
+	return true
+}
+
+// admit 占用一个探测名额, 关闭状态下总是返回true
+func (b *circuitBreaker) admit(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refresh(now)
+	switch b.state {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probes >= outlierHalfOpenProbes {
+			return false
+		}
+		b.probes++
+		b.lastProbe = now
+	}
+	return true
+}
+
+func (b *circuitBreaker) status(now time.Time) OutlierStatus {
+	b.Lock()
+	defer b.Unlock()
+	b.refresh(now)
+	s := OutlierStatus{
+		Addr:      b.addr,
+		State:     b.state,
+		Ejections: b.totalEjections,
+		ErrorRate: b.lastErrorRate,
+		P99:       float64(b.lastP99) / float64(time.Millisecond),
+	}
+	if b.state == BreakerOpen {
+		s.EjectedUntil = b.ejectedUntil.Format(time.RFC3339)
+	}
+	return s
+}
+
+// percentile 返回样本的p分位数, 不修改samples
+func percentile(samples []time.Duration, p float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(samples))
+	copy(sorted, samples)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	index := int(float64(len(sorted))*p+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(sorted) {
+		index = len(sorted) - 1
+	}
+	return sorted[index]
+}
@@ -0,0 +1,222 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestOutlierDetector(p99Latency int) *OutlierDetector {
+	return NewOutlierDetector("ns", &models.Slice{
+		Name:               "slice-0",
+		Slaves:             []string{"c3-mysql-test00:3306@2#c3", "c3-mysql-test01:3306"},
+		OutlierDetection:   true,
+		OutlierP99Latency:  p99Latency,
+		OutlierMinRequests: 10,
+	})
+}
+
+func TestNewOutlierDetector(t *testing.T) {
+	assert.Nil(t, NewOutlierDetector("ns", &models.Slice{Name: "slice-0", Slaves: []string{"127.0.0.1:3306"}}))
+
+	d := newTestOutlierDetector(0)
+	assert.Equal(t, 2, len(d.breakers))
+	assert.Equal(t, defaultOutlierErrorRate, d.errorRate)
+	assert.Equal(t, defaultOutlierEjectionTime, d.ejectionTime)
+	_, ok := d.GetStatus("c3-mysql-test00:3306")
+	assert.True(t, ok)
+
+	// 不是从库的地址直接忽略
+	d.Report("127.0.0.1:3306", time.Second, errors.New("timeout"))
+	assert.False(t, d.IsEjected("127.0.0.1:3306"))
+}
+
+func TestEjectionDuration(t *testing.T) {
+	d := newTestOutlierDetector(0)
+	assert.Equal(t, 30*time.Second, d.ejectionDuration(1))
+	assert.Equal(t, 60*time.Second, d.ejectionDuration(2))
+	assert.Equal(t, 240*time.Second, d.ejectionDuration(4))
+	assert.Equal(t, 300*time.Second, d.ejectionDuration(5))
+	assert.Equal(t, 300*time.Second, d.ejectionDuration(100))
+}
+
+func TestIsBackendFailure(t *testing.T) {
+	assert.False(t, isBackendFailure(nil))
+	assert.True(t, isBackendFailure(errors.New("read tcp: i/o timeout")))
+	assert.True(t, isBackendFailure(mysql.NewError(mysql.ErrConCount, "Too many connections")))
+	assert.True(t, isBackendFailure(mysql.NewError(errQueryTimeout, "Query execution was interrupted, maximum statement execution time exceeded")))
+	assert.False(t, isBackendFailure(mysql.NewError(mysql.ErrQueryInterrupted, "Query execution was interrupted")))
+	assert.False(t, isBackendFailure(mysql.NewError(mysql.ErrSyntax, "syntax error")))
+	assert.False(t, isBackendFailure(mysql.NewError(mysql.ErrDupEntry, "Duplicate entry")))
+}
+
+func TestCircuitBreakerErrorRate(t *testing.T) {
+	d := newTestOutlierDetector(0)
+	b := d.breakers["c3-mysql-test00:3306"]
+	now := time.Now()
+
+	// 请求数不够时不摘除
+	for i := 0; i < 9; i++ {
+		b.report(d, now, time.Millisecond, true)
+	}
+	assert.Equal(t, BreakerClosed, b.state)
+	b.report(d, now, time.Millisecond, true)
+	assert.Equal(t, BreakerOpen, b.state)
+	assert.False(t, b.available(now.Add(29*time.Second)))
+
+	// 摘除时间结束后半开, 只放行outlierHalfOpenProbes个探测请求
+	now = now.Add(30 * time.Second)
+	assert.True(t, b.available(now))
+	assert.Equal(t, BreakerHalfOpen, b.state)
+	for i := 0; i < outlierHalfOpenProbes; i++ {
+		assert.True(t, b.admit(now))
+	}
+	assert.False(t, b.admit(now))
+	assert.False(t, b.available(now))
+
+	// 失败的探测请求达到错误率时按指数退避再次摘除
+	for i := 0; i < outlierHalfOpenProbes/2-1; i++ {
+		b.report(d, now, time.Millisecond, true)
+	}
+	assert.Equal(t, BreakerHalfOpen, b.state)
+	b.report(d, now, time.Millisecond, true)
+	assert.Equal(t, BreakerOpen, b.state)
+	assert.Equal(t, now.Add(60*time.Second), b.ejectedUntil)
+
+	// 没有返回结果的探测请求一个窗口后不再占用名额
+	now = now.Add(60 * time.Second)
+	for i := 0; i < outlierHalfOpenProbes; i++ {
+		assert.True(t, b.admit(now))
+	}
+	assert.False(t, b.admit(now.Add(outlierWindow-time.Second)))
+	assert.True(t, b.admit(now.Add(outlierWindow)))
+
+	// 所有探测请求完成后错误率低于阈值时恢复
+	b.report(d, now, time.Millisecond, true)
+	for i := 1; i < outlierHalfOpenProbes; i++ {
+		assert.Equal(t, BreakerHalfOpen, b.state)
+		b.report(d, now, time.Millisecond, false)
+	}
+	assert.Equal(t, BreakerClosed, b.state)
+	assert.True(t, b.admit(now))
+	status := b.status(now)
+	assert.Equal(t, int64(2), status.Ejections)
+	assert.Equal(t, "", status.EjectedUntil)
+	assert.Equal(t, int64(2), d.TakeEjections(b.addr))
+	assert.Equal(t, int64(0), d.TakeEjections(b.addr))
+
+	// 正常的窗口结束后连续摘除次数减1
+	for i := 0; i < 20; i++ {
+		b.report(d, now, time.Millisecond, i%5 == 0)
+	}
+	b.report(d, now.Add(outlierWindow), time.Millisecond, false)
+	assert.Equal(t, BreakerClosed, b.state)
+	assert.Equal(t, 1, b.ejections)
+	assert.Equal(t, 20.0, b.status(now).ErrorRate)
+}
+
+func TestCircuitBreakerP99Latency(t *testing.T) {
+	d := newTestOutlierDetector(100)
+	b := d.breakers["c3-mysql-test01:3306"]
+	now := time.Now()
+
+	for i := 0; i < 100; i++ {
+		latency := time.Millisecond
+		if i >= 98 {
+			latency = time.Second
+		}
+		b.report(d, now, latency, false)
+	}
+	assert.Equal(t, BreakerClosed, b.state)
+
+	// p99延迟在窗口结束时检查
+	b.report(d, now.Add(outlierWindow), time.Millisecond, false)
+	assert.Equal(t, BreakerOpen, b.state)
+	assert.Equal(t, now.Add(outlierWindow+30*time.Second), b.ejectedUntil)
+
+	data, err := json.Marshal(d.Status())
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), `"state":"open"`)
+
+	// 半开状态下按p90延迟判断, 单个慢请求不会再次摘除
+	now = b.ejectedUntil
+	for i := 0; i < outlierHalfOpenProbes; i++ {
+		latency := time.Millisecond
+		if i == 0 {
+			latency = time.Second
+		}
+		b.report(d, now, latency, false)
+	}
+	assert.Equal(t, BreakerClosed, b.state)
+
+	b.eject(d, now)
+	now = b.ejectedUntil
+	for i := 0; i < outlierHalfOpenProbes; i++ {
+		latency := time.Millisecond
+		if i < 2 {
+			latency = time.Second
+		}
+		b.report(d, now, latency, false)
+	}
+	assert.Equal(t, BreakerOpen, b.state)
+}
+
+func TestGetSlaveConnSkipEjected(t *testing.T) {
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	dbInfo := generateDBInfo(mockCtl, []string{"c3-mysql-test00:3306", "c3-mysql-test01:3306"}, []StatusCode{StatusUp, StatusUp})
+	s := &Slice{Slave: dbInfo, Outliers: newTestOutlierDetector(0)}
+	for i := 0; i < 10; i++ {
+		s.ReportResult("c3-mysql-test00:3306", time.Millisecond, errors.New("i/o timeout"))
+	}
+	assert.True(t, s.Outliers.IsEjected("c3-mysql-test00:3306"))
+
+	for i := 0; i < 4; i++ {
+		pc, err := s.GetSlaveConn(dbInfo, LocalSlaveReadClosed)
+		assert.Nil(t, err)
+		assert.Equal(t, "c3-mysql-test01:3306", pc.GetAddr())
+	}
+
+	// 半开状态的从库探测名额用完后不再选择
+	b := s.Outliers.breakers["c3-mysql-test00:3306"]
+	b.Lock()
+	b.ejectedUntil = time.Now()
+	b.Unlock()
+	selected := 0
+	for i := 0; i < 4*outlierHalfOpenProbes; i++ {
+		pc, err := s.GetSlaveConn(dbInfo, LocalSlaveReadClosed)
+		assert.Nil(t, err)
+		if pc.GetAddr() == "c3-mysql-test00:3306" {
+			selected++
+		}
+	}
+	assert.Equal(t, outlierHalfOpenProbes, selected)
+
+	// 所有从库都被摘除时忽略摘除
+	for i := 0; i < 10; i++ {
+		s.ReportResult("c3-mysql-test01:3306", time.Millisecond, errors.New("i/o timeout"))
+	}
+	assert.Nil(t, s.Outliers.ejectedSlaves(dbInfo))
+	_, err := s.GetSlaveConn(dbInfo, LocalSlaveReadClosed)
+	assert.Nil(t, err)
+}
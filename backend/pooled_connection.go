@@ -42,6 +42,8 @@ func (pc *pooledConnectImpl) Recycle() {
 	if pc.IsClosed() {
 		pc.pool.Put(nil)
 	} else {
+		// 没有被取走的GTID属于上一个会话
+		pc.directConnection.gtids = nil
 		pc.pool.Put(pc)
 		pc.returnTime = time.Now()
 	}
@@ -51,7 +53,7 @@ func (pc *pooledConnectImpl) Recycle() {
 // If we get "MySQL server has gone away (errno 2006)", then call Reconnect
 func (pc *pooledConnectImpl) Reconnect() error {
 	pc.directConnection.Close()
-	newConn, err := NewDirectConnection(pc.pool.addr, pc.pool.user, pc.pool.password, pc.pool.db, pc.pool.charset, pc.pool.collationID, pc.pool.clientCapability)
+	newConn, err := NewDirectConnection(pc.pool.addr, pc.pool.user, pc.pool.password, pc.pool.db, pc.pool.charset, pc.pool.collationID, pc.pool.clientCapability, pc.pool.tlsConfig)
 	if err != nil {
 		return err
 	}
@@ -90,7 +92,14 @@ func (pc *pooledConnectImpl) PingWithTimeout(timeout time.Duration) error {
 
 // Execute wrapper of direct connection, execute sql
 func (pc *pooledConnectImpl) Execute(sql string, maxRows int) (*mysql.Result, error) {
-	rs, err := pc.directConnection.Execute(sql, maxRows)
+	return pc.ExecuteWithFetchSize(sql, maxRows, mysql.MaxPayloadLen)
+}
+
+// ExecuteWithFetchSize wrapper of direct connection, execute sql and read at most fetchSize bytes of rows
+func (pc *pooledConnectImpl) ExecuteWithFetchSize(sql string, maxRows, fetchSize int) (*mysql.Result, error) {
+	start := time.Now()
+	rs, err := pc.directConnection.ExecuteWithFetchSize(sql, maxRows, fetchSize)
+	pc.observeLatency(start)
 	pc.moreRowsExist = pc.directConnection.moreRowExists
 	if err != nil {
 		return nil, err
@@ -106,7 +115,12 @@ func (pc *pooledConnectImpl) Execute(sql string, maxRows int) (*mysql.Result, er
 }
 
 func (pc *pooledConnectImpl) FetchMoreRows(result *mysql.Result, maxRows int) error {
-	err := pc.directConnection.readResultRows(result, false, maxRows)
+	return pc.FetchMoreRowsWithFetchSize(result, maxRows, mysql.MaxPayloadLen)
+}
+
+// FetchMoreRowsWithFetchSize read at most fetchSize bytes of the rest rows
+func (pc *pooledConnectImpl) FetchMoreRowsWithFetchSize(result *mysql.Result, maxRows, fetchSize int) error {
+	err := pc.directConnection.readResultRows(result, false, maxRows, fetchSize)
 	pc.moreRowsExist = pc.directConnection.moreRowExists
 	return err
 }
@@ -114,7 +128,7 @@ func (pc *pooledConnectImpl) FetchMoreRows(result *mysql.Result, maxRows int) er
 func (pc *pooledConnectImpl) ReadMoreResult(maxRows int) (*mysql.Result, error) {
 	// set default to false
 	pc.moreResultsExist = false
-	rs, err := pc.directConnection.readResult(false, maxRows)
+	rs, err := pc.directConnection.readResult(false, maxRows, mysql.MaxPayloadLen)
 	if err != nil {
 		return nil, err
 	}
@@ -125,9 +139,23 @@ func (pc *pooledConnectImpl) ReadMoreResult(maxRows int) (*mysql.Result, error)
 }
 
 func (pc *pooledConnectImpl) ExecuteWithTimeout(sql string, maxRows int, timeout time.Duration) (*mysql.Result, error) {
+	start := time.Now()
+	defer pc.observeLatency(start)
 	return pc.directConnection.ExecuteWithTimeout(sql, maxRows, timeout)
 }
 
+// observeLatency 记录执行SQL的延迟到连接池
+func (pc *pooledConnectImpl) observeLatency(start time.Time) {
+	if pc.pool != nil && pc.pool.latency != nil {
+		pc.pool.latency.observe(time.Since(start))
+	}
+}
+
+// TakeGTIDs wrapper of direct connection, return gtids committed since last call
+func (pc *pooledConnectImpl) TakeGTIDs() string {
+	return pc.directConnection.TakeGTIDs()
+}
+
 func (pc *pooledConnectImpl) MoreRowsExist() bool {
 	return pc.moreRowsExist
 }
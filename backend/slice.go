@@ -86,6 +86,14 @@ func (dbi *DBInfo) GetStatus(index int) (StatusCode, error) {
 	return StatusDown, fmt.Errorf("can't get status of index:%d", index)
 }
 
+// TakeSelectedCount 返回上次调用后节点被负载均衡选中的次数, 用于累加到监控的计数器
+func (dbi *DBInfo) TakeSelectedCount(index int) int64 {
+	if dbi.Balancer == nil {
+		return 0
+	}
+	return dbi.Balancer.takeSelected(index)
+}
+
 func (dbi *DBInfo) SetStatus(index int, status StatusCode) {
 	dbi.StatusMap.Store(index, status)
 }
@@ -102,6 +110,39 @@ type Slice struct {
 	charset         string
 	collationID     mysql.CollationID
 	HealthCheckSql  string
+	SessionTrack    bool       // 后端连接是否开启会话状态跟踪, 开启后可以从OK包中获取写入的GTID
+	TLSConfig       *TLSConfig // 连接后端使用的TLS配置, 为nil时不使用TLS
+	// 协调多个proxy自动切换主库, 为nil时master不可用后只标记为StatusDown
+	Failover      FailoverCoordinator
+	failoverVoted bool // 只在检查master状态的goroutine中访问
+	// 被动健康检查, 为nil时不摘除从库
+	Outliers *OutlierDetector
+}
+
+// GetMaster 自动切换主库时会替换Master和Slave, 需要加锁读取
+func (s *Slice) GetMaster() *DBInfo {
+	s.RLock()
+	defer s.RUnlock()
+	return s.Master
+}
+
+// GetSlave return slaves of slice
+func (s *Slice) GetSlave() *DBInfo {
+	s.RLock()
+	defer s.RUnlock()
+	return s.Slave
+}
+
+// GetStatisticSlave return statistic slaves of slice
+func (s *Slice) GetStatisticSlave() *DBInfo {
+	s.RLock()
+	defer s.RUnlock()
+	return s.StatisticSlave
+}
+
+// ReportResult 记录在实例addr上执行SQL的延迟和错误, 用于被动健康检查
+func (s *Slice) ReportResult(addr string, latency time.Duration, err error) {
+	s.Outliers.Report(addr, latency, err)
 }
 
 // GetSliceName return name of slice
@@ -113,12 +154,12 @@ func (s *Slice) GetSliceName() string {
 func (s *Slice) GetConn(fromSlave bool, userType int, localSlaveReadPriority int) (pc PooledConnect, err error) {
 	if fromSlave {
 		if userType == models.StatisticUser {
-			pc, err = s.GetSlaveConn(s.StatisticSlave, localSlaveReadPriority)
+			pc, err = s.GetSlaveConn(s.GetStatisticSlave(), localSlaveReadPriority)
 			if err != nil {
 				return nil, err
 			}
 		} else {
-			pc, err = s.GetSlaveConn(s.Slave, localSlaveReadPriority)
+			pc, err = s.GetSlaveConn(s.GetSlave(), localSlaveReadPriority)
 			if err != nil {
 				log.Warn("get connection from slave failed, try to get from master, error: %s", err.Error())
 				pc, err = s.GetMasterConn()
@@ -133,35 +174,102 @@ func (s *Slice) GetConn(fromSlave bool, userType int, localSlaveReadPriority int
 	return
 }
 
+// GetConsistentConn get connection from slave which has executed gtids, so that the session can read its own writes.
+// If the slave doesn't execute gtids in timeout, return connection of master.
+func (s *Slice) GetConsistentConn(userType int, localSlaveReadPriority int, gtids string, timeout time.Duration) (PooledConnect, error) {
+	slavesInfo := s.GetSlave()
+	if userType == models.StatisticUser {
+		slavesInfo = s.GetStatisticSlave()
+	}
+	pc, err := s.GetSlaveConn(slavesInfo, localSlaveReadPriority)
+	if err != nil {
+		log.Debug("get connection from slave failed, try to get from master, error: %s", err.Error())
+		return s.GetMasterConn()
+	}
+
+	executed, err := waitForExecutedGTIDs(pc, gtids, timeout)
+	if err != nil {
+		log.Warn("wait for gtids executed failed, addr: %s, gtids: %s, error: %s", pc.GetAddr(), gtids, err.Error())
+		pc.Close()
+		pc.Recycle()
+		return s.GetMasterConn()
+	}
+	if !executed {
+		log.Debug("slave doesn't execute gtids in %v, try to get from master, addr: %s, gtids: %s", timeout, pc.GetAddr(), gtids)
+		pc.Recycle()
+		return s.GetMasterConn()
+	}
+	return pc, nil
+}
+
+// waitForExecutedGTIDs 检查实例是否已经执行了gtids, timeout大于0时使用WAIT_FOR_EXECUTED_GTID_SET最多等待timeout
+func waitForExecutedGTIDs(pc PooledConnect, gtids string, timeout time.Duration) (bool, error) {
+	var sql string
+	if timeout > 0 {
+		sql = fmt.Sprintf("SELECT WAIT_FOR_EXECUTED_GTID_SET('%s', %s)", mysql.Escape(gtids), strconv.FormatFloat(timeout.Seconds(), 'f', 3, 64))
+	} else {
+		sql = fmt.Sprintf("SELECT GTID_SUBSET('%s', @@GLOBAL.gtid_executed)", mysql.Escape(gtids))
+	}
+	r, err := pc.Execute(sql, 0)
+	if err != nil {
+		return false, err
+	}
+	if r.Resultset == nil || r.RowNumber() == 0 {
+		return false, fmt.Errorf("empty result of %s", sql)
+	}
+	v, err := r.GetInt(0, 0)
+	if err != nil {
+		return false, err
+	}
+	// WAIT_FOR_EXECUTED_GTID_SET返回0表示已执行, 1表示超时; GTID_SUBSET返回1表示已执行
+	if timeout > 0 {
+		return v == 0, nil
+	}
+	return v == 1, nil
+}
+
+// capability 连接后端使用的客户端能力, 开启会话状态跟踪时需要加上CLIENT_SESSION_TRACK
+func (s *Slice) capability() uint32 {
+	capability := s.Cfg.Capability
+	if s.SessionTrack {
+		if capability == 0 {
+			capability = defaultCapability
+		}
+		capability |= mysql.ClientSessionTrack
+	}
+	return capability
+}
+
 func (s *Slice) GetDirectConn(addr string) (*DirectConnection, error) {
-	return NewDirectConnection(addr, s.Cfg.UserName, s.Cfg.Password, "", s.charset, s.collationID, s.Cfg.Capability)
+	return NewDirectConnection(addr, s.Cfg.UserName, s.Cfg.Password, "", s.charset, s.collationID, s.capability(), s.TLSConfig)
 }
 
 // GetMasterConn return a connection in master pool
 func (s *Slice) GetMasterConn() (PooledConnect, error) {
-	if v, _ := s.Master.StatusMap.Load(0); v != StatusUp {
-		return nil, fmt.Errorf("master:%s is Down", s.Cfg.Master)
+	master := s.GetMaster()
+	if v, _ := master.StatusMap.Load(0); v != StatusUp {
+		return nil, fmt.Errorf("master:%s is Down", master.ConnPool[0].Addr())
 	}
 
 	ctx := context.TODO()
-	return s.Master.ConnPool[0].Get(ctx)
+	return master.ConnPool[0].Get(ctx)
 }
 
 // GetMasterStatus return master status
 func (s *Slice) GetMasterStatus() (StatusCode, error) {
-	return s.Master.GetStatus(0)
+	return s.GetMaster().GetStatus(0)
 }
 
 // SetMasterStatus set master status
 func (s *Slice) SetMasterStatus(code StatusCode) {
-	s.Master.SetStatus(0, code)
+	s.GetMaster().SetStatus(0, code)
 }
 
 // CheckStatus check slice instance status
 func (s *Slice) CheckStatus(ctx context.Context, name string, downAfterNoAlive int, secondsBehindMaster int) {
 	go s.checkBackendMasterStatus(ctx, name, downAfterNoAlive)
-	go s.checkBackendSlaveStatus(ctx, s.Slave, name, downAfterNoAlive, secondsBehindMaster)
-	go s.checkBackendSlaveStatus(ctx, s.StatisticSlave, name, downAfterNoAlive, secondsBehindMaster)
+	go s.checkBackendSlaveStatus(ctx, s.GetSlave, name, downAfterNoAlive, secondsBehindMaster)
+	go s.checkBackendSlaveStatus(ctx, s.GetStatisticSlave, name, downAfterNoAlive, secondsBehindMaster)
 }
 
 func (s *Slice) checkBackendMasterStatus(ctx context.Context, name string, downAfterNoAlive int) {
@@ -176,19 +284,26 @@ func (s *Slice) checkBackendMasterStatus(ctx context.Context, name string, downA
 			log.Warn("[ns:%s, %s] check master status canceled", name, s.Cfg.Name)
 			return
 		case <-time.After(time.Duration(PingPeriod) * time.Second):
-			if len(s.Master.ConnPool) == 0 {
+			master := s.GetMaster()
+			if len(master.ConnPool) == 0 {
 				log.Warn("[ns:%s, %s] master is empty", name, s.Cfg.Name)
 				continue
 			}
-			cp := s.Master.ConnPool[0]
+			cp := master.ConnPool[0]
 			log.Debug("[ns:%s, %s:%s] start check master", name, s.Cfg.Name, cp.Addr())
 			_, err := checkInstanceStatus(name, cp, s.HealthCheckSql)
 
 			if time.Now().Unix()-cp.GetLastChecked() >= int64(downAfterNoAlive) {
 				s.SetMasterStatus(StatusDown)
 				log.Warn("[ns:%s, %s:%s] check master StatusDown for %ds. err: %s", name, s.Cfg.Name, cp.Addr(), time.Now().Unix()-cp.GetLastChecked(), err)
+				if s.Failover != nil {
+					s.tryFailover(name, cp.Addr())
+				}
 				continue
 			}
+			if s.failoverVoted {
+				s.revokeFailoverVote(name)
+			}
 
 			oldStatus, err := s.GetMasterStatus()
 			if err != nil {
@@ -204,7 +319,7 @@ func (s *Slice) checkBackendMasterStatus(ctx context.Context, name string, downA
 	}
 }
 
-func (s *Slice) checkBackendSlaveStatus(ctx context.Context, db *DBInfo, name string, downAfterNoAlive int, secondBehindMaster int) {
+func (s *Slice) checkBackendSlaveStatus(ctx context.Context, getDB func() *DBInfo, name string, downAfterNoAlive int, secondBehindMaster int) {
 	defer func() {
 		if err := recover(); err != nil {
 			log.Fatal("[ns:%s, %s] check slave status panic:%s", name, s.Cfg.Name, err)
@@ -217,6 +332,7 @@ func (s *Slice) checkBackendSlaveStatus(ctx context.Context, db *DBInfo, name st
 			log.Warn("[ns:%s, %s] check slave status canceled", name, s.Cfg.Name)
 			return
 		case <-time.After(time.Duration(PingPeriod) * time.Second):
+			db := getDB()
 			for idx, cp := range db.ConnPool {
 				log.Debug("[ns:%s, %s:%s] start check slave", name, s.Cfg.Name, cp.Addr())
 
@@ -324,8 +440,48 @@ func (s *Slice) GetSlaveConn(slavesInfo *DBInfo, localSlaveReadPriority int) (Po
 	if len(slavesInfo.ConnPool) == 0 || allSlaveIsOffline(slavesInfo.StatusMap) {
 		return nil, errors.ErrNoSlaveDB
 	}
+	selectSlave := func(ejected []bool) (int, error) {
+		return s.selectSlave(slavesInfo, localSlaveReadPriority, ejected)
+	}
+	if slavesInfo.Balancer.isLoadAware() {
+		selectSlave = func(ejected []bool) (int, error) {
+			return s.selectSlaveByLoad(slavesInfo, localSlaveReadPriority, ejected)
+		}
+	}
+
+	ejected := s.Outliers.ejectedSlaves(slavesInfo)
+	index, err := selectSlave(ejected)
+	if err != nil {
+		return nil, err
+	}
+	// 半开状态的从库探测名额用完时换一个从库, 没有其他从库可选时仍然使用该从库
+	for s.Outliers != nil && !s.Outliers.admit(slavesInfo.ConnPool[index].Addr()) {
+		if ejected == nil {
+			ejected = make([]bool, len(slavesInfo.ConnPool))
+		}
+		ejected[index] = true
+		next, err := selectSlave(ejected)
+		if err != nil {
+			break
+		}
+		index = next
+	}
+	slavesInfo.Balancer.markSelected(index)
+
+	// 获取连接失败(连接数满、连接超时等)同样计入被动健康检查
+	cp := slavesInfo.ConnPool[index]
+	startTime := time.Now()
+	pc, err := cp.Get(context.TODO())
+	if err != nil && s.Outliers != nil {
+		s.ReportResult(cp.Addr(), time.Since(startTime), err)
+	}
+	return pc, err
+}
+
+// selectSlave 按负载均衡策略选择可用并且没有被摘除的从库, 开启LocalSlaveReadPriority时优先选择本机房的从库
+func (s *Slice) selectSlave(slavesInfo *DBInfo, localSlaveReadPriority int, ejected []bool) (int, error) {
 	var index int
-	partialFoundIndex, foundIndex := -1, -1
+	partialFoundIndex := -1
 	// find the idx of the ConnPool that isn't mark as down
 	for size := len(slavesInfo.ConnPool); size > 0; size-- {
 		s.Lock()
@@ -333,7 +489,7 @@ func (s *Slice) GetSlaveConn(slavesInfo *DBInfo, localSlaveReadPriority int) (Po
 		index, err = slavesInfo.Balancer.next()
 		s.Unlock()
 		if err != nil {
-			return nil, err
+			return -1, err
 		}
 
 		if status, err := slavesInfo.GetStatus(index); err != nil {
@@ -343,47 +499,73 @@ func (s *Slice) GetSlaveConn(slavesInfo *DBInfo, localSlaveReadPriority int) (Po
 			log.Debug("get slave status err or down,addr:%s", slavesInfo.ConnPool[index].Addr())
 			continue
 		}
+		if ejected != nil && ejected[index] {
+			log.Debug("slave is ejected by outlier detection,addr:%s", slavesInfo.ConnPool[index].Addr())
+			continue
+		}
 
 		// partial found slave cause slave status StatusUP
 		partialFoundIndex = index
 
-		// check localSlaveReadPriority and update foundIndex
-		if localSlaveReadPriority == LocalSlaveReadClosed {
-			foundIndex = partialFoundIndex
-			break
+		// check localSlaveReadPriority and datacenter
+		if localSlaveReadPriority == LocalSlaveReadClosed || slavesInfo.ConnPool[index].Datacenter() == s.ProxyDatacenter {
+			return index, nil
 		}
-		// check datacenter
-		if slavesInfo.ConnPool[index].Datacenter() == s.ProxyDatacenter {
-			foundIndex = index
-			break
+	}
+	if partialFoundIndex >= 0 && localSlaveReadPriority != LocalSlaveReadForce {
+		return partialFoundIndex, nil
+	}
+	return -1, fmt.Errorf("get backend conn error,no local datacenter slaves")
+}
+
+// selectSlaveByLoad 在可用并且没有被摘除的从库中按负载选择, 开启LocalSlaveReadPriority时只在本机房的从库中选择
+func (s *Slice) selectSlaveByLoad(slavesInfo *DBInfo, localSlaveReadPriority int, ejected []bool) (int, error) {
+	var all, local []int
+	for index, cp := range slavesInfo.ConnPool {
+		if status, err := slavesInfo.GetStatus(index); err != nil || status == StatusDown {
+			continue
+		}
+		if ejected != nil && ejected[index] {
+			continue
+		}
+		all = append(all, index)
+		if cp.Datacenter() == s.ProxyDatacenter {
+			local = append(local, index)
 		}
 	}
-	if foundIndex >= 0 {
-		return slavesInfo.ConnPool[foundIndex].Get(context.TODO())
+
+	candidates := all
+	if localSlaveReadPriority != LocalSlaveReadClosed {
+		if len(local) > 0 {
+			candidates = local
+		} else if localSlaveReadPriority == LocalSlaveReadForce {
+			return -1, fmt.Errorf("get backend conn error,no local datacenter slaves")
+		}
 	}
-	if partialFoundIndex >= 0 && localSlaveReadPriority != LocalSlaveReadForce {
-		return slavesInfo.ConnPool[partialFoundIndex].Get(context.TODO())
+	if len(candidates) == 0 {
+		return -1, errors.ErrNoSlaveDB
 	}
-	return nil, fmt.Errorf("get backend conn error,no local datacenter slaves")
+	return slavesInfo.Balancer.pick(candidates, slavesInfo.ConnPool), nil
 }
 
 // Close close the pool in slice
 func (s *Slice) Close() error {
-	s.Lock()
-	defer s.Unlock()
 	// close master
-	for i := range s.Master.ConnPool {
-		s.Master.ConnPool[i].Close()
+	master := s.GetMaster()
+	for i := range master.ConnPool {
+		master.ConnPool[i].Close()
 	}
 
 	// close slaves
-	for i := range s.Slave.ConnPool {
-		s.Slave.ConnPool[i].Close()
+	slaves := s.GetSlave()
+	for i := range slaves.ConnPool {
+		slaves.ConnPool[i].Close()
 	}
 
 	// close statistic slaves
-	for i := range s.StatisticSlave.ConnPool {
-		s.StatisticSlave.ConnPool[i].Close()
+	statisticSlaves := s.GetStatisticSlave()
+	for i := range statisticSlaves.ConnPool {
+		statisticSlaves.ConnPool[i].Close()
 	}
 
 	return nil
@@ -403,7 +585,7 @@ func (s *Slice) ParseMaster(masterStr string) error {
 		log.Warn("get master(%s) datacenter err:%s,will use default proxy datacenter.", masterStr, err)
 		dc = s.ProxyDatacenter
 	}
-	connectionPool := NewConnectionPool(masterStr, s.Cfg.UserName, s.Cfg.Password, "", s.Cfg.Capacity, s.Cfg.MaxCapacity, idleTimeout, s.charset, s.collationID, s.Cfg.Capability, s.Cfg.InitConnect, dc)
+	connectionPool := NewConnectionPool(masterStr, s.Cfg.UserName, s.Cfg.Password, "", s.Cfg.Capacity, s.Cfg.MaxCapacity, idleTimeout, s.charset, s.collationID, s.capability(), s.Cfg.InitConnect, dc, s.TLSConfig)
 	if err := connectionPool.Open(); err != nil {
 		return err
 	}
@@ -467,7 +649,7 @@ func (s *Slice) ParseSlave(slaves []string) (*DBInfo, error) {
 		}
 		datacenter = append(datacenter, dc)
 
-		cp := NewConnectionPool(addrAndWeight[0], s.Cfg.UserName, s.Cfg.Password, "", s.Cfg.Capacity, s.Cfg.MaxCapacity, idleTimeout, s.charset, s.collationID, s.Cfg.Capability, s.Cfg.InitConnect, dc)
+		cp := NewConnectionPool(addrAndWeight[0], s.Cfg.UserName, s.Cfg.Password, "", s.Cfg.Capacity, s.Cfg.MaxCapacity, idleTimeout, s.charset, s.collationID, s.capability(), s.Cfg.InitConnect, dc, s.TLSConfig)
 		if err = cp.Open(); err != nil {
 			return nil, err
 		}
@@ -478,6 +660,7 @@ func (s *Slice) ParseSlave(slaves []string) (*DBInfo, error) {
 		return &DBInfo{}, nil
 	}
 	slaveBalancer := newBalancer(slaveWeights, len(connPool))
+	slaveBalancer.setStrategy(s.Cfg.BalanceStrategy)
 	StatusMap := &sync.Map{}
 	for idx := range connPool {
 		StatusMap.Store(idx, StatusUp)
@@ -496,6 +679,8 @@ type SlaveStatus struct {
 	SecondsBehindMaster uint64
 	SlaveIORunning      string
 	SlaveSQLRunning     string
+	MasterHost          string
+	MasterPort          uint64
 	MasterLogFile       string
 	ReadMasterLogPos    uint64
 	RelayMasterLogFile  string
@@ -561,6 +746,14 @@ func GetSlaveStatus(conn PooledConnect) (bool, SlaveStatus, error) {
 		return true, slaveStatus, nil
 	}
 
+	slaveStatus, err = parseSlaveStatus(res)
+	return false, slaveStatus, err
+}
+
+// parseSlaveStatus parse the first row of show slave status
+func parseSlaveStatus(res *mysql.Result) (SlaveStatus, error) {
+	var slaveStatus SlaveStatus
+	var err error
 	for _, f := range res.Fields {
 		fieldName := string(f.Name)
 		var col any
@@ -592,6 +785,22 @@ func GetSlaveStatus(conn PooledConnect) (bool, SlaveStatus, error) {
 			default:
 				slaveStatus.SlaveSQLRunning = "No"
 			}
+		case "master_host":
+			switch typ := col.(type) {
+			case string:
+				slaveStatus.MasterHost = typ
+			default:
+				slaveStatus.MasterHost = ""
+			}
+		case "master_port":
+			switch typ := col.(type) {
+			case uint64:
+				slaveStatus.MasterPort = typ
+			case int64:
+				slaveStatus.MasterPort = uint64(typ)
+			default:
+				slaveStatus.MasterPort = 0
+			}
 		case "master_log_file":
 			switch typ := col.(type) {
 			case string:
@@ -624,5 +833,5 @@ func GetSlaveStatus(conn PooledConnect) (bool, SlaveStatus, error) {
 			continue
 		}
 	}
-	return false, slaveStatus, err
+	return slaveStatus, err
 }
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/XiaoMi/Gaea/mysql"
 	"github.com/XiaoMi/Gaea/util"
@@ -310,3 +311,90 @@ func TestCheckSlaveSyncStatus(t *testing.T) {
 		})
 	}
 }
+
+func TestGetConsistentConn(t *testing.T) {
+	const gtids = "3e11fa47-71ca-11e1-9e33-c80aa9429562:23"
+	newIntResult := func(v int64) *mysql.Result {
+		return &mysql.Result{
+			Resultset: &mysql.Resultset{
+				Fields:     []*mysql.Field{{Name: []byte("r")}},
+				FieldNames: map[string]int{"r": 0},
+				Values:     [][]any{{v}},
+			},
+		}
+	}
+
+	testCases := []struct {
+		name       string
+		timeout    time.Duration
+		sql        string
+		result     *mysql.Result
+		err        error
+		expectAddr string
+	}{
+		{
+			name:       "test slave executed gtids",
+			timeout:    50 * time.Millisecond,
+			sql:        "SELECT WAIT_FOR_EXECUTED_GTID_SET('" + gtids + "', 0.050)",
+			result:     newIntResult(0),
+			expectAddr: "127.0.0.1:3307",
+		},
+		{
+			name:       "test slave wait timeout",
+			timeout:    50 * time.Millisecond,
+			sql:        "SELECT WAIT_FOR_EXECUTED_GTID_SET('" + gtids + "', 0.050)",
+			result:     newIntResult(1),
+			expectAddr: "127.0.0.1:3306",
+		},
+		{
+			name:       "test slave executed gtids without wait",
+			sql:        "SELECT GTID_SUBSET('" + gtids + "', @@GLOBAL.gtid_executed)",
+			result:     newIntResult(1),
+			expectAddr: "127.0.0.1:3307",
+		},
+		{
+			name:       "test slave not executed gtids without wait",
+			sql:        "SELECT GTID_SUBSET('" + gtids + "', @@GLOBAL.gtid_executed)",
+			result:     newIntResult(0),
+			expectAddr: "127.0.0.1:3306",
+		},
+		{
+			name:       "test slave wait error",
+			timeout:    50 * time.Millisecond,
+			sql:        "SELECT WAIT_FOR_EXECUTED_GTID_SET('" + gtids + "', 0.050)",
+			err:        fmt.Errorf("FUNCTION WAIT_FOR_EXECUTED_GTID_SET does not exist"),
+			expectAddr: "127.0.0.1:3306",
+		},
+	}
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	for _, tt := range testCases {
+		t.Run(tt.name, func(t *testing.T) {
+			slaveConn := NewMockPooledConnect(mockCtl)
+			slaveConn.EXPECT().GetAddr().Return("127.0.0.1:3307").AnyTimes()
+			slaveConn.EXPECT().Execute(tt.sql, 0).Return(tt.result, tt.err)
+			slaveConn.EXPECT().Recycle().AnyTimes()
+			slaveConn.EXPECT().Close().AnyTimes()
+			slavePool := NewMockConnectionPool(mockCtl)
+			slavePool.EXPECT().Get(context.TODO()).Return(slaveConn, nil)
+
+			masterConn := NewMockPooledConnect(mockCtl)
+			masterConn.EXPECT().GetAddr().Return("127.0.0.1:3306").AnyTimes()
+			masterPool := NewMockConnectionPool(mockCtl)
+			masterPool.EXPECT().Get(context.TODO()).Return(masterConn, nil).AnyTimes()
+
+			slaveStatus := &sync.Map{}
+			slaveStatus.Store(0, StatusUp)
+			masterStatus := &sync.Map{}
+			masterStatus.Store(0, StatusUp)
+			s := &Slice{
+				Master: &DBInfo{ConnPool: []ConnectionPool{masterPool}, StatusMap: masterStatus},
+				Slave:  &DBInfo{ConnPool: []ConnectionPool{slavePool}, Balancer: newBalancer([]int{1}, 1), StatusMap: slaveStatus},
+			}
+
+			pc, err := s.GetConsistentConn(0, LocalSlaveReadClosed, gtids, tt.timeout)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.expectAddr, pc.GetAddr())
+		})
+	}
+}
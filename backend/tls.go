@@ -0,0 +1,106 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/XiaoMi/Gaea/models"
+)
+
+// TLSConfig 连接后端MySQL使用的TLS配置, 为nil时不使用TLS
+type TLSConfig struct {
+	mode   string
+	config *tls.Config
+}
+
+// NewTLSConfig 按slice配置加载证书, ssl_mode为disabled时返回nil
+func NewTLSConfig(mode, ca, cert, key string) (*TLSConfig, error) {
+	mode = models.NormalizeSSLMode(mode)
+	switch mode {
+	case "", models.SSLModeDisabled:
+		return nil, nil
+	case models.SSLModePreferred, models.SSLModeRequired, models.SSLModeVerifyIdentity:
+	default:
+		return nil, fmt.Errorf("invalid ssl_mode: %s", mode)
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, fmt.Errorf("load ssl_cert %s and ssl_key %s error: %v", cert, key, err)
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	if ca != "" {
+		data, err := os.ReadFile(ca)
+		if err != nil {
+			return nil, fmt.Errorf("read ssl_ca %s error: %v", ca, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no valid certificate in ssl_ca %s", ca)
+		}
+		config.RootCAs = pool
+	}
+
+	switch {
+	case mode == models.SSLModeVerifyIdentity:
+		// 由crypto/tls校验证书链和主机名, 连接时按地址设置ServerName
+	case mode == models.SSLModeRequired && config.RootCAs != nil:
+		// 与MySQL客户端相同, 配置了CA时校验证书链, 不校验主机名
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = verifyCertificateChain(config.RootCAs)
+	default:
+		config.InsecureSkipVerify = true
+	}
+	return &TLSConfig{mode: mode, config: config}, nil
+}
+
+// IsRequired MySQL不支持TLS时是否返回错误
+func (t *TLSConfig) IsRequired() bool {
+	return t.mode != models.SSLModePreferred
+}
+
+// clientConfig 返回连接addr使用的配置
+func (t *TLSConfig) clientConfig(addr string) *tls.Config {
+	config := t.config.Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		config.ServerName = host
+	} else {
+		config.ServerName = addr
+	}
+	return config
+}
+
+func verifyCertificateChain(roots *x509.CertPool) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate from mysql")
+		}
+		opts := x509.VerifyOptions{Roots: roots, Intermediates: x509.NewCertPool()}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package backend
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestCert 生成自签名证书, 证书中的IP为127.0.0.1, 返回证书和私钥的文件路径
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "mysql"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.Nil(t, err)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	require.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+// fakeTLSMySQL 模拟MySQL的握手过程, 切换到authPlugin后要求完整认证, 校验TLS连接中发送的明文密码
+type fakeTLSMySQL struct {
+	tlsConfig  *tls.Config // 为nil时不支持TLS
+	authPlugin string
+	password   string
+}
+
+func (f *fakeTLSMySQL) serve(netConn net.Conn) error {
+	defer netConn.Close()
+	c := mysql.NewConn(netConn)
+
+	capability := mysql.ClientProtocol41 | mysql.ClientSecureConnection | mysql.ClientLongPassword |
+		mysql.ClientTransactions | mysql.ClientLongFlag | mysql.ClientPluginAuth
+	if f.tlsConfig != nil {
+		capability |= mysql.ClientSSL
+	}
+	salt := bytes.Repeat([]byte{'a'}, 20)
+	var handshake []byte
+	handshake = append(handshake, mysql.ProtocolVersion)
+	handshake = append(handshake, "8.0.32\x00"...)
+	handshake = mysql.AppendUint32(handshake, 1)
+	handshake = append(handshake, salt[:8]...)
+	handshake = append(handshake, 0)
+	handshake = mysql.AppendUint16(handshake, uint16(capability))
+	handshake = append(handshake, byte(mysql.DefaultCollationID))
+	handshake = mysql.AppendUint16(handshake, mysql.ServerStatusAutocommit)
+	handshake = mysql.AppendUint16(handshake, uint16(capability>>16))
+	handshake = append(handshake, 21)
+	handshake = append(handshake, make([]byte, 10)...)
+	handshake = append(handshake, salt[8:]...)
+	handshake = append(handshake, 0)
+	handshake = append(handshake, mysql.MysqlNativePassword+"\x00"...)
+	if err := c.WritePacket(handshake); err != nil {
+		return err
+	}
+
+	// SSLRequest之后的TLS握手数据不能被缓存读取
+	data, err := c.ReadEphemeralPacketDirect()
+	if err != nil {
+		return err
+	}
+	isSSLRequest := binary.LittleEndian.Uint32(data)&mysql.ClientSSL > 0
+	length := len(data)
+	c.RecycleReadPacket()
+	if isSSLRequest {
+		if length != 32 {
+			return fmt.Errorf("invalid SSLRequest length: %d", length)
+		}
+		if err := c.UpgradeToServerTLS(f.tlsConfig); err != nil {
+			return err
+		}
+		if data, err = c.ReadPacket(); err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(data)&mysql.ClientSSL == 0 {
+			return fmt.Errorf("handshake response without CLIENT_SSL")
+		}
+	}
+
+	if f.authPlugin == mysql.MysqlNativePassword {
+		return c.WriteOKPacket(0, 0, mysql.ServerStatusAutocommit, 0, "")
+	}
+
+	authSwitch := append([]byte{mysql.EOFHeader}, f.authPlugin+"\x00"...)
+	authSwitch = append(append(authSwitch, salt...), 0)
+	if err := c.WritePacket(authSwitch); err != nil {
+		return err
+	}
+	first, err := c.ReadPacket()
+	if err != nil {
+		return err
+	}
+	if f.authPlugin == mysql.CachingSHA2Password {
+		if err := c.WritePacket([]byte{mysql.AuthMoreDataHeader, mysql.CachingSha2PasswordPerformFullAuthentication}); err != nil {
+			return err
+		}
+		if data, err = c.ReadPacket(); err != nil {
+			return err
+		}
+	} else {
+		// sha256_password切换认证插件后, TLS连接中第一个包就是明文密码
+		data = first
+	}
+	if string(data) != f.password+"\x00" {
+		return c.WriteErrorPacket(mysql.ErrAccessDenied, "28000", "Access denied for user")
+	}
+	return c.WriteOKPacket(0, 0, mysql.ServerStatusAutocommit, 0, "")
+}
+
+func startFakeTLSMySQL(t *testing.T, f *fakeTLSMySQL) (string, chan error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	t.Cleanup(func() { ln.Close() })
+	done := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		done <- f.serve(conn)
+	}()
+	return ln.Addr().String(), done
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+
+	for _, mode := range []string{"", "disabled", "DISABLED"} {
+		c, err := NewTLSConfig(mode, certFile, "", "")
+		require.Nil(t, err)
+		require.Nil(t, c)
+	}
+
+	c, err := NewTLSConfig("preferred", "", "", "")
+	require.Nil(t, err)
+	require.False(t, c.IsRequired())
+	require.True(t, c.config.InsecureSkipVerify)
+
+	c, err = NewTLSConfig("required", certFile, certFile, keyFile)
+	require.Nil(t, err)
+	require.True(t, c.IsRequired())
+	require.NotNil(t, c.config.VerifyConnection)
+	require.Len(t, c.config.Certificates, 1)
+
+	c, err = NewTLSConfig("verify-identity", certFile, "", "")
+	require.Nil(t, err)
+	require.False(t, c.config.InsecureSkipVerify)
+	require.Equal(t, "127.0.0.1", c.clientConfig("127.0.0.1:3306").ServerName)
+
+	_, err = NewTLSConfig("verify_ca", "", "", "")
+	require.NotNil(t, err)
+	_, err = NewTLSConfig("required", keyFile, "", "")
+	require.NotNil(t, err)
+	_, err = NewTLSConfig("required", "", certFile, certFile)
+	require.NotNil(t, err)
+}
+
+func TestDirectConnectionWithTLS(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	otherCert, _ := writeTestCert(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	require.Nil(t, err)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	tests := []struct {
+		name      string
+		mode      string
+		ca        string
+		serverTLS *tls.Config
+		plugin    string
+		password  string
+		expectTLS bool
+		hasErr    bool
+	}{
+		{name: "caching_sha2_password full auth", mode: "required", serverTLS: serverTLS, plugin: mysql.CachingSHA2Password, expectTLS: true},
+		{name: "wrong password", mode: "required", serverTLS: serverTLS, plugin: mysql.CachingSHA2Password, password: "wrong", hasErr: true},
+		{name: "sha256_password", mode: "required", serverTLS: serverTLS, plugin: mysql.Sha256Password, expectTLS: true},
+		{name: "verify identity", mode: "verify_identity", ca: certFile, serverTLS: serverTLS, plugin: mysql.CachingSHA2Password, expectTLS: true},
+		{name: "required with ca", mode: "required", ca: certFile, serverTLS: serverTLS, plugin: mysql.MysqlNativePassword, expectTLS: true},
+		{name: "required with wrong ca", mode: "required", ca: otherCert, serverTLS: serverTLS, plugin: mysql.MysqlNativePassword, hasErr: true},
+		{name: "required but mysql not support", mode: "required", plugin: mysql.MysqlNativePassword, hasErr: true},
+		{name: "preferred but mysql not support", mode: "preferred", plugin: mysql.MysqlNativePassword},
+		{name: "disabled", mode: "disabled", serverTLS: serverTLS, plugin: mysql.MysqlNativePassword},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlsConfig, err := NewTLSConfig(test.mode, test.ca, "", "")
+			require.Nil(t, err)
+			addr, done := startFakeTLSMySQL(t, &fakeTLSMySQL{tlsConfig: test.serverTLS, authPlugin: test.plugin, password: "secret"})
+
+			password := "secret"
+			if test.password != "" {
+				password = test.password
+			}
+			dc, err := NewDirectConnection(addr, "gaea", password, "", "utf8mb4", mysql.DefaultCollationID, 0, tlsConfig)
+			if test.hasErr {
+				require.NotNil(t, err)
+				return
+			}
+			require.Nil(t, err)
+			require.Nil(t, <-done)
+			require.Equal(t, test.expectTLS, dc.conn.IsTLS())
+			dc.Close()
+		})
+	}
+}
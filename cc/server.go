@@ -70,6 +70,7 @@ func (s *Server) registerURL() {
 	api.GET("/namespace/detail/:name", s.detailNamespace)
 	api.PUT("/namespace/modify", s.modifyNamespace)
 	api.PUT("/namespace/delete/:name", s.delNamespace)
+	api.PUT("/namespace/failover/:name", s.failoverNamespace)
 	api.GET("/namespace/sqlfingerprint/:name", s.sqlFingerprint)
 	api.GET("/proxy/config/fingerprint", s.proxyConfigFingerprint)
 }
@@ -220,6 +221,45 @@ func (s *Server) modifyNamespace(c *gin.Context) {
 	c.JSON(http.StatusOK, h)
 }
 
+// @Summary 写回slice主库切换后的拓扑
+// @Description 获取集群名称, 将slice的从库提升为主库并通知所有proxy, 由proxy自动切换主库后调用, 未传入为默认集群
+// @Accept  json
+// @Produce  json
+// @Param cluster header string false "cluster name"
+// @Param name path string true "namespace name"
+// @Param failover body json true "slice, old_master, new_master"
+// @Success 200 {object} RetHeader
+// @Security BasicAuth
+// @Router /api/cc/namespace/failover/{name} [put]
+func (s *Server) failoverNamespace(c *gin.Context) {
+	var failover models.SliceFailover
+	h := &RetHeader{RetCode: -1, RetMessage: ""}
+
+	name := strings.TrimSpace(c.Param("name"))
+	if name == "" {
+		h.RetMessage = "input name is empty"
+		c.JSON(http.StatusBadRequest, h)
+		return
+	}
+	if err := c.BindJSON(&failover); err != nil {
+		log.Warn("failoverNamespace failed, err: %v", err)
+		h.RetMessage = err.Error()
+		c.JSON(http.StatusBadRequest, h)
+		return
+	}
+	cluster := c.DefaultQuery("cluster", s.cfg.DefaultCluster)
+	if err := service.FailoverNamespace(name, &failover, s.cfg, cluster); err != nil {
+		log.Warn("failoverNamespace failed, err: %v", err)
+		h.RetMessage = err.Error()
+		c.JSON(http.StatusBadRequest, h)
+		return
+	}
+
+	h.RetCode = 0
+	h.RetMessage = "SUCC"
+	c.JSON(http.StatusOK, h)
+}
+
 // @Summary 删除namespace配置
 // @Description 获取集群名称, 根据namespace name删除namespace, 未传入为默认集群
 // @Produce  json
@@ -164,6 +164,37 @@ func ModifyNamespace(namespace *models.Namespace, cfg *models.CCConfig, cluster
 	return nil
 }
 
+// FailoverNamespace 将slice的从库提升为主库并通知所有proxy, 由proxy自动切换主库后调用
+func FailoverNamespace(name string, failover *models.SliceFailover, cfg *models.CCConfig, cluster string) error {
+	client := models.NewClient(cfg.CoordinatorType, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, getCoordinatorRoot(cluster))
+	storeConn := models.NewStore(client)
+	namespace, err := storeConn.LoadNamespace(cfg.EncryptKey, name)
+	storeConn.Close()
+	if err != nil {
+		return err
+	}
+
+	var slice *models.Slice
+	for _, s := range namespace.Slices {
+		if s.Name == failover.Slice {
+			slice = s
+			break
+		}
+	}
+	if slice == nil {
+		return fmt.Errorf("slice %s not found in namespace %s", failover.Slice, name)
+	}
+	// proxy重试时新的拓扑可能已经写入
+	if slice.Master == failover.NewMaster {
+		return nil
+	}
+	if err = slice.PromoteSlave(failover.OldMaster, failover.NewMaster); err != nil {
+		return err
+	}
+	log.Notice("namespace %s, failover master of %s from %s to %s", name, failover.Slice, failover.OldMaster, failover.NewMaster)
+	return ModifyNamespace(namespace, cfg, cluster)
+}
+
 // DelNamespace delete namespace
 func DelNamespace(name string, cfg *models.CCConfig, cluster string) error {
 	client := models.NewClient(cfg.CoordinatorType, cfg.CoordinatorAddr, cfg.UserName, cfg.Password, getCoordinatorRoot(cluster))
@@ -64,6 +64,16 @@ var (
 	ErrExecInMulti = errors.New("exec in multi slice")
 	// ErrTransInMulti transaction cross slices, not support
 	ErrTransInMulti = errors.New("transaction in multi slice")
+	// ErrDistinctMemoryExceeded distinct aggregate in multiple shards uses too much memory
+	ErrDistinctMemoryExceeded = errors.New("distinct aggregate memory exceeds limit")
+	// ErrInsertSelectRowsExceeded insert ... select forwarded by gaea inserts too many rows
+	ErrInsertSelectRowsExceeded = errors.New("insert select rows exceeds limit")
+	// ErrUpdateKeyNotInTrans update shard key by moving rows out of transaction
+	ErrUpdateKeyNotInTrans = errors.New("update of routing key is only allowed in transaction")
+	// ErrUpdateKeyRowsExceeded update shard key moves too many rows
+	ErrUpdateKeyRowsExceeded = errors.New("rows of routing key update exceeds limit")
+	// ErrCrossShardJoinUnsupported join between tables with different sharding rules can not be executed by gaea
+	ErrCrossShardJoinUnsupported = errors.New("cross-shard join not supported")
 	// ErrUnsupportedShard unsupport shard type
 	ErrUnsupportedShard = errors.New("sql is unsupported in shard mode")
 
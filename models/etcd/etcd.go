@@ -194,6 +194,25 @@ func (c *EtcdClient) UpdateWithTTL(path string, data []byte, ttl time.Duration)
 	return nil
 }
 
+// CreateWithTTL create path with data and ttl, return error if path already exists
+func (c *EtcdClient) CreateWithTTL(path string, data []byte, ttl time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return ErrClosedEtcdClient
+	}
+	cntx, canceller := c.contextWithTimeout()
+	defer canceller()
+	log.Debug("etcd create node %s with ttl %d", path, ttl)
+	_, err := c.kapi.Set(cntx, path, string(data), &client.SetOptions{PrevExist: client.PrevNoExist, TTL: ttl})
+	if err != nil {
+		log.Debug("etcd create node %s failed: %s", path, err)
+		return err
+	}
+	log.Debug("etcd create node OK")
+	return nil
+}
+
 // Delete delete path
 func (c *EtcdClient) Delete(path string) error {
 	c.Lock()
@@ -31,6 +31,9 @@ import (
 // ErrClosedEtcdClient means etcd client closed
 var ErrClosedEtcdClient = errors.New("use of closed etcd client")
 
+// ErrNodeExists means the key to create already exists
+var ErrNodeExists = errors.New("etcd node already exists")
+
 const (
 	defaultEtcdPrefix = "/gaea"
 )
@@ -246,6 +249,41 @@ func (c *EtcdClientV3) UpdateWithLease(path string, data []byte, leaseID clientv
 	return nil
 }
 
+// CreateWithTTL create path with data and ttl, return ErrNodeExists if path already exists
+func (c *EtcdClientV3) CreateWithTTL(path string, data []byte, ttl time.Duration) error {
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return ErrClosedEtcdClient
+	}
+	cntx, canceller := c.contextWithTimeout()
+	defer canceller()
+	_ = log.Debug("etcd create node %s with ttl %f", path, ttl.Seconds())
+
+	lse, err := c.kapi.Grant(cntx, int64(ttl.Seconds()))
+	if err != nil {
+		_ = log.Debug("etcd lease node with ttl %f failed: %s ", ttl.Seconds(), err)
+		return err
+	}
+
+	// CreateRevision为0表示key不存在, 保证只有一个调用方创建成功
+	resp, err := c.kapi.Txn(cntx).
+		If(clientv3.Compare(clientv3.CreateRevision(path), "=", 0)).
+		Then(clientv3.OpPut(path, string(data), clientv3.WithLease(lse.ID))).
+		Commit()
+	if err != nil {
+		_ = log.Debug("etcd create node %s failed: %s", path, err)
+		return err
+	}
+	if !resp.Succeeded {
+		// key已经存在时回收未使用的lease
+		_, _ = c.kapi.Revoke(cntx, lse.ID)
+		return ErrNodeExists
+	}
+	_ = log.Debug("etcd create node OK")
+	return nil
+}
+
 // Delete delete path
 func (c *EtcdClientV3) Delete(path string) error {
 	c.Lock()
@@ -83,6 +83,11 @@ func (c *Client) UpdateWithTTL(path string, data []byte, ttl time.Duration) erro
 	return nil
 }
 
+// CreateWithTTL do nothing
+func (c *Client) CreateWithTTL(path string, data []byte, ttl time.Duration) error {
+	return nil
+}
+
 // Delete delete path
 func (c *Client) Delete(path string) error {
 	return nil
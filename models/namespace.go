@@ -61,6 +61,20 @@ type Namespace struct {
 	ClientQPSLimit          uint32            `json:"client_qps_limit"`          // Namespace 级别的 qps 限制，默认为 0，即不开启
 	SupportLimitTransaction bool              `json:"support_limit_transaction"` // 是否支持限制事务
 	AllowedSessionVariables map[string]string `json:"allowed_session_variables"` // 允许设置的会话变量
+	SupportXA               bool              `json:"support_xa"`                // 是否对跨分片事务使用XA两阶段提交, 默认为 false
+	MaxDistinctMemory       int               `json:"max_distinct_memory"`       // 跨分片COUNT/SUM(DISTINCT)去重时可使用的最大内存(字节), 默认64MB, -1表示不限制
+	MaxInsertSelectRows     int               `json:"max_insert_select_rows"`    // 不能下推的INSERT ... SELECT最多插入的行数, 默认100000, -1表示不限制
+	SupportUpdateShardKey   bool              `json:"support_update_shard_key"`  // 是否允许在事务中UPDATE分片列, 通过在新分片插入、旧分片删除的方式移动数据, 默认为 false
+	MaxUpdateShardKeyRows   int               `json:"max_update_shard_key_rows"` // UPDATE分片列时最多移动的行数, 默认1000, -1表示不限制
+	MaxSubqueryInValues     int               `json:"max_subquery_in_values"`    // IN (SELECT ...)子查询替换为常量列表时的最大数量, 默认10000, -1表示不限制
+	StreamMergeFetchSize    int               `json:"stream_merge_fetch_size"`   // 多分片ORDER BY查询流式归并时, 每次从每个分片读取的最大字节数, 默认64KB, -1表示不使用流式归并
+	StreamMergeMaxConns     int               `json:"stream_merge_max_conns"`    // 流式归并时每个slice最多使用的后端连接数, 分片SQL超过该数量时不使用流式归并, 默认16, -1表示不限制
+	DDLParallelismPerSlice  int               `json:"ddl_parallelism_per_slice"` // 分片表DDL广播到各物理表时, 每个slice同时执行的DDL数量, 默认为4
+	PlanCacheCapacity       int               `json:"plan_cache_capacity"`       // 点查语句执行计划缓存的最大数量, 默认128, -1表示不使用缓存
+	ReadYourWrites          bool              `json:"read_your_writes"`          // 读写分离时, 写入后的读请求是否只发往已执行了写入GTID的slave, 默认为 false
+	ReadYourWritesWindow    int               `json:"read_your_writes_window"`   // 写入后多长时间(毫秒)内的读请求需要读到写入的数据, 默认为0, 表示会话结束前一直保证
+	GTIDWaitTimeout         int               `json:"gtid_wait_timeout"`         // 等待slave执行写入GTID的最长时间(毫秒), 超时后读master, 默认50, -1表示不等待
+	RewriteRules            []*RewriteRule    `json:"rewrite_rules"`             // SQL改写规则, 在生成执行计划前修改语句
 }
 
 // Encode encode json
@@ -114,6 +128,10 @@ func (n *Namespace) Verify() error {
 		return err
 	}
 
+	if err := n.verifyRewriteRules(); err != nil {
+		return err
+	}
+
 	n.verifyCapability()
 	n.verifyDefaultSessionVariables()
 
@@ -298,6 +316,21 @@ func (n *Namespace) verifyGrayRules() error {
 	return nil
 }
 
+func (n *Namespace) verifyRewriteRules() error {
+	names := make(map[string]bool, len(n.RewriteRules))
+	for _, rule := range n.RewriteRules {
+		if err := rule.verify(); err != nil {
+			return fmt.Errorf("rewrite rule config error, namespace: %s, %v", n.Name, err)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("rewrite rule duped, namespace: %s, rule: %s", n.Name, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	return nil
+}
+
 func (n *Namespace) verifyShardRules() error {
 	var sliceNames []string
 	var linkedRuleShards []*Shard
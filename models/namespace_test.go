@@ -254,6 +254,8 @@ func TestVerifySlices_Error(t *testing.T) {
 		{Name: "slice1", UserName: "user", Password: "", Master: "", Slaves: []string{""}, Capacity: 1, MaxCapacity: 1, IdleTimeout: 100},
 		{Name: "slice1", UserName: "user", Password: "", Master: "1.1.1.1:1", Slaves: []string{"1.1.1.1:2"}, Capacity: 0, MaxCapacity: 1, IdleTimeout: 100},
 		{Name: "slice1", UserName: "user", Password: "", Master: "1.1.1.1:1", Slaves: []string{"1.1.1.1:2"}, Capacity: 1, MaxCapacity: 0, IdleTimeout: 100},
+		{Name: "slice1", UserName: "user", Password: "", Master: "1.1.1.1:1", Slaves: []string{"1.1.1.1:2"}, Capacity: 1, MaxCapacity: 1, IdleTimeout: 100, BalanceStrategy: "random"},
+		{Name: "slice1", UserName: "user", Password: "", Master: "1.1.1.1:1", Slaves: []string{"1.1.1.1:2"}, Capacity: 1, MaxCapacity: 1, IdleTimeout: 100, OutlierDetection: true, OutlierErrorRate: 101},
 	}
 	for _, slicef := range slicefs {
 		nf.Slices = append(nf.Slices, slice1)
@@ -980,3 +982,44 @@ func TestNamespace_Verify(t *testing.T) {
 		t.Errorf("namespace verify failed, err: %v", err)
 	}
 }
+
+func TestNamespace_VerifyRewriteRules(t *testing.T) {
+	tests := []struct {
+		rules  []*RewriteRule
+		hasErr bool
+	}{
+		{rules: []*RewriteRule{{Name: "r1", Table: "tbl_ks", ForceIndex: []string{"idx_a"}}, {Name: "r2", Fingerprint: "select * from t", SelectFields: "id"}}},
+		{rules: []*RewriteRule{{Name: "r1", Table: "tbl_ks", MaxLimit: 10}, {Name: "r1", Table: "tbl_ks", MaxLimit: 20}}, hasErr: true},
+		{rules: []*RewriteRule{{Table: "tbl_ks", MaxLimit: 10}}, hasErr: true},
+		{rules: []*RewriteRule{{Name: "r.1", Table: "tbl_ks", MaxLimit: 10}}, hasErr: true},
+		{rules: []*RewriteRule{{Name: "r1", MaxLimit: 10}}, hasErr: true},
+		{rules: []*RewriteRule{{Name: "r1", Table: "tbl_ks"}}, hasErr: true},
+		{rules: []*RewriteRule{{Name: "r1", Table: "tbl_ks", StmtType: "insert", MaxLimit: 10}}, hasErr: true},
+		{rules: []*RewriteRule{{Name: "r1", Fingerprint: "select * from t", ForceIndex: []string{"idx_a"}}}, hasErr: true},
+		{rules: []*RewriteRule{{Name: "r1", Table: "tbl_ks", MaxLimit: -1}}, hasErr: true},
+		{rules: []*RewriteRule{{Name: "r1", Table: "tbl_ks", StmtType: "update", SelectFields: "id"}}, hasErr: true},
+	}
+	for i, test := range tests {
+		ns := &Namespace{RewriteRules: test.rules}
+		err := ns.verifyRewriteRules()
+		if test.hasErr != (err != nil) {
+			t.Errorf("test %d: expect error: %t, actual: %v", i, test.hasErr, err)
+		}
+	}
+}
+
+func TestSlicePromoteSlave(t *testing.T) {
+	s := &Slice{Name: "slice-0", Master: "10.0.0.1:3306", Slaves: []string{"10.0.0.2:3306@2#c3", "10.0.0.3:3306"}}
+	if err := s.PromoteSlave("10.0.0.9:3306", "10.0.0.2:3306"); err == nil {
+		t.Errorf("promote slave with wrong old master should fail")
+	}
+	if err := s.PromoteSlave("10.0.0.1:3306", "10.0.0.4:3306"); err == nil {
+		t.Errorf("promote unknown slave should fail")
+	}
+	if err := s.PromoteSlave("10.0.0.1:3306", "10.0.0.2:3306"); err != nil {
+		t.Fatalf("promote slave failed, %v", err)
+	}
+	if s.Master != "10.0.0.2:3306" || len(s.Slaves) != 1 || s.Slaves[0] != "10.0.0.3:3306" {
+		t.Errorf("unexpected slice after promote, master: %s, slaves: %v", s.Master, s.Slaves)
+	}
+}
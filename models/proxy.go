@@ -74,6 +74,21 @@ type Proxy struct {
 	NumCPU        int    `ini:"num_cpu"`
 	NetBufferSize int    `ini:"net_buffer_size"`
 	ConfigFile    string
+
+	// XA 事务决策日志目录, 默认为 log_path/xa
+	XALogPath string `ini:"xa_log_path"`
+	// XA 事务分支的proxy标识, 默认在第一次启动时生成并保存在xa_log_path中
+	XAProxyID string `ini:"xa_proxy_id"`
+
+	// 客户端连接TLS配置, 配置证书和私钥后开启, 配置CA后校验客户端证书
+	SSLCert string `ini:"ssl_cert"`
+	SSLKey  string `ini:"ssl_key"`
+	SSLCA   string `ini:"ssl_ca"`
+
+	// gaea-cc地址, 自动切换主库后通过gaea-cc写回新的拓扑
+	CCAddr          string `ini:"cc_addr"`
+	CCAdminUser     string `ini:"cc_admin_user"`
+	CCAdminPassword string `ini:"cc_admin_password"`
 }
 
 // ParseProxyConfigFromFile parser proxy config from file
@@ -142,9 +157,29 @@ func (p *Proxy) Verify() (err error) {
 	default:
 		return fmt.Errorf("unsupport auth_plugin: %s", p.AuthPlugin)
 	}
+
+	if (p.SSLCert == "") != (p.SSLKey == "") {
+		return fmt.Errorf("ssl_cert and ssl_key should be set together")
+	}
+	if p.SSLCA != "" && p.SSLCert == "" {
+		return fmt.Errorf("ssl_ca requires ssl_cert and ssl_key")
+	}
+	if p.CCAddr != "" && p.ConfigType == ConfigFile {
+		return fmt.Errorf("cc_addr is not supported when config_type is file")
+	}
 	return
 }
 
+// IsFailoverEnabled 是否可以自动切换slice的主库, 需要通过etcd协调多个proxy
+func (p *Proxy) IsFailoverEnabled() bool {
+	return p.CCAddr != "" && p.ConfigType != ConfigFile
+}
+
+// IsSSLEnabled check if client connections could use TLS
+func (p *Proxy) IsSSLEnabled() bool {
+	return p.SSLCert != "" && p.SSLKey != ""
+}
+
 // ProxyInfo for report proxy information
 type ProxyInfo struct {
 	Token     string `json:"token"`
@@ -0,0 +1,71 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SQL改写规则匹配的语句类型
+const (
+	RewriteStmtSelect = "select"
+	RewriteStmtUpdate = "update"
+	RewriteStmtDelete = "delete"
+)
+
+// RewriteRule SQL改写规则, 在生成执行计划前修改解析后的语句, 用于不修改业务代码修正有问题的SQL.
+// 按指纹或语法树匹配, 同时配置时都需要满足.
+type RewriteRule struct {
+	Name         string   `json:"name"`          // 规则名称, 用于统计命中次数
+	Fingerprint  string   `json:"fingerprint"`   // 按SQL指纹匹配, 可以配置SQL或指纹, 计算方式与black_sql相同
+	DB           string   `json:"db"`            // 按语法树匹配: 语句中使用的表所在的库, 为空时为会话的库
+	Table        string   `json:"table"`         // 按语法树匹配: 语句中使用的表
+	StmtType     string   `json:"stmt_type"`     // 按语法树匹配: select, update, delete, 为空时不限制, 没有force_index时只匹配select
+	ForceIndex   []string `json:"force_index"`   // 为table加上FORCE INDEX, 替换原有的USE INDEX和FORCE INDEX
+	MaxLimit     int      `json:"max_limit"`     // LIMIT的上限, 没有LIMIT时加上LIMIT, 0表示不修改. UPDATE, DELETE需要显式配置stmt_type
+	SelectFields string   `json:"select_fields"` // 替换SELECT *的列, 如"id, name"
+}
+
+func (r *RewriteRule) verify() error {
+	if r.Name == "" {
+		return errors.New("name is required")
+	}
+	if strings.Contains(r.Name, ".") {
+		return fmt.Errorf("name %s must not contain '.'", r.Name)
+	}
+	if strings.TrimSpace(r.Fingerprint) == "" && r.Table == "" {
+		return fmt.Errorf("rule %s must specify fingerprint or table", r.Name)
+	}
+	switch strings.ToLower(r.StmtType) {
+	case "", RewriteStmtSelect, RewriteStmtUpdate, RewriteStmtDelete:
+	default:
+		return fmt.Errorf("rule %s has invalid stmt_type: %s", r.Name, r.StmtType)
+	}
+	if len(r.ForceIndex) == 0 && r.MaxLimit == 0 && strings.TrimSpace(r.SelectFields) == "" {
+		return fmt.Errorf("rule %s must specify at least one of force_index, max_limit, select_fields", r.Name)
+	}
+	if len(r.ForceIndex) != 0 && r.Table == "" {
+		return fmt.Errorf("rule %s must specify table for force_index", r.Name)
+	}
+	if r.MaxLimit < 0 {
+		return fmt.Errorf("rule %s has invalid max_limit: %d", r.Name, r.MaxLimit)
+	}
+	if r.SelectFields != "" && r.StmtType != "" && !strings.EqualFold(r.StmtType, RewriteStmtSelect) {
+		return fmt.Errorf("rule %s: select_fields only works for select", r.Name)
+	}
+	return nil
+}
@@ -17,6 +17,23 @@ package models
 import (
 	"errors"
 	"fmt"
+	"strings"
+)
+
+// 连接后端MySQL的TLS模式, 与MySQL客户端的--ssl-mode相同
+const (
+	SSLModeDisabled       = "disabled"        // 不使用TLS
+	SSLModePreferred      = "preferred"       // MySQL支持时使用TLS, 不校验证书
+	SSLModeRequired       = "required"        // 必须使用TLS, 配置ssl_ca时校验证书链
+	SSLModeVerifyIdentity = "verify_identity" // 必须使用TLS, 校验证书链和主机名
+)
+
+// 从库负载均衡策略
+const (
+	BalanceRoundRobin       = "round_robin"       // 按权重轮询, 默认值
+	BalanceLeastOutstanding = "least_outstanding" // 选择正在使用的连接数/权重最小的从库
+	BalancePeakEWMA         = "peak_ewma"         // 选择延迟峰值EWMA*(正在使用的连接数+1)/权重最小的从库
+	BalanceP2C              = "p2c"               // 按权重随机选择两个从库, 使用peak_ewma的代价选择其中较小的
 )
 
 // Slice means config model of slice
@@ -34,6 +51,21 @@ type Slice struct {
 	InitConnect     string   `json:"init_connect"`     // 与MySQL的init_connect相同，连接池中的连接新建之后即会发送请求，以分号分隔
 	HealthCheckSql  string   `json:"health_check_sql"` // 简单语句的健康查询
 	// gaea proxy as client connected to MySQL  default is 0
+	SSLMode string `json:"ssl_mode"` // 连接MySQL的TLS模式: disabled, preferred, required, verify_identity, 默认为disabled
+	SSLCA   string `json:"ssl_ca"`   // 校验MySQL证书的CA文件, 为空时使用系统CA
+	SSLCert string `json:"ssl_cert"` // MySQL要求客户端证书时使用的证书文件
+	SSLKey  string `json:"ssl_key"`  // 客户端证书的私钥文件
+	// master不可用时自动提升从库, 需要proxy配置gaea-cc地址并使用etcd作为配置中心
+	EnableFailover bool `json:"enable_failover"`
+	// 从库负载均衡策略: round_robin, least_outstanding, peak_ewma, p2c, 默认为round_robin
+	BalanceStrategy string `json:"balance_strategy"`
+	// 被动健康检查: 根据执行SQL的错误率和p99延迟临时摘除从库
+	OutlierDetection       bool `json:"outlier_detection"`
+	OutlierErrorRate       int  `json:"outlier_error_rate"`        // 统计窗口内错误率超过该百分比时摘除, 默认50
+	OutlierP99Latency      int  `json:"outlier_p99_latency"`       // 统计窗口内p99延迟超过该值时摘除, 单位ms, 默认0不检查延迟
+	OutlierMinRequests     int  `json:"outlier_min_requests"`      // 统计窗口内请求数少于该值时不摘除, 默认20
+	OutlierEjectionTime    int  `json:"outlier_ejection_time"`     // 第一次摘除的时间, 连续摘除时每次翻倍, 单位秒, 默认30
+	OutlierMaxEjectionTime int  `json:"outlier_max_ejection_time"` // 最长摘除时间, 单位秒, 默认300
 }
 
 func (s *Slice) verify() error {
@@ -67,5 +99,73 @@ func (s *Slice) verify() error {
 		return fmt.Errorf("connection pool capacity should be less than max connection pool capactiy")
 	}
 
+	s.SSLMode = NormalizeSSLMode(s.SSLMode)
+	switch s.SSLMode {
+	case "", SSLModeDisabled, SSLModePreferred, SSLModeRequired, SSLModeVerifyIdentity:
+	default:
+		return fmt.Errorf("invalid ssl_mode: %s", s.SSLMode)
+	}
+	if (s.SSLCert == "") != (s.SSLKey == "") {
+		return errors.New("ssl_cert and ssl_key should be set together")
+	}
+
+	if s.EnableFailover && (s.Master == "" || len(s.Slaves) == 0) {
+		return errors.New("enable_failover requires both master and slaves")
+	}
+
+	if s.OutlierErrorRate < 0 || s.OutlierErrorRate > 100 {
+		return fmt.Errorf("outlier_error_rate should be in [0, 100]")
+	}
+	if s.OutlierP99Latency < 0 || s.OutlierMinRequests < 0 || s.OutlierEjectionTime < 0 || s.OutlierMaxEjectionTime < 0 {
+		return errors.New("outlier detection config should be >= 0")
+	}
+
+	s.BalanceStrategy = strings.ToLower(strings.TrimSpace(s.BalanceStrategy))
+	switch s.BalanceStrategy {
+	case "", BalanceRoundRobin, BalanceLeastOutstanding, BalancePeakEWMA, BalanceP2C:
+	default:
+		return fmt.Errorf("invalid balance_strategy: %s", s.BalanceStrategy)
+	}
+
 	return nil
 }
+
+// SliceFailover 自动切换主库后proxy通过gaea-cc写回的拓扑变更
+type SliceFailover struct {
+	Slice     string `json:"slice"`
+	OldMaster string `json:"old_master"`
+	NewMaster string `json:"new_master"`
+}
+
+// PromoteSlave 将从库newMaster提升为主库并从slaves中移除, 原主库不再保留
+func (s *Slice) PromoteSlave(oldMaster, newMaster string) error {
+	if s.Master != oldMaster {
+		return fmt.Errorf("master of slice %s is %s, not %s", s.Name, s.Master, oldMaster)
+	}
+	slaves := make([]string, 0, len(s.Slaves))
+	found := false
+	for _, slave := range s.Slaves {
+		if SlaveAddr(slave) == newMaster {
+			found = true
+			continue
+		}
+		slaves = append(slaves, slave)
+	}
+	if !found {
+		return fmt.Errorf("%s is not a slave of slice %s", newMaster, s.Name)
+	}
+	s.Master = newMaster
+	s.Slaves = slaves
+	return nil
+}
+
+// SlaveAddr 去掉从库配置中的权重和机房, 如c3-mysql-test00.bj:3306@10#bj
+func SlaveAddr(slave string) string {
+	addr := strings.SplitN(slave, "#", 2)[0]
+	return strings.SplitN(addr, "@", 2)[0]
+}
+
+// NormalizeSSLMode 转为小写, 兼容verify-identity等写法
+func NormalizeSSLMode(mode string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(mode)), "-", "_", -1)
+}
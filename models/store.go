@@ -40,6 +40,7 @@ type Client interface {
 	Create(path string, data []byte) error
 	Update(path string, data []byte) error
 	UpdateWithTTL(path string, data []byte, ttl time.Duration) error
+	CreateWithTTL(path string, data []byte, ttl time.Duration) error
 	Delete(path string) error
 	Read(path string) ([]byte, error)
 	List(path string) ([]string, error)
@@ -182,6 +183,88 @@ func (s *Store) DelNamespace(name string) error {
 	return s.client.Delete(s.NamespacePath(name))
 }
 
+// FailoverPath concat path of failover lease and votes of slice
+func (s *Store) FailoverPath(namespace, slice string) string {
+	return filepath.Join(s.prefix, "failover", namespace, slice)
+}
+
+func (s *Store) failoverLeasePath(namespace, slice string) string {
+	return filepath.Join(s.FailoverPath(namespace, slice), "lease")
+}
+
+func (s *Store) failoverVoteBase(namespace, slice string) string {
+	return filepath.Join(s.FailoverPath(namespace, slice), "vote")
+}
+
+// VoteMasterDown 记录proxy探测到slice的master不可用, 超过ttl未更新时自动失效
+func (s *Store) VoteMasterDown(namespace, slice, token, master string, ttl time.Duration) error {
+	return s.client.UpdateWithTTL(filepath.Join(s.failoverVoteBase(namespace, slice), token), []byte(master), ttl)
+}
+
+// RevokeMasterDownVote delete vote of proxy
+func (s *Store) RevokeMasterDownVote(namespace, slice, token string) error {
+	return s.client.Delete(filepath.Join(s.failoverVoteBase(namespace, slice), token))
+}
+
+// ListMasterDownVotes return votes of slice, key is proxy token, value is master address
+func (s *Store) ListMasterDownVotes(namespace, slice string) (map[string]string, error) {
+	values, err := s.client.ListWithValues(s.failoverVoteBase(namespace, slice))
+	if err != nil {
+		return nil, err
+	}
+	votes := make(map[string]string, len(values))
+	for path, master := range values {
+		votes[filepath.Base(path)] = master
+	}
+	return votes, nil
+}
+
+// AcquireFailoverLease 获取slice主库切换的租约, 租约被其他proxy持有时返回false
+func (s *Store) AcquireFailoverLease(namespace, slice, token string, ttl time.Duration) (bool, error) {
+	path := s.failoverLeasePath(namespace, slice)
+	err := s.client.CreateWithTTL(path, []byte(token), ttl)
+	if err == nil {
+		return true, nil
+	}
+	// 创建失败时检查租约是否已经由当前proxy持有
+	holder, readErr := s.client.Read(path)
+	if readErr != nil || holder == nil {
+		return false, err
+	}
+	return string(holder) == token, nil
+}
+
+func (s *Store) failoverCandidatePath(namespace, slice string) string {
+	return filepath.Join(s.FailoverPath(namespace, slice), "candidate")
+}
+
+// SetFailoverCandidate 记录持有租约的proxy选择的新master, 超过ttl后自动失效
+func (s *Store) SetFailoverCandidate(namespace, slice, master string, ttl time.Duration) error {
+	return s.client.UpdateWithTTL(s.failoverCandidatePath(namespace, slice), []byte(master), ttl)
+}
+
+// GetFailoverCandidate 返回记录的新master, 没有记录时返回空字符串
+func (s *Store) GetFailoverCandidate(namespace, slice string) (string, error) {
+	master, err := s.client.Read(s.failoverCandidatePath(namespace, slice))
+	if err != nil {
+		return "", err
+	}
+	return string(master), nil
+}
+
+// ReleaseFailoverLease 释放proxy持有的租约, 租约不存在或者被其他proxy持有时不做处理
+func (s *Store) ReleaseFailoverLease(namespace, slice, token string) error {
+	path := s.failoverLeasePath(namespace, slice)
+	holder, err := s.client.Read(path)
+	if err != nil {
+		return err
+	}
+	if string(holder) != token {
+		return nil
+	}
+	return s.client.Delete(path)
+}
+
 // ListProxyMonitorMetrics list proxies in proxy register path
 func (s *Store) ListProxyMonitorMetrics() (map[string]*ProxyMonitorMetric, error) {
 	files, err := s.client.List(s.ProxyBase())
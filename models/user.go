@@ -47,6 +47,8 @@ type User struct {
 	RWFlag        int    `json:"rw_flag"`        //1: 只读 2:读写
 	RWSplit       int    `json:"rw_split"`       //0: 不采用读写分离 1:读写分离
 	OtherProperty int    `json:"other_property"` // 1:统计用户
+	Admin         bool   `json:"admin"`          // 是否允许使用GAEA_ROUTE, GAEA_BROADCAST路由hint
+	RequireSSL    bool   `json:"require_ssl"`    // 是否只允许通过TLS连接
 }
 
 func (p *User) verify() error {
@@ -33,6 +33,7 @@ package mysql
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
@@ -521,6 +522,38 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
 
+// UpgradeToServerTLS upgrades the connection to TLS on the server side,
+// after the client sent the SSLRequest packet.
+// The SSLRequest packet must be read by ReadEphemeralPacketDirect, so that
+// no TLS handshake data is left in the buffered reader.
+func (c *Conn) UpgradeToServerTLS(config *tls.Config) error {
+	conn := tls.Server(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake error: %v", err)
+	}
+	c.conn = conn
+	c.bufferedReader.Reset(conn)
+	return nil
+}
+
+// UpgradeToClientTLS upgrades the connection to TLS on the client side,
+// after the SSLRequest packet was sent to the server.
+func (c *Conn) UpgradeToClientTLS(config *tls.Config) error {
+	conn := tls.Client(c.conn, config)
+	if err := conn.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake error: %v", err)
+	}
+	c.conn = conn
+	c.bufferedReader.Reset(conn)
+	return nil
+}
+
+// IsTLS returns true if the connection is using TLS.
+func (c *Conn) IsTLS() bool {
+	_, ok := c.conn.(*tls.Conn)
+	return ok
+}
+
 // GetConnectionID returns the MySQL connection ID for this connection.
 func (c *Conn) GetConnectionID() uint32 {
 	return c.ConnectionID
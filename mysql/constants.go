@@ -71,6 +71,18 @@ const (
 	ServerStatusMetadataChanged    uint16 = 0x0400
 	ServerStatusWasSlow            uint16 = 0x0800
 	ServerPSOutParams              uint16 = 0x1000
+	ServerStatusInTransReadonly    uint16 = 0x2000
+	ServerSessionStateChanged      uint16 = 0x4000
+)
+
+// Session state change type, used in OK packet when ClientSessionTrack is set.
+const (
+	SessionTrackSystemVariables byte = iota
+	SessionTrackSchema
+	SessionTrackStateChange
+	SessionTrackGtids
+	SessionTrackTransactionCharacteristics
+	SessionTrackTransactionState
 )
 
 const (
@@ -143,6 +155,9 @@ const (
 	ClientPluginAuth
 	ClientConnectAtts
 	ClientPluginAuthLenencClientData
+	ClientCanHandleExpiredPasswords
+	ClientSessionTrack
+	ClientDeprecateEOF
 )
 
 // PrivilegeType  privilege
@@ -391,6 +391,30 @@ func ReadLenEncStringAsBytes(data []byte, pos int) ([]byte, int, bool, bool) {
 	return data[pos : pos+s], pos + s, isNull, true
 }
 
+// ReadSessionTrackGtids read gtids from session state info of OK packet, return empty string if gtids is not tracked.
+// https://dev.mysql.com/doc/dev/mysql-server/latest/page_protocol_basic_ok_packet.html
+func ReadSessionTrackGtids(data []byte) string {
+	pos := 0
+	for pos < len(data) {
+		typ := data[pos]
+		value, next, _, ok := ReadLenEncStringAsBytes(data, pos+1)
+		if !ok {
+			return ""
+		}
+		pos = next
+		if typ != SessionTrackGtids || len(value) == 0 {
+			continue
+		}
+		// skip encoding specification, only 0 (GTID text) is defined
+		gtids, _, _, ok := ReadLenEncStringAsBytes(value, 1)
+		if !ok {
+			return ""
+		}
+		return string(gtids)
+	}
+	return ""
+}
+
 // FormatBinaryDate format binary date type
 func FormatBinaryDate(n int, data []byte) ([]byte, error) {
 	switch n {
@@ -359,3 +359,27 @@ func TestEncString(t *testing.T) {
 		}
 	}
 }
+
+func TestReadSessionTrackGtids(t *testing.T) {
+	gtids := "3e11fa47-71ca-11e1-9e33-c80aa9429562:23"
+	gtidValue := AppendLenEncStringBytes([]byte{0x00}, []byte(gtids))
+	schemaValue := AppendLenEncStringBytes(nil, []byte("db_test"))
+
+	var data []byte
+	data = append(data, SessionTrackSchema)
+	data = AppendLenEncStringBytes(data, schemaValue)
+	data = append(data, SessionTrackGtids)
+	data = AppendLenEncStringBytes(data, gtidValue)
+	if got := ReadSessionTrackGtids(data); got != gtids {
+		t.Errorf("ReadSessionTrackGtids returned %q, but expected %q", got, gtids)
+	}
+
+	data = append([]byte{SessionTrackSchema}, AppendLenEncStringBytes(nil, schemaValue)...)
+	if got := ReadSessionTrackGtids(data); got != "" {
+		t.Errorf("ReadSessionTrackGtids returned %q, but expected empty", got)
+	}
+
+	if got := ReadSessionTrackGtids([]byte{SessionTrackGtids, 0x10, 0x00}); got != "" {
+		t.Errorf("ReadSessionTrackGtids returned %q for malformed data, but expected empty", got)
+	}
+}
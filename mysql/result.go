@@ -513,6 +513,11 @@ func BuildResultset(fields []*Field, names []string, values [][]any) (*Resultset
 		} else {
 			return nil, errors.ErrInvalidArgument
 		}
+		// 没有数据行时也要返回列信息
+		for j := range fields {
+			r.Fields[j] = fields[j]
+			r.FieldNames[string(r.Fields[j].Name)] = j
+		}
 	}
 
 	var b []byte
@@ -526,22 +531,20 @@ func BuildResultset(fields []*Field, names []string, values [][]any) (*Resultset
 		var row []byte
 		for j, value := range vs {
 			// build fields
-			if i == 0 {
-				if ExistFields {
-					r.Fields[j] = fields[j]
-					r.FieldNames[string(r.Fields[j].Name)] = j
-				} else {
-					field := &Field{}
-					r.Fields[j] = field
-					r.FieldNames[string(r.Fields[j].Name)] = j
-					field.Name = hack.Slice(names[j])
-					if err = formatField(field, value); err != nil {
-						return nil, err
-					}
+			if i == 0 && !ExistFields {
+				field := &Field{}
+				r.Fields[j] = field
+				field.Name = hack.Slice(names[j])
+				r.FieldNames[string(r.Fields[j].Name)] = j
+				if err = formatField(field, value); err != nil {
+					return nil, err
 				}
-
 			}
 			// build row values
+			if value == nil {
+				row = append(row, 0xfb)
+				continue
+			}
 			b, err = formatValue(value)
 			if err != nil {
 				return nil, err
@@ -77,26 +77,26 @@ func (r *ResultsetSorter) Len() int {
 }
 
 func (r *ResultsetSorter) Less(i, j int) bool {
-	v1 := r.Values[i]
-	v2 := r.Values[j]
+	return CompareRow(r.Values[i], r.Values[j], r.sk) < 0
+}
 
-	for _, k := range r.sk {
+// CompareRow 按SortKey中的column和方向比较两行, v1排在v2之前时返回负数, 相等时返回0
+func CompareRow(v1, v2 []any, sk []SortKey) int {
+	for _, k := range sk {
 		v := cmpValue(v1[k.Column], v2[k.Column])
 
 		if k.Direction == SortDesc {
 			v = -v
 		}
 
-		if v < 0 {
-			return true
-		} else if v > 0 {
-			return false
+		if v != 0 {
+			return v
 		}
 
 		//equal, cmp next key
 	}
 
-	return false
+	return 0
 }
 
 // compare value using asc
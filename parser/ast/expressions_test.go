@@ -191,6 +191,7 @@ func TestBinaryOperationExpr(t *testing.T) {
 		{"3-5", "3-5"},
 		{"a<>5", "`a`!=5"},
 		{"a=1", "`a`=1"},
+		{"a div 100", "`a` DIV 100"},
 	}
 	extractNodeFunc := func(node Node) Node {
 		return node.(*SelectStmt).Fields.Fields[0].Expr
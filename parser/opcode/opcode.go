@@ -125,7 +125,7 @@ var opsLiteral = map[Op]string{
 	Mul:        "*",
 	Not:        "!",
 	BitNeg:     "~",
-	IntDiv:     "DIV",
+	IntDiv:     " DIV ",
 	NullEQ:     "<=>",
 	In:         "IN",
 	Like:       "LIKE",
@@ -0,0 +1,121 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ParamKind 参数化SQL中常量的类型, 与解析后ValueExpr中值的类型对应
+const (
+	ParamKindInt     = 'i' // int64
+	ParamKindUint    = 'u' // uint64
+	ParamKindDecimal = 'd' // *types.MyDecimal
+	ParamKindFloat   = 'f' // float64
+	ParamKindString  = 's' // string
+	ParamKindHex     = 'x' // types.HexLiteral
+	ParamKindBit     = 'b' // types.BitLiteral
+)
+
+// ParameterizedSQL SQL中的常量被替换为?后的模板
+type ParameterizedSQL struct {
+	Template string        // 常量替换为?后的SQL
+	Kinds    string        // 各常量的类型, 见ParamKind
+	Params   []interface{} // 按出现顺序排列的常量值, 与解析SQL时生成的值相同
+
+	markers []int // 各个?在Template中的位置
+}
+
+// ParameterizeSQL 使用词法分析把SQL中的常量替换为?, 其余部分保持原样.
+// 包含/*! */注释的SQL不支持参数化.
+func ParameterizeSQL(sql string) (*ParameterizedSQL, error) {
+	s := NewScanner(sql)
+	v := &yySymType{}
+	b := &strings.Builder{}
+	k := &strings.Builder{}
+	p := &ParameterizedSQL{}
+	last := 0
+	for {
+		tok := s.Lex(v)
+		if len(s.errs) != 0 {
+			return nil, s.errs[0]
+		}
+		if tok == 0 {
+			// 未结束的字符串也会返回0
+			if v.offset != len(sql) {
+				return nil, fmt.Errorf("unexpected end at offset %d", v.offset)
+			}
+			break
+		}
+		if tok == invalid {
+			return nil, fmt.Errorf("invalid token at offset %d", v.offset)
+		}
+
+		var kind byte
+		var value interface{}
+		switch tok {
+		case intLit:
+			value = v.item
+			if _, ok := v.item.(uint64); ok {
+				kind = ParamKindUint
+			} else {
+				kind = ParamKindInt
+			}
+		case decLit:
+			kind, value = ParamKindDecimal, v.item
+		case floatLit:
+			kind, value = ParamKindFloat, v.item
+		case stringLit:
+			kind, value = ParamKindString, v.ident
+		case hexLit:
+			kind, value = ParamKindHex, v.item
+		case bitLit:
+			kind, value = ParamKindBit, v.item
+		default:
+			continue
+		}
+		if s.specialComment != nil {
+			return nil, fmt.Errorf("sql with special comment is not supported")
+		}
+
+		b.WriteString(sql[last:v.offset])
+		p.markers = append(p.markers, b.Len())
+		b.WriteByte('?')
+		k.WriteByte(kind)
+		p.Params = append(p.Params, value)
+		last = s.r.pos().Offset
+	}
+	b.WriteString(sql[last:])
+	p.Template = b.String()
+	p.Kinds = k.String()
+	return p, nil
+}
+
+// Fill 把Template中的?依次替换为literals, 生成新的SQL
+func (p *ParameterizedSQL) Fill(literals []string) (string, error) {
+	if len(literals) != len(p.markers) {
+		return "", fmt.Errorf("literal count not match, expect: %d, actual: %d", len(p.markers), len(literals))
+	}
+	b := &strings.Builder{}
+	last := 0
+	for i, marker := range p.markers {
+		b.WriteString(p.Template[last:marker])
+		b.WriteString(literals[i])
+		last = marker + 1
+	}
+	b.WriteString(p.Template[last:])
+	return b.String(), nil
+}
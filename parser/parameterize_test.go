@@ -0,0 +1,86 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package parser
+
+import (
+	"testing"
+
+	requires "github.com/stretchr/testify/require"
+)
+
+func TestParameterizeSQL(t *testing.T) {
+	tests := []struct {
+		sql      string
+		template string
+		kinds    string
+		params   []interface{}
+	}{
+		{
+			sql:      "select * from t where id = 1 and name = 'a' limit 10; ",
+			template: "select * from t where id = ? and name = ? limit ?; ",
+			kinds:    "isi",
+			params:   []interface{}{int64(1), "a", int64(10)},
+		},
+		{
+			sql:      "SELECT a FROM t WHERE b IN (18446744073709551615, 1.5, 1e3)",
+			template: "SELECT a FROM t WHERE b IN (?, ?, ?)",
+			kinds:    "udf",
+		},
+		{
+			sql:      "insert into t(a, b) values (x'0a', b'1'), (\"it''s\", -2)",
+			template: "insert into t(a, b) values (?, ?), (?, -?)",
+			kinds:    "xbsi",
+		},
+		{
+			sql:      "select /* 1 */ `c1` from t -- 2",
+			template: "select /* 1 */ `c1` from t -- 2",
+			kinds:    "",
+		},
+	}
+	for _, test := range tests {
+		p, err := ParameterizeSQL(test.sql)
+		requires.NoError(t, err)
+		requires.Equal(t, test.template, p.Template)
+		requires.Equal(t, test.kinds, p.Kinds)
+		requires.Len(t, p.Params, len(test.kinds))
+		if test.params != nil {
+			requires.Equal(t, test.params, p.Params)
+		}
+	}
+}
+
+func TestParameterizedSQLFill(t *testing.T) {
+	p, err := ParameterizeSQL("select '?' from t /* ? */ where a = 1 and b in ('x', 2)")
+	requires.NoError(t, err)
+	requires.Equal(t, "select ? from t /* ? */ where a = ? and b in (?, ?)", p.Template)
+
+	sql, err := p.Fill([]string{"'a'", "10", "'y'", "20"})
+	requires.NoError(t, err)
+	requires.Equal(t, "select 'a' from t /* ? */ where a = 10 and b in ('y', 20)", sql)
+
+	_, err = p.Fill([]string{"1"})
+	requires.Error(t, err)
+}
+
+func TestParameterizeSQLError(t *testing.T) {
+	sqls := []string{
+		"select /*!40001 1, */ a from t",
+		"select 'a from t",
+	}
+	for _, sql := range sqls {
+		_, err := ParameterizeSQL(sql)
+		requires.Error(t, err, sql)
+	}
+}
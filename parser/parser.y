@@ -922,6 +922,7 @@ import (
 	DefaultKwdOpt		"optional DEFAULT keyword"
 	DatabaseSym		"DATABASE or SCHEMA"
 	ExplainSym		"EXPLAIN or DESCRIBE or DESC"
+	ExplainFormatType	"explain format type"
 	RegexpSym		"REGEXP or RLIKE"
 	IntoOpt			"INTO or EmptyString"
 	ValueSym		"Value or Values"
@@ -2545,6 +2546,9 @@ TraceStmt:
 ExplainSym:
 "EXPLAIN" | "DESCRIBE" | "DESC"
 
+ExplainFormatType:
+	stringLit | Identifier
+
 ExplainStmt:
 	ExplainSym TableName
 	{
@@ -2572,7 +2576,7 @@ ExplainStmt:
 			Format: "row",
 		}
 	}
-|	ExplainSym "FORMAT" "=" stringLit ExplainableStmt
+|	ExplainSym "FORMAT" "=" ExplainFormatType ExplainableStmt
 	{
 		$$ = &ast.ExplainStmt{
 			Stmt:	$5,
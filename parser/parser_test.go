@@ -2456,6 +2456,10 @@ func TestExplain(t *testing.T) {
 		{"EXPLAIN FORMAT = 'row' SELECT 1", true, "EXPLAIN FORMAT = 'row' SELECT 1"},
 		{"EXPLAIN FORMAT = 'ROW' SELECT 1", true, "EXPLAIN FORMAT = 'ROW' SELECT 1"},
 		{"EXPLAIN SELECT 1", true, "EXPLAIN FORMAT = 'row' SELECT 1"},
+		{"EXPLAIN FORMAT=GAEA SELECT 1", true, "EXPLAIN FORMAT = 'GAEA' SELECT 1"},
+		{"DESC FORMAT = `gaea` SELECT format FROM t WHERE format = x", true, "EXPLAIN FORMAT = 'gaea' SELECT `format` FROM `t` WHERE `format`=`x`"},
+		{"EXPLAIN FORMAT = json SELECT 1", true, "EXPLAIN FORMAT = 'json' SELECT 1"},
+		{"SELECT format FROM t WHERE format = gaea", true, "SELECT `format` FROM `t` WHERE `format`=`gaea`"},
 	}
 	RunTest(t, table, false)
 }
@@ -0,0 +1,229 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/XiaoMi/Gaea/core/errors"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser/ast"
+)
+
+// 每个去重值除key之外的估算内存开销, 包括map entry和保存的原始值
+const distinctValueOverhead = 64
+
+// distinctAggregate is COUNT/SUM/AVG(DISTINCT) in multiple shards
+// 分片上只返回去重后的参数列, 由Gaea按GROUP BY列再次去重, 然后计算聚合结果
+type distinctAggregate struct {
+	funcType   string // count, sum, avg
+	fieldIndex int    // 聚合列位置, 分片返回的是第一个参数的值
+	argIndexes []int  // 参数列位置, 第一个参数即为fieldIndex
+	fieldName  string // 返回给客户端的列名
+}
+
+// distinctResultType SUM/AVG(DISTINCT)的结果类型, 由参数列的类型决定
+type distinctResultType struct {
+	isDecimal bool  // 整数和DECIMAL参数的结果为DECIMAL, 其他为DOUBLE
+	scale     int32 // DECIMAL结果的小数位数, SUM与参数相同, AVG为参数+4
+}
+
+// distinctValueSet 保存一个分组内某个聚合函数的去重值
+type distinctValueSet map[string]any
+
+// distinctAggregateMerger 对结果集中的DISTINCT聚合函数去重并计算结果, 只在一次结果合并中使用
+type distinctAggregateMerger struct {
+	aggregates []*distinctAggregate
+	delta      int                           // SELECT * 等情况下结果集比FieldList多出的列数
+	sets       map[string][]distinctValueSet // key = group by key
+	columns    [][]keyColumn                 // 与aggregates一一对应, 参数列的比较规则
+	types      []distinctResultType          // 与aggregates一一对应, 在rewriteFields中根据参数列确定
+
+	maxMemory int // 小于等于0表示不限制
+	memory    int
+}
+
+func newDistinctAggregateMerger(aggregates []*distinctAggregate, fields []*mysql.Field, delta int, maxMemory int) *distinctAggregateMerger {
+	columns := make([][]keyColumn, len(aggregates))
+	for i, agg := range aggregates {
+		for _, idx := range agg.argIndexes {
+			var field *mysql.Field
+			if idx+delta < len(fields) {
+				field = fields[idx+delta]
+			}
+			columns[i] = append(columns[i], newKeyColumn(field))
+		}
+	}
+	return &distinctAggregateMerger{
+		aggregates: aggregates,
+		delta:      delta,
+		sets:       make(map[string][]distinctValueSet),
+		columns:    columns,
+		maxMemory:  maxMemory,
+	}
+}
+
+// add 把一行结果中的参数值加入到所在分组的去重集合中
+func (d *distinctAggregateMerger) add(groupKey string, row ResultRow) error {
+	sets, ok := d.sets[groupKey]
+	if !ok {
+		sets = make([]distinctValueSet, len(d.aggregates))
+		for i := range sets {
+			sets[i] = make(distinctValueSet)
+		}
+		d.sets[groupKey] = sets
+		d.memory += len(groupKey) + distinctValueOverhead
+	}
+
+	for i, agg := range d.aggregates {
+		args := make([]any, 0, len(agg.argIndexes))
+		hasNull := false
+		for _, idx := range agg.argIndexes {
+			v := row.GetValue(idx + d.delta)
+			if v == nil {
+				hasNull = true
+				break
+			}
+			args = append(args, v)
+		}
+		// 与MySQL一致, 参数中存在NULL的行不参与计算
+		if hasNull {
+			continue
+		}
+
+		// 分片返回的值类型可能不同, 归一化后去重
+		key, err := generateNormalizedMapKey(args, d.columns[i])
+		if err != nil {
+			return err
+		}
+		if _, ok := sets[i][key]; ok {
+			continue
+		}
+		sets[i][key] = args[0]
+
+		d.memory += len(key) + distinctValueOverhead
+		if d.maxMemory > 0 && d.memory > d.maxMemory {
+			return fmt.Errorf("%v, max_distinct_memory: %d bytes", errors.ErrDistinctMemoryExceeded, d.maxMemory)
+		}
+	}
+	return nil
+}
+
+// finalize 用去重集合计算每个分组的聚合结果, 写回分组的结果行
+func (d *distinctAggregateMerger) finalize(groupKey string, row ResultRow) error {
+	sets := d.sets[groupKey]
+	for i, agg := range d.aggregates {
+		var set distinctValueSet
+		if sets != nil {
+			set = sets[i]
+		}
+		v, err := agg.calculate(set, d.types[i])
+		if err != nil {
+			return fmt.Errorf("calculate %s(DISTINCT) error: %v", agg.funcType, err)
+		}
+		row.SetValue(agg.fieldIndex+d.delta, v)
+	}
+	return nil
+}
+
+// rewriteFields 把聚合列的列信息改写为聚合函数的结果类型, 分片返回的是参数列的列信息
+// 需要在finalize之前调用, 结果值的精度依赖参数列的类型
+func (d *distinctAggregateMerger) rewriteFields(r *mysql.Result) {
+	d.types = make([]distinctResultType, len(d.aggregates))
+	for i, agg := range d.aggregates {
+		field := &mysql.Field{
+			Name:    []byte(agg.fieldName),
+			Charset: mysql.BinaryCollationID,
+			Flag:    uint16(mysql.BinaryFlag),
+		}
+		if agg.funcType == ast.AggFuncCount {
+			field.Type = mysql.TypeLonglong
+			field.ColumnLength = 21
+			field.Flag |= uint16(mysql.NotNullFlag)
+			r.Fields[agg.fieldIndex+d.delta] = field
+			continue
+		}
+
+		d.types[i] = newDistinctResultType(agg.funcType, r.Fields[agg.fieldIndex+d.delta])
+		if d.types[i].isDecimal {
+			field.Type = mysql.TypeNewDecimal
+			field.ColumnLength = 65
+			field.Decimal = uint8(d.types[i].scale)
+		} else {
+			field.Type = mysql.TypeDouble
+			field.ColumnLength = 23
+			field.Decimal = mysql.NotFixedDec
+		}
+		r.Fields[agg.fieldIndex+d.delta] = field
+	}
+}
+
+// 与MySQL一致, 整数和DECIMAL参数的SUM/AVG结果为DECIMAL, 浮点数和字符串等参数的结果为DOUBLE
+func newDistinctResultType(funcType string, arg *mysql.Field) distinctResultType {
+	if arg == nil {
+		return distinctResultType{}
+	}
+	var scale int32
+	switch {
+	case mysql.IsIntegerType(arg.Type), arg.Type == mysql.TypeYear:
+	case arg.Type == mysql.TypeNewDecimal || arg.Type == mysql.TypeDecimal:
+		if arg.Decimal > mysql.MaxDecimalScale {
+			return distinctResultType{}
+		}
+		scale = int32(arg.Decimal)
+	default:
+		return distinctResultType{}
+	}
+	if funcType == ast.AggFuncAvg {
+		scale += 4
+		if scale > mysql.MaxDecimalScale {
+			scale = mysql.MaxDecimalScale
+		}
+	}
+	return distinctResultType{isDecimal: true, scale: scale}
+}
+
+func (a *distinctAggregate) calculate(set distinctValueSet, resultType distinctResultType) (any, error) {
+	if a.funcType == ast.AggFuncCount {
+		return int64(len(set)), nil
+	}
+	if len(set) == 0 {
+		return nil, nil
+	}
+
+	sum := decimal.Zero
+	for _, v := range set {
+		value, err := ResultRow{v}.GetDecimal(0)
+		if err != nil {
+			return nil, err
+		}
+		sum = sum.Add(value)
+	}
+
+	if !resultType.isDecimal {
+		if a.funcType == ast.AggFuncAvg {
+			sum = sum.Div(decimal.NewFromInt(int64(len(set))))
+		}
+		ret, _ := sum.Float64()
+		return ret, nil
+	}
+
+	if a.funcType == ast.AggFuncAvg {
+		sum = sum.DivRound(decimal.NewFromInt(int64(len(set))), resultType.scale)
+	}
+	return sum.StringFixed(resultType.scale), nil
+}
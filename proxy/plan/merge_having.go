@@ -0,0 +1,443 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/opcode"
+	"github.com/XiaoMi/Gaea/parser/tidb-types"
+)
+
+var (
+	havingTrue  = decimal.NewFromInt(1)
+	havingFalse = decimal.NewFromInt(0)
+)
+
+// havingFilter 多分片聚合时HAVING不下推到分片, 由Gaea在合并后的结果上计算.
+// 计算过程中的值只有四种: nil (NULL), decimal.Decimal, string (SQL中的常量)和havingText (结果集中字符串列的值)
+type havingFilter struct {
+	expr    ast.ExprNode
+	columns map[ast.ExprNode]int // HAVING中的列和聚合函数在FieldList中的位置
+
+	collations []keyColumn // 结果集中每一列的排序规则, 过滤时根据列信息生成
+}
+
+// havingText 结果集中字符串列的值, 按列的排序规则比较
+type havingText struct {
+	s         string
+	collation keyColumn
+}
+
+// 字符串转换为数值时使用开头的数值部分, 与MySQL一致
+var havingNumberPrefix = regexp.MustCompile(`^[+-]?(\d+(\.\d*)?|\.\d+)([eE][+-]?\d+)?`)
+
+// havingRefCollector 检查HAVING中的表达式是否支持, 并收集需要从结果中取值的列和聚合函数
+type havingRefCollector struct {
+	refs         []ast.ExprNode
+	hasAggregate bool
+	err          error
+}
+
+// Enter implement ast.Visitor
+func (v *havingRefCollector) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if v.err != nil {
+		return n, true
+	}
+	switch x := n.(type) {
+	case *ast.AggregateFuncExpr:
+		v.hasAggregate = true
+		v.refs = append(v.refs, x)
+		return n, true
+	case *ast.ColumnNameExpr:
+		v.refs = append(v.refs, x)
+		return n, true
+	case ast.ValueExpr, *ast.ParenthesesExpr, *ast.IsNullExpr, *ast.IsTruthExpr, *ast.BetweenExpr:
+	case *ast.PatternInExpr:
+		if x.Sel != nil {
+			v.err = fmt.Errorf("subquery in HAVING is not supported")
+		}
+	case *ast.UnaryOperationExpr:
+		switch x.Op {
+		case opcode.Not, opcode.Minus, opcode.Plus:
+		default:
+			v.err = fmt.Errorf("operator %s in HAVING is not supported", x.Op)
+		}
+	case *ast.BinaryOperationExpr:
+		switch x.Op {
+		case opcode.LogicAnd, opcode.LogicOr, opcode.LogicXor,
+			opcode.EQ, opcode.NE, opcode.LT, opcode.LE, opcode.GT, opcode.GE, opcode.NullEQ,
+			opcode.Plus, opcode.Minus, opcode.Mul, opcode.Div, opcode.IntDiv, opcode.Mod:
+		default:
+			v.err = fmt.Errorf("operator %s in HAVING is not supported", x.Op)
+		}
+	default:
+		v.err = fmt.Errorf("expression %T in HAVING is not supported", n)
+	}
+	return n, v.err != nil
+}
+
+// Leave implement ast.Visitor
+func (v *havingRefCollector) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+// filter 去掉不满足HAVING条件的行, delta为SELECT *等情况下结果集比FieldList多出的列数
+func (h *havingFilter) filter(r *mysql.Result, delta int) error {
+	h.collations = make([]keyColumn, len(r.Fields))
+	for i, field := range r.Fields {
+		if column := newKeyColumn(field); !column.numeric {
+			h.collations[i] = column
+		}
+	}
+	values := r.Values[:0]
+	for _, row := range r.Values {
+		v, err := h.eval(h.expr, ResultRow(row), delta)
+		if err != nil {
+			return fmt.Errorf("evaluate HAVING error: %v", err)
+		}
+		if isHavingTrue(v) {
+			values = append(values, row)
+		}
+	}
+	r.Values = values
+	r.RowDatas = nil
+	return nil
+}
+
+func (h *havingFilter) eval(expr ast.ExprNode, row ResultRow, delta int) (any, error) {
+	if idx, ok := h.columns[expr]; ok {
+		if idx+delta >= len(row) {
+			return nil, fmt.Errorf("field index out of bound: %d", idx+delta)
+		}
+		v := toHavingValue(row.GetValue(idx + delta))
+		if s, ok := v.(string); ok && idx+delta < len(h.collations) {
+			return havingText{s: s, collation: h.collations[idx+delta]}, nil
+		}
+		return v, nil
+	}
+
+	switch x := expr.(type) {
+	case ast.ValueExpr:
+		return toHavingValue(x.GetValue()), nil
+	case *ast.ParenthesesExpr:
+		return h.eval(x.Expr, row, delta)
+	case *ast.UnaryOperationExpr:
+		v, err := h.eval(x.V, row, delta)
+		if err != nil || v == nil {
+			return nil, err
+		}
+		switch x.Op {
+		case opcode.Not:
+			return havingBool(!isHavingTrue(v)), nil
+		case opcode.Minus:
+			return havingDecimal(v).Neg(), nil
+		default:
+			return havingDecimal(v), nil
+		}
+	case *ast.BinaryOperationExpr:
+		l, err := h.eval(x.L, row, delta)
+		if err != nil {
+			return nil, err
+		}
+		r, err := h.eval(x.R, row, delta)
+		if err != nil {
+			return nil, err
+		}
+		return evalHavingBinary(x.Op, l, r)
+	case *ast.IsNullExpr:
+		v, err := h.eval(x.Expr, row, delta)
+		if err != nil {
+			return nil, err
+		}
+		return havingBool((v == nil) != x.Not), nil
+	case *ast.IsTruthExpr:
+		v, err := h.eval(x.Expr, row, delta)
+		if err != nil {
+			return nil, err
+		}
+		ret := v != nil && isHavingTrue(v) == (x.True != 0)
+		return havingBool(ret != x.Not), nil
+	case *ast.BetweenExpr:
+		v, err := h.eval(x.Expr, row, delta)
+		if err != nil {
+			return nil, err
+		}
+		left, err := h.eval(x.Left, row, delta)
+		if err != nil {
+			return nil, err
+		}
+		right, err := h.eval(x.Right, row, delta)
+		if err != nil {
+			return nil, err
+		}
+		ge, err := evalHavingBinary(opcode.GE, v, left)
+		if err != nil {
+			return nil, err
+		}
+		le, err := evalHavingBinary(opcode.LE, v, right)
+		if err != nil {
+			return nil, err
+		}
+		ret, _ := evalHavingBinary(opcode.LogicAnd, ge, le)
+		if x.Not {
+			return evalHavingNot(ret), nil
+		}
+		return ret, nil
+	case *ast.PatternInExpr:
+		return h.evalIn(x, row, delta)
+	default:
+		return nil, fmt.Errorf("expression %T in HAVING is not supported", expr)
+	}
+}
+
+// 与MySQL一致, 没有匹配的值且列表中有NULL时结果为NULL
+func (h *havingFilter) evalIn(x *ast.PatternInExpr, row ResultRow, delta int) (any, error) {
+	v, err := h.eval(x.Expr, row, delta)
+	if err != nil || v == nil {
+		return nil, err
+	}
+	var ret any = havingFalse
+	for _, item := range x.List {
+		iv, err := h.eval(item, row, delta)
+		if err != nil {
+			return nil, err
+		}
+		if iv == nil {
+			ret = nil
+			continue
+		}
+		c, err := compareHavingValue(v, iv)
+		if err != nil {
+			return nil, err
+		}
+		if c == 0 {
+			ret = havingTrue
+			break
+		}
+	}
+	if x.Not {
+		return evalHavingNot(ret), nil
+	}
+	return ret, nil
+}
+
+func evalHavingBinary(op opcode.Op, l, r any) (any, error) {
+	switch op {
+	case opcode.LogicAnd:
+		if (l != nil && !isHavingTrue(l)) || (r != nil && !isHavingTrue(r)) {
+			return havingFalse, nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return havingTrue, nil
+	case opcode.LogicOr:
+		if (l != nil && isHavingTrue(l)) || (r != nil && isHavingTrue(r)) {
+			return havingTrue, nil
+		}
+		if l == nil || r == nil {
+			return nil, nil
+		}
+		return havingFalse, nil
+	case opcode.NullEQ:
+		if l == nil || r == nil {
+			return havingBool(l == nil && r == nil), nil
+		}
+		c, err := compareHavingValue(l, r)
+		return havingBool(c == 0), err
+	}
+
+	if l == nil || r == nil {
+		return nil, nil
+	}
+	switch op {
+	case opcode.LogicXor:
+		return havingBool(isHavingTrue(l) != isHavingTrue(r)), nil
+	case opcode.EQ, opcode.NE, opcode.LT, opcode.LE, opcode.GT, opcode.GE:
+		c, err := compareHavingValue(l, r)
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opcode.EQ:
+			return havingBool(c == 0), nil
+		case opcode.NE:
+			return havingBool(c != 0), nil
+		case opcode.LT:
+			return havingBool(c < 0), nil
+		case opcode.LE:
+			return havingBool(c <= 0), nil
+		case opcode.GT:
+			return havingBool(c > 0), nil
+		default:
+			return havingBool(c >= 0), nil
+		}
+	}
+
+	ld, rd := havingDecimal(l), havingDecimal(r)
+	switch op {
+	case opcode.Plus:
+		return ld.Add(rd), nil
+	case opcode.Minus:
+		return ld.Sub(rd), nil
+	case opcode.Mul:
+		return ld.Mul(rd), nil
+	}
+	// 与MySQL一致, 除数为0时结果为NULL
+	if rd.IsZero() {
+		return nil, nil
+	}
+	switch op {
+	case opcode.Div:
+		return ld.Div(rd), nil
+	case opcode.IntDiv:
+		return ld.Div(rd).Truncate(0), nil
+	case opcode.Mod:
+		return ld.Mod(rd), nil
+	}
+	return nil, nil
+}
+
+func evalHavingNot(v any) any {
+	if v == nil {
+		return nil
+	}
+	return havingBool(!isHavingTrue(v))
+}
+
+// 两边都是字符串时按排序规则比较, 否则按数值比较.
+// 常量使用列的排序规则, 两边都是常量时与MySQL默认的排序规则一样忽略大小写和末尾空格, 两列的排序规则不同时返回错误
+func compareHavingValue(l, r any) (int, error) {
+	ls, lc, lok := havingString(l)
+	rs, rc, rok := havingString(r)
+	if !lok || !rok {
+		return havingDecimal(l).Cmp(havingDecimal(r)), nil
+	}
+
+	collation := keyColumn{caseInsensitive: true, padSpace: true}
+	switch {
+	case lc != nil && rc != nil:
+		if *lc != *rc {
+			return 0, fmt.Errorf("illegal mix of collations for comparing %q and %q", ls, rs)
+		}
+		collation = *lc
+	case lc != nil:
+		collation = *lc
+	case rc != nil:
+		collation = *rc
+	}
+	lb, err := normalizeKeyText([]byte(ls), collation)
+	if err != nil {
+		return 0, err
+	}
+	rb, err := normalizeKeyText([]byte(rs), collation)
+	if err != nil {
+		return 0, err
+	}
+	return bytes.Compare(lb, rb), nil
+}
+
+// havingString 返回字符串的值和所在列的排序规则, 常量没有排序规则
+func havingString(v any) (string, *keyColumn, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, nil, true
+	case havingText:
+		return x.s, &x.collation, true
+	default:
+		return "", nil, false
+	}
+}
+
+func isHavingTrue(v any) bool {
+	if v == nil {
+		return false
+	}
+	return !havingDecimal(v).IsZero()
+}
+
+func havingBool(b bool) decimal.Decimal {
+	if b {
+		return havingTrue
+	}
+	return havingFalse
+}
+
+// havingDecimal 字符串转换为数值, 与MySQL一样使用开头的数值部分('12abc'为12), 没有数值部分时当作0
+func havingDecimal(v any) decimal.Decimal {
+	switch x := v.(type) {
+	case decimal.Decimal:
+		return x
+	case string:
+		return parseHavingNumber(x)
+	case havingText:
+		return parseHavingNumber(x.s)
+	default:
+		return havingFalse
+	}
+}
+
+func parseHavingNumber(s string) decimal.Decimal {
+	prefix := havingNumberPrefix.FindString(strings.TrimLeft(s, " \t\r\n"))
+	if prefix == "" {
+		return havingFalse
+	}
+	// decimal不支持小数点后没有数字, 如'12.'和'12.e3'
+	prefix = strings.Replace(prefix, ".e", "e", 1)
+	prefix = strings.Replace(prefix, ".E", "E", 1)
+	prefix = strings.TrimSuffix(prefix, ".")
+	d, err := decimal.NewFromString(prefix)
+	if err != nil {
+		return havingFalse
+	}
+	return d
+}
+
+// toHavingValue 把结果集和SQL中的值转换为nil, decimal.Decimal或string
+func toHavingValue(v any) any {
+	switch x := v.(type) {
+	case nil:
+		return nil
+	case decimal.Decimal:
+		return x
+	case int64:
+		return decimal.NewFromInt(x)
+	case uint64:
+		d, _ := decimal.NewFromString(strconv.FormatUint(x, 10))
+		return d
+	case float64:
+		return decimal.NewFromFloat(x)
+	case *types.MyDecimal:
+		d, _ := decimal.NewFromString(x.String())
+		return d
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	case types.BinaryLiteral:
+		return string(x)
+	default:
+		return fmt.Sprintf("%v", x)
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/shopspring/decimal"
+
+	"github.com/XiaoMi/Gaea/mysql"
+)
+
+// keyColumn 描述一列值在生成去重和连接key时的比较规则
+type keyColumn struct {
+	numeric         bool // 按数值比较, 字符串需要能完整解析为数值
+	caseInsensitive bool // _ci排序规则, 忽略大小写
+	padSpace        bool // PAD SPACE排序规则, 忽略末尾空格
+}
+
+// newKeyColumn 根据列信息确定比较规则, 列信息为空时按二进制比较
+func newKeyColumn(field *mysql.Field) keyColumn {
+	if field == nil {
+		return keyColumn{}
+	}
+	if isNumericFieldType(field.Type) {
+		return keyColumn{numeric: true}
+	}
+	name, ok := mysql.Collations[mysql.CollationID(field.Charset)]
+	if !ok || name == "binary" {
+		return keyColumn{}
+	}
+	return keyColumn{
+		caseInsensitive: strings.HasSuffix(name, "_ci"),
+		padSpace:        !strings.Contains(name, "_0900_"),
+	}
+}
+
+func newKeyColumns(fields []*mysql.Field) []keyColumn {
+	columns := make([]keyColumn, len(fields))
+	for i, field := range fields {
+		columns[i] = newKeyColumn(field)
+	}
+	return columns
+}
+
+func isNumericFieldType(tp byte) bool {
+	switch tp {
+	case mysql.TypeFloat, mysql.TypeDouble, mysql.TypeYear:
+		return true
+	default:
+		return mysql.IsIntegerType(tp) || isDecimalType(tp)
+	}
+}
+
+// generateNormalizedMapKey 与generateMapKey类似, 但按MySQL的比较规则归一化每个值, 用于UNION, DISTINCT聚合去重和跨分片JOIN
+// 1. 数值按大小归一化, int64, uint64, float64和DECIMAL文本相等时生成相同的key, DECIMAL文本不经过float64
+// 2. 字符串按列的排序规则归一化, _ci忽略大小写, PAD SPACE忽略末尾空格, 无法安全忽略大小写的字符返回错误
+// 3. 每个值带有类型和长度前缀, NULL与字符串'NULL', 以及包含分隔符的值不会冲突
+func generateNormalizedMapKey(values []any, columns []keyColumn) (string, error) {
+	bk := make([]byte, 0, 16)
+	for i, v := range values {
+		var column keyColumn
+		if i < len(columns) {
+			column = columns[i]
+		}
+		if v == nil {
+			bk = append(bk, 'N')
+			continue
+		}
+		b, err := normalizeKeyValue(v, column)
+		if err != nil {
+			return "", err
+		}
+		bk = append(bk, 'V')
+		bk = binary.AppendUvarint(bk, uint64(len(b)))
+		bk = append(bk, b...)
+	}
+	return string(bk), nil
+}
+
+func normalizeKeyValue(v any, column keyColumn) ([]byte, error) {
+	switch x := v.(type) {
+	case int64:
+		return strconv.AppendInt(nil, x, 10), nil
+	case uint64:
+		return strconv.AppendUint(nil, x, 10), nil
+	case float64:
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return strconv.AppendFloat(nil, x, 'g', -1, 64), nil
+		}
+		return []byte(decimal.NewFromFloat(x).String()), nil
+	case string:
+		return normalizeKeyText([]byte(x), column)
+	case []byte:
+		return normalizeKeyText(x, column)
+	default:
+		return formatValue(v)
+	}
+}
+
+func normalizeKeyText(text []byte, column keyColumn) ([]byte, error) {
+	if column.numeric {
+		d, err := decimal.NewFromString(strings.TrimSpace(string(text)))
+		if err != nil {
+			return nil, fmt.Errorf("value %q can not be compared as a number", text)
+		}
+		return []byte(d.String()), nil
+	}
+	if column.padSpace {
+		text = []byte(strings.TrimRight(string(text), " "))
+	}
+	if !column.caseInsensitive {
+		return text, nil
+	}
+	s := string(text)
+	for _, r := range s {
+		if !isCaseFoldSafe(r) {
+			return nil, fmt.Errorf("value %q can not be compared case-insensitively by gaea", text)
+		}
+	}
+	return []byte(strings.ToUpper(s)), nil
+}
+
+// MySQL的_ci排序规则对带重音的拉丁字母等字符还会忽略重音, Gaea只能安全地处理ASCII和没有大小写的字符
+func isCaseFoldSafe(r rune) bool {
+	if r < utf8.RuneSelf {
+		return true
+	}
+	return unicode.SimpleFold(r) == r && !unicode.Is(unicode.Latin, r)
+}
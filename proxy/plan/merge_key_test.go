@@ -0,0 +1,78 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"testing"
+
+	"github.com/XiaoMi/Gaea/mysql"
+)
+
+func TestGenerateNormalizedMapKey(t *testing.T) {
+	numeric := newKeyColumn(&mysql.Field{Type: mysql.TypeNewDecimal})
+	ci := newKeyColumn(&mysql.Field{Type: mysql.TypeVarString, Charset: uint16(mysql.CollationNames["utf8mb4_general_ci"])})
+	noPad := newKeyColumn(&mysql.Field{Type: mysql.TypeVarString, Charset: uint16(mysql.CollationNames["utf8mb4_0900_ai_ci"])})
+	bin := newKeyColumn(&mysql.Field{Type: mysql.TypeVarString, Charset: uint16(mysql.CollationNames["utf8mb4_bin"])})
+
+	tests := []struct {
+		name   string
+		column keyColumn
+		v1, v2 any
+		equal  bool
+	}{
+		{"int64 and uint64", numeric, int64(1), uint64(1), true},
+		{"int64 and float64", numeric, int64(1), float64(1), true},
+		{"decimal text and float64", numeric, []byte("1.50"), float64(1.5), true},
+		{"decimal text and int64", numeric, "2.000", int64(2), true},
+		{"18 digits decimal", numeric, []byte("12345678901234.5678"), []byte("12345678901234.5679"), false},
+		{"null and string NULL", keyColumn{}, nil, "NULL", false},
+		{"ci", ci, "abc", []byte("ABC  "), true},
+		{"ci cjk", ci, "中文", "中文 ", true},
+		{"no pad", noPad, "abc", "ABC ", false},
+		{"bin pad space", bin, "abc", "abc ", true},
+		{"bin case sensitive", bin, "abc", "ABC", false},
+		{"binary", keyColumn{}, []byte("abc"), []byte("abc "), false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			k1, err := generateNormalizedMapKey([]any{test.v1}, []keyColumn{test.column})
+			if err != nil {
+				t.Fatalf("generate key error: %v", err)
+			}
+			k2, err := generateNormalizedMapKey([]any{test.v2}, []keyColumn{test.column})
+			if err != nil {
+				t.Fatalf("generate key error: %v", err)
+			}
+			if (k1 == k2) != test.equal {
+				t.Errorf("key equal not match, expect: %v, key1: %q, key2: %q", test.equal, k1, k2)
+			}
+		})
+	}
+
+	// 分隔符不会导致不同的行生成相同的key
+	k1, _ := generateNormalizedMapKey([]any{"a+", "b"}, nil)
+	k2, _ := generateNormalizedMapKey([]any{"a", "+b"}, nil)
+	if k1 == k2 {
+		t.Errorf("keys of different rows should not be equal: %q", k1)
+	}
+
+	// 无法安全比较的值返回错误
+	if _, err := generateNormalizedMapKey([]any{"café"}, []keyColumn{ci}); err == nil {
+		t.Errorf("expect error for accented value in ci collation")
+	}
+	if _, err := generateNormalizedMapKey([]any{"1abc"}, []keyColumn{numeric}); err == nil {
+		t.Errorf("expect error for non numeric value in numeric column")
+	}
+}
@@ -23,6 +23,7 @@ import (
 
 	"github.com/XiaoMi/Gaea/mysql"
 	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/util"
 	"github.com/XiaoMi/Gaea/util/hack"
 	"github.com/XiaoMi/Gaea/util/math"
 )
@@ -419,6 +420,100 @@ func (a *AggregateFuncGroupConcatMerger) MergeTo(from, to ResultRow) error {
 	return a.concatToString(from, to)
 }
 
+// AggregateFuncAvgMerger merge AVG() column in result
+// 分片上的AVG(x)会补充SUM(x)和COUNT(x)两列, 合并这两列之后重新计算平均值
+type AggregateFuncAvgMerger struct {
+	aggregateFuncBaseMerger
+	sumMerger   *AggregateFuncSumMerger
+	countMerger *AggregateFuncCountMerger
+}
+
+// NewAggregateFuncAvgMerger constructor of AggregateFuncAvgMerger
+// fieldIndex is the AVG column, sumIndex and countIndex are the extra SUM and COUNT columns
+func NewAggregateFuncAvgMerger(fieldIndex, sumIndex, countIndex int) *AggregateFuncAvgMerger {
+	ret := &AggregateFuncAvgMerger{
+		sumMerger:   new(AggregateFuncSumMerger),
+		countMerger: new(AggregateFuncCountMerger),
+	}
+	ret.fieldIndex = fieldIndex
+	ret.sumMerger.fieldIndex = sumIndex
+	ret.countMerger.fieldIndex = countIndex
+	return ret
+}
+
+// MergeTo implement AggregateFuncMerger
+func (a *AggregateFuncAvgMerger) MergeTo(from, to ResultRow) error {
+	idx := a.fieldIndex
+	if idx >= len(from) || idx >= len(to) {
+		return fmt.Errorf("field index out of bound: %d", a.fieldIndex)
+	}
+
+	if err := a.sumMerger.MergeTo(from, to); err != nil {
+		return fmt.Errorf("merge avg sum column error: %v", err)
+	}
+	if err := a.countMerger.MergeTo(from, to); err != nil {
+		return fmt.Errorf("merge avg count column error: %v", err)
+	}
+
+	// 合并过程中的AVG值只用于HAVING和排序, 返回前在formatAvgResult中按列精度重新计算
+	avg, ok, err := a.average(to, int32(decimal.DivisionPrecision))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		to.SetValue(idx, nil)
+		return nil
+	}
+	f, _ := avg.Float64()
+	to.SetValue(idx, f)
+	return nil
+}
+
+// average 用SUM和COUNT列计算平均值, 结果保留scale位小数
+// 与MySQL一致, 没有非NULL值时AVG结果为NULL, 此时ok为false
+func (a *AggregateFuncAvgMerger) average(row ResultRow, scale int32) (avg decimal.Decimal, ok bool, err error) {
+	count, err := row.GetInt(a.countMerger.fieldIndex)
+	if err != nil {
+		return avg, false, fmt.Errorf("get count value error: %v", err)
+	}
+	if count == 0 || row.GetValue(a.sumMerger.fieldIndex) == nil {
+		return avg, false, nil
+	}
+
+	sum, err := row.GetDecimal(a.sumMerger.fieldIndex)
+	if err != nil {
+		return avg, false, fmt.Errorf("get sum value error: %v", err)
+	}
+	return sum.DivRound(decimal.NewFromInt(count), scale), true, nil
+}
+
+// format 按结果列的类型重写所有行的AVG值
+// DECIMAL类型的AVG列返回定点小数, 精度为列信息中的Decimal (MySQL为参数精度+4), 其他类型保持浮点数
+func (a *AggregateFuncAvgMerger) format(r *mysql.Result) error {
+	if a.fieldIndex >= len(r.Fields) {
+		return fmt.Errorf("field index out of bound: %d", a.fieldIndex)
+	}
+	field := r.Fields[a.fieldIndex]
+	if field.Type != mysql.TypeNewDecimal || field.Decimal > mysql.MaxDecimalScale {
+		return nil
+	}
+
+	scale := int32(field.Decimal)
+	for _, v := range r.Values {
+		row := ResultRow(v)
+		avg, ok, err := a.average(row, scale)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			row.SetValue(a.fieldIndex, nil)
+			continue
+		}
+		row.SetValue(a.fieldIndex, avg.StringFixed(scale))
+	}
+	return nil
+}
+
 // MergeExecResult merge execution results, like UPDATE, INSERT, DELETE, ...
 func MergeExecResult(rs []*mysql.Result) (*mysql.Result, error) {
 	r := mysql.ResultPool.GetWithoutResultSet()
@@ -438,7 +533,7 @@ func MergeExecResult(rs []*mysql.Result) (*mysql.Result, error) {
 }
 
 // MergeSelectResult merge select results
-func MergeSelectResult(p *SelectPlan, stmt *ast.SelectStmt, rs []*mysql.Result) (*mysql.Result, error) {
+func MergeSelectResult(reqCtx *util.RequestContext, p *SelectPlan, stmt *ast.SelectStmt, rs []*mysql.Result) (*mysql.Result, error) {
 	ret := mergeMultiResultSet(rs)
 
 	if p.distinct {
@@ -448,7 +543,7 @@ func MergeSelectResult(p *SelectPlan, stmt *ast.SelectStmt, rs []*mysql.Result)
 	}
 
 	if stmt.GroupBy != nil {
-		if err := buildSelectGroupByResult(p, ret); err != nil {
+		if err := buildSelectGroupByResult(reqCtx, p, ret); err != nil {
 			return nil, err
 		}
 	} else {
@@ -457,6 +552,12 @@ func MergeSelectResult(p *SelectPlan, stmt *ast.SelectStmt, rs []*mysql.Result)
 		}
 	}
 
+	if p.having != nil {
+		if err := p.having.filter(ret, len(ret.Fields)-p.GetColumnCount()); err != nil {
+			return nil, err
+		}
+	}
+
 	if err := sortSelectResult(p, stmt, ret); err != nil {
 		return nil, err
 	}
@@ -465,6 +566,10 @@ func MergeSelectResult(p *SelectPlan, stmt *ast.SelectStmt, rs []*mysql.Result)
 		return nil, err
 	}
 
+	if err := formatAvgResult(p, ret); err != nil {
+		return nil, fmt.Errorf("formatAvgResult error: %v", err)
+	}
+
 	if err := trimExtraFields(p, ret); err != nil {
 		return nil, fmt.Errorf("trimExtraFields error: %v", err)
 	}
@@ -547,13 +652,18 @@ func removeDistinctRowInResult(p *SelectPlan, r *mysql.Result) error {
 }
 
 // contains mergeGroupByWithoutFunc() and mergeGroupByWithFunc()
-func buildSelectGroupByResult(p *SelectPlan, r *mysql.Result) error {
+func buildSelectGroupByResult(reqCtx *util.RequestContext, p *SelectPlan, r *mysql.Result) error {
 	resultMap := make(map[string]ResultRow)
 
 	resultFieldLength := len(r.Fields)
 	originColumnCount := p.GetColumnCount()
 	deltaColumnCount := resultFieldLength - originColumnCount
 
+	var distinctMerger *distinctAggregateMerger
+	if len(p.distinctAggregates) != 0 {
+		distinctMerger = newDistinctAggregateMerger(p.distinctAggregates, r.Fields, deltaColumnCount, reqCtx.GetMaxDistinctMemory())
+	}
+
 	// 根据group by的列进行结果聚合
 	for i, v := range r.Values {
 		keySlice := make([]any, 0)
@@ -565,6 +675,12 @@ func buildSelectGroupByResult(p *SelectPlan, r *mysql.Result) error {
 			return err
 		}
 
+		if distinctMerger != nil {
+			if err := distinctMerger.add(mk, ResultRow(v)); err != nil {
+				return err
+			}
+		}
+
 		// 用找到的第一个结果行作为聚合结果
 		_, ok := resultMap[mk]
 		if !ok {
@@ -585,6 +701,12 @@ func buildSelectGroupByResult(p *SelectPlan, r *mysql.Result) error {
 		}
 	}
 
+	if distinctMerger != nil {
+		if err := buildDistinctAggregateResult(p, r, distinctMerger, resultMap); err != nil {
+			return fmt.Errorf("buildDistinctAggregateResult error: %v", err)
+		}
+	}
+
 	err := buildResultFromResultMap(r, resultMap)
 	if err != nil {
 		return fmt.Errorf("buildResultFromResultMap error: %v", err)
@@ -593,6 +715,28 @@ func buildSelectGroupByResult(p *SelectPlan, r *mysql.Result) error {
 	return nil
 }
 
+// 计算DISTINCT聚合函数的结果
+// 原SQL没有GROUP BY时, 即使分片都没有返回结果, 也需要返回一行聚合结果
+func buildDistinctAggregateResult(p *SelectPlan, r *mysql.Result, distinctMerger *distinctAggregateMerger, resultMap map[string]ResultRow) error {
+	if len(resultMap) == 0 && !p.HasGroupBy() {
+		row := make(ResultRow, len(r.Fields))
+		for idx, mfunc := range p.aggregateFuncs {
+			if _, ok := mfunc.(*AggregateFuncCountMerger); ok {
+				row.SetValue(idx+distinctMerger.delta, int64(0))
+			}
+		}
+		resultMap[""] = row
+	}
+
+	distinctMerger.rewriteFields(r)
+	for mk, row := range resultMap {
+		if err := distinctMerger.finalize(mk, row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func buildSelectOnlyResult(p *SelectPlan, rs *mysql.Result) error {
 	r := rs.Resultset
 	// 没有聚合函数, 直接把所有分片结果添加到同一个ResultSet下面
@@ -625,6 +769,20 @@ func buildSelectOnlyResult(p *SelectPlan, rs *mysql.Result) error {
 	return nil
 }
 
+// 用补充的SUM和COUNT列计算AVG列的最终结果, 需要在去掉补充列之前调用
+func formatAvgResult(p *SelectPlan, r *mysql.Result) error {
+	for _, mfunc := range p.aggregateFuncs {
+		avgMerger, ok := mfunc.(*AggregateFuncAvgMerger)
+		if !ok {
+			continue
+		}
+		if err := avgMerger.format(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // this function modifies the first value of origin results
 func buildResultFromResultMap(r *mysql.Result, resultMap map[string]ResultRow) error {
 	// no group by result means the result row count is 0, so return the first result
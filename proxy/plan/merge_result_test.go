@@ -16,9 +16,16 @@ package plan
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/shopspring/decimal"
+
+	"github.com/XiaoMi/Gaea/core/errors"
 	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/util"
 )
 
 func TestLimitSelectResult(t *testing.T) {
@@ -63,3 +70,453 @@ func TestLimitSelectResult(t *testing.T) {
 		})
 	}
 }
+
+// 列类型由第一个非NULL值决定, 与mysql.BuildResultset一致
+func createTestSelectResult(names []string, values [][]any) *mysql.Result {
+	fields := make([]*mysql.Field, 0, len(names))
+	for i, name := range names {
+		field := &mysql.Field{Name: []byte(name), Type: mysql.TypeVarString}
+		for _, row := range values {
+			switch row[i].(type) {
+			case int64, uint64:
+				field.Type = mysql.TypeLonglong
+			case float64:
+				field.Type = mysql.TypeDouble
+			case nil:
+				continue
+			}
+			break
+		}
+		fields = append(fields, field)
+	}
+	r, err := mysql.BuildResultset(fields, names, values)
+	if err != nil {
+		panic(err)
+	}
+	return &mysql.Result{Resultset: r}
+}
+
+func TestMergeSelectResultAvg(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	// 分片上AVG(x)和补充的SUM(x)为DECIMAL类型, AVG的精度为参数精度+4
+	avgFields := func(scale uint8, groupBy ...string) []*mysql.Field {
+		var fields []*mysql.Field
+		for _, name := range groupBy {
+			fields = append(fields, &mysql.Field{Name: []byte(name), Type: mysql.TypeVarString})
+		}
+		return append(fields,
+			&mysql.Field{Name: []byte("AVG(`id`)"), Type: mysql.TypeNewDecimal, Decimal: scale + 4},
+			&mysql.Field{Name: []byte("SUM(`id`)"), Type: mysql.TypeNewDecimal, Decimal: scale},
+			&mysql.Field{Name: []byte("COUNT(`id`)"), Type: mysql.TypeLonglong},
+		)
+	}
+	avgResult := func(fields []*mysql.Field, values [][]any) *mysql.Result {
+		r, err := mysql.BuildResultset(fields, make([]string, len(fields)), values)
+		if err != nil {
+			t.Fatalf("build resultset error: %v", err)
+		}
+		return &mysql.Result{Resultset: r}
+	}
+
+	doubleFields := []*mysql.Field{
+		{Name: []byte("AVG(`id`)"), Type: mysql.TypeDouble, Decimal: mysql.NotFixedDec},
+		{Name: []byte("SUM(`id`)"), Type: mysql.TypeDouble, Decimal: mysql.NotFixedDec},
+		{Name: []byte("COUNT(`id`)"), Type: mysql.TypeLonglong},
+	}
+
+	tests := []struct {
+		sql    string
+		rs     []*mysql.Result
+		expect [][]any
+	}{
+		{
+			sql: "select avg(id) from tbl_mycat",
+			rs: []*mysql.Result{
+				avgResult(avgFields(0), [][]any{{float64(2), float64(6), int64(3)}}),
+				avgResult(avgFields(0), [][]any{{float64(10), float64(10), int64(1)}}),
+				avgResult(avgFields(0), [][]any{{nil, nil, int64(0)}}),
+			},
+			expect: [][]any{{"4.0000"}},
+		},
+		{
+			sql: "select avg(id) from tbl_mycat",
+			rs: []*mysql.Result{
+				avgResult(avgFields(0), [][]any{{nil, nil, int64(0)}}),
+				avgResult(avgFields(0), [][]any{{nil, nil, int64(0)}}),
+			},
+			expect: [][]any{{nil}},
+		},
+		{
+			// 10/3按精度四舍五入, 不会出现浮点数的尾数
+			sql: "select avg(id) from tbl_mycat",
+			rs: []*mysql.Result{
+				avgResult(avgFields(2), [][]any{{float64(3.005), float64(6.01), int64(2)}}),
+				avgResult(avgFields(2), [][]any{{float64(3.99), float64(3.99), int64(1)}}),
+			},
+			expect: [][]any{{"3.333333"}},
+		},
+		{
+			// 没有参与合并的分组也按相同精度返回
+			sql: "select user, avg(id) from tbl_mycat group by user order by user",
+			rs: []*mysql.Result{
+				avgResult(avgFields(0, "user"), [][]any{
+					{"a", float64(1.5), float64(3), int64(2)},
+					{"b", float64(5), float64(5), int64(1)},
+				}),
+				avgResult(avgFields(0, "user"), [][]any{
+					{"a", float64(6), float64(6), int64(1)},
+				}),
+			},
+			expect: [][]any{{"a", "3.0000"}, {"b", "5.0000"}},
+		},
+		{
+			// DOUBLE类型的AVG列保持浮点数
+			sql: "select avg(id) from tbl_mycat",
+			rs: []*mysql.Result{
+				avgResult(doubleFields, [][]any{{float64(1.5), float64(3), int64(2)}}),
+				avgResult(doubleFields, [][]any{{float64(4), float64(4), int64(1)}}),
+			},
+			expect: [][]any{{float64(7) / 3}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			selectPlan := p.(*SelectPlan)
+
+			ret, err := MergeSelectResult(util.NewRequestContext(), selectPlan, stmt.(*ast.SelectStmt), test.rs)
+			if err != nil {
+				t.Fatalf("MergeSelectResult error: %v", err)
+			}
+			if len(ret.Fields) != len(test.expect[0]) {
+				t.Fatalf("extra fields not trimmed, fields count: %d", len(ret.Fields))
+			}
+			if fmt.Sprint(ret.Values) != fmt.Sprint(test.expect) {
+				t.Errorf("values not equal, expect: %v, actual: %v", test.expect, ret.Values)
+			}
+		})
+	}
+}
+
+func TestMergeSelectResultDistinctAggregate(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	// 分片返回的是参数列, 列类型决定SUM/AVG(DISTINCT)的结果类型和精度
+	withType := func(r *mysql.Result, tp byte, scale uint8) *mysql.Result {
+		for _, f := range r.Fields {
+			f.Type, f.Decimal = tp, scale
+		}
+		return r
+	}
+
+	tests := []struct {
+		sql    string
+		rs     []*mysql.Result
+		names  []string
+		expect [][]any
+	}{
+		{
+			sql: "select count(distinct user), sum(distinct user), avg(distinct user) from tbl_mycat",
+			rs: []*mysql.Result{
+				withType(createTestSelectResult([]string{"user", "user", "user"}, [][]any{{int64(1), int64(1), int64(1)}, {int64(2), int64(2), int64(2)}, {nil, nil, nil}}), mysql.TypeLonglong, 0),
+				withType(createTestSelectResult([]string{"user", "user", "user"}, [][]any{{int64(2), int64(2), int64(2)}, {int64(6), int64(6), int64(6)}}), mysql.TypeLonglong, 0),
+			},
+			names:  []string{"count(distinct user)", "sum(distinct user)", "avg(distinct user)"},
+			expect: [][]any{{int64(3), "9", "3.0000"}},
+		},
+		{
+			sql: "select sum(distinct user), avg(distinct user) from tbl_mycat",
+			rs: []*mysql.Result{
+				withType(createTestSelectResult([]string{"user", "user"}, [][]any{{float64(0.1), float64(0.1)}, {float64(0.2), float64(0.2)}}), mysql.TypeNewDecimal, 2),
+				withType(createTestSelectResult([]string{"user", "user"}, [][]any{{float64(0.2), float64(0.2)}, {float64(1), float64(1)}}), mysql.TypeNewDecimal, 2),
+			},
+			names:  []string{"sum(distinct user)", "avg(distinct user)"},
+			expect: [][]any{{"1.30", "0.433333"}},
+		},
+		{
+			sql: "select sum(distinct user), avg(distinct user) from tbl_mycat",
+			rs: []*mysql.Result{
+				withType(createTestSelectResult([]string{"user", "user"}, [][]any{{float64(1.5), float64(1.5)}}), mysql.TypeDouble, mysql.NotFixedDec),
+				withType(createTestSelectResult([]string{"user", "user"}, [][]any{{float64(2.5), float64(2.5)}}), mysql.TypeDouble, mysql.NotFixedDec),
+			},
+			names:  []string{"sum(distinct user)", "avg(distinct user)"},
+			expect: [][]any{{float64(4), float64(2)}},
+		},
+		{
+			sql: "select count(distinct user), count(*) from tbl_mycat",
+			rs: []*mysql.Result{
+				createTestSelectResult([]string{"user", "COUNT(1)"}, nil),
+				createTestSelectResult([]string{"user", "COUNT(1)"}, nil),
+			},
+			names:  []string{"count(distinct user)", "COUNT(1)"},
+			expect: [][]any{{int64(0), int64(0)}},
+		},
+		{
+			sql: "select id, count(distinct user) as c, count(*) from tbl_mycat group by id order by id",
+			rs: []*mysql.Result{
+				createTestSelectResult([]string{"id", "c", "COUNT(1)"}, [][]any{
+					{int64(1), "a", int64(2)},
+					{int64(1), "b", int64(1)},
+					{int64(2), "a", int64(1)},
+				}),
+				createTestSelectResult([]string{"id", "c", "COUNT(1)"}, [][]any{
+					{int64(1), "a", int64(3)},
+					{int64(2), "c", int64(1)},
+				}),
+			},
+			names:  []string{"id", "c", "COUNT(1)"},
+			expect: [][]any{{int64(1), int64(2), int64(6)}, {int64(2), int64(2), int64(2)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			ret, err := MergeSelectResult(util.NewRequestContext(), p.(*SelectPlan), stmt.(*ast.SelectStmt), test.rs)
+			if err != nil {
+				t.Fatalf("MergeSelectResult error: %v", err)
+			}
+			if fmt.Sprint(ret.Values) != fmt.Sprint(test.expect) {
+				t.Errorf("values not equal, expect: %v, actual: %v", test.expect, ret.Values)
+			}
+			var names []string
+			for _, f := range ret.Fields {
+				names = append(names, string(f.Name))
+			}
+			if fmt.Sprint(names) != fmt.Sprint(test.names) {
+				t.Errorf("field names not equal, expect: %v, actual: %v", test.names, names)
+			}
+		})
+	}
+}
+
+func TestMergeSelectResultDistinctMemoryExceeded(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	sql := "select count(distinct user) from tbl_mycat"
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", sql, ns.rt, nil, ns.seqs, nil)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	var values [][]any
+	for i := 0; i < 100; i++ {
+		values = append(values, []any{fmt.Sprintf("user_%d", i)})
+	}
+	rs := []*mysql.Result{createTestSelectResult([]string{"user"}, values)}
+
+	reqCtx := util.NewRequestContext()
+	reqCtx.SetMaxDistinctMemory(1024)
+	_, err = MergeSelectResult(reqCtx, p.(*SelectPlan), stmt.(*ast.SelectStmt), rs)
+	if err == nil || !strings.Contains(err.Error(), errors.ErrDistinctMemoryExceeded.Error()) {
+		t.Errorf("expect memory exceeded error, got: %v", err)
+	}
+}
+
+func TestMergeSelectResultHaving(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		sql    string
+		rs     []*mysql.Result
+		expect [][]any
+	}{
+		{
+			// 每个分片上的SUM都不大于10, 合并后满足HAVING
+			sql: "select user, sum(id) as total from tbl_mycat group by user having total > 10 order by user",
+			rs: []*mysql.Result{
+				createTestSelectResult([]string{"user", "total"}, [][]any{{"a", int64(6)}, {"b", int64(3)}}),
+				createTestSelectResult([]string{"user", "total"}, [][]any{{"a", int64(7)}, {"c", int64(20)}}),
+			},
+			expect: [][]any{{"a", int64(13)}, {"c", int64(20)}},
+		},
+		{
+			sql: "select user from tbl_mycat group by user having sum(id) > 10 and avg(id) < 5 order by user limit 1",
+			rs: []*mysql.Result{
+				createTestSelectResult([]string{"user", "SUM(`id`)", "AVG(`id`)", "SUM(`id`)", "COUNT(`id`)"}, [][]any{
+					{"a", int64(8), float64(4), int64(8), int64(2)},
+					{"b", int64(9), float64(9), int64(9), int64(1)},
+				}),
+				createTestSelectResult([]string{"user", "SUM(`id`)", "AVG(`id`)", "SUM(`id`)", "COUNT(`id`)"}, [][]any{
+					{"a", int64(4), float64(4), int64(4), int64(1)},
+					{"b", int64(3), float64(1.5), int64(3), int64(2)},
+					{"c", int64(12), float64(3), int64(12), int64(4)},
+				}),
+			},
+			expect: [][]any{{"a"}},
+		},
+		{
+			sql: "select count(*) as c from tbl_mycat having c between 3 and 4 or c is null",
+			rs: []*mysql.Result{
+				createTestSelectResult([]string{"c"}, [][]any{{int64(1)}}),
+				createTestSelectResult([]string{"c"}, [][]any{{int64(2)}}),
+			},
+			expect: [][]any{{int64(3)}},
+		},
+		{
+			sql: "select user, max(id) as m from tbl_mycat group by user having m not in (1, 2) and (m - 1) / 2 >= 1 and user <> 'x' order by user",
+			rs: []*mysql.Result{
+				createTestSelectResult([]string{"user", "m"}, [][]any{{"a", int64(1)}, {"x", int64(9)}, {"b", int64(3)}}),
+				createTestSelectResult([]string{"user", "m"}, [][]any{{"a", int64(2)}, {"c", nil}}),
+			},
+			expect: [][]any{{"b", int64(3)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			ret, err := MergeSelectResult(util.NewRequestContext(), p.(*SelectPlan), stmt.(*ast.SelectStmt), test.rs)
+			if err != nil {
+				t.Fatalf("MergeSelectResult error: %v", err)
+			}
+			if fmt.Sprint(ret.Values) != fmt.Sprint(test.expect) {
+				t.Errorf("values not equal, expect: %v, actual: %v", test.expect, ret.Values)
+			}
+		})
+	}
+}
+
+func TestCompareHavingValue(t *testing.T) {
+	ci := havingText{collation: newKeyColumn(&mysql.Field{Type: mysql.TypeVarString, Charset: uint16(mysql.CollationNames["utf8mb4_general_ci"])})}
+	bin := havingText{collation: newKeyColumn(&mysql.Field{Type: mysql.TypeVarString, Charset: uint16(mysql.CollationNames["utf8mb4_bin"])})}
+	text := func(column havingText, s string) havingText {
+		column.s = s
+		return column
+	}
+
+	tests := []struct {
+		name   string
+		l, r   any
+		expect int
+		hasErr bool
+	}{
+		{name: "ci column and const", l: text(ci, "abc"), r: "ABC", expect: 0},
+		{name: "ci trailing spaces", l: text(ci, "abc  "), r: text(ci, "ABC"), expect: 0},
+		{name: "ci order", l: text(ci, "a"), r: "B", expect: -1},
+		{name: "bin column", l: text(bin, "abc"), r: "ABC", expect: 1},
+		{name: "bin trailing spaces", l: text(bin, "abc "), r: "abc", expect: 0},
+		{name: "consts", l: "x", r: "X", expect: 0},
+		{name: "different collations", l: text(ci, "a"), r: text(bin, "a"), hasErr: true},
+		{name: "accent in ci", l: text(ci, "café"), r: "CAFE", hasErr: true},
+		{name: "numeric prefix", l: "12abc", r: decimal.NewFromInt(12), expect: 0},
+		{name: "column numeric prefix", l: text(ci, " 1.5e1x"), r: decimal.NewFromInt(15), expect: 0},
+		{name: "no numeric prefix", l: "abc", r: decimal.NewFromInt(0), expect: 0},
+		{name: "decimal point", l: "12.", r: decimal.NewFromInt(12), expect: 0},
+		{name: "negative", l: "-3y", r: decimal.NewFromInt(-2), expect: -1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := compareHavingValue(test.l, test.r)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, actual: %d", c)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("compareHavingValue error: %v", err)
+			}
+			if c != test.expect {
+				t.Errorf("compare result not equal, expect: %d, actual: %d", test.expect, c)
+			}
+		})
+	}
+}
+
+func TestMergeSelectResultByItemExpr(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		sql    string
+		rs     []*mysql.Result
+		expect [][]any
+	}{
+		{
+			// 按补充列的值排序, 返回结果中去掉补充列
+			sql: "select id from tbl_mycat order by date(create_time) desc, id",
+			rs: []*mysql.Result{
+				createTestSelectResult([]string{"id", "gaea_by_0"}, [][]any{{int64(4), "2024-01-02"}, {int64(0), "2024-01-01"}}),
+				createTestSelectResult([]string{"id", "gaea_by_0"}, [][]any{{int64(1), "2024-01-03"}, {int64(5), "2024-01-01"}}),
+			},
+			expect: [][]any{{int64(1)}, {int64(4)}, {int64(0)}, {int64(5)}},
+		},
+		{
+			// 按补充列的值分组
+			sql: "select count(*) as c from tbl_mycat group by amount div 100 order by c",
+			rs: []*mysql.Result{
+				createTestSelectResult([]string{"c", "gaea_by_0"}, [][]any{{int64(2), int64(0)}, {int64(1), int64(1)}}),
+				createTestSelectResult([]string{"c", "gaea_by_0"}, [][]any{{int64(5), int64(0)}, {int64(3), int64(2)}}),
+			},
+			expect: [][]any{{int64(1)}, {int64(3)}, {int64(7)}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			ret, err := MergeSelectResult(util.NewRequestContext(), p.(*SelectPlan), stmt.(*ast.SelectStmt), test.rs)
+			if err != nil {
+				t.Fatalf("MergeSelectResult error: %v", err)
+			}
+			if fmt.Sprint(ret.Values) != fmt.Sprint(test.expect) {
+				t.Errorf("values not equal, expect: %v, actual: %v", test.expect, ret.Values)
+			}
+			if len(ret.Fields) != len(test.expect[0]) {
+				t.Errorf("fields count not equal, expect: %d, actual: %d", len(test.expect[0]), len(ret.Fields))
+			}
+		})
+	}
+}
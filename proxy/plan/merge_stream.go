@@ -0,0 +1,222 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"container/heap"
+	"fmt"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// RowCursor 按顺序读取一条分片SQL的结果, 每次只缓存一部分行
+type RowCursor interface {
+	// Fields 结果集的列信息
+	Fields() []*mysql.Field
+	// Next 返回下一行, 没有更多的行时返回nil
+	Next() ([]any, error)
+	// BufferSize 当前缓存的行占用的字节数
+	BufferSize() int
+	Close()
+}
+
+// StreamExecutor 以游标的方式执行分片SQL, 用于流式归并多分片的结果
+type StreamExecutor interface {
+	// ExecuteSQLsInStream 返回的游标与SQL一一对应, 出错时已经打开的游标由实现方关闭
+	ExecuteSQLsInStream(*util.RequestContext, map[string]map[string][]string) ([]RowCursor, error)
+}
+
+// StreamMerger 对各分片已按ORDER BY排好序的结果做k路归并,
+// 每个分片只缓存一批行, 返回offset+count行后不再读取后端的结果
+type StreamMerger struct {
+	cursors   []RowCursor
+	rows      *mergeHeap
+	fields    []*mysql.Field
+	columnCnt int // 返回给客户端的列数, 不包含补充的ORDER BY列
+
+	offset   int64
+	count    int64 // -1表示没有LIMIT
+	skipped  int64
+	returned int64
+
+	bufferSize     int
+	peakBufferSize int
+	closed         bool
+}
+
+type mergeItem struct {
+	row    []any
+	cursor int
+}
+
+// mergeHeap 按ORDER BY排序的小顶堆, 相等时按分片顺序, 保证结果稳定
+type mergeHeap struct {
+	items    []*mergeItem
+	sortKeys []mysql.SortKey
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	if c := mysql.CompareRow(h.items[i].row, h.items[j].row, h.sortKeys); c != 0 {
+		return c < 0
+	}
+	return h.items[i].cursor < h.items[j].cursor
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap) Push(x any) {
+	h.items = append(h.items, x.(*mergeItem))
+}
+
+func (h *mergeHeap) Pop() any {
+	n := len(h.items)
+	item := h.items[n-1]
+	h.items[n-1] = nil
+	h.items = h.items[:n-1]
+	return item
+}
+
+// NewStreamMerger 读取每个游标的第一行后构建堆, 出错时关闭所有游标
+func NewStreamMerger(p *SelectPlan, cursors []RowCursor) (*StreamMerger, error) {
+	m := &StreamMerger{
+		cursors: cursors,
+		rows:    &mergeHeap{},
+		count:   -1,
+	}
+	if err := m.init(p); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *StreamMerger) init(p *SelectPlan) error {
+	if len(m.cursors) == 0 {
+		return fmt.Errorf("no cursor to merge")
+	}
+
+	// 与合并结果集时相同, 以列数最少的结果为准
+	for _, c := range m.cursors {
+		if m.fields == nil || len(c.Fields()) < len(m.fields) {
+			m.fields = c.Fields()
+		}
+	}
+	deltaColumnCount := len(m.fields) - p.GetColumnCount()
+	m.columnCnt = deltaColumnCount + p.GetOriginColumnCount()
+	if m.columnCnt <= 0 || m.columnCnt > len(m.fields) {
+		return fmt.Errorf("invalid column count, fields: %d, columns: %d", len(m.fields), m.columnCnt)
+	}
+	m.fields = m.fields[:m.columnCnt]
+
+	orderByColumns, orderByDirections := p.GetOrderByColumnInfo()
+	for i := range orderByColumns {
+		sortKey := mysql.SortKey{Column: orderByColumns[i] + deltaColumnCount, Direction: mysql.SortAsc}
+		if orderByDirections[i] {
+			sortKey.Direction = mysql.SortDesc
+		}
+		m.rows.sortKeys = append(m.rows.sortKeys, sortKey)
+	}
+
+	if p.HasLimit() {
+		m.offset, m.count = p.GetLimitValue()
+	}
+
+	for i := range m.cursors {
+		row, err := m.fetch(i)
+		if err != nil {
+			return err
+		}
+		if row != nil {
+			m.rows.items = append(m.rows.items, &mergeItem{row: row, cursor: i})
+		}
+	}
+	heap.Init(m.rows)
+	return nil
+}
+
+// 读取游标的下一行, 并记录缓存的行占用的最大内存
+func (m *StreamMerger) fetch(i int) ([]any, error) {
+	c := m.cursors[i]
+	before := c.BufferSize()
+	row, err := c.Next()
+	if err != nil {
+		return nil, err
+	}
+	m.bufferSize += c.BufferSize() - before
+	if m.bufferSize > m.peakBufferSize {
+		m.peakBufferSize = m.bufferSize
+	}
+	if row != nil && len(row) < m.columnCnt {
+		return nil, fmt.Errorf("row has %d column less than %d", len(row), m.columnCnt)
+	}
+	return row, nil
+}
+
+// Fields 返回给客户端的列信息
+func (m *StreamMerger) Fields() []*mysql.Field {
+	return m.fields
+}
+
+// Next 按顺序返回归并后的下一行, 返回nil表示没有更多的行
+func (m *StreamMerger) Next() ([]any, error) {
+	for {
+		if m.closed || m.rows.Len() == 0 || (m.count >= 0 && m.returned >= m.count) {
+			return nil, nil
+		}
+
+		item := m.rows.items[0]
+		row := item.row
+		next, err := m.fetch(item.cursor)
+		if err != nil {
+			return nil, err
+		}
+		if next != nil {
+			item.row = next
+			heap.Fix(m.rows, 0)
+		} else {
+			heap.Pop(m.rows)
+		}
+
+		if m.skipped < m.offset {
+			m.skipped++
+			continue
+		}
+		m.returned++
+		return row[:m.columnCnt], nil
+	}
+}
+
+// PeakBufferSize 归并过程中所有游标缓存的行占用的最大字节数
+func (m *StreamMerger) PeakBufferSize() int {
+	return m.peakBufferSize
+}
+
+// Close 关闭所有游标, 可以重复调用
+func (m *StreamMerger) Close() {
+	if m.closed {
+		return
+	}
+	m.closed = true
+	for _, c := range m.cursors {
+		c.Close()
+	}
+}
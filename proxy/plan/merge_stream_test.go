@@ -0,0 +1,183 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// testRowCursor 按批返回行, 每行按10字节计算缓存大小
+type testRowCursor struct {
+	fields  []*mysql.Field
+	batches [][][]any
+	current [][]any
+	read    int
+	closed  bool
+}
+
+func newTestRowCursor(names []string, batches ...[][]any) *testRowCursor {
+	return &testRowCursor{fields: createTestSelectResult(names, nil).Fields, batches: batches}
+}
+
+func (c *testRowCursor) Fields() []*mysql.Field {
+	return c.fields
+}
+
+func (c *testRowCursor) Next() ([]any, error) {
+	for len(c.current) == 0 {
+		if len(c.batches) == 0 {
+			return nil, nil
+		}
+		c.current, c.batches = c.batches[0], c.batches[1:]
+	}
+	row := c.current[0]
+	c.current = c.current[1:]
+	c.read++
+	return row, nil
+}
+
+func (c *testRowCursor) BufferSize() int {
+	return len(c.current) * 10
+}
+
+func (c *testRowCursor) Close() {
+	c.closed = true
+}
+
+type streamExecutor struct {
+	mockExecutor
+	cursors []RowCursor
+}
+
+func (e *streamExecutor) ExecuteSQLsInStream(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]RowCursor, error) {
+	return e.cursors, nil
+}
+
+func TestSelectPlanCanExecuteInStream(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		db     string
+		sql    string
+		expect bool
+	}{
+		{db: "db_mycat", sql: "select id, a from tbl_mycat order by b desc limit 10, 20", expect: true},
+		{db: "db_ks", sql: "select * from tbl_ks order by id", expect: true},
+		{db: "db_mycat", sql: "select id from tbl_mycat where id = 1 order by id", expect: false},
+		{db: "db_mycat", sql: "select id from tbl_mycat", expect: false},
+		{db: "db_mycat", sql: "select distinct id from tbl_mycat order by id", expect: false},
+		{db: "db_mycat", sql: "select id, count(*) from tbl_mycat group by id order by id", expect: false},
+		{db: "db_mycat", sql: "select count(*) from tbl_mycat order by 1", expect: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, test.db, test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			if actual := p.(*SelectPlan).CanExecuteInStream(); actual != test.expect {
+				t.Errorf("CanExecuteInStream not equal, expect: %v, actual: %v", test.expect, actual)
+			}
+		})
+	}
+}
+
+func TestSelectPlanExecuteInStream(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	sql := "select id, a from tbl_mycat order by b desc, id limit 1, 3"
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", sql, ns.rt, nil, ns.seqs, nil)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	// 每个分片的结果已经按ORDER BY排序, 最后一列为补充的ORDER BY列
+	names := []string{"id", "a", "b"}
+	cursors := []*testRowCursor{
+		newTestRowCursor(names,
+			[][]any{{int64(1), "a1", int64(9)}, {int64(5), "a5", int64(7)}},
+			[][]any{{int64(9), "a9", int64(3)}, {int64(13), "a13", int64(1)}},
+		),
+		newTestRowCursor(names),
+		newTestRowCursor(names,
+			[][]any{{int64(2), "a2", int64(9)}, {int64(6), "a6", int64(8)}, {int64(10), "a10", int64(2)}},
+		),
+		newTestRowCursor(names,
+			[][]any{{int64(3), "a3", nil}},
+		),
+	}
+	executor := &streamExecutor{}
+	for _, c := range cursors {
+		executor.cursors = append(executor.cursors, c)
+	}
+
+	m, err := p.(*SelectPlan).ExecuteInStream(util.NewRequestContext(), executor)
+	if err != nil {
+		t.Fatalf("ExecuteInStream error: %v", err)
+	}
+	if len(m.Fields()) != 2 {
+		t.Errorf("fields count not equal, expect: 2, actual: %d", len(m.Fields()))
+	}
+
+	var rows [][]any
+	for {
+		row, err := m.Next()
+		if err != nil {
+			t.Fatalf("Next error: %v", err)
+		}
+		if row == nil {
+			break
+		}
+		rows = append(rows, row)
+	}
+	expect := [][]any{{int64(2), "a2"}, {int64(6), "a6"}, {int64(5), "a5"}}
+	if !reflect.DeepEqual(rows, expect) {
+		t.Errorf("rows not equal, expect: %v, actual: %v", expect, rows)
+	}
+
+	// 输出offset+count行后不再读取剩余的行
+	if cursors[0].read != 3 {
+		t.Errorf("rows read from cursor 0 not equal, expect: 3, actual: %d", cursors[0].read)
+	}
+	if m.PeakBufferSize() != 30 {
+		t.Errorf("peak buffer size not equal, expect: 30, actual: %d", m.PeakBufferSize())
+	}
+
+	m.Close()
+	for i, c := range cursors {
+		if !c.closed {
+			t.Errorf("cursor %d is not closed", i)
+		}
+	}
+}
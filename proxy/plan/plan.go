@@ -192,6 +192,8 @@ type StmtInfo struct {
 	tableRules       map[string]router.Rule // key = table name, value = router.Rule, 记录使用到的分片表
 	globalTableRules map[string]router.Rule // 记录使用到的全局表
 	result           *RouteResult
+	routeHint        *RouteHint        // GAEA_ROUTE或GAEA_BROADCAST指定的路由, 覆盖计算出的路由
+	routeHintPhyDBs  map[string]string // 逻辑库名到物理库名的映射, 按hint中的物理库名过滤分片
 }
 
 // TableAliasStmtInfo 使用到表别名, 且依赖表别名做路由计算的StmtNode, 目前包括UPDATE, SELECT
@@ -213,7 +215,7 @@ func BuildPlan(stmt ast.StmtNode, phyDBs map[string]string, db, sql string, rout
 	}
 
 	if estmt, ok := stmt.(*ast.ExplainStmt); ok {
-		return buildExplainPlan(estmt, phyDBs, db, sql, router, seq, hintPlan)
+		return buildExplainPlan(estmt, phyDBs, db, sql, router, grayRouter, seq, hintPlan)
 	}
 
 	checker := NewChecker(db, router, grayRouter)
@@ -224,7 +226,7 @@ func BuildPlan(stmt ast.StmtNode, phyDBs map[string]string, db, sql string, rout
 	}
 
 	if checker.IsShard() {
-		return buildShardPlan(stmt, db, sql, router, seq, hintPlan)
+		return buildShardPlan(stmt, phyDBs, db, sql, router, grayRouter, seq, hintPlan)
 	}
 
 	// TODO：只处理读
@@ -333,15 +335,29 @@ func buildGrayPlan(stmt ast.StmtNode, db string, phyDBs map[string]string, unsha
 		if err != nil {
 			return nil, fmt.Errorf("generate gray compression error: %v", err)
 		}
-
-		if s.Where == nil {
-			s.Where = expr
-		} else {
-			s.Where = &ast.BinaryOperationExpr{
-				L:  s.Where,
-				R:  expr,
-				Op: opcode.LogicAnd,
-			}
+		s.Where = addGrayCondition(s.Where, expr)
+		return CreateUnshardPlan(s, phyDBs, db, unshardTables)
+	case *ast.UpdateStmt:
+		// 只更新灰度范围内的行, 且不能把行更新到灰度范围之外
+		if err := checkGrayAssignments(rule, s.List, tav.GetTableAlias()); err != nil {
+			return nil, err
+		}
+		expr, err := generateGrayExpression(rule, tav.GetTableAlias())
+		if err != nil {
+			return nil, fmt.Errorf("generate gray compression error: %v", err)
+		}
+		s.Where = addGrayCondition(s.Where, expr)
+		return CreateUnshardPlan(s, phyDBs, db, unshardTables)
+	case *ast.DeleteStmt:
+		expr, err := generateGrayExpression(rule, tav.GetTableAlias())
+		if err != nil {
+			return nil, fmt.Errorf("generate gray compression error: %v", err)
+		}
+		s.Where = addGrayCondition(s.Where, expr)
+		return CreateUnshardPlan(s, phyDBs, db, unshardTables)
+	case *ast.InsertStmt:
+		if err := buildGrayInsert(s, rule); err != nil {
+			return nil, err
 		}
 		return CreateUnshardPlan(s, phyDBs, db, unshardTables)
 	default:
@@ -349,9 +365,18 @@ func buildGrayPlan(stmt ast.StmtNode, db string, phyDBs map[string]string, unsha
 	}
 }
 
-func buildShardPlan(stmt ast.StmtNode, db string, sql string, router *router.Router, seq *sequence.SequenceManager, hintPlan Plan) (Plan, error) {
+func buildShardPlan(stmt ast.StmtNode, phyDBs map[string]string, db string, sql string, router *router.Router, grayRouter *router.GrayRouter, seq *sequence.SequenceManager, hintPlan Plan) (Plan, error) {
+	// 先执行IN (SELECT ...)和EXISTS子查询, 再按结果计算外层查询的路由
+	if len(collectSubqueries(stmt)) != 0 {
+		return buildSubqueryPlan(stmt, phyDBs, db, sql, router, grayRouter, seq)
+	}
+
 	switch s := stmt.(type) {
 	case *ast.SelectStmt:
+		// 分片规则不同的分片表之间的JOIN, 由Gaea执行
+		if isCrossShardJoin(s, db, router) {
+			return buildJoinPlan(s, db, router)
+		}
 		plan := NewSelectPlan(db, sql, router)
 		// convert MyCat hint Plan to hint DB
 		if p, ok := hintPlan.(*SelectPlan); ok {
@@ -369,12 +394,19 @@ func buildShardPlan(stmt ast.StmtNode, db string, sql string, router *router.Rou
 		return plan, nil
 	case *ast.InsertStmt:
 		// InsertStmt contains REPLACE statement
+		if s.Select != nil {
+			return buildInsertSelectPlan(s, phyDBs, db, sql, router, grayRouter, seq)
+		}
 		plan := NewInsertPlan(db, sql, router, seq)
 		if err := HandleInsertStmt(plan, s); err != nil {
 			return nil, err
 		}
 		return plan, nil
 	case *ast.UpdateStmt:
+		// 更新分片列时需要在分片之间移动数据
+		if isUpdateShardKey(s, db, router) {
+			return buildUpdateShardKeyPlan(s, db, sql, router)
+		}
 		plan := NewUpdatePlan(s, db, sql, router)
 		if err := HandleUpdatePlan(plan); err != nil {
 			return nil, err
@@ -386,6 +418,15 @@ func buildShardPlan(stmt ast.StmtNode, db string, sql string, router *router.Rou
 			return nil, err
 		}
 		return plan, nil
+	case *ast.UnionStmt:
+		plan := NewUnionPlan(s)
+		if err := HandleUnionStmt(plan, phyDBs, db, router, grayRouter, seq); err != nil {
+			return nil, err
+		}
+		return plan, nil
+	case *ast.CreateTableStmt, *ast.AlterTableStmt, *ast.DropTableStmt:
+		// 分片表的DDL在每一张物理表上执行
+		return buildDDLPlan(s.(ast.DDLNode), db, router)
 	default:
 		return nil, fmt.Errorf("stmt type does not support shard now")
 	}
@@ -467,12 +508,7 @@ func (s *StmtInfo) checkStmtRouteResult(rule router.Rule) error {
 	}
 
 	db := rule.GetDB()
-	var table string
-	if linkedRule, ok := rule.(*router.LinkedRule); ok {
-		table = linkedRule.GetParentTable()
-	} else {
-		table = rule.GetTable()
-	}
+	table := getRouteTable(rule)
 
 	if s.result.db == "" && s.result.table == "" {
 		s.result.db = db
@@ -487,6 +523,14 @@ func (s *StmtInfo) checkStmtRouteResult(rule router.Rule) error {
 	return nil
 }
 
+// 获取路由时使用的表名, 关联表与父表的分片方式一致, 使用父表的表名
+func getRouteTable(rule router.Rule) string {
+	if linkedRule, ok := rule.(*router.LinkedRule); ok {
+		return linkedRule.GetParentTable()
+	}
+	return rule.GetTable()
+}
+
 // 用于WHERE条件或JOIN ON条件中, 只存在列名时, 查找对应的路由规则
 func (s *StmtInfo) getSettedRuleByColumnName(column string) (router.Rule, bool, error) {
 	var columnExistsInShardingTables int // 记录分片表名出现在分片表中分片列的次数
@@ -509,6 +553,10 @@ func (s *StmtInfo) getSettedRuleByColumnName(column string) (router.Rule, bool,
 // 这种情况会随机路由到各个分片表
 // 如果有多个全局表, 则只取第一个全局表的配置, 因此需要业务上保证这些全局表的配置是一致的.
 func postHandleGlobalTableRouteResultInQuery(p *StmtInfo) error {
+	// 有路由hint时已经按hint选择了分片
+	if p.routeHint != nil {
+		return nil
+	}
 	if len(p.tableRules) == 0 && len(p.globalTableRules) != 0 {
 		var tableName string
 		var rule router.Rule
@@ -0,0 +1,295 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/model"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// DDL在物理表上的执行状态
+const (
+	DDLStatusSuccess = "success"
+	DDLStatusFailed  = "failed"
+	DDLStatusSkipped = "skipped" // 断点续做时跳过上一次已经成功的物理表
+)
+
+// DDLTask 一张物理表上的DDL
+type DDLTask struct {
+	Slice string
+	DB    string
+	Table string
+	SQL   string
+	Err   error // 由DDLExecutor设置
+}
+
+func (t *DDLTask) key() string {
+	return t.Slice + "." + t.DB + "." + t.Table
+}
+
+// DDLExecutor 执行分片表DDL广播的Executor
+type DDLExecutor interface {
+	// ExecuteDDLs 执行各物理表上的DDL, 每个slice同时执行的数量由实现方控制,
+	// 单张物理表的执行错误记录在DDLTask.Err中, 返回的error表示无法执行
+	ExecuteDDLs(reqCtx *util.RequestContext, tasks []*DDLTask) error
+
+	// GetDDLProgress 返回namespace中记录的DDL执行进度
+	GetDDLProgress() *DDLProgress
+}
+
+// DDLProgress 记录未全部成功的DDL在哪些物理表上已经执行成功, 用于断点续做
+type DDLProgress struct {
+	lock      sync.Mutex
+	succeeded map[string]map[string]bool // key: DDL, value: 已经成功的物理表
+}
+
+// NewDDLProgress constructor of DDLProgress
+func NewDDLProgress() *DDLProgress {
+	return &DDLProgress{succeeded: make(map[string]map[string]bool)}
+}
+
+// Get 返回DDL已经成功的物理表
+func (p *DDLProgress) Get(key string) map[string]bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ret := make(map[string]bool, len(p.succeeded[key]))
+	for table := range p.succeeded[key] {
+		ret[table] = true
+	}
+	return ret
+}
+
+// Set 记录DDL已经成功的物理表, 为空时删除记录
+func (p *DDLProgress) Set(key string, succeeded map[string]bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(succeeded) == 0 {
+		delete(p.succeeded, key)
+		return
+	}
+	p.succeeded[key] = succeeded
+}
+
+// Delete 删除DDL的执行记录
+func (p *DDLProgress) Delete(key string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.succeeded, key)
+}
+
+// DDLPlan is the plan for CREATE/ALTER/DROP TABLE on sharded table.
+// DDL被改写后在规则中的每一张物理表上执行, 返回每张物理表的执行结果.
+type DDLPlan struct {
+	basePlan
+
+	db    string
+	table string
+	sql   string // 改写前的DDL, 用于记录执行进度
+	tasks []*DDLTask
+}
+
+// 分片表DDL中只能出现一张表, 如CREATE TABLE ... LIKE, 外键, RENAME等涉及其他表的DDL不支持
+type ddlTableNameVisitor struct {
+	tableNames []*ast.TableName
+}
+
+// Enter implement ast.Visitor
+func (v *ddlTableNameVisitor) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if tableName, ok := n.(*ast.TableName); ok {
+		v.tableNames = append(v.tableNames, tableName)
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *ddlTableNameVisitor) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+func buildDDLPlan(stmt ast.DDLNode, db string, r *router.Router) (Plan, error) {
+	switch s := stmt.(type) {
+	case *ast.CreateTableStmt:
+		if s.Select != nil {
+			return nil, fmt.Errorf("CREATE TABLE ... SELECT on sharded table is not supported")
+		}
+	case *ast.AlterTableStmt:
+		for _, spec := range s.Specs {
+			if spec.Tp == ast.AlterTableRenameTable {
+				return nil, fmt.Errorf("rename sharded table is not supported")
+			}
+		}
+	case *ast.DropTableStmt:
+		if s.IsView {
+			return nil, fmt.Errorf("DROP VIEW on sharded table is not supported")
+		}
+	}
+
+	v := &ddlTableNameVisitor{}
+	stmt.Accept(v)
+	if len(v.tableNames) != 1 {
+		return nil, fmt.Errorf("DDL on sharded table can only contain one table")
+	}
+	tableName := v.tableNames[0]
+	if tableName.Schema.L != "" {
+		db = tableName.Schema.L
+	}
+	rule, ok := r.GetShardRule(db, tableName.Name.L)
+	if !ok {
+		return nil, fmt.Errorf("cannot find shard rule, db: %s, table: %s", db, tableName.Name.L)
+	}
+
+	sql, err := generateUnshardingSQL(stmt)
+	if err != nil {
+		return nil, fmt.Errorf("generate sql error: %v", err)
+	}
+	p := &DDLPlan{
+		db:    db,
+		table: tableName.Name.L,
+		sql:   sql,
+	}
+
+	// 逐个改写为物理表名, 生成SQL后恢复
+	origin := *tableName
+	defer func() {
+		*tableName = origin
+	}()
+	for _, index := range rule.GetSubTableIndexes() {
+		phyDB, err := rule.GetDatabaseNameByTableIndex(index)
+		if err != nil {
+			return nil, fmt.Errorf("get database name error, index: %d, err: %v", index, err)
+		}
+		phyTable := getPhysicalTableName(rule, origin.Name.O, index)
+		if origin.Schema.O != "" {
+			tableName.Schema = model.NewCIStr(phyDB)
+		}
+		tableName.Name = model.NewCIStr(phyTable)
+
+		phySQL, err := generateUnshardingSQL(stmt)
+		if err != nil {
+			return nil, fmt.Errorf("generate sql error, table: %s, err: %v", phyTable, err)
+		}
+		p.tasks = append(p.tasks, &DDLTask{
+			Slice: rule.GetSlice(rule.GetSliceIndexFromTableIndex(index)),
+			DB:    phyDB,
+			Table: phyTable,
+			SQL:   phySQL,
+		})
+	}
+	if len(p.tasks) == 0 {
+		return nil, fmt.Errorf("no physical table of %s.%s", db, tableName.Name.L)
+	}
+	return p, nil
+}
+
+// 与TableNameDecorator的改写方式一致, kingshard需要添加表序号, mycat和全局表不需要
+func getPhysicalTableName(rule router.Rule, table string, index int) string {
+	ruleType := rule.GetType()
+	if ruleType == router.GlobalTableRuleType || router.IsMycatShardingRule(ruleType) {
+		return table
+	}
+	return fmt.Sprintf("%s_%04d", table, index)
+}
+
+// GetTasks return ddl of every physical table
+func (p *DDLPlan) GetTasks() []*DDLTask {
+	return p.tasks
+}
+
+func (p *DDLPlan) progressKey() string {
+	return p.db + ":" + p.sql
+}
+
+// ExecuteIn implement Plan
+// 开启断点续做时, 跳过上一次执行同一条DDL时已经成功的物理表
+func (p *DDLPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	executor, ok := sess.(DDLExecutor)
+	if !ok {
+		return nil, fmt.Errorf("executor does not support DDL on sharded table")
+	}
+
+	progress := executor.GetDDLProgress()
+	key := p.progressKey()
+	succeeded := make(map[string]bool)
+	if reqCtx.IsDDLResume() {
+		succeeded = progress.Get(key)
+	}
+
+	// 执行计划可能被复用, 每次执行时复制一份
+	tasks := make([]*DDLTask, 0, len(p.tasks))
+	pending := make([]*DDLTask, 0, len(p.tasks))
+	for _, t := range p.tasks {
+		task := *t
+		tasks = append(tasks, &task)
+		if !succeeded[task.key()] {
+			pending = append(pending, &task)
+		}
+	}
+
+	if len(pending) != 0 {
+		if err := executor.ExecuteDDLs(reqCtx, pending); err != nil {
+			return nil, err
+		}
+	}
+
+	failed := false
+	for _, task := range pending {
+		if task.Err != nil {
+			failed = true
+		} else {
+			succeeded[task.key()] = true
+		}
+	}
+	if failed {
+		progress.Set(key, succeeded)
+	} else {
+		progress.Delete(key)
+	}
+
+	return createDDLResult(tasks, pending)
+}
+
+// 每张物理表返回一行: slice, db, table, status, message
+func createDDLResult(tasks []*DDLTask, executed []*DDLTask) (*mysql.Result, error) {
+	isExecuted := make(map[string]bool, len(executed))
+	for _, task := range executed {
+		isExecuted[task.key()] = true
+	}
+
+	var rows [][]any
+	for _, task := range tasks {
+		status, message := DDLStatusSuccess, ""
+		if task.Err != nil {
+			status, message = DDLStatusFailed, task.Err.Error()
+		} else if !isExecuted[task.key()] {
+			status = DDLStatusSkipped
+		}
+		rows = append(rows, []any{task.Slice, task.DB, task.Table, status, message})
+	}
+
+	names := []string{"slice", "db", "table", "status", "message"}
+	r, err := mysql.BuildResultset(nil, names, rows)
+	if err != nil {
+		return nil, err
+	}
+	ret := mysql.ResultPool.Get()
+	ret.Resultset = r
+	return ret, nil
+}
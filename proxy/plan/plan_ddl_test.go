@@ -0,0 +1,199 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// ddlExecutor 记录执行过的DDL, failed中的物理表执行失败
+type ddlExecutor struct {
+	mockExecutor
+	progress *DDLProgress
+	failed   map[string]bool
+	executed []string
+}
+
+func (e *ddlExecutor) ExecuteDDLs(reqCtx *util.RequestContext, tasks []*DDLTask) error {
+	for _, task := range tasks {
+		e.executed = append(e.executed, task.Table)
+		if e.failed[task.Table] {
+			task.Err = fmt.Errorf("execute error")
+		}
+	}
+	return nil
+}
+
+func (e *ddlExecutor) GetDDLProgress() *DDLProgress {
+	return e.progress
+}
+
+func TestBuildDDLPlan(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		db     string
+		sql    string
+		expect []DDLTask
+	}{
+		{
+			db:  "db_ks",
+			sql: "alter table tbl_ks add column c int",
+			expect: []DDLTask{
+				{Slice: "slice-0", DB: "db_ks", Table: "tbl_ks_0000", SQL: "ALTER TABLE `tbl_ks_0000` ADD COLUMN `c` INT"},
+				{Slice: "slice-0", DB: "db_ks", Table: "tbl_ks_0001", SQL: "ALTER TABLE `tbl_ks_0001` ADD COLUMN `c` INT"},
+				{Slice: "slice-1", DB: "db_ks", Table: "tbl_ks_0002", SQL: "ALTER TABLE `tbl_ks_0002` ADD COLUMN `c` INT"},
+				{Slice: "slice-1", DB: "db_ks", Table: "tbl_ks_0003", SQL: "ALTER TABLE `tbl_ks_0003` ADD COLUMN `c` INT"},
+			},
+		},
+		{
+			db:  "db_ks",
+			sql: "create table if not exists db_ks.tbl_ks (id int primary key)",
+			expect: []DDLTask{
+				{Slice: "slice-0", DB: "db_ks", Table: "tbl_ks_0000", SQL: "CREATE TABLE IF NOT EXISTS `db_ks`.`tbl_ks_0000` (`id` INT PRIMARY KEY)"},
+				{Slice: "slice-0", DB: "db_ks", Table: "tbl_ks_0001", SQL: "CREATE TABLE IF NOT EXISTS `db_ks`.`tbl_ks_0001` (`id` INT PRIMARY KEY)"},
+				{Slice: "slice-1", DB: "db_ks", Table: "tbl_ks_0002", SQL: "CREATE TABLE IF NOT EXISTS `db_ks`.`tbl_ks_0002` (`id` INT PRIMARY KEY)"},
+				{Slice: "slice-1", DB: "db_ks", Table: "tbl_ks_0003", SQL: "CREATE TABLE IF NOT EXISTS `db_ks`.`tbl_ks_0003` (`id` INT PRIMARY KEY)"},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "drop table if exists db_mycat.tbl_mycat",
+			expect: []DDLTask{
+				{Slice: "slice-0", DB: "db_mycat_0", Table: "tbl_mycat", SQL: "DROP TABLE IF EXISTS `db_mycat_0`.`tbl_mycat`"},
+				{Slice: "slice-0", DB: "db_mycat_1", Table: "tbl_mycat", SQL: "DROP TABLE IF EXISTS `db_mycat_1`.`tbl_mycat`"},
+				{Slice: "slice-1", DB: "db_mycat_2", Table: "tbl_mycat", SQL: "DROP TABLE IF EXISTS `db_mycat_2`.`tbl_mycat`"},
+				{Slice: "slice-1", DB: "db_mycat_3", Table: "tbl_mycat", SQL: "DROP TABLE IF EXISTS `db_mycat_3`.`tbl_mycat`"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, test.db, test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			ddlPlan, ok := p.(*DDLPlan)
+			if !ok {
+				t.Fatalf("plan type not equal, expect: *DDLPlan, actual: %T", p)
+			}
+			var actual []DDLTask
+			for _, task := range ddlPlan.GetTasks() {
+				actual = append(actual, *task)
+			}
+			if !reflect.DeepEqual(actual, test.expect) {
+				t.Errorf("tasks not equal, expect: %v, actual: %v", test.expect, actual)
+			}
+		})
+	}
+}
+
+func TestBuildDDLPlanError(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	grayRouter := router.NewGrayRouter(&models.Namespace{})
+	sqls := []string{
+		"create table tbl_ks_new like tbl_ks",
+		"create table tbl_ks select * from tbl_ks_child",
+		"alter table tbl_ks rename to tbl_ks_new",
+		"drop table tbl_ks, tbl_ks_child",
+	}
+	for _, sql := range sqls {
+		t.Run(sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			if _, err := BuildPlan(stmt, ns.phyDBs, "db_ks", sql, ns.rt, grayRouter, ns.seqs, nil); err == nil {
+				t.Errorf("expect error, sql: %s", sql)
+			}
+		})
+	}
+}
+
+func TestDDLPlanExecuteInResume(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	sql := "alter table tbl_ks add column c int"
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	p, err := BuildPlan(stmt, ns.phyDBs, "db_ks", sql, ns.rt, nil, ns.seqs, nil)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	getStatus := func(e *ddlExecutor, resume bool) []any {
+		reqCtx := util.NewRequestContext()
+		reqCtx.SetDDLResume(resume)
+		r, err := p.ExecuteIn(reqCtx, e)
+		if err != nil {
+			t.Fatalf("ExecuteIn error: %v", err)
+		}
+		var status []any
+		for _, row := range r.Values {
+			status = append(status, row[3])
+		}
+		return status
+	}
+
+	// 第一次执行有一张物理表失败
+	progress := NewDDLProgress()
+	e := &ddlExecutor{progress: progress, failed: map[string]bool{"tbl_ks_0002": true}}
+	status := getStatus(e, false)
+	expect := []any{DDLStatusSuccess, DDLStatusSuccess, DDLStatusFailed, DDLStatusSuccess}
+	if !reflect.DeepEqual(status, expect) {
+		t.Errorf("status not equal, expect: %v, actual: %v", expect, status)
+	}
+
+	// 断点续做只执行失败的物理表
+	e = &ddlExecutor{progress: progress}
+	status = getStatus(e, true)
+	expect = []any{DDLStatusSkipped, DDLStatusSkipped, DDLStatusSuccess, DDLStatusSkipped}
+	if !reflect.DeepEqual(status, expect) {
+		t.Errorf("status not equal, expect: %v, actual: %v", expect, status)
+	}
+	if !reflect.DeepEqual(e.executed, []string{"tbl_ks_0002"}) {
+		t.Errorf("executed tables not equal, expect: [tbl_ks_0002], actual: %v", e.executed)
+	}
+
+	// 全部成功后删除执行进度, 再次执行时在所有物理表上执行
+	e = &ddlExecutor{progress: progress}
+	getStatus(e, true)
+	if len(e.executed) != 4 {
+		t.Errorf("executed tables count not equal, expect: 4, actual: %d", len(e.executed))
+	}
+}
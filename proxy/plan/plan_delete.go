@@ -86,6 +86,10 @@ func HandleDeletePlan(p *DeletePlan) error {
 		return fmt.Errorf("post handle global table error: %v", err)
 	}
 
+	if err := postHandleRouteHint(p.StmtInfo); err != nil {
+		return fmt.Errorf("handle route hint error: %v", err)
+	}
+
 	sqls, err := generateShardingSQLs(p.stmt, p.GetRouteResult(), p.router)
 	if err != nil {
 		return fmt.Errorf("generate sqls error: %v", err)
@@ -16,6 +16,7 @@ package plan
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/XiaoMi/Gaea/mysql"
 	"github.com/XiaoMi/Gaea/parser/ast"
@@ -37,13 +38,17 @@ type ExplainPlan struct {
 	sqls      map[string]map[string][]string
 }
 
-func buildExplainPlan(stmt *ast.ExplainStmt, phyDBs map[string]string, db, sql string, r *router.Router, seq *sequence.SequenceManager, hintPlan Plan) (*ExplainPlan, error) {
+func buildExplainPlan(stmt *ast.ExplainStmt, phyDBs map[string]string, db, sql string, r *router.Router, grayRouter *router.GrayRouter, seq *sequence.SequenceManager, hintPlan Plan) (Plan, error) {
 	stmtToExplain := stmt.Stmt
 	if _, ok := stmtToExplain.(*ast.ExplainStmt); ok {
 		return nil, fmt.Errorf("nested explain")
 	}
 
-	p, err := BuildPlan(stmtToExplain, phyDBs, db, sql, r, nil, seq, hintPlan)
+	if stmt.Analyze || strings.EqualFold(stmt.Format, ExplainFormatGaea) {
+		return buildGaeaExplainPlan(stmt, phyDBs, db, r, grayRouter, seq, hintPlan)
+	}
+
+	p, err := BuildPlan(stmtToExplain, phyDBs, db, sql, r, grayRouter, seq, hintPlan)
 	if err != nil {
 		return nil, fmt.Errorf("build plan to explain error: %v", err)
 	}
@@ -0,0 +1,494 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/opcode"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/proxy/sequence"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// ExplainFormatGaea EXPLAIN FORMAT=GAEA, 输出Gaea的路由决策, 改写后的SQL和后端的EXPLAIN结果
+const ExplainFormatGaea = "gaea"
+
+// EXPLAIN FORMAT=GAEA结果集中每一行的类型
+const (
+	explainStepRoute   = "route"   // 路由决策
+	explainStepPrune   = "prune"   // WHERE中计算路由的条件及其命中的分表
+	explainStepSQL     = "sql"     // 改写后在每张物理表上执行的SQL
+	explainStepRuntime = "runtime" // 依赖其他SQL的结果, 执行时才能生成的SQL
+	explainStepBackend = "backend" // 后端对改写后SQL的EXPLAIN
+	explainStepExecute = "execute" // ANALYZE时每条分片SQL的耗时和行数
+	explainStepMerge   = "merge"   // ANALYZE时Gaea合并结果的耗时
+)
+
+var gaeaExplainColumns = []string{"step", "plan", "slice", "db", "table", "sql", "detail"}
+
+// GaeaExplainPlan EXPLAIN FORMAT=GAEA和EXPLAIN ANALYZE的执行计划, 支持所有类型的执行计划.
+// ANALYZE只支持SELECT, 会实际执行语句, 为了分别计时, 各分片的SQL依次执行.
+type GaeaExplainPlan struct {
+	basePlan
+
+	analyze bool
+	phyDBs  map[string]string
+	plan    Plan           // 被EXPLAIN的语句的执行计划
+	steps   []*explainStep // 生成计划时就能确定的路由和SQL
+}
+
+type explainStep struct {
+	step   string
+	plan   string // 所属的执行计划, 嵌套的执行计划用/分隔
+	slice  string
+	db     string // 物理库名
+	table  string
+	sql    string
+	detail string
+
+	execDB string // 执行SQL时传给Executor的库名
+}
+
+func (s *explainStep) row() []any {
+	return []any{s.step, s.plan, s.slice, s.db, s.table, s.sql, s.detail}
+}
+
+func buildGaeaExplainPlan(stmt *ast.ExplainStmt, phyDBs map[string]string, db string, r *router.Router, grayRouter *router.GrayRouter, seq *sequence.SequenceManager, hintPlan Plan) (*GaeaExplainPlan, error) {
+	if stmt.Analyze {
+		switch stmt.Stmt.(type) {
+		case *ast.SelectStmt, *ast.UnionStmt:
+		default:
+			return nil, fmt.Errorf("EXPLAIN ANALYZE only supports SELECT")
+		}
+	}
+
+	sql, err := generateUnshardingSQL(stmt.Stmt)
+	if err != nil {
+		return nil, err
+	}
+	// 生成执行计划会改写语法树, 计算各条件的路由时使用重新解析得到的原始语法树
+	origin, err := parser.ParseSQL(sql)
+	if err != nil {
+		return nil, fmt.Errorf("parse sql to explain error: %v", err)
+	}
+	p, err := BuildPlan(stmt.Stmt, phyDBs, db, sql, r, grayRouter, seq, hintPlan)
+	if err != nil {
+		return nil, fmt.Errorf("build plan to explain error: %v", err)
+	}
+
+	d := &explainDescriber{
+		router:       r,
+		phyDBs:       phyDBs,
+		defaultSlice: r.GetDefaultRule().GetSlice(0),
+	}
+	if err := d.describe("main", p, origin); err != nil {
+		return nil, err
+	}
+	return &GaeaExplainPlan{analyze: stmt.Analyze, phyDBs: phyDBs, plan: p, steps: d.steps}, nil
+}
+
+// explainDescriber 遍历执行计划, 生成路由决策和改写后的SQL
+type explainDescriber struct {
+	router       *router.Router
+	phyDBs       map[string]string
+	defaultSlice string
+	steps        []*explainStep
+}
+
+func (d *explainDescriber) add(step *explainStep) {
+	d.steps = append(d.steps, step)
+}
+
+func (d *explainDescriber) physicalDB(db string) string {
+	return explainPhysicalDB(d.phyDBs, db)
+}
+
+// 分片SQL中kingshard分片为逻辑库名, mycat分片为物理库名
+func explainPhysicalDB(phyDBs map[string]string, db string) string {
+	if phyDB, ok := phyDBs[db]; ok {
+		return phyDB
+	}
+	return db
+}
+
+// describe origin为生成执行计划前的语法树, 不能确定对应关系时为nil
+func (d *explainDescriber) describe(label string, p Plan, origin ast.StmtNode) error {
+	planType := strings.TrimPrefix(fmt.Sprintf("%T", p), "*plan.")
+	switch x := p.(type) {
+	case *SelectPlan:
+		var where ast.ExprNode
+		if s, ok := origin.(*ast.SelectStmt); ok {
+			where = s.Where
+		}
+		return d.describeShardPlan(label, planType, x.TableAliasStmtInfo, where, x.sqls)
+	case *UpdatePlan:
+		var where ast.ExprNode
+		if s, ok := origin.(*ast.UpdateStmt); ok {
+			where = s.Where
+		}
+		return d.describeShardPlan(label, planType, x.TableAliasStmtInfo, where, x.sqls)
+	case *DeletePlan:
+		var where ast.ExprNode
+		if s, ok := origin.(*ast.DeleteStmt); ok {
+			where = s.Where
+		}
+		return d.describeShardPlan(label, planType, x.TableAliasStmtInfo, where, x.sqls)
+	case *InsertPlan:
+		d.describeRoute(label, planType, x.StmtInfo)
+		d.describeSQLs(label, x.StmtInfo, x.sqls)
+		return nil
+	case *UnshardPlan:
+		d.add(&explainStep{step: explainStepRoute, plan: label, slice: d.defaultSlice, detail: fmt.Sprintf("plan: %s, no shard table, execute on default slice", planType)})
+		d.add(&explainStep{step: explainStepSQL, plan: label, slice: d.defaultSlice, db: d.physicalDB(x.db), sql: x.sql, execDB: x.db})
+		return nil
+	case *UnionPlan:
+		detail := fmt.Sprintf("plan: %s, %d selects merged by Gaea", planType, len(x.selectPlans))
+		d.add(&explainStep{step: explainStepRoute, plan: label, detail: detail + describeMerge(x.orderByItems != nil, x.offset, x.count)})
+		var selects []*ast.SelectStmt
+		if s, ok := origin.(*ast.UnionStmt); ok && s.SelectList != nil && len(s.SelectList.Selects) == len(x.selectPlans) {
+			selects = s.SelectList.Selects
+		}
+		for i, sp := range x.selectPlans {
+			var o ast.StmtNode
+			if selects != nil {
+				o = selects[i]
+			}
+			if err := d.describe(fmt.Sprintf("%s/union[%d]", label, i), sp, o); err != nil {
+				return err
+			}
+		}
+		return nil
+	case *JoinPlan:
+		driver, inner := x.sides[x.driver], x.sides[1-x.driver]
+		detail := fmt.Sprintf("plan: %s, driver table: %s, inner table: %s, hash join by Gaea", planType, driver.tableSQL, inner.tableSQL)
+		d.add(&explainStep{step: explainStepRoute, plan: label, detail: detail + describeMerge(x.orderByItems != nil, x.offset, x.count)})
+		if err := d.describe(label+"/driver", x.driverPlan, nil); err != nil {
+			return err
+		}
+		d.add(&explainStep{step: explainStepRuntime, plan: label + "/inner", table: inner.table, sql: describeJoinInnerSQL(inner),
+			detail: "join keys of driver table are pushed down in batches of 500"})
+		return nil
+	case *SubqueryPlan:
+		d.add(&explainStep{step: explainStepRoute, plan: label, detail: fmt.Sprintf("plan: %s, %d subqueries are executed first", planType, len(x.subqueryPlans))})
+		for i, sp := range x.subqueryPlans {
+			if err := d.describe(fmt.Sprintf("%s/subquery[%d]", label, i), sp, nil); err != nil {
+				return err
+			}
+		}
+		d.add(&explainStep{step: explainStepRuntime, plan: label + "/outer", sql: x.sql,
+			detail: "subqueries are replaced by their results, then the route is calculated"})
+		return nil
+	case *InsertSelectPlan:
+		d.add(&explainStep{step: explainStepRoute, plan: label, table: x.table.Name.O, detail: fmt.Sprintf("plan: %s, rows of select are inserted by Gaea", planType)})
+		if x.selectPlan != nil {
+			if err := d.describe(label+"/select", x.selectPlan, nil); err != nil {
+				return err
+			}
+		}
+		d.add(&explainStep{step: explainStepRuntime, plan: label + "/insert", table: x.table.Name.O,
+			detail: "rows are routed by the rule of target table and inserted in batches of 500"})
+		return nil
+	case *UpdateShardKeyPlan:
+		d.add(&explainStep{step: explainStepRoute, plan: label, table: x.table.Name.O, detail: fmt.Sprintf("plan: %s, rows are moved to new shards", planType)})
+		if err := d.describe(label+"/select", x.selectPlan, nil); err != nil {
+			return err
+		}
+		if err := d.describe(label+"/delete", x.deletePlan, nil); err != nil {
+			return err
+		}
+		d.add(&explainStep{step: explainStepRuntime, plan: label + "/insert", table: x.table.Name.O,
+			detail: "locked rows are inserted by the new value of shard column"})
+		return nil
+	default:
+		d.add(&explainStep{step: explainStepRoute, plan: label, detail: fmt.Sprintf("plan: %s, executed by Gaea", planType)})
+		return nil
+	}
+}
+
+func (d *explainDescriber) describeShardPlan(label, planType string, info *TableAliasStmtInfo, where ast.ExprNode, sqls map[string]map[string][]string) error {
+	d.describeRoute(label, planType, info.StmtInfo)
+	if where != nil {
+		if err := d.describePrune(label, info, where); err != nil {
+			return err
+		}
+	}
+	d.describeSQLs(label, info.StmtInfo, sqls)
+	return nil
+}
+
+func (d *explainDescriber) describeRoute(label, planType string, info *StmtInfo) {
+	step := &explainStep{step: explainStepRoute, plan: label, detail: "plan: " + planType}
+	result := info.GetRouteResult()
+	if rule, ok := d.router.GetShardRule(result.db, result.table); ok {
+		indexes := result.GetShardIndexes()
+		step.table = result.db + "." + result.table
+		step.detail += fmt.Sprintf(", rule: %s", rule.GetType())
+		if column := rule.GetShardingColumn(); column != "" {
+			step.detail += ", shard key: " + column
+		}
+		step.detail += fmt.Sprintf(", tables: %d/%d %s", len(indexes), len(rule.GetSubTableIndexes()), formatTableIndexes(indexes))
+	}
+	d.add(step)
+}
+
+// describePrune 分别计算WHERE中每个条件的路由, 只输出能确定路由的条件.
+// 条件之间AND取交集, OR取并集, 最终的结果见route.
+func (d *explainDescriber) describePrune(label string, info *TableAliasStmtInfo, where ast.ExprNode) error {
+	for _, cond := range splitRouteConditions(where, nil) {
+		text, err := restoreNode(cond)
+		if err != nil {
+			return err
+		}
+		has, indexes, _, err := handleComparisonExpr(info, cond)
+		if err != nil {
+			return fmt.Errorf("calculate route of %s error: %v", text, err)
+		}
+		if !has {
+			continue
+		}
+		d.add(&explainStep{step: explainStepPrune, plan: label, detail: fmt.Sprintf("%s -> tables %s", text, formatTableIndexes(indexes))})
+	}
+	return nil
+}
+
+// splitRouteConditions 按AND, OR拆分条件
+func splitRouteConditions(expr ast.ExprNode, conds []ast.ExprNode) []ast.ExprNode {
+	switch x := expr.(type) {
+	case *ast.BinaryOperationExpr:
+		if x.Op == opcode.LogicAnd || x.Op == opcode.LogicOr {
+			conds = splitRouteConditions(x.L, conds)
+			return splitRouteConditions(x.R, conds)
+		}
+	case *ast.ParenthesesExpr:
+		return splitRouteConditions(x.Expr, conds)
+	}
+	return append(conds, expr)
+}
+
+// describeSQLs 输出每条分片SQL, 分片SQL按路由结果的顺序生成, 由此得到对应的物理表
+func (d *explainDescriber) describeSQLs(label string, info *StmtInfo, sqls map[string]map[string][]string) {
+	tables := make(map[string][]string) // key: slice/db
+	result := info.GetRouteResult()
+	if rule, ok := d.router.GetShardRule(result.db, result.table); ok {
+		for _, index := range result.GetShardIndexes() {
+			slice := rule.GetSlice(rule.GetSliceIndexFromTableIndex(index))
+			db, _ := rule.GetDatabaseNameByTableIndex(index)
+			key := slice + "/" + db
+			tables[key] = append(tables[key], getPhysicalTableName(rule, result.table, index))
+		}
+	}
+
+	for _, slice := range sortedKeys(sqls) {
+		for _, db := range sortedKeys(sqls[slice]) {
+			names := tables[slice+"/"+db]
+			for i, sql := range sqls[slice][db] {
+				step := &explainStep{step: explainStepSQL, plan: label, slice: slice, db: d.physicalDB(db), sql: sql, execDB: db}
+				if len(names) == len(sqls[slice][db]) {
+					step.table = names[i]
+				}
+				d.add(step)
+			}
+		}
+	}
+}
+
+func describeMerge(hasOrderBy bool, offset, count int64) string {
+	var s string
+	if hasOrderBy {
+		s += ", order by Gaea"
+	}
+	if count >= 0 {
+		s += fmt.Sprintf(", limit %d,%d by Gaea", offset, count)
+	}
+	return s
+}
+
+func describeJoinInnerSQL(s *joinSide) string {
+	fields := append(append([]string{}, s.fields...), s.keys...)
+	conditions := append([]string{}, s.conditions...)
+	for _, key := range s.keys {
+		conditions = append(conditions, key+" IN (...)")
+	}
+	return fmt.Sprintf("SELECT %s FROM %s WHERE (%s)", strings.Join(fields, ","), s.tableSQL, strings.Join(conditions, ") AND ("))
+}
+
+func formatTableIndexes(indexes []int) string {
+	s := make([]string, 0, len(indexes))
+	for _, index := range indexes {
+		s = append(s, fmt.Sprint(index))
+	}
+	return "[" + strings.Join(s, ",") + "]"
+}
+
+// ExecuteIn implement Plan
+func (p *GaeaExplainPlan) ExecuteIn(reqCtx *util.RequestContext, se Executor) (*mysql.Result, error) {
+	var rows [][]any
+	for _, step := range p.steps {
+		rows = append(rows, step.row())
+		if step.step != explainStepSQL {
+			continue
+		}
+		backend, err := explainInBackend(reqCtx, se, step)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, backend...)
+	}
+
+	if p.analyze {
+		analyzed, err := p.executeAndAnalyze(reqCtx, se)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, analyzed...)
+	}
+
+	r, err := mysql.BuildResultset(nil, gaeaExplainColumns, rows)
+	if err != nil {
+		return nil, fmt.Errorf("build explain result error: %v", err)
+	}
+	ret := mysql.ResultPool.Get()
+	ret.Resultset = r
+	return ret, nil
+}
+
+// explainInBackend 在后端执行EXPLAIN, 每一行转换为name=value的列表
+func explainInBackend(reqCtx *util.RequestContext, se Executor, step *explainStep) ([][]any, error) {
+	r, err := se.ExecuteSQL(reqCtx, step.slice, step.execDB, ExplainKey+" "+step.sql)
+	if err != nil {
+		return nil, fmt.Errorf("explain in backend error, slice: %s, db: %s, err: %v", step.slice, step.db, err)
+	}
+	if r == nil || r.Resultset == nil {
+		return nil, nil
+	}
+	rows := make([][]any, 0, len(r.Values))
+	for _, values := range r.Values {
+		items := make([]string, 0, len(values))
+		for i, v := range values {
+			if i < len(r.Fields) {
+				items = append(items, string(r.Fields[i].Name)+"="+explainValueString(v))
+			}
+		}
+		backend := &explainStep{step: explainStepBackend, plan: step.plan, slice: step.slice, db: step.db, table: step.table, detail: strings.Join(items, ", ")}
+		rows = append(rows, backend.row())
+	}
+	return rows, nil
+}
+
+// executeAndAnalyze 执行语句, 记录每条分片SQL的耗时和行数, 总耗时去掉后端的耗时即为Gaea合并结果的耗时
+func (p *GaeaExplainPlan) executeAndAnalyze(reqCtx *util.RequestContext, se Executor) ([][]any, error) {
+	ae := &analyzeExecutor{Executor: se, phyDBs: p.phyDBs}
+	start := time.Now()
+	r, err := p.plan.ExecuteIn(reqCtx, ae)
+	total := time.Since(start)
+	if err != nil {
+		return nil, fmt.Errorf("execute in EXPLAIN ANALYZE error: %v", err)
+	}
+
+	rows := make([][]any, 0, len(ae.steps)+1)
+	for _, step := range ae.steps {
+		rows = append(rows, step.row())
+	}
+	merge := &explainStep{
+		step:   explainStepMerge,
+		plan:   "main",
+		detail: fmt.Sprintf("rows: %d, merge time: %s, backend time: %s, total time: %s", resultRowCount(r), total-ae.backendTime, ae.backendTime, total),
+	}
+	rows = append(rows, merge.row())
+	return rows, nil
+}
+
+// analyzeExecutor 依次执行每条分片SQL并记录耗时和行数
+type analyzeExecutor struct {
+	Executor
+	phyDBs map[string]string
+
+	steps       []*explainStep
+	backendTime time.Duration
+}
+
+// ExecuteSQL implement Executor
+func (e *analyzeExecutor) ExecuteSQL(reqCtx *util.RequestContext, slice, db, sql string) (*mysql.Result, error) {
+	start := time.Now()
+	r, err := e.Executor.ExecuteSQL(reqCtx, slice, db, sql)
+	if err != nil {
+		return nil, err
+	}
+	e.record(slice, db, sql, r, time.Since(start))
+	return r, nil
+}
+
+// ExecuteSQLs implement Executor
+func (e *analyzeExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]*mysql.Result, error) {
+	if len(sqls) == 0 {
+		return e.Executor.ExecuteSQLs(reqCtx, sqls)
+	}
+	var rs []*mysql.Result
+	for _, slice := range sortedKeys(sqls) {
+		for _, db := range sortedKeys(sqls[slice]) {
+			for _, sql := range sqls[slice][db] {
+				start := time.Now()
+				ret, err := e.Executor.ExecuteSQLs(reqCtx, map[string]map[string][]string{slice: {db: {sql}}})
+				if err != nil {
+					return nil, err
+				}
+				cost := time.Since(start)
+				for _, r := range ret {
+					e.record(slice, db, sql, r, cost)
+				}
+				rs = append(rs, ret...)
+			}
+		}
+	}
+	return rs, nil
+}
+
+func (e *analyzeExecutor) record(slice, db, sql string, r *mysql.Result, cost time.Duration) {
+	e.backendTime += cost
+	e.steps = append(e.steps, &explainStep{
+		step:   explainStepExecute,
+		slice:  slice,
+		db:     explainPhysicalDB(e.phyDBs, db),
+		sql:    sql,
+		detail: fmt.Sprintf("rows: %d, time: %s", resultRowCount(r), cost),
+	})
+}
+
+func resultRowCount(r *mysql.Result) uint64 {
+	if r == nil {
+		return 0
+	}
+	if r.Resultset != nil {
+		return uint64(len(r.Values))
+	}
+	return r.AffectedRows
+}
+
+func explainValueString(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(x)
+	default:
+		return fmt.Sprint(x)
+	}
+}
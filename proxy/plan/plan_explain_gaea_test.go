@@ -0,0 +1,203 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// gaeaExplainExecutor 后端EXPLAIN返回explain, 其他SQL按分片和库返回预设的结果
+type gaeaExplainExecutor struct {
+	showExecutor
+	explain *mysql.Result
+}
+
+func (e *gaeaExplainExecutor) ExecuteSQL(ctx *util.RequestContext, slice, db, sql string) (*mysql.Result, error) {
+	if strings.HasPrefix(sql, ExplainKey+" ") {
+		e.executed = append(e.executed, slice+"/"+db+": "+sql)
+		return e.explain, nil
+	}
+	return e.showExecutor.ExecuteSQL(ctx, slice, db, sql)
+}
+
+func newGaeaExplainExecutor(results map[string]*mysql.Result) *gaeaExplainExecutor {
+	return &gaeaExplainExecutor{
+		showExecutor: showExecutor{results: results},
+		explain: createTestSelectResult([]string{"id", "select_type", "table", "type", "key", "rows"}, [][]any{
+			{int64(1), "SIMPLE", "t", "ALL", nil, int64(10)},
+		}),
+	}
+}
+
+func executeGaeaExplain(t *testing.T, db, sql string, e Executor) [][]string {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	p, err := BuildPlan(stmt, ns.phyDBs, db, sql, ns.rt, nil, ns.seqs, nil)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	if _, ok := p.(*GaeaExplainPlan); !ok {
+		t.Fatalf("expect GaeaExplainPlan, actual: %T", p)
+	}
+	r, err := p.ExecuteIn(util.NewRequestContext(), e)
+	if err != nil {
+		t.Fatalf("ExecuteIn error: %v", err)
+	}
+	if len(r.Fields) != len(gaeaExplainColumns) {
+		t.Fatalf("column count not equal, expect: %d, actual: %d", len(gaeaExplainColumns), len(r.Fields))
+	}
+	var rows [][]string
+	for _, row := range r.Values {
+		var values []string
+		for _, v := range row {
+			values = append(values, fmt.Sprint(v))
+		}
+		rows = append(rows, values)
+	}
+	return rows
+}
+
+func TestGaeaExplainShardSelect(t *testing.T) {
+	e := newGaeaExplainExecutor(nil)
+	rows := executeGaeaExplain(t, "db_ks", "explain format=gaea select * from tbl_ks where (id in (1, 3) or id = 5) and name = 'a'", e)
+	expect := [][]string{
+		{"route", "main", "", "", "db_ks.tbl_ks", "", "plan: SelectPlan, rule: mod, shard key: id, tables: 2/4 [1,3]"},
+		{"prune", "main", "", "", "", "", "`id` IN (1,3) -> tables [1,3]"},
+		{"prune", "main", "", "", "", "", "`id`=5 -> tables [1]"},
+		{"sql", "main", "slice-0", "db_ks", "tbl_ks_0001", "SELECT * FROM `tbl_ks_0001` WHERE (`id` IN (1) OR `id`=5) AND `name`='a'", ""},
+		{"backend", "main", "slice-0", "db_ks", "tbl_ks_0001", "", "id=1, select_type=SIMPLE, table=t, type=ALL, key=NULL, rows=10"},
+		{"sql", "main", "slice-1", "db_ks", "tbl_ks_0003", "SELECT * FROM `tbl_ks_0003` WHERE (`id` IN (3) OR `id`=5) AND `name`='a'", ""},
+		{"backend", "main", "slice-1", "db_ks", "tbl_ks_0003", "", "id=1, select_type=SIMPLE, table=t, type=ALL, key=NULL, rows=10"},
+	}
+	if fmt.Sprintf("%q", rows) != fmt.Sprintf("%q", expect) {
+		t.Errorf("rows not equal\nexpect: %q\nactual: %q", expect, rows)
+	}
+	expectExecuted := []string{
+		"slice-0/db_ks: explain SELECT * FROM `tbl_ks_0001` WHERE (`id` IN (1) OR `id`=5) AND `name`='a'",
+		"slice-1/db_ks: explain SELECT * FROM `tbl_ks_0003` WHERE (`id` IN (3) OR `id`=5) AND `name`='a'",
+	}
+	if fmt.Sprint(e.executed) != fmt.Sprint(expectExecuted) {
+		t.Errorf("executed sql not equal\nexpect: %v\nactual: %v", expectExecuted, e.executed)
+	}
+}
+
+func TestGaeaExplainOtherPlans(t *testing.T) {
+	tests := []struct {
+		db     string
+		sql    string
+		expect []string // 每一行的step, plan和detail的前缀
+	}{
+		{
+			db:  "db_mycat",
+			sql: "explain format = 'GAEA' select id from tbl_unshard union all select id from tbl_mycat where id = 2 order by id limit 10",
+			expect: []string{
+				"route main plan: UnionPlan, 2 selects merged by Gaea, order by Gaea, limit 0,10 by Gaea",
+				"route main/union[0] plan: UnshardPlan, no shard table",
+				"sql main/union[0] ",
+				"backend main/union[0] id=1",
+				"route main/union[1] plan: SelectPlan, rule: mycat_mod, shard key: id, tables: 1/4 [2]",
+				"prune main/union[1] `id`=2 -> tables [2]",
+				"sql main/union[1] ",
+				"backend main/union[1] id=1",
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "explain format = gaea delete from tbl_mycat where id in (0, 1)",
+			expect: []string{
+				"route main plan: DeletePlan, rule: mycat_mod, shard key: id, tables: 2/4 [0,1]",
+				"prune main `id` IN (0,1) -> tables [0,1]",
+				"sql main ",
+				"backend main id=1",
+				"sql main ",
+				"backend main id=1",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			rows := executeGaeaExplain(t, test.db, test.sql, newGaeaExplainExecutor(nil))
+			if len(rows) != len(test.expect) {
+				t.Fatalf("row count not equal, expect: %d, actual: %d, rows: %q", len(test.expect), len(rows), rows)
+			}
+			for i, row := range rows {
+				actual := row[0] + " " + row[1] + " " + row[6]
+				if !strings.HasPrefix(actual, test.expect[i]) {
+					t.Errorf("row %d not match, expect prefix: %s, actual: %s", i, test.expect[i], actual)
+				}
+			}
+		})
+	}
+}
+
+func TestGaeaExplainAnalyze(t *testing.T) {
+	e := newGaeaExplainExecutor(map[string]*mysql.Result{
+		"slice-0/db_ks": createTestSelectResult([]string{"id"}, [][]any{{int64(1)}, {int64(5)}}),
+		"slice-1/db_ks": createTestSelectResult([]string{"id"}, [][]any{{int64(3)}}),
+	})
+	rows := executeGaeaExplain(t, "db_ks", "explain analyze select id from tbl_ks where id in (1, 3, 5)", e)
+
+	var executes, merges [][]string
+	for _, row := range rows {
+		switch row[0] {
+		case explainStepExecute:
+			executes = append(executes, row)
+		case explainStepMerge:
+			merges = append(merges, row)
+		}
+	}
+	if len(executes) != 2 {
+		t.Fatalf("execute row count not equal, expect: 2, actual: %d, rows: %q", len(executes), rows)
+	}
+	if executes[0][2] != "slice-0" || executes[0][5] != "SELECT `id` FROM `tbl_ks_0001` WHERE `id` IN (1,5)" || !strings.HasPrefix(executes[0][6], "rows: 2, time: ") {
+		t.Errorf("execute row of slice-0 not match: %q", executes[0])
+	}
+	if executes[1][2] != "slice-1" || !strings.HasPrefix(executes[1][6], "rows: 1, time: ") {
+		t.Errorf("execute row of slice-1 not match: %q", executes[1])
+	}
+	if len(merges) != 1 || !strings.HasPrefix(merges[0][6], "rows: 3, merge time: ") {
+		t.Errorf("merge row not match: %q", merges)
+	}
+	if rows[len(rows)-1][0] != explainStepMerge {
+		t.Errorf("merge row should be the last row")
+	}
+}
+
+func TestGaeaExplainAnalyzeNotSelect(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	sql := "explain analyze delete from tbl_ks where id = 1"
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	if _, err := BuildPlan(stmt, ns.phyDBs, "db_ks", sql, ns.rt, nil, ns.seqs, nil); err == nil {
+		t.Errorf("expect error of EXPLAIN ANALYZE DELETE")
+	}
+}
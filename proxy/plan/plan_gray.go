@@ -0,0 +1,196 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/opcode"
+	"github.com/XiaoMi/Gaea/proxy/router"
+)
+
+// addGrayCondition 把灰度条件AND到原有的WHERE条件上, 原条件加括号避免OR的优先级问题
+func addGrayCondition(where ast.ExprNode, expr ast.ExprNode) ast.ExprNode {
+	if where == nil {
+		return expr
+	}
+	return &ast.BinaryOperationExpr{
+		L:  &ast.ParenthesesExpr{Expr: where},
+		R:  expr,
+		Op: opcode.LogicAnd,
+	}
+}
+
+// buildGrayInsert 写入灰度表时检查每一行的灰度列是否在灰度范围内, 不在范围内的行写入后对灰度流量不可见, 直接返回错误.
+// 从灰度表读取数据写入其他表时, 在SELECT中加上灰度条件.
+func buildGrayInsert(stmt *ast.InsertStmt, rule *router.GrayRule) error {
+	if !isGrayInsertTarget(stmt, rule) {
+		sel, ok := stmt.Select.(*ast.SelectStmt)
+		if !ok {
+			return nil
+		}
+		tav := newTableAliasVistor()
+		sel.Accept(tav)
+		expr, err := generateGrayExpression(rule, tav.GetTableAlias())
+		if err != nil {
+			return fmt.Errorf("generate gray compression error: %v", err)
+		}
+		sel.Where = addGrayCondition(sel.Where, expr)
+		return nil
+	}
+
+	// REPLACE和ON DUPLICATE KEY UPDATE可能删除或修改灰度范围之外的冲突行
+	if stmt.IsReplace {
+		return fmt.Errorf("REPLACE into gray table %s is not supported", rule.Table)
+	}
+	if len(stmt.OnDuplicate) != 0 {
+		return fmt.Errorf("INSERT ... ON DUPLICATE KEY UPDATE into gray table %s is not supported", rule.Table)
+	}
+	if stmt.Select != nil {
+		return fmt.Errorf("INSERT ... SELECT into gray table %s is not supported", rule.Table)
+	}
+
+	if len(stmt.Setlist) != 0 {
+		for _, a := range stmt.Setlist {
+			if strings.EqualFold(a.Column.Name.O, rule.GrayColumn) {
+				return checkGrayValue(rule, a.Expr)
+			}
+		}
+		return fmt.Errorf("gray column %s of table %s must be set in INSERT", rule.GrayColumn, rule.Table)
+	}
+
+	if len(stmt.Columns) == 0 {
+		return fmt.Errorf("INSERT into gray table %s must specify column list", rule.Table)
+	}
+	columnIndex := -1
+	for i, c := range stmt.Columns {
+		if strings.EqualFold(c.Name.O, rule.GrayColumn) {
+			columnIndex = i
+			break
+		}
+	}
+	if columnIndex == -1 {
+		return fmt.Errorf("gray column %s of table %s must be set in INSERT", rule.GrayColumn, rule.Table)
+	}
+	for i, row := range stmt.Lists {
+		if columnIndex >= len(row) {
+			return fmt.Errorf("column count doesn't match value count at row %d", i+1)
+		}
+		if err := checkGrayValue(rule, row[columnIndex]); err != nil {
+			return fmt.Errorf("row %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func isGrayInsertTarget(stmt *ast.InsertStmt, rule *router.GrayRule) bool {
+	if stmt.Table == nil || stmt.Table.TableRefs == nil {
+		return false
+	}
+	ts, ok := stmt.Table.TableRefs.Left.(*ast.TableSource)
+	if !ok {
+		return false
+	}
+	tn, ok := ts.Source.(*ast.TableName)
+	if !ok {
+		return false
+	}
+	return tn.Name.L == rule.Table
+}
+
+// checkGrayAssignments UPDATE修改灰度列时, 新值必须是灰度范围内的常量
+func checkGrayAssignments(rule *router.GrayRule, list []*ast.Assignment, alias map[string]string) error {
+	for _, a := range list {
+		if !strings.EqualFold(a.Column.Name.O, rule.GrayColumn) {
+			continue
+		}
+		// 多表UPDATE时, 只检查灰度表的列, 不带表名的列无法区分, 也需要检查
+		if table := a.Column.Table.L; table != "" && table != rule.Table && table != strings.ToLower(alias[rule.Table]) {
+			continue
+		}
+		if err := checkGrayValue(rule, a.Expr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkGrayValue 检查灰度列的值是否在灰度范围内
+func checkGrayValue(rule *router.GrayRule, expr ast.ExprNode) error {
+	v, ok := grayConstValue(expr)
+	if !ok {
+		return fmt.Errorf("value of gray column %s of table %s must be a constant", rule.GrayColumn, rule.Table)
+	}
+	if !inGraySet(rule, v) {
+		return fmt.Errorf("value %v of gray column %s is out of gray rule of table %s", v, rule.GrayColumn, rule.Table)
+	}
+	return nil
+}
+
+// grayConstValue 取常量的值, 转换方式与HAVING计算相同
+func grayConstValue(expr ast.ExprNode) (any, bool) {
+	switch x := expr.(type) {
+	case ast.ValueExpr:
+		return toHavingValue(x.GetValue()), true
+	case *ast.ParenthesesExpr:
+		return grayConstValue(x.Expr)
+	case *ast.UnaryOperationExpr:
+		v, ok := grayConstValue(x.V)
+		if !ok || v == nil {
+			return v, ok
+		}
+		switch x.Op {
+		case opcode.Minus:
+			return havingDecimal(v).Neg(), true
+		case opcode.Plus:
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// inGraySet 与生成的灰度条件语义一致, NULL既不满足IN也不满足NOT IN
+func inGraySet(rule *router.GrayRule, v any) bool {
+	if v == nil {
+		return false
+	}
+	found := false
+	for _, w := range rule.GrayValues {
+		if grayValueEqual(v, toHavingValue(w)) {
+			found = true
+			break
+		}
+	}
+	if rule.Exclude {
+		return !found
+	}
+	return rule.Include && found
+}
+
+// 字符串按MySQL默认的大小写不敏感排序规则比较, 其他情况按数值比较
+func grayValueEqual(l, r any) bool {
+	if r == nil {
+		return false
+	}
+	ls, lok := l.(string)
+	rs, rok := r.(string)
+	if lok && rok {
+		return strings.EqualFold(ls, rs)
+	}
+	c, err := compareHavingValue(l, r)
+	return err == nil && c == 0
+}
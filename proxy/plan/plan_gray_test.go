@@ -0,0 +1,158 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"testing"
+
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/proxy/router"
+)
+
+func TestGrayPlan(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	grayRouter := router.NewGrayRouter(&models.Namespace{
+		GrayRules: []*models.GrayRule{
+			// 配置从json解析, 数值类型为float64, 生成的条件中为浮点数常量
+			{DB: "db_ks", Table: "tbl_gray", Column: "uid", Include: true, WhiteList: []any{float64(1), float64(2)}},
+			{DB: "db_ks", Table: "tbl_gray_ex", Column: "name", Exclude: true, WhiteList: []any{"a"}},
+		},
+	})
+
+	tests := []struct {
+		sql    string
+		expect string
+		hasErr bool
+	}{
+		{
+			sql:    "select * from tbl_gray where a = 1 or b = 2",
+			expect: "SELECT * FROM `tbl_gray` WHERE (`a`=1 OR `b`=2) AND `uid` IN (1e+00,2e+00)",
+		},
+		{
+			sql:    "update tbl_gray set a = 1 where b = 2",
+			expect: "UPDATE `tbl_gray` SET `a`=1 WHERE (`b`=2) AND `uid` IN (1e+00,2e+00)",
+		},
+		{
+			sql:    "update tbl_gray set a = 1",
+			expect: "UPDATE `tbl_gray` SET `a`=1 WHERE `uid` IN (1e+00,2e+00)",
+		},
+		{
+			sql:    "update tbl_gray t set t.uid = 2 where t.id = 3",
+			expect: "UPDATE `tbl_gray` AS `t` SET `t`.`uid`=2 WHERE (`t`.`id`=3) AND `t`.`uid` IN (1e+00,2e+00)",
+		},
+		{
+			// 不能把行更新到灰度范围之外
+			sql:    "update tbl_gray set uid = 3 where id = 1",
+			hasErr: true,
+		},
+		{
+			sql:    "update tbl_gray set uid = uid + 1",
+			hasErr: true,
+		},
+		{
+			sql:    "delete from tbl_gray where id > 10",
+			expect: "DELETE FROM `tbl_gray` WHERE (`id`>10) AND `uid` IN (1e+00,2e+00)",
+		},
+		{
+			sql:    "delete from tbl_gray_ex",
+			expect: "DELETE FROM `tbl_gray_ex` WHERE `name`!='a'",
+		},
+		{
+			sql:    "insert into tbl_gray (id, uid) values (1, 1), (2, '2')",
+			expect: "INSERT INTO `tbl_gray` (`id`,`uid`) VALUES (1,1),(2,'2')",
+		},
+		{
+			sql:    "insert into tbl_gray set id = 1, uid = 2",
+			expect: "INSERT INTO `tbl_gray` SET `id`=1,`uid`=2",
+		},
+		{
+			sql:    "insert into tbl_gray (id, uid) values (1, 1), (2, 3)",
+			hasErr: true,
+		},
+		{
+			sql:    "insert into tbl_gray (id, uid) values (1, -1)",
+			hasErr: true,
+		},
+		{
+			sql:    "insert into tbl_gray (id, uid) values (1, null)",
+			hasErr: true,
+		},
+		{
+			// 没有灰度列时无法判断
+			sql:    "insert into tbl_gray (id) values (1)",
+			hasErr: true,
+		},
+		{
+			sql:    "insert into tbl_gray values (1, 1)",
+			hasErr: true,
+		},
+		{
+			sql:    "replace into tbl_gray (id, uid) values (1, 1)",
+			hasErr: true,
+		},
+		{
+			sql:    "insert into tbl_gray (id, uid) values (1, 1) on duplicate key update a = 1",
+			hasErr: true,
+		},
+		{
+			sql:    "insert into tbl_gray (id, uid) select id, uid from tbl_other",
+			hasErr: true,
+		},
+		{
+			sql:    "insert into tbl_gray_ex (id, name) values (1, 'b')",
+			expect: "INSERT INTO `tbl_gray_ex` (`id`,`name`) VALUES (1,'b')",
+		},
+		{
+			// 排除名单中的字符串比较不区分大小写
+			sql:    "insert into tbl_gray_ex (id, name) values (1, 'A')",
+			hasErr: true,
+		},
+		{
+			// 从灰度表读取数据写入其他表
+			sql:    "insert into tbl_other (id) select id from tbl_gray where a = 1",
+			expect: "INSERT INTO `tbl_other` (`id`) SELECT `id` FROM `tbl_gray` WHERE (`a`=1) AND `uid` IN (1e+00,2e+00)",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, "db_ks", test.sql, ns.rt, grayRouter, ns.seqs, nil)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("build plan error: %v", err)
+			}
+			up, ok := p.(*UnshardPlan)
+			if !ok {
+				t.Fatalf("expect UnshardPlan, got %T", p)
+			}
+			if up.sql != test.expect {
+				t.Errorf("sql not equal, expect: %s, actual: %s", test.expect, up.sql)
+			}
+		})
+	}
+}
@@ -0,0 +1,408 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/model"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+const (
+	informationSchemaDB     = "information_schema"
+	informationSchemaTables = "tables"
+
+	// 合并同一个逻辑表的行时使用的补充列
+	informationSchemaKeySchema = "gaea_table_schema"
+	informationSchemaKeyName   = "gaea_table_name"
+)
+
+// information_schema.TABLES中的列, MySQL 5.7和8.0相同
+var informationSchemaTablesFields = []string{
+	"TABLE_CATALOG", "TABLE_SCHEMA", "TABLE_NAME", "TABLE_TYPE", "ENGINE", "VERSION", "ROW_FORMAT",
+	"TABLE_ROWS", "AVG_ROW_LENGTH", "DATA_LENGTH", "MAX_DATA_LENGTH", "INDEX_LENGTH", "DATA_FREE",
+	"AUTO_INCREMENT", "CREATE_TIME", "UPDATE_TIME", "CHECK_TIME", "TABLE_COLLATION", "CHECKSUM",
+	"CREATE_OPTIONS", "TABLE_COMMENT",
+}
+
+// InformationSchemaTablesPlan 有分片表的namespace中查询information_schema.TABLES.
+// information_schema.TABLES被替换为把物理库名和物理表名转换为逻辑名的派生表, 在默认分片和分片表所在的分片上执行,
+// 合并时同一个逻辑表的行数和大小相加, ORDER BY和LIMIT由Gaea处理.
+type InformationSchemaTablesPlan struct {
+	basePlan
+
+	sqls map[string]map[string][]string
+
+	keyColumns   bool // 是否补充了TABLE_SCHEMA和TABLE_NAME列, SELECT DISTINCT不补列, 按整行去重
+	orderByItems []*resultOrderByItem
+	offset       int64
+	count        int64 // -1表示没有LIMIT
+}
+
+// IsInformationSchemaTablesStmt 是否是只查询information_schema.TABLES一张表的SELECT
+func IsInformationSchemaTablesStmt(stmt ast.StmtNode) bool {
+	_, ok := getInformationSchemaTablesSource(stmt)
+	return ok
+}
+
+func getInformationSchemaTablesSource(stmt ast.StmtNode) (*ast.TableSource, bool) {
+	sel, ok := stmt.(*ast.SelectStmt)
+	if !ok || sel.From == nil || sel.From.TableRefs == nil || sel.From.TableRefs.Right != nil {
+		return nil, false
+	}
+	ts, ok := sel.From.TableRefs.Left.(*ast.TableSource)
+	if !ok {
+		return nil, false
+	}
+	tn, ok := ts.Source.(*ast.TableName)
+	if !ok || tn.Schema.L != informationSchemaDB || tn.Name.L != informationSchemaTables {
+		return nil, false
+	}
+	return ts, true
+}
+
+// BuildInformationSchemaTablesPlan 生成查询information_schema.TABLES的执行计划, 不支持聚合函数, GROUP BY和HAVING
+func BuildInformationSchemaTablesPlan(stmt ast.StmtNode, phyDBs map[string]string, db string, r *router.Router) (*InformationSchemaTablesPlan, error) {
+	ts, ok := getInformationSchemaTablesSource(stmt)
+	if !ok {
+		return nil, fmt.Errorf("not a query on information_schema.TABLES")
+	}
+	sel := stmt.(*ast.SelectStmt)
+	if sel.GroupBy != nil || sel.Having != nil {
+		return nil, fmt.Errorf("GROUP BY and HAVING on information_schema.TABLES is not supported")
+	}
+	for _, field := range sel.Fields.Fields {
+		if field.Expr == nil {
+			continue
+		}
+		detector := &aggregateFuncDetector{}
+		field.Expr.Accept(detector)
+		if detector.found {
+			return nil, fmt.Errorf("aggregate function on information_schema.TABLES is not supported")
+		}
+	}
+
+	p := &InformationSchemaTablesPlan{
+		sqls:       make(map[string]map[string][]string),
+		keyColumns: !sel.Distinct,
+		count:      -1,
+	}
+	if sel.OrderBy != nil {
+		items, err := getResultOrderByItems(sel.OrderBy)
+		if err != nil {
+			return nil, err
+		}
+		p.orderByItems = items
+	}
+	if sel.Limit != nil {
+		offset, count, err := getLimitValue(sel.Limit)
+		if err != nil {
+			return nil, err
+		}
+		p.offset, p.count = offset, count
+	}
+
+	views, err := buildInformationSchemaTablesViews(phyDBs, r)
+	if err != nil {
+		return nil, err
+	}
+
+	// 派生表中的库名是逻辑库名, DATABASE()在后端返回的是物理库名, 替换为当前的逻辑库
+	sel.Accept(&informationSchemaRewriter{db: db})
+	sel.OrderBy = nil
+	sel.Limit = nil
+	if p.keyColumns {
+		sel.Fields.Fields = append(sel.Fields.Fields,
+			&ast.SelectField{Expr: &ast.ColumnNameExpr{Name: &ast.ColumnName{Name: model.NewCIStr("TABLE_SCHEMA")}}, AsName: model.NewCIStr(informationSchemaKeySchema)},
+			&ast.SelectField{Expr: &ast.ColumnNameExpr{Name: &ast.ColumnName{Name: model.NewCIStr("TABLE_NAME")}}, AsName: model.NewCIStr(informationSchemaKeyName)},
+		)
+	}
+	if ts.AsName.L == "" {
+		ts.AsName = model.NewCIStr("TABLES")
+	}
+
+	for slice, view := range views {
+		ts.Source = view
+		sql, err := generateUnshardingSQL(sel)
+		if err != nil {
+			return nil, fmt.Errorf("generate sql error, slice: %s, err: %v", slice, err)
+		}
+		p.sqls[slice] = map[string][]string{informationSchemaDB: {sql}}
+	}
+	return p, nil
+}
+
+// buildInformationSchemaTablesViews 生成每个分片上代替information_schema.TABLES的派生表.
+// 默认分片返回namespace中的库中非分片表的物理表, 每个分片返回所在的分片表的物理表, 全局表只返回第一张.
+func buildInformationSchemaTablesViews(phyDBs map[string]string, r *router.Router) (map[string]*ast.SelectStmt, error) {
+	schemas := make(map[string]string)                  // key: 物理库名, value: 逻辑库名
+	names := make(map[string]map[string]bool)           // key: 逻辑库名.逻辑表名, value: 物理表名集合
+	allTables := make(map[string][]string)              // key: 物理库名, value: 所有分片上的物理表
+	shardDBs := make(map[string]bool)                   // 只有分片表的物理库, 如mycat分片的非默认库
+	sliceTables := make(map[string]map[string][]string) // key: 分片, 物理库名, value: 分片上的物理表
+
+	for db, phyDB := range phyDBs {
+		if db != phyDB {
+			schemas[phyDB] = db
+		}
+	}
+	for db, rules := range r.GetAllRules() {
+		for table, rule := range rules {
+			tables, err := getPhysicalTables(rule, phyDBs)
+			if err != nil {
+				return nil, err
+			}
+			for _, t := range tables {
+				if t.db != db {
+					schemas[t.db] = db
+				}
+				if t.db != phyDBs[db] {
+					shardDBs[t.db] = true
+				}
+				if t.table != table {
+					key := db + "." + table
+					if names[key] == nil {
+						names[key] = make(map[string]bool)
+					}
+					names[key][t.table] = true
+				}
+				allTables[t.db] = append(allTables[t.db], t.table)
+				if t.replica {
+					continue
+				}
+				if sliceTables[t.slice] == nil {
+					sliceTables[t.slice] = make(map[string][]string)
+				}
+				sliceTables[t.slice][t.db] = append(sliceTables[t.slice][t.db], t.table)
+			}
+		}
+	}
+
+	var phyDBList []string
+	for _, phyDB := range phyDBs {
+		if !shardDBs[phyDB] {
+			phyDBList = append(phyDBList, phyDB)
+		}
+	}
+	defaultSlice := r.GetDefaultRule().GetSlice(0)
+	if _, ok := sliceTables[defaultSlice]; !ok {
+		sliceTables[defaultSlice] = nil
+	}
+
+	schemaExpr := buildInformationSchemaSchemaExpr(schemas)
+	nameExpr := buildInformationSchemaNameExpr(names, schemaExpr)
+	views := make(map[string]*ast.SelectStmt, len(sliceTables))
+	for slice, tables := range sliceTables {
+		var conditions []string
+		if slice == defaultSlice {
+			// 分片表的物理表都由所在分片的条件返回
+			cond := "`TABLE_SCHEMA` IN (" + quoteStringList(uniqueSortedStrings(phyDBList)) + ")"
+			for _, phyDB := range sortedKeys(allTables) {
+				cond += fmt.Sprintf(" AND NOT (`TABLE_SCHEMA`='%s' AND `TABLE_NAME` IN (%s))", mysql.Escape(phyDB), quoteStringList(uniqueSortedStrings(allTables[phyDB])))
+			}
+			conditions = append(conditions, "("+cond+")")
+		}
+		for _, phyDB := range sortedKeys(tables) {
+			conditions = append(conditions, fmt.Sprintf("(`TABLE_SCHEMA`='%s' AND `TABLE_NAME` IN (%s))", mysql.Escape(phyDB), quoteStringList(uniqueSortedStrings(tables[phyDB]))))
+		}
+
+		var fields []string
+		for _, f := range informationSchemaTablesFields {
+			switch f {
+			case "TABLE_SCHEMA":
+				fields = append(fields, schemaExpr+" AS `TABLE_SCHEMA`")
+			case "TABLE_NAME":
+				fields = append(fields, nameExpr+" AS `TABLE_NAME`")
+			default:
+				fields = append(fields, "`"+f+"`")
+			}
+		}
+		sql := fmt.Sprintf("SELECT %s FROM `information_schema`.`TABLES` WHERE %s", strings.Join(fields, ","), strings.Join(conditions, " OR "))
+		stmt, err := parser.ParseSQL(sql)
+		if err != nil {
+			return nil, fmt.Errorf("parse information_schema view error: %v", err)
+		}
+		views[slice] = stmt.(*ast.SelectStmt)
+	}
+	return views, nil
+}
+
+func buildInformationSchemaSchemaExpr(schemas map[string]string) string {
+	if len(schemas) == 0 {
+		return "`TABLE_SCHEMA`"
+	}
+	b := &strings.Builder{}
+	b.WriteString("CASE `TABLE_SCHEMA`")
+	for _, phyDB := range sortedKeys(schemas) {
+		fmt.Fprintf(b, " WHEN '%s' THEN '%s'", mysql.Escape(phyDB), mysql.Escape(schemas[phyDB]))
+	}
+	b.WriteString(" ELSE `TABLE_SCHEMA` END")
+	return b.String()
+}
+
+// 物理表名与逻辑表名不同的分片表(kingshard), 物理表名替换为逻辑表名, 库名转换为逻辑库名后再比较
+func buildInformationSchemaNameExpr(names map[string]map[string]bool, schemaExpr string) string {
+	if len(names) == 0 {
+		return "`TABLE_NAME`"
+	}
+	b := &strings.Builder{}
+	b.WriteString("CASE")
+	for _, key := range sortedKeys(names) {
+		idx := strings.Index(key, ".")
+		db, table := key[:idx], key[idx+1:]
+		fmt.Fprintf(b, " WHEN (%s)='%s' AND `TABLE_NAME` IN (%s) THEN '%s'",
+			schemaExpr, mysql.Escape(db), quoteStringList(sortedKeys(names[key])), mysql.Escape(table))
+	}
+	b.WriteString(" ELSE `TABLE_NAME` END")
+	return b.String()
+}
+
+// informationSchemaRewriter 去掉列名中的information_schema库名, 并把DATABASE()替换为逻辑库名
+type informationSchemaRewriter struct {
+	db string
+}
+
+// Enter implement ast.Visitor
+func (v *informationSchemaRewriter) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if _, ok := n.(*ast.TableSource); ok {
+		return n, true
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *informationSchemaRewriter) Leave(n ast.Node) (node ast.Node, ok bool) {
+	switch x := n.(type) {
+	case *ast.ColumnName:
+		if x.Schema.L == informationSchemaDB {
+			x.Schema = model.CIStr{}
+		}
+	case *ast.FuncCallExpr:
+		if x.FnName.L == "database" || x.FnName.L == "schema" {
+			if v.db == "" {
+				return ast.NewValueExpr(nil), true
+			}
+			return ast.NewValueExpr(v.db), true
+		}
+	}
+	return n, true
+}
+
+// ExecuteIn implement Plan
+func (p *InformationSchemaTablesPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	rs, err := sess.ExecuteSQLs(reqCtx, p.sqls)
+	if err != nil {
+		return nil, fmt.Errorf("execute in InformationSchemaTablesPlan error: %v", err)
+	}
+	if len(rs) == 0 || rs[0] == nil || rs[0].Resultset == nil {
+		return nil, fmt.Errorf("no result set of information_schema.TABLES")
+	}
+	return p.merge(rs)
+}
+
+func (p *InformationSchemaTablesPlan) merge(rs []*mysql.Result) (*mysql.Result, error) {
+	ret := mysql.ResultPool.Get()
+	ret.Resultset = &mysql.Resultset{
+		Fields:     rs[0].Fields,
+		FieldNames: rs[0].FieldNames,
+	}
+	columnCount := len(ret.Fields)
+	if p.keyColumns {
+		columnCount -= 2
+	}
+	m := newTableStatusMerger(ret.Fields[:columnCount], informationSchemaTablesColumns)
+
+	rows := make(map[string][]any)
+	merged := make(map[string]bool)
+	for _, r := range rs {
+		ret.Status |= r.Status
+		for _, row := range r.Values {
+			if len(row) != len(ret.Fields) {
+				return nil, fmt.Errorf("column count of information_schema.TABLES not match, expect: %d, actual: %d", len(ret.Fields), len(row))
+			}
+			var key string
+			var err error
+			if p.keyColumns {
+				key, err = generateMapKey(row[columnCount:])
+			} else {
+				key, err = generateMapKey(row)
+			}
+			if err != nil {
+				return nil, err
+			}
+			dst, ok := rows[key]
+			if !ok {
+				row = append([]any(nil), row...)
+				rows[key] = row
+				ret.Values = append(ret.Values, row)
+				continue
+			}
+			if p.keyColumns {
+				m.merge(dst, row)
+				merged[key] = true
+			}
+		}
+	}
+	for key := range merged {
+		m.finish(rows[key])
+	}
+
+	sp, err := createResultMergePlan(ret, p.orderByItems, p.offset, p.count)
+	if err != nil {
+		return nil, err
+	}
+	if err := sortSelectResult(sp, nil, ret); err != nil {
+		return nil, fmt.Errorf("sort information_schema.TABLES result error: %v", err)
+	}
+	if err := limitSelectResult(sp, ret); err != nil {
+		return nil, fmt.Errorf("limit information_schema.TABLES result error: %v", err)
+	}
+
+	if p.keyColumns {
+		ret.Fields = ret.Fields[:columnCount]
+		ret.FieldNames = nil
+		for i := range ret.Values {
+			ret.Values[i] = ret.Values[i][:columnCount]
+		}
+	}
+	if err := GenerateSelectResultRowData(ret); err != nil {
+		return nil, fmt.Errorf("generate RowData error: %v", err)
+	}
+	return ret, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func uniqueSortedStrings(values []string) []string {
+	m := make(map[string]bool, len(values))
+	for _, v := range values {
+		m[v] = true
+	}
+	return sortedKeys(m)
+}
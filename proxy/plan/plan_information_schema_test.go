@@ -0,0 +1,135 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+func buildTestInformationSchemaTablesPlan(sql string) (*InformationSchemaTablesPlan, error) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		return nil, err
+	}
+	if !IsInformationSchemaTablesStmt(stmt) {
+		return nil, fmt.Errorf("not a query on information_schema.TABLES: %s", sql)
+	}
+	return BuildInformationSchemaTablesPlan(stmt, ns.phyDBs, "db_ks", ns.rt)
+}
+
+func TestIsInformationSchemaTablesStmt(t *testing.T) {
+	tests := []struct {
+		sql    string
+		expect bool
+	}{
+		{"select * from information_schema.tables", true},
+		{"select table_name from INFORMATION_SCHEMA.TABLES t where t.table_schema = 'db_ks'", true},
+		{"select * from information_schema.columns", false},
+		{"select * from information_schema.tables a join information_schema.tables b on a.table_name = b.table_name", false},
+		{"select * from tables", false},
+	}
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			if actual := IsInformationSchemaTablesStmt(stmt); actual != test.expect {
+				t.Errorf("expect: %v, actual: %v", test.expect, actual)
+			}
+		})
+	}
+}
+
+func TestBuildInformationSchemaTablesPlanError(t *testing.T) {
+	sqls := []string{
+		"select count(*) from information_schema.tables",
+		"select table_schema from information_schema.tables group by table_schema",
+		"select table_name from information_schema.tables order by length(table_name)",
+	}
+	for _, sql := range sqls {
+		t.Run(sql, func(t *testing.T) {
+			if _, err := buildTestInformationSchemaTablesPlan(sql); err == nil {
+				t.Errorf("expect error, sql: %s", sql)
+			}
+		})
+	}
+}
+
+func TestBuildInformationSchemaTablesPlan(t *testing.T) {
+	sql := "select table_name, table_rows from information_schema.tables where table_schema = database() order by table_rows desc limit 2"
+	p, err := buildTestInformationSchemaTablesPlan(sql)
+	if err != nil {
+		t.Fatalf("build plan error: %v", err)
+	}
+	if len(p.sqls) != 2 {
+		t.Fatalf("slice count not equal, expect: 2, actual: %d", len(p.sqls))
+	}
+
+	expects := map[string][]string{
+		"slice-0": {"THEN 'tbl_ks'", "`TABLE_SCHEMA` IN ('db_ks','db_mycat_0') AND !(", "`TABLE_SCHEMA`='db_mycat_1' AND"},
+		"slice-1": {"THEN 'tbl_ks'", "`TABLE_NAME` IN ('tbl_ks_0002','tbl_ks_0003',", "`TABLE_SCHEMA`='db_mycat_3' AND"},
+	}
+	for slice, contains := range expects {
+		sqls := p.sqls[slice][informationSchemaDB]
+		if len(sqls) != 1 {
+			t.Fatalf("sql count of %s not equal, expect: 1, actual: %d", slice, len(sqls))
+		}
+		if _, err := parser.ParseSQL(sqls[0]); err != nil {
+			t.Errorf("generated sql of %s is invalid: %v, sql: %s", slice, err, sqls[0])
+		}
+		for _, s := range append(contains, informationSchemaKeySchema, informationSchemaKeyName) {
+			if !strings.Contains(sqls[0], s) {
+				t.Errorf("sql of %s should contain %s, sql: %s", slice, s, sqls[0])
+			}
+		}
+		if strings.Contains(sqls[0], "LIMIT") || !strings.HasSuffix(sqls[0], "WHERE `table_schema`='db_ks'") {
+			t.Errorf("LIMIT should be removed and DATABASE() should be replaced, sql: %s", sqls[0])
+		}
+	}
+
+	names := []string{"TABLE_NAME", "TABLE_ROWS", informationSchemaKeySchema, informationSchemaKeyName}
+	e := &showExecutor{results: map[string]*mysql.Result{
+		"slice-0/information_schema": createTestSelectResult(names, [][]any{
+			{"tbl_ks", uint64(10), "db_ks", "tbl_ks"},
+			{"tbl_unshard", uint64(5), "db_ks", "tbl_unshard"},
+			{"tbl_other", uint64(1), "db_ks", "tbl_other"},
+		}),
+		"slice-1/information_schema": createTestSelectResult(names, [][]any{
+			{"tbl_ks", uint64(7), "db_ks", "tbl_ks"},
+		}),
+	}}
+	r, err := p.ExecuteIn(util.NewRequestContext(), e)
+	if err != nil {
+		t.Fatalf("ExecuteIn error: %v", err)
+	}
+	expect := [][]any{{"tbl_ks", uint64(17)}, {"tbl_unshard", uint64(5)}}
+	if fmt.Sprint(r.Values) != fmt.Sprint(expect) {
+		t.Errorf("values not equal, expect: %v, actual: %v", expect, r.Values)
+	}
+	if len(r.Fields) != 2 || len(r.RowDatas) != 2 {
+		t.Errorf("hidden columns should be removed, fields: %d, rows: %d", len(r.Fields), len(r.RowDatas))
+	}
+}
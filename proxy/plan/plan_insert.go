@@ -40,7 +40,8 @@ type InsertPlan struct {
 	isAssignmentMode    bool
 	shardingColumnIndex int
 
-	sequences *sequence.SequenceManager
+	sequences       *sequence.SequenceManager
+	firstSequenceID uint64 // 本条SQL生成的第一个全局序列号
 
 	sqls map[string]map[string][]string
 }
@@ -126,9 +127,10 @@ func precheckInsertStmt(p *InsertPlan) error {
 		return errors.ErrIRNoColumns
 	}
 
-	values := stmt.Lists[0]
-	if len(stmt.Columns) != len(values) {
-		return fmt.Errorf("column count doesn't match value count")
+	for _, values := range stmt.Lists {
+		if len(stmt.Columns) != len(values) {
+			return fmt.Errorf("column count doesn't match value count")
+		}
 	}
 
 	return nil
@@ -229,26 +231,15 @@ func removeSchemaAndTableInfoInColumnName(column *ast.ColumnName) {
 	column.Table.L = ""
 }
 
-// TODO: refactor
+// 按分片列的值计算每一行的路由, 同一个分表的行合并成一条INSERT, 跨分片的批量INSERT会拆分成每个分表一条SQL
 func handleInsertValues(p *InsertPlan) error {
 	// assignment mode
 	if p.isAssignmentMode {
-		valueItem := p.stmt.Setlist[p.shardingColumnIndex].Expr
-		switch x := valueItem.(type) {
-		case *driver.ValueExpr:
-			v, err := util.GetValueExprResult(x)
-			if err != nil {
-				return fmt.Errorf("get value expr result failed, %v", err)
-			}
-			if v == nil {
-				return fmt.Errorf("sharding value cannot be null")
-			}
-			routeIdx, err := p.tableRules[p.table].FindTableIndex(v)
-			if err != nil {
-				return fmt.Errorf("find table index error: %v", err)
-			}
-			p.result.Inter([]int{routeIdx})
+		routeIdx, err := findInsertValueTableIndex(p, p.stmt.Setlist[p.shardingColumnIndex].Expr)
+		if err != nil {
+			return err
 		}
+		p.result.Inter([]int{routeIdx})
 		p.rewriteStmts = append(p.rewriteStmts, p.stmt)
 		return nil
 	}
@@ -257,30 +248,19 @@ func handleInsertValues(p *InsertPlan) error {
 	routeIdxs := make([]int, 0, len(p.result.indexes))
 	newStmtMap := make(map[int]*ast.InsertStmt)
 	for _, valueList := range p.stmt.Lists {
-		valueItem := valueList[p.shardingColumnIndex]
-		switch x := valueItem.(type) {
-		case *driver.ValueExpr:
-			v, err := util.GetValueExprResult(x)
-			if err != nil {
-				return fmt.Errorf("get value expr result failed, %v", err)
-			}
-			if v == nil {
-				return fmt.Errorf("sharding value cannot be null")
-			}
-			routeIdx, err := p.tableRules[p.table].FindTableIndex(v)
-			if newStmt, ok := newStmtMap[routeIdx]; ok {
-				newStmt.Lists = append(newStmt.Lists, valueList)
-			} else {
-				newStmt := *p.stmt
-				newStmt.Lists = [][]ast.ExprNode{valueList}
-				routeIdxs = append(routeIdxs, routeIdx)
-				p.rewriteStmts = append(p.rewriteStmts, &newStmt)
-				newStmtMap[routeIdx] = &newStmt
-			}
-			if err != nil {
-				return fmt.Errorf("find table index error: %v", err)
-			}
+		routeIdx, err := findInsertValueTableIndex(p, valueList[p.shardingColumnIndex])
+		if err != nil {
+			return err
+		}
+		if newStmt, ok := newStmtMap[routeIdx]; ok {
+			newStmt.Lists = append(newStmt.Lists, valueList)
+			continue
 		}
+		newStmt := *p.stmt
+		newStmt.Lists = [][]ast.ExprNode{valueList}
+		routeIdxs = append(routeIdxs, routeIdx)
+		p.rewriteStmts = append(p.rewriteStmts, &newStmt)
+		newStmtMap[routeIdx] = &newStmt
 	}
 
 	p.result.indexes = routeIdxs
@@ -288,6 +268,26 @@ func handleInsertValues(p *InsertPlan) error {
 	return nil
 }
 
+// 根据分片列的值计算分表索引, 分片列的值必须是常量, 否则无法计算路由
+func findInsertValueTableIndex(p *InsertPlan, valueItem ast.ExprNode) (int, error) {
+	x, ok := valueItem.(*driver.ValueExpr)
+	if !ok {
+		return -1, fmt.Errorf("sharding value must be a constant, type: %T", valueItem)
+	}
+	v, err := util.GetValueExprResult(x)
+	if err != nil {
+		return -1, fmt.Errorf("get value expr result failed, %v", err)
+	}
+	if v == nil {
+		return -1, fmt.Errorf("sharding value cannot be null")
+	}
+	routeIdx, err := p.tableRules[p.table].FindTableIndex(v)
+	if err != nil {
+		return -1, fmt.Errorf("find table index error: %v", err)
+	}
+	return routeIdx, nil
+}
+
 // check on duplicate key
 // 不管分片表的配置信息, 只要在OnDuplicate出现分片列, 就返回错误
 // 去掉ColumnName中的DB名和表名
@@ -327,6 +327,7 @@ func handleInsertGlobalSequenceValue(p *InsertPlan) error {
 							return fmt.Errorf("get next seq error: %v", err)
 						}
 						assignment.Expr = ast.NewValueExpr(id)
+						p.firstSequenceID = uint64(id)
 						break
 					}
 				}
@@ -379,6 +380,9 @@ func handleInsertGlobalSequenceValue(p *InsertPlan) error {
 				return fmt.Errorf("get next seq error: %v", err)
 			}
 			valueList[seqIndex] = ast.NewValueExpr(id)
+			if p.firstSequenceID == 0 {
+				p.firstSequenceID = uint64(id)
+			}
 		}
 
 	}
@@ -398,6 +402,12 @@ func (s *InsertPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mys
 		return nil, err
 	}
 
+	// 与MySQL自增列语义一致, 使用全局序列号时LAST_INSERT_ID为本条SQL生成的第一个序列号,
+	// 否则为各分片返回的自增ID中最小的一个
+	if s.firstSequenceID != 0 {
+		r.InsertID = s.firstSequenceID
+	}
+
 	if r.InsertID != 0 {
 		sess.SetLastInsertID(r.InsertID)
 	}
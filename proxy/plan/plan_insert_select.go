@@ -0,0 +1,665 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/XiaoMi/Gaea/core/errors"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/tidb-types"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/proxy/sequence"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// 不能下推的INSERT ... SELECT, 每批插入的最大行数
+const insertSelectBatchSize = 500
+
+// InsertSelectPlan is the plan for INSERT ... SELECT which can not be pushed down to backend.
+// SELECT的结果由Gaea读取后, 按目标表的分片规则分批重新插入.
+type InsertSelectPlan struct {
+	basePlan
+
+	db        string
+	sql       string
+	phyDBs    map[string]string
+	router    *router.Router
+	sequences *sequence.SequenceManager
+
+	stmt        *ast.InsertStmt
+	table       *ast.TableName // 目标表
+	isShard     bool           // 目标表是否为分片表
+	readsTarget bool           // SELECT是否读取了目标表, 读取时需要先取出全部结果再插入
+	selectPlan  Plan
+}
+
+// NewInsertSelectPlan constructor of InsertSelectPlan
+func NewInsertSelectPlan(db string, sql string, phyDBs map[string]string, r *router.Router, seq *sequence.SequenceManager) *InsertSelectPlan {
+	return &InsertSelectPlan{
+		db:        db,
+		sql:       sql,
+		phyDBs:    phyDBs,
+		router:    r,
+		sequences: seq,
+	}
+}
+
+// 目标表与源表分片一致时下推到各分片执行, 否则由Gaea读取SELECT结果后重新插入
+func buildInsertSelectPlan(stmt *ast.InsertStmt, phyDBs map[string]string, db, sql string, r *router.Router, grayRouter *router.GrayRouter, seq *sequence.SequenceManager) (Plan, error) {
+	if canPushDownInsertSelect(db, stmt, r, seq) {
+		p := NewInsertPlan(db, sql, r, seq)
+		if err := HandleInsertSelectStmt(p, stmt); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	p := NewInsertSelectPlan(db, sql, phyDBs, r, seq)
+	if err := HandleInsertSelectPlan(p, stmt, grayRouter); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// HandleInsertSelectStmt build a InsertPlan for INSERT ... SELECT which can be pushed down to backend
+func HandleInsertSelectStmt(p *InsertPlan, stmt *ast.InsertStmt) error {
+	sel, ok := stmt.Select.(*ast.SelectStmt)
+	if !ok {
+		return fmt.Errorf("not a select stmt in insert, type: %T", stmt.Select)
+	}
+	p.stmt = stmt
+
+	// SELECT与INSERT共用同一个路由结果, 保证源表与目标表路由到同一个分表
+	sp := NewSelectPlan(p.db, p.sql, p.router)
+	sp.stmt = sel
+	p.StmtInfo = sp.StmtInfo
+
+	if err := handleTableRefs(sp, sel); err != nil {
+		return fmt.Errorf("handle From error: %v", err)
+	}
+	if err := handleFieldList(sp, sel); err != nil {
+		return fmt.Errorf("handle Fields error: %v", err)
+	}
+	if err := handleWhere(sp, sel); err != nil {
+		return fmt.Errorf("handle Where error: %v", err)
+	}
+
+	// 目标表放在SELECT之后处理, 否则WHERE中不带表名的分片列会与目标表的分片列冲突
+	if _, err := handleInsertTableRefs(p); err != nil {
+		return fmt.Errorf("handleInsertTableRefs error: %v", err)
+	}
+	if err := handleInsertColumnNames(p); err != nil {
+		return fmt.Errorf("handleInsertColumnNames error: %v", err)
+	}
+	if err := handleInsertOnDuplicate(p); err != nil {
+		return fmt.Errorf("handleInsertOnDuplicate error: %v", err)
+	}
+
+	sqls, err := generateShardingSQLs(stmt, p.result, p.router)
+	if err != nil {
+		return fmt.Errorf("generate insert select sqls error: %v", err)
+	}
+	p.sqls = sqls
+	return nil
+}
+
+// 满足以下条件时, INSERT ... SELECT可以下推到各分片执行:
+// 1. 目标表是分片表, 且没有使用全局序列号
+// 2. SELECT不需要Gaea合并结果, 即不包含GROUP BY, HAVING, LIMIT, DISTINCT, 聚合函数和子查询
+// 3. 源表中的分片表与目标表分片一致 (同一个表或关联表), 其余的表只能是全局表
+// 4. 插入目标表分片列的值就是源表的分片列
+func canPushDownInsertSelect(db string, stmt *ast.InsertStmt, r *router.Router, seq *sequence.SequenceManager) bool {
+	sel, ok := stmt.Select.(*ast.SelectStmt)
+	if !ok {
+		return false
+	}
+	if sel.Distinct || sel.GroupBy != nil || sel.Having != nil || sel.Limit != nil || sel.From == nil || sel.Fields == nil {
+		return false
+	}
+	if len(stmt.Columns) == 0 || len(stmt.Columns) != len(sel.Fields.Fields) {
+		return false
+	}
+
+	targetName, ok := getInsertTableName(stmt)
+	if !ok {
+		return false
+	}
+	targetDB, targetTable := getTableInfoFromTableName(targetName)
+	if targetDB == "" {
+		targetDB = db
+	}
+	targetRule, ok := r.GetShardRule(targetDB, targetTable)
+	if !ok || targetRule.GetType() == router.GlobalTableRuleType {
+		return false
+	}
+	if seq != nil {
+		if _, ok := seq.GetSequence(targetDB, targetTable); ok {
+			return false
+		}
+	}
+
+	checker := &insertSelectPushDownChecker{}
+	sel.Accept(checker)
+	if checker.unsupported {
+		return false
+	}
+
+	// 源表按表名和别名记录分片规则
+	sourceRules := make(map[string]router.Rule)
+	var shardRules []router.Rule
+	for _, source := range checker.tableSources {
+		tableName := source.Source.(*ast.TableName)
+		sourceDB, sourceTable := getTableInfoFromTableName(tableName)
+		if sourceDB == "" {
+			sourceDB = db
+		}
+		rule, ok := r.GetShardRule(sourceDB, sourceTable)
+		if !ok {
+			return false
+		}
+		if rule.GetType() == router.GlobalTableRuleType {
+			continue
+		}
+		if rule.GetDB() != targetRule.GetDB() || getRouteTable(rule) != getRouteTable(targetRule) {
+			return false
+		}
+		sourceRules[sourceTable] = rule
+		if source.AsName.L != "" {
+			sourceRules[source.AsName.L] = rule
+		}
+		shardRules = append(shardRules, rule)
+	}
+	if len(shardRules) == 0 {
+		return false
+	}
+
+	shardingColumnIndex := -1
+	for i, col := range stmt.Columns {
+		if col.Name.L == targetRule.GetShardingColumn() {
+			shardingColumnIndex = i
+			break
+		}
+	}
+	if shardingColumnIndex == -1 {
+		return false
+	}
+
+	field := sel.Fields.Fields[shardingColumnIndex]
+	if field.WildCard != nil {
+		return false
+	}
+	column, ok := field.Expr.(*ast.ColumnNameExpr)
+	if !ok {
+		return false
+	}
+	columnName := column.Name.Name.L
+	if column.Name.Table.L != "" {
+		rule, ok := sourceRules[column.Name.Table.L]
+		return ok && rule.GetShardingColumn() == columnName
+	}
+
+	var matched int
+	for _, rule := range shardRules {
+		if rule.GetShardingColumn() == columnName {
+			matched++
+		}
+	}
+	return matched == 1
+}
+
+// insertSelectPushDownChecker 收集SELECT中的表, 并检查是否包含需要Gaea处理的子查询和聚合函数
+type insertSelectPushDownChecker struct {
+	tableSources []*ast.TableSource
+	depth        int
+	unsupported  bool
+}
+
+// Enter implement ast.Visitor
+func (c *insertSelectPushDownChecker) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	switch nn := n.(type) {
+	case *ast.SelectStmt:
+		c.depth++
+		if c.depth > 1 {
+			c.unsupported = true
+		}
+	case *ast.SubqueryExpr, *ast.UnionStmt, *ast.AggregateFuncExpr:
+		c.unsupported = true
+	case *ast.TableSource:
+		if _, ok := nn.Source.(*ast.TableName); !ok {
+			c.unsupported = true
+			break
+		}
+		c.tableSources = append(c.tableSources, nn)
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (c *insertSelectPushDownChecker) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+func getInsertTableName(stmt *ast.InsertStmt) (*ast.TableName, bool) {
+	if stmt.Table.TableRefs.Right != nil {
+		return nil, false
+	}
+	tableSource, ok := stmt.Table.TableRefs.Left.(*ast.TableSource)
+	if !ok {
+		return nil, false
+	}
+	tableName, ok := tableSource.Source.(*ast.TableName)
+	return tableName, ok
+}
+
+// HandleInsertSelectPlan build a InsertSelectPlan
+func HandleInsertSelectPlan(p *InsertSelectPlan, stmt *ast.InsertStmt, grayRouter *router.GrayRouter) error {
+	p.stmt = stmt
+
+	sel, ok := stmt.Select.(ast.StmtNode)
+	if !ok {
+		return fmt.Errorf("not a select stmt in insert, type: %T", stmt.Select)
+	}
+	if len(stmt.Columns) == 0 {
+		return errors.ErrIRNoColumns
+	}
+
+	tableName, ok := getInsertTableName(stmt)
+	if !ok {
+		return fmt.Errorf("have multi tables in insert")
+	}
+	p.table = tableName
+
+	db, table := getTableInfoFromTableName(tableName)
+	if db == "" {
+		db = p.db
+	}
+	if rule, ok := p.router.GetShardRule(db, table); ok {
+		p.isShard = true
+		if rule.GetType() != router.GlobalTableRuleType {
+			if err := checkInsertSelectShardingColumn(p, db, table, rule); err != nil {
+				return err
+			}
+		}
+	}
+
+	checker := &insertSelectPushDownChecker{}
+	sel.Accept(checker)
+	for _, source := range checker.tableSources {
+		sourceDB, sourceTable := getTableInfoFromTableName(source.Source.(*ast.TableName))
+		if sourceDB == "" {
+			sourceDB = p.db
+		}
+		if sourceDB == db && sourceTable == table {
+			p.readsTarget = true
+		}
+	}
+
+	selectSQL, err := generateUnshardingSQL(sel)
+	if err != nil {
+		return fmt.Errorf("generate select sql error: %v", err)
+	}
+	selectPlan, err := BuildPlan(sel, p.phyDBs, p.db, selectSQL, p.router, grayRouter, p.sequences, nil)
+	if err != nil {
+		return fmt.Errorf("build select plan in insert error: %v", err)
+	}
+	p.selectPlan = selectPlan
+	return nil
+}
+
+// 插入分片表时必须指定分片列, 或者分片列使用全局序列号自动生成
+func checkInsertSelectShardingColumn(p *InsertSelectPlan, db, table string, rule router.Rule) error {
+	shardingColumn := rule.GetShardingColumn()
+	for _, col := range p.stmt.Columns {
+		if col.Name.L == shardingColumn {
+			return nil
+		}
+	}
+	if p.sequences != nil {
+		if seq, ok := p.sequences.GetSequence(db, table); ok && seq.GetPKName() == shardingColumn {
+			return nil
+		}
+	}
+	return fmt.Errorf("sharding column not found")
+}
+
+// ExecuteIn implement Plan
+func (p *InsertSelectPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	w := &insertSelectWriter{
+		plan:    p,
+		reqCtx:  reqCtx,
+		sess:    sess,
+		maxRows: reqCtx.GetMaxInsertSelectRows(),
+	}
+
+	// 结果不需要合并时逐个分片读取, 避免一次读取所有分片的结果
+	// SELECT读取了目标表时, 先取出所有分片的结果再插入
+	if sp, ok := p.selectPlan.(*SelectPlan); ok && sp.canStreamResult() {
+		var pending []*mysql.Result
+		for _, sqls := range sp.splitSQLsByDB() {
+			rs, err := sess.ExecuteSQLs(reqCtx, sqls)
+			if err != nil {
+				return nil, fmt.Errorf("execute select in insert error: %v", err)
+			}
+			if p.readsTarget {
+				pending = append(pending, rs...)
+				continue
+			}
+			for _, r := range rs {
+				if err := w.write(r, true); err != nil {
+					return nil, err
+				}
+			}
+		}
+		for _, r := range pending {
+			if err := w.write(r, true); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		r, err := p.selectPlan.ExecuteIn(reqCtx, sess)
+		if err != nil {
+			return nil, fmt.Errorf("execute select in insert error: %v", err)
+		}
+		if err := w.write(r, isBackendResult(p.selectPlan)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+	return w.result(), nil
+}
+
+// 计划的执行结果是否为分片直接返回的结果, 此时RowDatas中保存的是分片返回的原始文本
+func isBackendResult(p Plan) bool {
+	switch pp := p.(type) {
+	case *UnshardPlan:
+		return true
+	case *SelectPlan:
+		return len(pp.GetSQLs()) != 0 && !pp.needMergeResult()
+	default:
+		return false
+	}
+}
+
+// 多个分片执行, 且不需要Gaea处理结果时, 可以逐个分片读取结果
+func (s *SelectPlan) canStreamResult() bool {
+	return !s.isExecOnSingleNode() && s.noAddColumns() && !s.distinct && !s.HasLimit() && !s.HasOrderBy() &&
+		s.stmt.GroupBy == nil && len(s.aggregateFuncs) == 0
+}
+
+// 按slice和db拆分SQL, 保证执行顺序固定
+func (s *SelectPlan) splitSQLsByDB() []map[string]map[string][]string {
+	var slices []string
+	for slice := range s.sqls {
+		slices = append(slices, slice)
+	}
+	sort.Strings(slices)
+
+	var ret []map[string]map[string][]string
+	for _, slice := range slices {
+		var dbs []string
+		for db := range s.sqls[slice] {
+			dbs = append(dbs, db)
+		}
+		sort.Strings(dbs)
+		for _, db := range dbs {
+			ret = append(ret, map[string]map[string][]string{slice: {db: s.sqls[slice][db]}})
+		}
+	}
+	return ret
+}
+
+// insertSelectWriter 把SELECT的结果按批次插入目标表, 每读取insertSelectBatchSize行插入一次
+// 读取的总行数超过限制时返回错误, 已经插入的批次需要由事务回滚
+type insertSelectWriter struct {
+	plan    *InsertSelectPlan
+	reqCtx  *util.RequestContext
+	sess    Executor
+	maxRows int // 小于等于0表示不限制
+
+	rows         int
+	pending      [][]ast.ExprNode
+	affectedRows uint64
+	insertID     uint64
+	status       uint16
+}
+
+// raw表示结果为分片直接返回的结果, 此时从原始文本中读取DECIMAL和字符串的值
+func (w *insertSelectWriter) write(r *mysql.Result, raw bool) error {
+	if r == nil || r.Resultset == nil {
+		return nil
+	}
+	if len(r.Fields) != len(w.plan.stmt.Columns) {
+		return fmt.Errorf("column count doesn't match value count")
+	}
+
+	for i := range r.Values {
+		w.rows++
+		if w.maxRows > 0 && w.rows > w.maxRows {
+			return fmt.Errorf("%v, max_insert_select_rows: %d", errors.ErrInsertSelectRowsExceeded, w.maxRows)
+		}
+
+		values, err := createResultRowValueExprs(r, i, raw)
+		if err != nil {
+			return err
+		}
+		w.pending = append(w.pending, values)
+		if len(w.pending) >= insertSelectBatchSize {
+			if err := w.flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// 能精确转换成float64的DECIMAL最大有效位数
+const maxExactDecimalDigits = 15
+
+// createResultRowValueExprs 把结果集中的一行转换成VALUES中的值
+// 结果集中的DECIMAL解析成了float64, raw为true时直接使用分片返回的原始文本, 避免精度损失
+func createResultRowValueExprs(r *mysql.Result, idx int, raw bool) ([]ast.ExprNode, error) {
+	row := r.Values[idx]
+	var texts [][]byte
+	if raw && len(r.RowDatas) == len(r.Values) {
+		var err error
+		if texts, err = parseTextRowData(r.RowDatas[idx], len(r.Fields)); err != nil {
+			return nil, err
+		}
+	}
+
+	values := make([]ast.ExprNode, len(row))
+	for i, v := range row {
+		if texts != nil && v != nil && isRawTextType(r.Fields[i].Type) {
+			value, err := createRawValueExpr(r.Fields[i], texts[i])
+			if err != nil {
+				return nil, err
+			}
+			values[i] = value
+			continue
+		}
+		value, err := createInsertValueExpr(r.Fields[i], v)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// 按文本协议解析一行数据, 返回每一列的原始文本, NULL返回nil
+func parseTextRowData(data mysql.RowData, columnCount int) ([][]byte, error) {
+	texts := make([][]byte, columnCount)
+	pos := 0
+	for i := 0; i < columnCount; i++ {
+		v, next, isNull, ok := mysql.ReadLenEncStringAsBytes(data, pos)
+		if !ok {
+			return nil, fmt.Errorf("read column %d of row data error", i)
+		}
+		if !isNull {
+			texts[i] = v
+		}
+		pos = next
+	}
+	return texts, nil
+}
+
+func isRawTextType(tp byte) bool {
+	return isDecimalType(tp) || tp == mysql.TypeVarchar || tp == mysql.TypeVarString || tp == mysql.TypeString
+}
+
+func isDecimalType(tp byte) bool {
+	return tp == mysql.TypeDecimal || tp == mysql.TypeNewDecimal
+}
+
+func createRawValueExpr(field *mysql.Field, text []byte) (ast.ExprNode, error) {
+	if isDecimalType(field.Type) {
+		return createDecimalValueExpr(text)
+	}
+	return ast.NewValueExpr(string(text)), nil
+}
+
+// DECIMAL作为定点数常量, 不使用字符串, 避免改变表达式的类型
+func createDecimalValueExpr(text []byte) (ast.ExprNode, error) {
+	d := new(types.MyDecimal)
+	if err := d.FromString(text); err != nil {
+		return nil, fmt.Errorf("invalid decimal value %s: %v", text, err)
+	}
+	return ast.NewValueExpr(d), nil
+}
+
+// createInsertValueExpr 把Gaea合并后的结果值转换成VALUES中的值
+// DECIMAL解析成了float64, 有效位数不超过15位时按列的精度格式化可以得到原值, 否则返回错误
+func createInsertValueExpr(field *mysql.Field, v any) (ast.ExprNode, error) {
+	if !isDecimalType(field.Type) {
+		return ast.NewValueExpr(v), nil
+	}
+	switch x := v.(type) {
+	case float64:
+		if getDecimalPrecision(field) > maxExactDecimalDigits {
+			return nil, fmt.Errorf("DECIMAL column %s merged by gaea has more than %d digits, can not be converted exactly", field.Name, maxExactDecimalDigits)
+		}
+		prec := -1
+		if field.Decimal <= mysql.MaxDecimalScale {
+			prec = int(field.Decimal)
+		}
+		return createDecimalValueExpr(strconv.AppendFloat(nil, x, 'f', prec, 64))
+	case string:
+		return createDecimalValueExpr([]byte(x))
+	case []byte:
+		return createDecimalValueExpr(x)
+	default:
+		return ast.NewValueExpr(v), nil
+	}
+}
+
+// DECIMAL列的有效位数, 列长度包括小数点和符号
+func getDecimalPrecision(field *mysql.Field) int {
+	precision := int(field.ColumnLength)
+	if field.Decimal > 0 {
+		precision--
+	}
+	if field.Flag&uint16(mysql.UnsignedFlag) == 0 {
+		precision--
+	}
+	return precision
+}
+
+// flush 按批次插入读取到的所有行
+func (w *insertSelectWriter) flush() error {
+	for len(w.pending) != 0 {
+		n := len(w.pending)
+		if n > insertSelectBatchSize {
+			n = insertSelectBatchSize
+		}
+		batch := w.pending[:n]
+		w.pending = w.pending[n:]
+		if err := w.insert(batch); err != nil {
+			return err
+		}
+	}
+	w.pending = nil
+	return nil
+}
+
+func (w *insertSelectWriter) insert(batch [][]ast.ExprNode) error {
+	p := w.plan
+	stmt := p.newBatchInsertStmt(batch)
+
+	var batchPlan Plan
+	if p.isShard {
+		ip := NewInsertPlan(p.db, p.sql, p.router, p.sequences)
+		if err := HandleInsertStmt(ip, stmt); err != nil {
+			return fmt.Errorf("build batch insert plan error: %v, inserted rows: %d", err, w.affectedRows)
+		}
+		batchPlan = ip
+	} else {
+		tableName, _ := getInsertTableName(stmt)
+		up, err := CreateUnshardPlan(stmt, p.phyDBs, p.db, []*ast.TableName{tableName})
+		if err != nil {
+			return fmt.Errorf("build batch insert plan error: %v, inserted rows: %d", err, w.affectedRows)
+		}
+		batchPlan = up
+	}
+
+	r, err := batchPlan.ExecuteIn(w.reqCtx, w.sess)
+	if err != nil {
+		return fmt.Errorf("execute batch insert error: %v, inserted rows: %d", err, w.affectedRows)
+	}
+	w.status |= r.Status
+	w.affectedRows += r.AffectedRows
+	if w.insertID == 0 {
+		w.insertID = r.InsertID
+	}
+	return nil
+}
+
+// 每个批次使用新的InsertStmt, 生成分片SQL时会改写表名和列
+func (p *InsertSelectPlan) newBatchInsertStmt(lists [][]ast.ExprNode) *ast.InsertStmt {
+	tableName := &ast.TableName{
+		Schema: p.table.Schema,
+		Name:   p.table.Name,
+	}
+	columns := make([]*ast.ColumnName, len(p.stmt.Columns))
+	copy(columns, p.stmt.Columns)
+
+	return &ast.InsertStmt{
+		IsReplace:   p.stmt.IsReplace,
+		IgnoreErr:   p.stmt.IgnoreErr,
+		Priority:    p.stmt.Priority,
+		Table:       &ast.TableRefsClause{TableRefs: &ast.Join{Left: &ast.TableSource{Source: tableName}}},
+		Columns:     columns,
+		Lists:       lists,
+		OnDuplicate: p.stmt.OnDuplicate,
+	}
+}
+
+// 与MySQL一致, LAST_INSERT_ID为第一批插入生成的ID
+func (w *insertSelectWriter) result() *mysql.Result {
+	r := mysql.ResultPool.GetWithoutResultSet()
+	r.Status = w.status
+	r.AffectedRows = w.affectedRows
+	r.InsertID = w.insertID
+	if r.InsertID != 0 {
+		w.sess.SetLastInsertID(r.InsertID)
+	}
+	return r
+}
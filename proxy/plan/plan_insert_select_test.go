@@ -0,0 +1,336 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/core/errors"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+func TestInsertSelectPushDown(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []SQLTestcase{
+		{
+			db:  "db_ks",
+			sql: "insert into tbl_ks_child (id, a) select id, a from tbl_ks where id = 1",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_ks": {"INSERT INTO `tbl_ks_child_0001` (`id`,`a`) SELECT `id`,`a` FROM `tbl_ks_0001` WHERE `id`=1"},
+				},
+			},
+		},
+		{
+			db:  "db_ks",
+			sql: "insert into tbl_ks_user_child (user_id, a) select t.id, b.c from tbl_ks t join tbl_ks_global_one b on t.id=b.id where t.id in (1,2)",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_ks": {"INSERT INTO `tbl_ks_user_child_0001` (`user_id`,`a`) SELECT `t`.`id`,`b`.`c` FROM `tbl_ks_0001` AS `t` JOIN `tbl_ks_global_one` AS `b` ON `t`.`id`=`b`.`id` WHERE `t`.`id` IN (1)"},
+				},
+				"slice-1": {
+					"db_ks": {"INSERT INTO `tbl_ks_user_child_0002` (`user_id`,`a`) SELECT `t`.`id`,`b`.`c` FROM `tbl_ks_0002` AS `t` JOIN `tbl_ks_global_one` AS `b` ON `t`.`id`=`b`.`id` WHERE `t`.`id` IN (2)"},
+				},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "insert into tbl_mycat_user_child (user_id, a) select id, a from tbl_mycat_child where id > 10 on duplicate key update a = values(a)",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"INSERT INTO `tbl_mycat_user_child` (`user_id`,`a`) SELECT `id`,`a` FROM `tbl_mycat_child` WHERE `id`>10 ON DUPLICATE KEY UPDATE `a`=VALUES(`a`)"},
+					"db_mycat_1": {"INSERT INTO `tbl_mycat_user_child` (`user_id`,`a`) SELECT `id`,`a` FROM `tbl_mycat_child` WHERE `id`>10 ON DUPLICATE KEY UPDATE `a`=VALUES(`a`)"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"INSERT INTO `tbl_mycat_user_child` (`user_id`,`a`) SELECT `id`,`a` FROM `tbl_mycat_child` WHERE `id`>10 ON DUPLICATE KEY UPDATE `a`=VALUES(`a`)"},
+					"db_mycat_3": {"INSERT INTO `tbl_mycat_user_child` (`user_id`,`a`) SELECT `id`,`a` FROM `tbl_mycat_child` WHERE `id`>10 ON DUPLICATE KEY UPDATE `a`=VALUES(`a`)"},
+				},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "insert into tbl_mycat_child (id, a) select user_id, a from tbl_mycat_user_child where user_id = 2",
+			sqls: map[string]map[string][]string{
+				"slice-1": {
+					"db_mycat_2": {"INSERT INTO `tbl_mycat_child` (`id`,`a`) SELECT `user_id`,`a` FROM `tbl_mycat_user_child` WHERE `user_id`=2"},
+				},
+			},
+		},
+		{
+			db:     "db_mycat",
+			sql:    "insert into tbl_mycat_murmur select * from tbl_mycat",
+			hasErr: true, // must specify columns
+		},
+		{
+			db:     "db_mycat",
+			sql:    "insert into tbl_mycat_murmur (a) select a from tbl_mycat",
+			hasErr: true, // sharding column not found
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, getTestFunc(ns, test))
+	}
+}
+
+func TestInsertSelectNotPushDown(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		db  string
+		sql string
+	}{
+		{"db_mycat", "insert into tbl_mycat_child (id, a) select a, id from tbl_mycat"},                      // 分片列的值不是源表分片列
+		{"db_mycat", "insert into tbl_mycat (id, a) select id, a from tbl_mycat_child"},                      // 目标表使用全局序列号
+		{"db_mycat", "insert into tbl_mycat_murmur (id, a) select id, a from tbl_mycat"},                     // 分片规则不一致
+		{"db_mycat", "insert into tbl_mycat_child (id, a) select id, count(*) from tbl_mycat group by id"},   // 需要合并结果
+		{"db_mycat", "insert into tbl_mycat_child (id, a) select id, a from tbl_mycat order by id limit 10"}, // 需要合并结果
+		{"db_ks", "insert into tbl_ks_child (id, a) select id, a from tbl_ks_range"},                         // 分片规则不一致
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, test.db, test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			if _, ok := p.(*InsertSelectPlan); !ok {
+				t.Errorf("plan type not equal, expect: *InsertSelectPlan, actual: %T", p)
+			}
+		})
+	}
+}
+
+// insertSelectExecutor 分片db_mycat_N上的SELECT返回rows行(默认一行), a列为(N+1)%4, 并记录插入的SQL
+type insertSelectExecutor struct {
+	mockExecutor
+	rows         int
+	selectCount  int
+	inserts      map[string][]string
+	lastInsertID uint64
+}
+
+func (e *insertSelectExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]*mysql.Result, error) {
+	var rs []*mysql.Result
+	for _, dbSQLs := range sqls {
+		for db, sqlList := range dbSQLs {
+			for _, sql := range sqlList {
+				if strings.HasPrefix(sql, "SELECT") {
+					e.selectCount++
+					var idx int
+					fmt.Sscanf(db, "db_mycat_%d", &idx)
+					values := [][]any{{int64((idx + 1) % 4), fmt.Sprintf("v%d", idx)}}
+					for i := 1; i < e.rows; i++ {
+						values = append(values, values[0])
+					}
+					rs = append(rs, createTestSelectResult([]string{"a", "id"}, values))
+					continue
+				}
+				e.inserts[db] = append(e.inserts[db], sql)
+				rs = append(rs, &mysql.Result{AffectedRows: 1, InsertID: uint64(100 + len(e.inserts))})
+			}
+		}
+	}
+	return rs, nil
+}
+
+func (e *insertSelectExecutor) SetLastInsertID(id uint64) {
+	e.lastInsertID = id
+}
+
+func TestInsertSelectPlanExecuteIn(t *testing.T) {
+	tests := []struct {
+		sql         string
+		maxRows     int
+		rows        int
+		selectCount int
+		hasErr      bool
+		inserted    bool // 超过限制前已经插入了部分批次
+	}{
+		{
+			// 逐个分片读取
+			sql:         "insert into tbl_mycat_child (id, a) select a, id from tbl_mycat",
+			maxRows:     -1,
+			selectCount: 4,
+		},
+		{
+			// 读取目标表时先取出全部结果
+			sql:         "insert into tbl_mycat_child (id, a) select a, id from tbl_mycat_child",
+			maxRows:     10,
+			selectCount: 4,
+		},
+		{
+			sql:     "insert into tbl_mycat_child (id, a) select a, id from tbl_mycat",
+			maxRows: 3,
+			hasErr:  true,
+		},
+		{
+			// 每个批次读取后立即插入, 超过限制前的批次已经插入
+			sql:      "insert into tbl_mycat_child (id, a) select a, id from tbl_mycat",
+			maxRows:  insertSelectBatchSize * 3,
+			rows:     insertSelectBatchSize,
+			hasErr:   true,
+			inserted: true,
+		},
+	}
+
+	expectInserts := map[string][]string{
+		"db_mycat_0": {"INSERT INTO `tbl_mycat_child` (`id`,`a`) VALUES (0,'v3')"},
+		"db_mycat_1": {"INSERT INTO `tbl_mycat_child` (`id`,`a`) VALUES (1,'v0')"},
+		"db_mycat_2": {"INSERT INTO `tbl_mycat_child` (`id`,`a`) VALUES (2,'v1')"},
+		"db_mycat_3": {"INSERT INTO `tbl_mycat_child` (`id`,`a`) VALUES (3,'v2')"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			ns, err := preparePlanInfo()
+			if err != nil {
+				t.Fatalf("prepare namespace error: %v", err)
+			}
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			reqCtx := util.NewRequestContext()
+			reqCtx.SetMaxInsertSelectRows(test.maxRows)
+			executor := &insertSelectExecutor{rows: test.rows, inserts: make(map[string][]string)}
+			r, err := p.ExecuteIn(reqCtx, executor)
+			if test.hasErr {
+				if err == nil || !strings.Contains(err.Error(), errors.ErrInsertSelectRowsExceeded.Error()) {
+					t.Fatalf("expect rows exceeded error, actual: %v", err)
+				}
+				if inserted := len(executor.inserts) != 0; inserted != test.inserted {
+					t.Errorf("inserted not equal, expect: %v, actual: %v", test.inserted, executor.inserts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExecuteIn error: %v", err)
+			}
+			if executor.selectCount != test.selectCount {
+				t.Errorf("select count not equal, expect: %d, actual: %d", test.selectCount, executor.selectCount)
+			}
+			if !reflect.DeepEqual(executor.inserts, expectInserts) {
+				t.Errorf("insert sqls not equal, expect: %v, actual: %v", expectInserts, executor.inserts)
+			}
+			if r.AffectedRows != 4 {
+				t.Errorf("affected rows not equal, expect: 4, actual: %d", r.AffectedRows)
+			}
+			if r.InsertID == 0 || executor.lastInsertID != r.InsertID {
+				t.Errorf("last insert id not set, result: %d, session: %d", r.InsertID, executor.lastInsertID)
+			}
+		})
+	}
+}
+
+func TestCreateResultRowValueExprs(t *testing.T) {
+	// 分片返回的原始文本中保留了DECIMAL的全部精度, 解析后的值为float64
+	fields := []*mysql.Field{
+		{Name: []byte("amount"), Type: mysql.TypeNewDecimal, Decimal: 4, ColumnLength: 20},
+		{Name: []byte("price"), Type: mysql.TypeNewDecimal, Decimal: 2, ColumnLength: 12},
+		{Name: []byte("name"), Type: mysql.TypeVarString},
+		{Name: []byte("id"), Type: mysql.TypeLonglong},
+	}
+	r := createTestSelectResultWithValues(t, fields, [][]any{
+		{"12345678901234.5678", "1234567.80", "a'b", int64(1)},
+		{"-99999999999999.9999", nil, nil, int64(2)},
+	})
+
+	tests := []struct {
+		raw    bool
+		expect []string
+		hasErr bool
+	}{
+		{raw: true, expect: []string{"12345678901234.5678,1234567.80,'a''b',1", "-99999999999999.9999,NULL,NULL,2"}},
+		// Gaea合并后的结果没有原始文本, 超过15位有效数字的DECIMAL无法精确转换
+		{raw: false, hasErr: true},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("raw=%v", test.raw), func(t *testing.T) {
+			var actual []string
+			for i := range r.Values {
+				values, err := createResultRowValueExprs(r, i, test.raw)
+				if test.hasErr {
+					if err == nil {
+						t.Fatalf("expect error, actual values: %v", values)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("createResultRowValueExprs error: %v", err)
+				}
+				var row []string
+				for _, v := range values {
+					s, err := restoreNode(v)
+					if err != nil {
+						t.Fatalf("restore value error: %v", err)
+					}
+					row = append(row, s)
+				}
+				actual = append(actual, strings.Join(row, ","))
+			}
+			if !reflect.DeepEqual(actual, test.expect) {
+				t.Errorf("values not equal, expect: %v, actual: %v", test.expect, actual)
+			}
+		})
+	}
+
+	// 有效位数不超过15位时, 合并后的float64按列精度格式化可以得到原值
+	value, err := createInsertValueExpr(fields[1], float64(1234567.8))
+	if err != nil {
+		t.Fatalf("createInsertValueExpr error: %v", err)
+	}
+	if s, _ := restoreNode(value); s != "1234567.80" {
+		t.Errorf("decimal value not equal, expect: 1234567.80, actual: %s", s)
+	}
+}
+
+// 按分片返回的文本构造RowDatas, Values与mysql.RowData.ParseText一致, DECIMAL解析为float64
+func createTestSelectResultWithValues(t *testing.T, fields []*mysql.Field, values [][]any) *mysql.Result {
+	rs, err := mysql.BuildResultset(fields, make([]string, len(fields)), values)
+	if err != nil {
+		t.Fatalf("build resultset error: %v", err)
+	}
+	for _, row := range rs.Values {
+		for i, v := range row {
+			if s, ok := v.(string); ok && fields[i].Type == mysql.TypeNewDecimal {
+				row[i], _ = strconv.ParseFloat(s, 64)
+			}
+		}
+	}
+	return &mysql.Result{Resultset: rs}
+}
@@ -14,7 +14,13 @@
 
 package plan
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/util"
+)
 
 func TestMycatShardSimpleInsert(t *testing.T) {
 	ns, err := preparePlanInfo()
@@ -176,6 +182,21 @@ func TestMycatShardSimpleInsert(t *testing.T) {
 			sql:    "insert into tbl_mycat (id, a) values (6)",
 			hasErr: true, // column count doesn't match value count
 		},
+		{
+			db:     "db_mycat",
+			sql:    "insert into tbl_mycat (id, a) values (6, 'hi'), (7)",
+			hasErr: true, // column count doesn't match value count
+		},
+		{
+			db:     "db_mycat",
+			sql:    "insert into tbl_mycat (id, a) values (6, 'hi'), (3+4, 'hi')",
+			hasErr: true, // sharding value must be a constant
+		},
+		{
+			db:     "db_mycat",
+			sql:    "insert into tbl_mycat set id = 3+4, a = 'hi'",
+			hasErr: true, // sharding value must be a constant
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.sql, getTestFunc(ns, test))
@@ -992,3 +1013,75 @@ func TestInserTableNameColumnCaseInsensitive(t *testing.T) {
 		t.Run(test.sql, getTestFunc(ns, test))
 	}
 }
+
+type insertResultExecutor struct {
+	mockExecutor
+	insertIDs    []uint64
+	lastInsertID uint64
+}
+
+func (e *insertResultExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]*mysql.Result, error) {
+	var rs []*mysql.Result
+	for _, id := range e.insertIDs {
+		rs = append(rs, &mysql.Result{AffectedRows: 2, InsertID: id})
+	}
+	return rs, nil
+}
+
+func (e *insertResultExecutor) SetLastInsertID(id uint64) {
+	e.lastInsertID = id
+}
+
+func TestInsertPlanExecuteInMultiShards(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		db           string
+		sql          string
+		insertIDs    []uint64
+		lastInsertID uint64
+	}{
+		{
+			// 不使用全局序列号, 返回各分片自增ID中最小的一个
+			db:           "db_mycat",
+			sql:          "insert into tbl_mycat_murmur (id, a) values (0, 'hi'),(1, 'hi'),(2, 'hi'),(4, 'hi')",
+			insertIDs:    []uint64{10, 7},
+			lastInsertID: 7,
+		},
+		{
+			// 使用全局序列号, 返回本条SQL生成的第一个序列号
+			db:           "db_ks",
+			sql:          "insert into tbl_ks (id, user_id) values (1, nextval()),(2, nextval())",
+			insertIDs:    []uint64{10, 7},
+			lastInsertID: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, test.db, test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			executor := &insertResultExecutor{insertIDs: test.insertIDs}
+			r, err := p.ExecuteIn(util.NewRequestContext(), executor)
+			if err != nil {
+				t.Fatalf("ExecuteIn error: %v", err)
+			}
+			if r.AffectedRows != uint64(2*len(test.insertIDs)) {
+				t.Errorf("affected rows not merged, expect: %d, actual: %d", 2*len(test.insertIDs), r.AffectedRows)
+			}
+			if r.InsertID != test.lastInsertID || executor.lastInsertID != test.lastInsertID {
+				t.Errorf("last insert id not equal, expect: %d, actual: %d, %d", test.lastInsertID, r.InsertID, executor.lastInsertID)
+			}
+		})
+	}
+}
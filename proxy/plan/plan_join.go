@@ -0,0 +1,877 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/XiaoMi/Gaea/core/errors"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/opcode"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// 每次下推到被驱动表的连接列的值的个数
+const joinBatchSize = 500
+
+// JoinPlan is the plan for select statement which joins two sharding tables with different sharding rules.
+// 先查询驱动表, 再把驱动表中连接列的值分批以IN条件下推到被驱动表的分片, 最后由Gaea在内存中做hash join.
+// 两个表的查询都通过SelectPlan生成, 因此与普通的分片查询一样改写表名和计算路由.
+type JoinPlan struct {
+	basePlan
+
+	db     string
+	router *router.Router
+
+	sides     [2]*joinSide // 按FROM中的顺序
+	driver    int          // 驱动表在sides中的位置, RIGHT JOIN时为右表
+	outerJoin bool         // LEFT JOIN或RIGHT JOIN, 驱动表中没有匹配的行也要输出
+	fields    []*joinField // 输出列, 按SELECT中的顺序
+
+	driverPlan *SelectPlan
+
+	orderByItems []*joinOrderByItem
+	offset       int64
+	count        int64 // -1表示没有LIMIT
+}
+
+// joinSide JOIN中的一个表, 以及下推到该表查询的列和条件
+type joinSide struct {
+	tableSQL string // FROM中的表, 包含别名
+	db       string
+	table    string
+	alias    string
+
+	fields     []string // 下推的列
+	wildcard   int      // 下推的列中该表通配符的位置, -1表示没有通配符
+	keys       []string // 连接列, 补充在下推的列之后
+	conditions []string // 下推的条件
+}
+
+// joinField 输出列来自哪个表的哪个下推的列
+type joinField struct {
+	side  int
+	index int
+}
+
+// joinOrderByItem ORDER BY只能引用输出列的列名或位置
+type joinOrderByItem struct {
+	side     int // 列名带有表名时为对应的表, 否则为-1
+	name     string
+	position int // 从1开始, 为0时使用列名
+	desc     bool
+}
+
+// FROM中有分片规则不同的分片表, 不能下推到分片执行, 需要由Gaea执行JOIN或者返回不支持的错误
+// 包括JOIN ... ON, JOIN ... USING, 逗号连接以及多个表的连接, 子查询中的表不计入
+func isCrossShardJoin(stmt *ast.SelectStmt, db string, r *router.Router) bool {
+	if stmt.From == nil || stmt.From.TableRefs == nil {
+		return false
+	}
+	var route string
+	for _, source := range collectJoinSources(stmt.From.TableRefs) {
+		_, rule, ok := newJoinSide(source, db, r)
+		if !ok {
+			continue
+		}
+		if key := rule.GetDB() + "." + getRouteTable(rule); route == "" {
+			route = key
+		} else if key != route {
+			return true
+		}
+	}
+	return false
+}
+
+// 按FROM中的顺序返回JOIN中的所有数据源, 括号中的JOIN也会展开
+func collectJoinSources(node ast.ResultSetNode) []ast.ResultSetNode {
+	switch x := node.(type) {
+	case *ast.Join:
+		sources := collectJoinSources(x.Left)
+		if x.Right != nil {
+			sources = append(sources, collectJoinSources(x.Right)...)
+		}
+		return sources
+	case *ast.TableSource:
+		if join, ok := x.Source.(*ast.Join); ok {
+			return collectJoinSources(join)
+		}
+	}
+	return []ast.ResultSetNode{node}
+}
+
+// 返回连接两个表的JOIN, 去掉外层只包含一个JOIN的括号
+func unwrapJoin(join *ast.Join) *ast.Join {
+	for join.Right == nil {
+		inner, ok := unwrapJoinSource(join.Left).(*ast.Join)
+		if !ok {
+			break
+		}
+		join = inner
+	}
+	return join
+}
+
+// 去掉数据源外层只包含一个数据源的JOIN, 逗号连接中左边的表为这种形式
+func unwrapJoinSource(node ast.ResultSetNode) ast.ResultSetNode {
+	for {
+		switch x := node.(type) {
+		case *ast.Join:
+			if x.Right != nil {
+				return x
+			}
+			node = x.Left
+		case *ast.TableSource:
+			join, ok := x.Source.(*ast.Join)
+			if !ok {
+				return x
+			}
+			node = join
+		default:
+			return node
+		}
+	}
+}
+
+func newJoinSide(node ast.ResultSetNode, db string, r *router.Router) (*joinSide, router.Rule, bool) {
+	tableSource, ok := node.(*ast.TableSource)
+	if !ok {
+		return nil, nil, false
+	}
+	tableName, ok := tableSource.Source.(*ast.TableName)
+	if !ok {
+		return nil, nil, false
+	}
+	tableDB, table := getTableInfoFromTableName(tableName)
+	if tableDB == "" {
+		tableDB = db
+	}
+	rule, ok := r.GetShardRule(tableDB, table)
+	if !ok || rule.GetType() == router.GlobalTableRuleType {
+		return nil, nil, false
+	}
+	return &joinSide{
+		db:       tableDB,
+		table:    table,
+		alias:    tableSource.AsName.L,
+		wildcard: -1,
+	}, rule, true
+}
+
+// 判断列是否属于该表, 有别名时只能通过别名引用
+func (s *joinSide) match(schema, table string) bool {
+	if s.alias != "" {
+		return schema == "" && table == s.alias
+	}
+	return (schema == "" || schema == s.db) && table == s.table
+}
+
+func (s *joinSide) addField(field string, wildcard bool) error {
+	if wildcard {
+		if s.wildcard != -1 {
+			return fmt.Errorf("only one wildcard of table %s is supported", s.table)
+		}
+		s.wildcard = len(s.fields)
+	}
+	s.fields = append(s.fields, field)
+	return nil
+}
+
+// 计算下推的列在结果中的位置, 返回每个下推的列的起始位置, 最后一个元素为连接列的起始位置
+func (s *joinSide) getColumnOffsets(r *mysql.Result) ([]int, error) {
+	columnCount := len(r.Fields) - len(s.keys)
+	wildcardCount := columnCount - (len(s.fields) - 1)
+	if columnCount < 0 || (s.wildcard == -1 && columnCount != len(s.fields)) || (s.wildcard != -1 && wildcardCount < 0) {
+		return nil, fmt.Errorf("invalid column count of table %s: %d", s.table, len(r.Fields))
+	}
+
+	offsets := make([]int, len(s.fields)+1)
+	for i := range s.fields {
+		width := 1
+		if i == s.wildcard {
+			width = wildcardCount
+		}
+		offsets[i+1] = offsets[i] + width
+	}
+	return offsets, nil
+}
+
+// 把AND连接的条件拆分开
+func splitAndConditions(expr ast.ExprNode) []ast.ExprNode {
+	switch x := expr.(type) {
+	case *ast.BinaryOperationExpr:
+		if x.Op == opcode.LogicAnd {
+			return append(splitAndConditions(x.L), splitAndConditions(x.R)...)
+		}
+	case *ast.ParenthesesExpr:
+		if _, ok := x.Expr.(*ast.BinaryOperationExpr); ok {
+			conditions := splitAndConditions(x.Expr)
+			if len(conditions) > 1 {
+				return conditions
+			}
+		}
+	}
+	return []ast.ExprNode{expr}
+}
+
+func buildJoinPlan(stmt *ast.SelectStmt, db string, r *router.Router) (Plan, error) {
+	if err := precheckJoinStmt(stmt); err != nil {
+		return nil, err
+	}
+
+	join := unwrapJoin(stmt.From.TableRefs)
+	p := &JoinPlan{
+		db:        db,
+		router:    r,
+		outerJoin: join.Tp == ast.LeftJoin || join.Tp == ast.RightJoin,
+		count:     -1,
+	}
+	if join.Tp == ast.RightJoin {
+		p.driver = 1
+	}
+	for i, node := range []ast.ResultSetNode{unwrapJoinSource(join.Left), unwrapJoinSource(join.Right)} {
+		side, _, ok := newJoinSide(node, db, r)
+		if !ok {
+			return nil, fmt.Errorf("%v: only sharding tables can be joined, subquery or unsharded table is not supported", errors.ErrCrossShardJoinUnsupported)
+		}
+		p.sides[i] = side
+		tableSQL, err := restoreNode(node)
+		if err != nil {
+			return nil, err
+		}
+		p.sides[i].tableSQL = tableSQL
+	}
+	if p.sides[0].alias != "" && p.sides[0].alias == p.sides[1].alias {
+		return nil, fmt.Errorf("not unique table alias: %s", p.sides[0].alias)
+	}
+
+	if err := p.handleFieldList(stmt.Fields); err != nil {
+		return nil, fmt.Errorf("handle Fields error: %v", err)
+	}
+	if join.On != nil {
+		if err := p.handleConditions(join.On.Expr, true); err != nil {
+			return nil, fmt.Errorf("handle On error: %v", err)
+		}
+	}
+	p.handleUsing(join.Using)
+	if stmt.Where != nil {
+		if err := p.handleConditions(stmt.Where, false); err != nil {
+			return nil, fmt.Errorf("handle Where error: %v", err)
+		}
+	}
+	if len(p.sides[0].keys) == 0 {
+		return nil, fmt.Errorf("%v: no equality condition between columns of table %s and %s", errors.ErrCrossShardJoinUnsupported, p.sides[0].table, p.sides[1].table)
+	}
+	if err := p.handleOrderBy(stmt.OrderBy); err != nil {
+		return nil, fmt.Errorf("handle OrderBy error: %v", err)
+	}
+	if stmt.Limit != nil {
+		offset, count, err := getLimitValue(stmt.Limit)
+		if err != nil {
+			return nil, fmt.Errorf("handle Limit error: %v", err)
+		}
+		p.offset, p.count = offset, count
+	}
+
+	driverPlan, err := p.createSidePlan(p.driver, "")
+	if err != nil {
+		return nil, fmt.Errorf("build driver table plan error: %v", err)
+	}
+	p.driverPlan = driverPlan
+	return p, nil
+}
+
+// 检查Gaea执行JOIN时不支持的语法
+func precheckJoinStmt(stmt *ast.SelectStmt) error {
+	if sources := collectJoinSources(stmt.From.TableRefs); len(sources) != 2 {
+		return fmt.Errorf("%v: only two tables can be joined, actual: %d", errors.ErrCrossShardJoinUnsupported, len(sources))
+	}
+	join := unwrapJoin(stmt.From.TableRefs)
+	switch {
+	case join.NaturalJoin:
+		return fmt.Errorf("cross-shard join does not support NATURAL JOIN")
+	case len(join.Using) != 0 && hasUnqualifiedWildcard(stmt.Fields):
+		// USING中的列只输出一次, Gaea不知道表结构, 无法展开SELECT *
+		return fmt.Errorf("cross-shard join does not support SELECT * with USING, select columns with table name instead")
+	case stmt.Distinct, stmt.GroupBy != nil, stmt.Having != nil:
+		return fmt.Errorf("cross-shard join does not support DISTINCT, GROUP BY or HAVING")
+	case len(stmt.WindowSpecs) != 0:
+		return fmt.Errorf("cross-shard join does not support WINDOW")
+	case stmt.LockTp != ast.SelectLockNone:
+		return fmt.Errorf("cross-shard join does not support locking read")
+	}
+	return nil
+}
+
+func hasUnqualifiedWildcard(fields *ast.FieldList) bool {
+	for _, field := range fields.Fields {
+		if field.WildCard != nil && field.WildCard.Table.L == "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *JoinPlan) handleFieldList(fields *ast.FieldList) error {
+	for i, field := range fields.Fields {
+		if field.WildCard != nil {
+			if field.WildCard.Table.L == "" {
+				// SELECT *按FROM中的顺序输出两个表的全部列
+				for side := range p.sides {
+					if err := p.addField(side, p.sides[side].getWildcardSQL(), true); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			side, err := p.getColumnSide(&ast.ColumnName{Schema: field.WildCard.Schema, Table: field.WildCard.Table, Name: field.WildCard.Table})
+			if err != nil {
+				return err
+			}
+			if err := p.addField(side, p.sides[side].getWildcardSQL(), true); err != nil {
+				return err
+			}
+			continue
+		}
+
+		side, err := p.getExprSide(field.Expr)
+		if err != nil {
+			return fmt.Errorf("field %d error: %v", i+1, err)
+		}
+		fieldSQL, err := restoreNode(field)
+		if err != nil {
+			return err
+		}
+		if err := p.addField(side, fieldSQL, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *joinSide) getWildcardSQL() string {
+	return fmt.Sprintf("`%s`.*", s.qualifier())
+}
+
+// 引用该表的列时使用的表名, 有别名时为别名
+func (s *joinSide) qualifier() string {
+	if s.alias != "" {
+		return s.alias
+	}
+	return s.table
+}
+
+func (p *JoinPlan) addField(side int, field string, wildcard bool) error {
+	p.fields = append(p.fields, &joinField{side: side, index: len(p.sides[side].fields)})
+	return p.sides[side].addField(field, wildcard)
+}
+
+// 两个表的列的等值条件作为连接列, 只涉及一个表的条件下推到该表
+// 外连接中, 被驱动表的条件只能出现在ON中, 驱动表的条件只能出现在WHERE中
+func (p *JoinPlan) handleConditions(expr ast.ExprNode, isOn bool) error {
+	for _, cond := range splitAndConditions(expr) {
+		if left, right, ok := p.getJoinKey(cond); ok && (isOn || !p.outerJoin) {
+			p.sides[0].keys = append(p.sides[0].keys, left)
+			p.sides[1].keys = append(p.sides[1].keys, right)
+			continue
+		}
+
+		condSQL, err := restoreNode(cond)
+		if err != nil {
+			return err
+		}
+		side, err := p.getExprSide(cond)
+		if err != nil {
+			return fmt.Errorf("condition %s error: %v", condSQL, err)
+		}
+		if p.outerJoin && isOn == (side == p.driver) {
+			return fmt.Errorf("condition %s is not supported in outer join", condSQL)
+		}
+		p.sides[side].conditions = append(p.sides[side].conditions, condSQL)
+	}
+	return nil
+}
+
+// USING中的每一列都是两个表的连接列
+func (p *JoinPlan) handleUsing(columns []*ast.ColumnName) {
+	for _, column := range columns {
+		for _, s := range p.sides {
+			s.keys = append(s.keys, fmt.Sprintf("`%s`.`%s`", s.qualifier(), column.Name.O))
+		}
+	}
+}
+
+// 返回两个表的列的等值条件中, 左表和右表的列
+func (p *JoinPlan) getJoinKey(cond ast.ExprNode) (string, string, bool) {
+	expr, ok := cond.(*ast.BinaryOperationExpr)
+	if !ok || expr.Op != opcode.EQ {
+		return "", "", false
+	}
+	l, ok := expr.L.(*ast.ColumnNameExpr)
+	if !ok {
+		return "", "", false
+	}
+	r, ok := expr.R.(*ast.ColumnNameExpr)
+	if !ok {
+		return "", "", false
+	}
+	lSide, err := p.getColumnSide(l.Name)
+	if err != nil {
+		return "", "", false
+	}
+	rSide, err := p.getColumnSide(r.Name)
+	if err != nil || lSide == rSide {
+		return "", "", false
+	}
+	if lSide == 1 {
+		l, r = r, l
+	}
+	lSQL, err := restoreNode(l)
+	if err != nil {
+		return "", "", false
+	}
+	rSQL, err := restoreNode(r)
+	if err != nil {
+		return "", "", false
+	}
+	return lSQL, rSQL, true
+}
+
+// 列名必须带有表名, 因为Gaea不知道表结构, 无法判断列属于哪个表
+func (p *JoinPlan) getColumnSide(column *ast.ColumnName) (int, error) {
+	if column.Table.L == "" {
+		return -1, fmt.Errorf("column %s must be qualified with table name in cross-shard join", column.Name.O)
+	}
+	side := -1
+	for i, s := range p.sides {
+		if !s.match(column.Schema.L, column.Table.L) {
+			continue
+		}
+		if side != -1 {
+			return -1, fmt.Errorf("table %s is ambiguous", column.Table.O)
+		}
+		side = i
+	}
+	if side == -1 {
+		return -1, fmt.Errorf("unknown table %s", column.Table.O)
+	}
+	return side, nil
+}
+
+// 表达式只能引用一个表的列, 没有引用列时下推到驱动表
+func (p *JoinPlan) getExprSide(expr ast.ExprNode) (int, error) {
+	v := &joinColumnVisitor{plan: p, side: -1}
+	expr.Accept(v)
+	if v.err != nil {
+		return -1, v.err
+	}
+	if v.side == -1 {
+		return p.driver, nil
+	}
+	return v.side, nil
+}
+
+// joinColumnVisitor 查找表达式引用的表, 并检查不支持的表达式
+type joinColumnVisitor struct {
+	plan *JoinPlan
+	side int
+	err  error
+}
+
+// Enter implement ast.Visitor
+func (v *joinColumnVisitor) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if v.err != nil {
+		return n, true
+	}
+	switch x := n.(type) {
+	case *ast.SubqueryExpr, *ast.ExistsSubqueryExpr, *ast.CompareSubqueryExpr:
+		v.err = fmt.Errorf("subquery is not supported in cross-shard join")
+	case *ast.AggregateFuncExpr, *ast.WindowFuncExpr:
+		v.err = fmt.Errorf("aggregate and window function are not supported in cross-shard join")
+	case *ast.ColumnName:
+		side, err := v.plan.getColumnSide(x)
+		if err != nil {
+			v.err = err
+		} else if v.side != -1 && v.side != side {
+			v.err = fmt.Errorf("expression on both tables is not supported in cross-shard join")
+		} else {
+			v.side = side
+		}
+	}
+	return n, v.err != nil
+}
+
+// Leave implement ast.Visitor
+func (v *joinColumnVisitor) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+func (p *JoinPlan) handleOrderBy(orderBy *ast.OrderByClause) error {
+	if orderBy == nil {
+		return nil
+	}
+
+	for _, item := range orderBy.Items {
+		orderByItem := &joinOrderByItem{side: -1, desc: item.Desc}
+		switch x := item.Expr.(type) {
+		case *ast.ColumnNameExpr:
+			if x.Name.Table.L != "" {
+				side, err := p.getColumnSide(x.Name)
+				if err != nil {
+					return err
+				}
+				orderByItem.side = side
+			}
+			orderByItem.name = x.Name.Name.L
+		case *ast.PositionExpr:
+			if x.P != nil {
+				return fmt.Errorf("param marker is not allowed in ORDER BY of cross-shard join")
+			}
+			orderByItem.position = x.N
+		default:
+			return fmt.Errorf("ORDER BY of cross-shard join only supports column name or position, type: %T", item.Expr)
+		}
+		p.orderByItems = append(p.orderByItems, orderByItem)
+	}
+	return nil
+}
+
+// 生成一个表的查询, 连接列补充在下推的列之后
+func (p *JoinPlan) createSidePlan(side int, keyCondition string) (*SelectPlan, error) {
+	s := p.sides[side]
+	fields := append(append([]string{}, s.fields...), s.keys...)
+	conditions := s.conditions
+	if keyCondition != "" {
+		conditions = append(append([]string{}, conditions...), keyCondition)
+	}
+
+	sql := fmt.Sprintf("SELECT %s FROM %s", strings.Join(fields, ","), s.tableSQL)
+	if len(conditions) == 1 {
+		sql += " WHERE " + conditions[0]
+	} else if len(conditions) > 1 {
+		sql += " WHERE (" + strings.Join(conditions, ") AND (") + ")"
+	}
+
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		return nil, fmt.Errorf("parse sql error: %v, sql: %s", err, sql)
+	}
+	sp := NewSelectPlan(p.db, sql, p.router)
+	if err := HandleSelectStmt(sp, stmt.(*ast.SelectStmt)); err != nil {
+		return nil, err
+	}
+	return sp, nil
+}
+
+// ExecuteIn implement Plan
+func (p *JoinPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	maxRows := reqCtx.GetMaxResultSize()
+
+	dr, err := p.driverPlan.ExecuteIn(reqCtx, sess)
+	if err != nil {
+		return nil, fmt.Errorf("execute driver table error: %v", err)
+	}
+	if dr.Resultset == nil {
+		return nil, fmt.Errorf("driver table returns no result set")
+	}
+	if err := checkJoinRows(len(dr.Values), maxRows); err != nil {
+		return nil, err
+	}
+
+	driver, inner := p.sides[p.driver], p.sides[1-p.driver]
+	driverKeyStart := len(dr.Fields) - len(driver.keys)
+	if driverKeyStart < 0 {
+		return nil, fmt.Errorf("invalid column count of driver table: %d", len(dr.Fields))
+	}
+
+	// 连接列的值去重后分批下推到被驱动表, NULL不会匹配任何行
+	// 下推时按原值去重, 由MySQL按列的类型和排序规则匹配被驱动表中的行
+	var keys [][]any
+	seen := make(map[string]bool)
+	for _, row := range dr.Values {
+		key := row[driverKeyStart:]
+		if hasNullValue(key) {
+			continue
+		}
+		mapKey, err := generateNormalizedMapKey(key, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[mapKey] {
+			seen[mapKey] = true
+			keys = append(keys, key)
+		}
+	}
+
+	var ir *mysql.Result
+	var keyColumns []keyColumn
+	innerRows := make(map[string][][]any)
+	var innerRowCount int
+	for start := 0; start == 0 || start < len(keys); start += joinBatchSize {
+		end := start + joinBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		r, err := p.executeInner(reqCtx, sess, dr.Fields[driverKeyStart:], keys[start:end])
+		if err != nil {
+			return nil, err
+		}
+		innerRowCount += len(r.Values)
+		if err := checkJoinRows(innerRowCount, maxRows); err != nil {
+			return nil, err
+		}
+
+		innerKeyStart := len(r.Fields) - len(inner.keys)
+		if innerKeyStart < 0 {
+			return nil, fmt.Errorf("invalid column count of inner table: %d", len(r.Fields))
+		}
+		if keyColumns == nil {
+			if keyColumns, err = newJoinKeyColumns(dr.Fields[driverKeyStart:], r.Fields[innerKeyStart:]); err != nil {
+				return nil, err
+			}
+		}
+		for _, row := range r.Values {
+			key := row[innerKeyStart:]
+			if hasNullValue(key) {
+				continue
+			}
+			mapKey, err := generateNormalizedMapKey(key, keyColumns)
+			if err != nil {
+				return nil, err
+			}
+			innerRows[mapKey] = append(innerRows[mapKey], row)
+		}
+		if ir == nil {
+			ir = r
+		} else {
+			ir.Status |= r.Status
+		}
+	}
+
+	results := [2]*mysql.Result{}
+	results[p.driver], results[1-p.driver] = dr, ir
+	ret, columns, err := p.createResult(results)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range dr.Values {
+		var matches [][]any
+		if key := row[driverKeyStart:]; !hasNullValue(key) {
+			mapKey, err := generateNormalizedMapKey(key, keyColumns)
+			if err != nil {
+				return nil, err
+			}
+			matches = innerRows[mapKey]
+		}
+		if len(matches) == 0 && p.outerJoin {
+			matches = [][]any{nil}
+		}
+		for _, match := range matches {
+			rows := [2][]any{}
+			rows[p.driver], rows[1-p.driver] = row, match
+			ret.Values = append(ret.Values, createJoinRow(columns, rows))
+		}
+		if err := checkJoinRows(len(ret.Values), maxRows); err != nil {
+			return nil, err
+		}
+	}
+	ret.Status = dr.Status | ir.Status
+
+	sp, err := p.createMergePlan(ret, columns)
+	if err != nil {
+		return nil, err
+	}
+	if err := sortSelectResult(sp, nil, ret); err != nil {
+		return nil, fmt.Errorf("sort join result error: %v", err)
+	}
+	if err := limitSelectResult(sp, ret); err != nil {
+		return nil, fmt.Errorf("limit join result error: %v", err)
+	}
+	if err := GenerateSelectResultRowData(ret); err != nil {
+		return nil, fmt.Errorf("generate RowData error: %v", err)
+	}
+	return ret, nil
+}
+
+// 在Gaea中匹配连接列时使用与MySQL一致的比较规则, 无法安全匹配时返回错误
+// 1. 任意一边是数值类型时按数值比较, 另一边的字符串需要能完整解析为数值, DECIMAL超过15位有效数字时解析结果可能不精确
+// 2. 两边都是字符串时需要使用相同的排序规则, 按排序规则忽略大小写和末尾空格
+func newJoinKeyColumns(driverFields, innerFields []*mysql.Field) ([]keyColumn, error) {
+	if len(driverFields) != len(innerFields) {
+		return nil, fmt.Errorf("join column count not match, driver: %d, inner: %d", len(driverFields), len(innerFields))
+	}
+	columns := make([]keyColumn, len(driverFields))
+	for i := range driverFields {
+		d, in := newKeyColumn(driverFields[i]), newKeyColumn(innerFields[i])
+		if !d.numeric && !in.numeric {
+			if d != in {
+				return nil, fmt.Errorf("join column %s and %s have different collations, can not be matched by gaea", driverFields[i].Name, innerFields[i].Name)
+			}
+			columns[i] = d
+			continue
+		}
+		for _, field := range []*mysql.Field{driverFields[i], innerFields[i]} {
+			if isDecimalType(field.Type) && getDecimalPrecision(field) > maxExactDecimalDigits {
+				return nil, fmt.Errorf("DECIMAL join column %s has more than %d digits, can not be matched by gaea", field.Name, maxExactDecimalDigits)
+			}
+		}
+		columns[i] = keyColumn{numeric: true}
+	}
+	return columns, nil
+}
+
+// 查询被驱动表中连接列的值在keys中的行, keys为空时只获取列信息
+func (p *JoinPlan) executeInner(reqCtx *util.RequestContext, sess Executor, keyFields []*mysql.Field, keys [][]any) (*mysql.Result, error) {
+	inner := 1 - p.driver
+	var conditions []string
+	if len(keys) == 0 {
+		conditions = append(conditions, "1 = 0")
+	}
+	for i, column := range p.sides[inner].keys {
+		values := make([]string, 0, len(keys))
+		seen := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			expr, err := createInsertValueExpr(keyFields[i], key[i])
+			if err != nil {
+				return nil, err
+			}
+			value, err := restoreNode(expr)
+			if err != nil {
+				return nil, err
+			}
+			if !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+		if len(values) != 0 {
+			conditions = append(conditions, fmt.Sprintf("%s IN (%s)", column, strings.Join(values, ",")))
+		}
+	}
+
+	sp, err := p.createSidePlan(inner, strings.Join(conditions, " AND "))
+	if err != nil {
+		return nil, fmt.Errorf("build inner table plan error: %v", err)
+	}
+	r, err := sp.ExecuteIn(reqCtx, sess)
+	if err != nil {
+		return nil, fmt.Errorf("execute inner table error: %v", err)
+	}
+	if r.Resultset == nil {
+		return nil, fmt.Errorf("inner table returns no result set")
+	}
+	return r, nil
+}
+
+// joinColumn 输出列在一个表的结果中的位置
+type joinColumn struct {
+	side  int
+	index int
+}
+
+// 根据两个表的结果生成输出列
+func (p *JoinPlan) createResult(results [2]*mysql.Result) (*mysql.Result, []*joinColumn, error) {
+	var offsets [2][]int
+	for i, s := range p.sides {
+		o, err := s.getColumnOffsets(results[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		offsets[i] = o
+	}
+
+	var fields []*mysql.Field
+	var columns []*joinColumn
+	for _, f := range p.fields {
+		start, end := offsets[f.side][f.index], offsets[f.side][f.index+1]
+		fields = append(fields, results[f.side].Fields[start:end]...)
+		for i := start; i < end; i++ {
+			columns = append(columns, &joinColumn{side: f.side, index: i})
+		}
+	}
+
+	fieldNames := make(map[string]int, len(fields))
+	for i, field := range fields {
+		if _, ok := fieldNames[string(field.Name)]; !ok {
+			fieldNames[string(field.Name)] = i
+		}
+	}
+	ret := mysql.ResultPool.Get()
+	ret.Resultset = &mysql.Resultset{
+		Fields:     fields,
+		FieldNames: fieldNames,
+	}
+	return ret, columns, nil
+}
+
+// 拼接两个表的行, 外连接中没有匹配的行时输出NULL
+func createJoinRow(columns []*joinColumn, rows [2][]any) []any {
+	row := make([]any, len(columns))
+	for i, c := range columns {
+		if rows[c.side] != nil {
+			row[i] = rows[c.side][c.index]
+		}
+	}
+	return row
+}
+
+// 根据输出列计算ORDER BY的列位置, 生成用于排序和LIMIT的SelectPlan
+func (p *JoinPlan) createMergePlan(r *mysql.Result, columns []*joinColumn) (*SelectPlan, error) {
+	sp := &SelectPlan{
+		originColumnCount: len(r.Fields),
+		columnCount:       len(r.Fields),
+		offset:            p.offset,
+		count:             p.count,
+	}
+
+	for _, item := range p.orderByItems {
+		index := item.position - 1
+		if item.position == 0 {
+			for i, field := range r.Fields {
+				if (item.side == -1 || item.side == columns[i].side) && strings.ToLower(string(field.Name)) == item.name {
+					index = i
+					break
+				}
+			}
+		}
+		if index < 0 || index >= len(r.Fields) {
+			return nil, fmt.Errorf("unknown column in ORDER BY of cross-shard join, name: %s, position: %d", item.name, item.position)
+		}
+		sp.orderByColumn = append(sp.orderByColumn, index)
+		sp.orderByDirections = append(sp.orderByDirections, item.desc)
+	}
+	return sp, nil
+}
+
+func hasNullValue(values []any) bool {
+	for _, v := range values {
+		if v == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func checkJoinRows(rows, maxRows int) error {
+	if maxRows > 0 && rows > maxRows {
+		return fmt.Errorf("%v %d", errors.ErrRowsLimitExceeded, maxRows)
+	}
+	return nil
+}
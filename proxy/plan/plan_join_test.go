@@ -0,0 +1,387 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/core/errors"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+func TestJoinPlan(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		db       string
+		sql      string
+		sqls     map[string]map[string][]string // 驱动表的SQL
+		innerSQL string                         // 被驱动表的SQL, 不包含连接列的IN条件
+		hasErr   bool
+	}{
+		{
+			db:  "db_mycat",
+			sql: "select a.id, b.*, concat(a.a, 'x') as c from tbl_mycat a join tbl_mycat_murmur b on a.a = b.id and b.a > 1 where a.id = 1 order by b.id desc limit 2",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat_1": {"SELECT `a`.`id`,CONCAT(`a`.`a`, 'x') AS `c`,`a`.`a` FROM `tbl_mycat` AS `a` WHERE `a`.`id`=1"}},
+			},
+			innerSQL: "SELECT `b`.*,`b`.`id` FROM `tbl_mycat_murmur` AS `b` WHERE `b`.`a`>1",
+		},
+		{
+			db:  "db_ks",
+			sql: "select * from tbl_ks t left join tbl_ks_range r on t.id = r.id and t.a = r.a and r.b in (1, 2) where t.id = 1",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_ks": {"SELECT `t`.*,`t`.`id`,`t`.`a` FROM `tbl_ks_0001` AS `t` WHERE `t`.`id`=1"}},
+			},
+			innerSQL: "SELECT `r`.*,`r`.`id`,`r`.`a` FROM `tbl_ks_range` AS `r` WHERE `r`.`b` IN (1,2)",
+		},
+		{
+			db:  "db_mycat",
+			sql: "select tbl_mycat.a from tbl_mycat right join db_mycat.tbl_mycat_murmur on tbl_mycat.a = tbl_mycat_murmur.id where tbl_mycat_murmur.id = 3",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat_1": {"SELECT `tbl_mycat_murmur`.`id` FROM `db_mycat_1`.`tbl_mycat_murmur` WHERE `tbl_mycat_murmur`.`id`=3"}},
+			},
+			innerSQL: "SELECT `tbl_mycat`.`a`,`tbl_mycat`.`a` FROM `tbl_mycat`",
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select id from tbl_mycat join tbl_mycat_murmur on tbl_mycat.id = tbl_mycat_murmur.id",
+			hasErr: true, // column must be qualified with table name
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select count(*) from tbl_mycat join tbl_mycat_murmur on tbl_mycat.id = tbl_mycat_murmur.id",
+			hasErr: true, // aggregate function is not supported
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select * from tbl_mycat join tbl_mycat_murmur on tbl_mycat.id = tbl_mycat_murmur.id where tbl_mycat.a + tbl_mycat_murmur.a > 1",
+			hasErr: true, // condition on both tables
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select * from tbl_mycat left join tbl_mycat_murmur on tbl_mycat.id = tbl_mycat_murmur.id where tbl_mycat_murmur.a = 1",
+			hasErr: true, // condition of inner table in WHERE of outer join
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select * from tbl_mycat join tbl_mycat_murmur on tbl_mycat.id = tbl_mycat_murmur.id group by tbl_mycat.a",
+			hasErr: true, // GROUP BY is not supported
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select * from tbl_mycat join tbl_mycat_murmur on tbl_mycat.id = 1",
+			hasErr: true, // no join key, tables have different route
+		},
+		{
+			db:  "db_mycat",
+			sql: "select a.id, b.b from tbl_mycat a, tbl_mycat_murmur b where a.a = b.id and a.id = 1",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat_1": {"SELECT `a`.`id`,`a`.`a` FROM `tbl_mycat` AS `a` WHERE `a`.`id`=1"}},
+			},
+			innerSQL: "SELECT `b`.`b`,`b`.`id` FROM `tbl_mycat_murmur` AS `b`",
+		},
+		{
+			db:  "db_mycat",
+			sql: "select a.a, b.b from tbl_mycat a left join tbl_mycat_murmur b using (id) where a.id = 1",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat_1": {"SELECT `a`.`a`,`a`.`id` FROM `tbl_mycat` AS `a` WHERE `a`.`id`=1"}},
+			},
+			innerSQL: "SELECT `b`.`b`,`b`.`id` FROM `tbl_mycat_murmur` AS `b`",
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select * from tbl_mycat a join tbl_mycat_murmur b using (id)",
+			hasErr: true, // SELECT * with USING
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select a.id from tbl_mycat a, tbl_mycat_murmur b",
+			hasErr: true, // no join key
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select a.id from tbl_mycat a join tbl_mycat_murmur b on a.id = b.id join tbl_mycat_child c on a.id = c.id",
+			hasErr: true, // more than two tables
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select a.id from tbl_mycat a, tbl_mycat_murmur b, tbl_mycat_child c where a.id = b.id and a.id = c.id",
+			hasErr: true, // more than two tables
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, test.db, test.sql, ns.rt, nil, ns.seqs, nil)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, actual plan: %T", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			jp, ok := p.(*JoinPlan)
+			if !ok {
+				t.Fatalf("plan type not equal, expect: *JoinPlan, actual: %T", p)
+			}
+			if !checkSQLs(test.sqls, jp.driverPlan.GetSQLs()) {
+				t.Errorf("driver sqls not equal, expect: %v, actual: %v", test.sqls, jp.driverPlan.GetSQLs())
+			}
+			innerPlan, err := jp.createSidePlan(1-jp.driver, "")
+			if err != nil {
+				t.Fatalf("create inner plan error: %v", err)
+			}
+			if innerPlan.sql != test.innerSQL {
+				t.Errorf("inner sql not equal, expect: %s, actual: %s", test.innerSQL, innerPlan.sql)
+			}
+		})
+	}
+}
+
+// joinExecutor 分片db_mycat_N上, tbl_mycat只有一行(id: N, a: joinTestA[N]), tbl_mycat_murmur只有一行(id: N, b: (N+1)*10),
+// 按SELECT的列返回结果, 并记录被驱动表的SQL
+type joinExecutor struct {
+	mockExecutor
+	innerSQLs []string
+}
+
+var joinTestA = []any{int64(10), int64(20), int64(10), nil}
+
+func (e *joinExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]*mysql.Result, error) {
+	var rs []*mysql.Result
+	for _, dbSQLs := range sqls {
+		for db, sqlList := range dbSQLs {
+			for _, sql := range sqlList {
+				if strings.Contains(sql, " IN (") {
+					e.innerSQLs = append(e.innerSQLs, sql)
+				}
+				var idx int
+				fmt.Sscanf(db, "db_mycat_%d", &idx)
+				r, err := createJoinTestResult(sql, idx)
+				if err != nil {
+					return nil, err
+				}
+				rs = append(rs, r)
+			}
+		}
+	}
+	return rs, nil
+}
+
+func createJoinTestResult(sql string, idx int) (*mysql.Result, error) {
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		return nil, err
+	}
+	sel := stmt.(*ast.SelectStmt)
+	columns, row := []string{"id", "a"}, []any{int64(idx), joinTestA[idx]}
+	if table := sel.From.TableRefs.Left.(*ast.TableSource).Source.(*ast.TableName); table.Name.L == "tbl_mycat_murmur" {
+		columns, row = []string{"id", "b"}, []any{int64(idx), int64((idx + 1) * 10)}
+	}
+
+	var names []string
+	var values []any
+	for _, field := range sel.Fields.Fields {
+		if field.WildCard != nil {
+			names = append(names, columns...)
+			values = append(values, row...)
+			continue
+		}
+		name := field.Expr.(*ast.ColumnNameExpr).Name.Name.L
+		for i, column := range columns {
+			if column == name {
+				names = append(names, name)
+				values = append(values, row[i])
+			}
+		}
+	}
+	return createTestSelectResult(names, [][]any{values}), nil
+}
+
+func TestJoinPlanExecuteIn(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		sql      string
+		maxRows  int
+		expect   [][]any
+		innerSQL string // 驱动表中连接列的值各不相同时, 被驱动表的IN条件
+		hasErr   bool
+	}{
+		{
+			sql: "select * from tbl_mycat a join tbl_mycat_murmur b on a.a = b.b order by a.id",
+			expect: [][]any{
+				{int64(0), int64(10), int64(0), int64(10)},
+				{int64(1), int64(20), int64(1), int64(20)},
+				{int64(2), int64(10), int64(0), int64(10)},
+			},
+		},
+		{
+			sql: "select a.id, b.b from tbl_mycat a left join tbl_mycat_murmur b on a.a = b.b order by a.id desc limit 1, 3",
+			expect: [][]any{
+				{int64(2), int64(10)},
+				{int64(1), int64(20)},
+				{int64(0), int64(10)},
+			},
+		},
+		{
+			sql: "select * from tbl_mycat a right join tbl_mycat_murmur b on a.a = b.b order by b.id, a.id",
+			expect: [][]any{
+				{int64(0), int64(10), int64(0), int64(10)},
+				{int64(2), int64(10), int64(0), int64(10)},
+				{int64(1), int64(20), int64(1), int64(20)},
+				{nil, nil, int64(2), int64(30)},
+				{nil, nil, int64(3), int64(40)},
+			},
+		},
+		{
+			sql:      "select b.id, b.b, a.id from tbl_mycat a join tbl_mycat_murmur b on a.a = b.b where a.id = 1",
+			expect:   [][]any{{int64(1), int64(20), int64(1)}},
+			innerSQL: "IN (20)",
+		},
+		{
+			// 逗号连接, 连接条件在WHERE中
+			sql:      "select a.id, b.b from tbl_mycat a, tbl_mycat_murmur b where a.a = b.b and a.id = 1",
+			expect:   [][]any{{int64(1), int64(20)}},
+			innerSQL: "IN (20)",
+		},
+		{
+			sql:     "select * from tbl_mycat a join tbl_mycat_murmur b on a.a = b.b",
+			maxRows: 2,
+			hasErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+
+			reqCtx := util.NewRequestContext()
+			reqCtx.SetMaxResultSize(test.maxRows)
+			executor := &joinExecutor{}
+			r, err := p.ExecuteIn(reqCtx, executor)
+			if test.hasErr {
+				if err == nil || !strings.Contains(err.Error(), errors.ErrRowsLimitExceeded.Error()) {
+					t.Fatalf("expect rows limit exceeded error, actual: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExecuteIn error: %v", err)
+			}
+			if !reflect.DeepEqual(r.Values, test.expect) {
+				t.Errorf("result not equal, expect: %v, actual: %v", test.expect, r.Values)
+			}
+			if len(r.RowDatas) != len(test.expect) {
+				t.Errorf("row data count not equal, expect: %d, actual: %d", len(test.expect), len(r.RowDatas))
+			}
+			// 连接列的值去重后一次下推
+			if len(executor.innerSQLs) == 0 {
+				t.Fatalf("join keys are not pushed down")
+			}
+			for _, sql := range executor.innerSQLs {
+				if test.innerSQL != "" && !strings.Contains(sql, test.innerSQL) {
+					t.Errorf("inner sql not match, expect: %s, actual: %s", test.innerSQL, sql)
+				}
+			}
+		})
+	}
+}
+
+func TestNewJoinKeyColumns(t *testing.T) {
+	varchar := func(collation string) *mysql.Field {
+		return &mysql.Field{Name: []byte("c"), Type: mysql.TypeVarString, Charset: uint16(mysql.CollationNames[collation])}
+	}
+	bigint := &mysql.Field{Name: []byte("c"), Type: mysql.TypeLonglong}
+	decimal := &mysql.Field{Name: []byte("c"), Type: mysql.TypeNewDecimal, ColumnLength: 14, Decimal: 2}
+	longDecimal := &mysql.Field{Name: []byte("c"), Type: mysql.TypeNewDecimal, ColumnLength: 22, Decimal: 4}
+
+	tests := []struct {
+		name          string
+		driver, inner *mysql.Field
+		v1, v2        any
+		equal         bool
+		hasErr        bool
+	}{
+		{name: "int and string", driver: bigint, inner: varchar("utf8mb4_general_ci"), v1: int64(1), v2: []byte("1"), equal: true},
+		{name: "int and decimal", driver: bigint, inner: decimal, v1: int64(1), v2: float64(1), equal: true},
+		{name: "decimal and string", driver: decimal, inner: varchar("utf8mb4_bin"), v1: float64(1.5), v2: "1.50", equal: true},
+		{name: "int and different number", driver: bigint, inner: varchar("utf8mb4_bin"), v1: int64(1), v2: "1.1", equal: false},
+		{name: "ci and trailing spaces", driver: varchar("utf8mb4_general_ci"), inner: varchar("utf8mb4_general_ci"), v1: "abc", v2: []byte("ABC  "), equal: true},
+		{name: "bin", driver: varchar("utf8mb4_bin"), inner: varchar("utf8mb4_bin"), v1: "abc", v2: "ABC", equal: false},
+		{name: "different collations", driver: varchar("utf8mb4_general_ci"), inner: varchar("utf8mb4_bin"), hasErr: true},
+		{name: "long decimal", driver: longDecimal, inner: bigint, hasErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			columns, err := newJoinKeyColumns([]*mysql.Field{test.driver}, []*mysql.Field{test.inner})
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, actual columns: %v", columns)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newJoinKeyColumns error: %v", err)
+			}
+			k1, err := generateNormalizedMapKey([]any{test.v1}, columns)
+			if err != nil {
+				t.Fatalf("generate key error: %v", err)
+			}
+			k2, err := generateNormalizedMapKey([]any{test.v2}, columns)
+			if err != nil {
+				t.Fatalf("generate key error: %v", err)
+			}
+			if (k1 == k2) != test.equal {
+				t.Errorf("key equal not match, expect: %v, key1: %q, key2: %q", test.equal, k1, k2)
+			}
+		})
+	}
+
+	// 数值比较时无法完整解析为数值的字符串返回错误
+	columns, err := newJoinKeyColumns([]*mysql.Field{bigint}, []*mysql.Field{varchar("utf8mb4_bin")})
+	if err != nil {
+		t.Fatalf("newJoinKeyColumns error: %v", err)
+	}
+	if _, err := generateNormalizedMapKey([]any{"1abc"}, columns); err == nil {
+		t.Errorf("expect error for non numeric value")
+	}
+}
@@ -0,0 +1,369 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/proxy/sequence"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+const (
+	routeHintName     = "gaea_route"
+	broadcastHintName = "gaea_broadcast"
+)
+
+// RouteHint 由SQL首尾注释中的 /*+ GAEA_ROUTE(slice=..., db=..., table_index=...) */ 或 /*+ GAEA_BROADCAST() */ 指定的路由,
+// 覆盖Gaea计算出的路由, 用于运维和排查问题
+type RouteHint struct {
+	Broadcast  bool
+	Slice      string
+	DB         string // 物理库名
+	TableIndex int    // 分片表的表序号, -1表示未指定
+}
+
+// String 返回hint的规范形式, 用于记录日志
+func (h *RouteHint) String() string {
+	if h.Broadcast {
+		return "GAEA_BROADCAST()"
+	}
+	var args []string
+	if h.Slice != "" {
+		args = append(args, "slice="+h.Slice)
+	}
+	if h.DB != "" {
+		args = append(args, "db="+h.DB)
+	}
+	if h.TableIndex >= 0 {
+		args = append(args, "table_index="+strconv.Itoa(h.TableIndex))
+	}
+	return "GAEA_ROUTE(" + strings.Join(args, ", ") + ")"
+}
+
+// ParseRouteHint 从SQL首尾的注释中解析路由hint, 没有hint时返回nil
+func ParseRouteHint(sql string) (*RouteHint, error) {
+	if !strings.Contains(sql, "/*+") {
+		return nil, nil
+	}
+	_, comments := parser.SplitMarginComments(sql)
+	var hint *RouteHint
+	for _, c := range []string{comments.Leading, comments.Trailing} {
+		for c != "" {
+			start := strings.Index(c, "/*+")
+			if start == -1 {
+				break
+			}
+			end := strings.Index(c[start:], "*/")
+			if end == -1 {
+				break
+			}
+			h, err := parseRouteHintComment(c[start+3 : start+end])
+			if err != nil {
+				return nil, err
+			}
+			if h != nil {
+				if hint != nil {
+					return nil, fmt.Errorf("duplicate route hint")
+				}
+				hint = h
+			}
+			c = c[start+end+2:]
+		}
+	}
+	return hint, nil
+}
+
+// parseRouteHintComment 解析一个优化器注释中的GAEA_ROUTE或GAEA_BROADCAST, 忽略其他hint
+func parseRouteHintComment(comment string) (*RouteHint, error) {
+	lower := strings.ToLower(comment)
+	var name string
+	pos := -1
+	for _, n := range []string{routeHintName, broadcastHintName} {
+		if i := strings.Index(lower, n); i != -1 {
+			if pos != -1 {
+				return nil, fmt.Errorf("GAEA_ROUTE and GAEA_BROADCAST cannot be used together")
+			}
+			name, pos = n, i
+		}
+	}
+	if pos == -1 {
+		return nil, nil
+	}
+
+	rest := strings.TrimSpace(comment[pos+len(name):])
+	if !strings.HasPrefix(rest, "(") {
+		return nil, fmt.Errorf("invalid route hint, missing '(' after %s", strings.ToUpper(name))
+	}
+	end := strings.Index(rest, ")")
+	if end == -1 {
+		return nil, fmt.Errorf("invalid route hint, missing ')' after %s", strings.ToUpper(name))
+	}
+	args := strings.TrimSpace(rest[1:end])
+
+	hint := &RouteHint{TableIndex: -1}
+	if name == broadcastHintName {
+		if args != "" {
+			return nil, fmt.Errorf("GAEA_BROADCAST does not accept arguments")
+		}
+		hint.Broadcast = true
+		return hint, nil
+	}
+
+	if args == "" {
+		return nil, fmt.Errorf("GAEA_ROUTE must specify at least one of slice, db, table_index")
+	}
+	for _, arg := range strings.Split(args, ",") {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid GAEA_ROUTE argument: %s", strings.TrimSpace(arg))
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := strings.Trim(strings.TrimSpace(kv[1]), "'\"`")
+		if value == "" {
+			return nil, fmt.Errorf("empty value of GAEA_ROUTE argument %s", key)
+		}
+		switch key {
+		case "slice":
+			hint.Slice = value
+		case "db":
+			hint.DB = value
+		case "table_index":
+			idx, err := strconv.Atoi(value)
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("invalid table_index of GAEA_ROUTE: %s", value)
+			}
+			hint.TableIndex = idx
+		default:
+			return nil, fmt.Errorf("unknown GAEA_ROUTE argument: %s", key)
+		}
+	}
+	return hint, nil
+}
+
+// filterTableIndexes 返回分片规则中满足hint的表序号.
+// hint中的db为物理库名, 分片规则中的库名需要经过phyDBs映射, kingshard规则的库名为逻辑库名
+func (h *RouteHint) filterTableIndexes(rule router.Rule, phyDBs map[string]string) ([]int, error) {
+	var indexes []int
+	for _, idx := range rule.GetSubTableIndexes() {
+		if h.TableIndex >= 0 && idx != h.TableIndex {
+			continue
+		}
+		if h.Slice != "" {
+			sliceIndex := rule.GetSliceIndexFromTableIndex(idx)
+			if sliceIndex < 0 || rule.GetSlice(sliceIndex) != h.Slice {
+				continue
+			}
+		}
+		if h.DB != "" {
+			db, err := rule.GetDatabaseNameByTableIndex(idx)
+			if err != nil {
+				continue
+			}
+			if phyDB, ok := phyDBs[db]; ok {
+				db = phyDB
+			}
+			if db != h.DB {
+				continue
+			}
+		}
+		indexes = append(indexes, idx)
+	}
+	if len(indexes) == 0 {
+		return nil, fmt.Errorf("no table of %s.%s matches %s", rule.GetDB(), rule.GetTable(), h)
+	}
+	return indexes, nil
+}
+
+// postHandleRouteHint 按hint重新计算分片表的路由, 覆盖遍历语法树时计算出的路由.
+// 只有全局表时, 从全局表的所有分片中选择.
+func postHandleRouteHint(p *StmtInfo) error {
+	if p.routeHint == nil {
+		return nil
+	}
+	if err := postHandleGlobalTableRouteResultInModify(p); err != nil {
+		return err
+	}
+	rule, ok := p.router.GetShardRule(p.result.db, p.result.table)
+	if !ok {
+		return fmt.Errorf("sharding rule of route result not found, result: %v", p.result)
+	}
+	indexes, err := p.routeHint.filterTableIndexes(rule, p.routeHintPhyDBs)
+	if err != nil {
+		return err
+	}
+	p.result.indexes = indexes
+	return nil
+}
+
+// RouteHintPlan 非分片SQL按hint在指定的slice上执行, GAEA_BROADCAST在所有slice上执行
+type RouteHintPlan struct {
+	basePlan
+
+	hint     *RouteHint
+	slices   []string // 为空时在默认slice上执行
+	phyDB    string
+	sql      string
+	isSelect bool
+}
+
+// BuildRouteHintPlan 按路由hint生成执行计划. slices为namespace中所有的slice名称.
+// 分片表只支持SELECT, UPDATE, DELETE, 路由结果由hint覆盖; 非分片SQL改为在hint指定的slice上执行.
+func BuildRouteHintPlan(stmt ast.StmtNode, phyDBs map[string]string, db, sql string, r *router.Router, grayRouter *router.GrayRouter, seq *sequence.SequenceManager, hint *RouteHint, slices []string) (Plan, error) {
+	if hint == nil {
+		return BuildPlan(stmt, phyDBs, db, sql, r, grayRouter, seq, nil)
+	}
+	if hint.Slice != "" && util.ArrayFindIndex(slices, hint.Slice) == -1 {
+		return nil, fmt.Errorf("slice %s of route hint not found", hint.Slice)
+	}
+
+	switch stmt.(type) {
+	case *ast.SelectStmt, *ast.UnionStmt, *ast.InsertStmt, *ast.UpdateStmt, *ast.DeleteStmt:
+	default:
+		return nil, fmt.Errorf("route hint is not supported for this statement")
+	}
+	if IsSelectLastInsertIDStmt(stmt) {
+		return nil, fmt.Errorf("route hint is not supported for SELECT LAST_INSERT_ID()")
+	}
+
+	checker := NewChecker(db, r, grayRouter)
+	stmt.Accept(checker)
+	if checker.IsDatabaseInvalid() {
+		return nil, fmt.Errorf("no database selected")
+	}
+	if checker.IsShard() {
+		return buildShardRouteHintPlan(stmt, phyDBs, db, sql, r, hint)
+	}
+
+	if hint.TableIndex >= 0 {
+		return nil, fmt.Errorf("table_index of route hint is only supported for sharding table")
+	}
+	unshardTables := checker.GetUnshardTableNames()
+	var p Plan
+	var err error
+	if checker.IsGray() {
+		p, err = buildGrayPlan(stmt, db, phyDBs, unshardTables, checker.grayRule)
+	} else {
+		p, err = CreateUnshardPlan(stmt, phyDBs, db, unshardTables)
+	}
+	if err != nil {
+		return nil, err
+	}
+	up := p.(*UnshardPlan)
+
+	ret := &RouteHintPlan{
+		hint:  hint,
+		phyDB: hint.DB,
+		sql:   up.sql,
+	}
+	if ret.phyDB == "" {
+		ret.phyDB = db
+		if phyDB, ok := phyDBs[db]; ok {
+			ret.phyDB = phyDB
+		}
+	}
+	switch {
+	case hint.Broadcast:
+		ret.slices = slices
+	case hint.Slice != "":
+		ret.slices = []string{hint.Slice}
+	}
+	switch stmt.(type) {
+	case *ast.SelectStmt, *ast.UnionStmt:
+		ret.isSelect = true
+	}
+	return ret, nil
+}
+
+// 分片表由hint覆盖路由结果, 需要由Gaea计算的子查询, 跨分片JOIN, 修改分片列等暂不支持
+func buildShardRouteHintPlan(stmt ast.StmtNode, phyDBs map[string]string, db, sql string, r *router.Router, hint *RouteHint) (Plan, error) {
+	if len(collectSubqueries(stmt)) != 0 {
+		return nil, fmt.Errorf("route hint is not supported for sharding table with subquery")
+	}
+	switch s := stmt.(type) {
+	case *ast.SelectStmt:
+		if isCrossShardJoin(s, db, r) {
+			return nil, fmt.Errorf("route hint is not supported for cross shard join")
+		}
+		p := NewSelectPlan(db, sql, r)
+		p.routeHint, p.routeHintPhyDBs = hint, phyDBs
+		if err := HandleSelectStmt(p, s); err != nil {
+			return nil, err
+		}
+		return p, nil
+	case *ast.UpdateStmt:
+		if isUpdateShardKey(s, db, r) {
+			return nil, fmt.Errorf("route hint is not supported for updating sharding column")
+		}
+		p := NewUpdatePlan(s, db, sql, r)
+		p.routeHint, p.routeHintPhyDBs = hint, phyDBs
+		if err := HandleUpdatePlan(p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	case *ast.DeleteStmt:
+		p := NewDeletePlan(s, db, sql, r)
+		p.routeHint, p.routeHintPhyDBs = hint, phyDBs
+		if err := HandleDeletePlan(p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("route hint of sharding table only supports SELECT, UPDATE and DELETE")
+	}
+}
+
+// GetSQLs 返回各slice上执行的SQL, key为空表示默认slice
+func (p *RouteHintPlan) GetSQLs() map[string]map[string][]string {
+	slices := p.slices
+	if len(slices) == 0 {
+		slices = []string{""}
+	}
+	sqls := make(map[string]map[string][]string, len(slices))
+	for _, slice := range slices {
+		sqls[slice] = map[string][]string{p.phyDB: {p.sql}}
+	}
+	return sqls
+}
+
+// ExecuteIn implement Plan
+func (p *RouteHintPlan) ExecuteIn(reqCtx *util.RequestContext, se Executor) (*mysql.Result, error) {
+	sqls := p.GetSQLs()
+	if s, ok := sqls[""]; ok {
+		delete(sqls, "")
+		sqls[reqCtx.GetDefaultSlice()] = s
+	}
+	rs, err := se.ExecuteSQLs(reqCtx, sqls)
+	if err != nil {
+		return nil, err
+	}
+	if p.isSelect {
+		return mergeMultiResultSet(rs), nil
+	}
+	r, err := MergeExecResult(rs)
+	if err != nil {
+		return nil, err
+	}
+	if r.InsertID != 0 {
+		se.SetLastInsertID(r.InsertID)
+	}
+	return r, nil
+}
@@ -0,0 +1,248 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/parser"
+)
+
+func TestParseRouteHint(t *testing.T) {
+	tests := []struct {
+		sql    string
+		expect string
+		hasErr bool
+	}{
+		{sql: "select * from tbl_ks"},
+		{sql: "/*+ master */ select * from tbl_ks"},
+		{sql: "/*+ GAEA_BROADCAST() */ select * from tbl_ks", expect: "GAEA_BROADCAST()"},
+		{sql: "select * from tbl_ks /*+ gaea_route(slice=slice-1) */", expect: "GAEA_ROUTE(slice=slice-1)"},
+		{sql: "/*master*/ /*+ GAEA_ROUTE(table_index = 3, db='db_ks') */ select * from tbl_ks", expect: "GAEA_ROUTE(db=db_ks, table_index=3)"},
+		{sql: "/*+ GAEA_ROUTE() */ select 1", hasErr: true},
+		{sql: "/*+ GAEA_ROUTE(slice) */ select 1", hasErr: true},
+		{sql: "/*+ GAEA_ROUTE(table=t) */ select 1", hasErr: true},
+		{sql: "/*+ GAEA_ROUTE(table_index=-1) */ select 1", hasErr: true},
+		{sql: "/*+ GAEA_BROADCAST(slice=slice-0) */ select 1", hasErr: true},
+		{sql: "/*+ GAEA_BROADCAST() */ select 1 /*+ GAEA_ROUTE(slice=slice-0) */", hasErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			hint, err := ParseRouteHint(test.sql)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse route hint error: %v", err)
+			}
+			if test.expect == "" {
+				if hint != nil {
+					t.Fatalf("expect no hint, got %s", hint)
+				}
+				return
+			}
+			if hint == nil || hint.String() != test.expect {
+				t.Errorf("hint not equal, expect: %s, actual: %v", test.expect, hint)
+			}
+		})
+	}
+}
+
+func TestRouteHintPlan(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	slices := []string{"slice-0", "slice-1"}
+
+	tests := []struct {
+		db     string
+		sql    string
+		sqls   map[string]map[string][]string
+		hasErr bool
+	}{
+		{
+			db:  "db_ks",
+			sql: "/*+ GAEA_ROUTE(table_index=3) */ select * from tbl_ks where id = 1",
+			sqls: map[string]map[string][]string{
+				"slice-1": {"db_ks": {"SELECT * FROM `tbl_ks_0003` WHERE `id`=1"}},
+			},
+		},
+		{
+			db:  "db_ks",
+			sql: "/*+ GAEA_ROUTE(slice=slice-0) */ select count(*) from tbl_ks",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_ks": {"SELECT COUNT(1) FROM `tbl_ks_0000`", "SELECT COUNT(1) FROM `tbl_ks_0001`"}},
+			},
+		},
+		{
+			db:  "db_ks",
+			sql: "select * from tbl_ks where id = 1 /*+ GAEA_BROADCAST() */",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_ks": {"SELECT * FROM `tbl_ks_0000` WHERE `id`=1", "SELECT * FROM `tbl_ks_0001` WHERE `id`=1"}},
+				"slice-1": {"db_ks": {"SELECT * FROM `tbl_ks_0002` WHERE `id`=1", "SELECT * FROM `tbl_ks_0003` WHERE `id`=1"}},
+			},
+		},
+		{
+			db:  "db_ks",
+			sql: "/*+ GAEA_ROUTE(table_index=2) */ update tbl_ks set a = 1",
+			sqls: map[string]map[string][]string{
+				"slice-1": {"db_ks": {"UPDATE `tbl_ks_0002` SET `a`=1"}},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "/*+ GAEA_ROUTE(db=db_mycat_2) */ delete from tbl_mycat where id = 1",
+			sqls: map[string]map[string][]string{
+				"slice-1": {"db_mycat_2": {"DELETE FROM `tbl_mycat` WHERE `id`=1"}},
+			},
+		},
+		{
+			// 只有全局表时从全局表的分片中选择
+			db:  "db_ks",
+			sql: "/*+ GAEA_ROUTE(slice=slice-1) */ select * from tbl_ks_global_one",
+			sqls: map[string]map[string][]string{
+				"slice-1": {"db_ks": {"SELECT * FROM `tbl_ks_global_one`", "SELECT * FROM `tbl_ks_global_one`"}},
+			},
+		},
+		{
+			db:  "db_ks",
+			sql: "/*+ GAEA_ROUTE(slice=slice-0) */ select * from tbl_unshard",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_ks": {"SELECT * FROM `tbl_unshard`"}},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "/*+ GAEA_BROADCAST() */ delete from tbl_unshard where a = 1",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat_0": {"DELETE FROM `tbl_unshard` WHERE `a`=1"}},
+				"slice-1": {"db_mycat_0": {"DELETE FROM `tbl_unshard` WHERE `a`=1"}},
+			},
+		},
+		{
+			// 表序号与slice不一致
+			db:     "db_ks",
+			sql:    "/*+ GAEA_ROUTE(slice=slice-0, table_index=3) */ select * from tbl_ks",
+			hasErr: true,
+		},
+		{
+			db:     "db_ks",
+			sql:    "/*+ GAEA_ROUTE(slice=slice-9) */ select * from tbl_ks",
+			hasErr: true,
+		},
+		{
+			db:     "db_ks",
+			sql:    "/*+ GAEA_ROUTE(table_index=0) */ select * from tbl_unshard",
+			hasErr: true,
+		},
+		{
+			db:     "db_ks",
+			sql:    "/*+ GAEA_ROUTE(table_index=0) */ insert into tbl_ks (id) values (1)",
+			hasErr: true,
+		},
+		{
+			db:     "db_ks",
+			sql:    "/*+ GAEA_ROUTE(table_index=0) */ update tbl_ks set id = 2 where id = 1",
+			hasErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			hint, err := ParseRouteHint(test.sql)
+			if err != nil {
+				t.Fatalf("parse route hint error: %v", err)
+			}
+			query, _ := parser.SplitMarginComments(test.sql)
+			stmt, err := parser.ParseSQL(query)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildRouteHintPlan(stmt, ns.phyDBs, test.db, test.sql, ns.rt, nil, ns.seqs, hint, slices)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("build plan error: %v", err)
+			}
+
+			var actual map[string]map[string][]string
+			switch plan := p.(type) {
+			case *SelectPlan:
+				actual = plan.GetSQLs()
+			case *UpdatePlan:
+				actual = plan.sqls
+			case *DeletePlan:
+				actual = plan.sqls
+			case *RouteHintPlan:
+				actual = plan.GetSQLs()
+			default:
+				t.Fatalf("unexpected plan type %T", p)
+			}
+			if !checkSQLs(test.sqls, actual) {
+				t.Errorf("sqls not equal, expect: %v, actual: %v", test.sqls, actual)
+			}
+		})
+	}
+}
+
+func TestRouteHintFilterPhysicalDB(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		db      string
+		table   string
+		hintDB  string
+		phyDBs  map[string]string
+		indexes []int
+	}{
+		// kingshard规则的库名为逻辑库名, hint中的db为物理库名
+		{db: "db_ks", table: "tbl_ks", hintDB: "db_ks_phy", phyDBs: map[string]string{"db_ks": "db_ks_phy"}, indexes: []int{0, 1, 2, 3}},
+		{db: "db_ks", table: "tbl_ks", hintDB: "db_ks", phyDBs: map[string]string{"db_ks": "db_ks_phy"}},
+		// mycat规则的库名为物理库名
+		{db: "db_mycat", table: "tbl_mycat", hintDB: "db_mycat_2", phyDBs: ns.phyDBs, indexes: []int{2}},
+	}
+	for _, test := range tests {
+		rule, ok := ns.rt.GetShardRule(test.db, test.table)
+		if !ok {
+			t.Fatalf("rule of %s.%s not found", test.db, test.table)
+		}
+		hint := &RouteHint{DB: test.hintDB, TableIndex: -1}
+		indexes, err := hint.filterTableIndexes(rule, test.phyDBs)
+		if test.indexes == nil {
+			if err == nil {
+				t.Fatalf("expect error of %s, got indexes %v", test.hintDB, indexes)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("filter table indexes of %s error: %v", test.hintDB, err)
+		}
+		if !reflect.DeepEqual(indexes, test.indexes) {
+			t.Fatalf("indexes of %s not equal, expect: %v, actual: %v", test.hintDB, test.indexes, indexes)
+		}
+	}
+}
@@ -16,15 +16,20 @@ package plan
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/XiaoMi/Gaea/mysql"
 	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/model"
 	"github.com/XiaoMi/Gaea/parser/opcode"
 	driver "github.com/XiaoMi/Gaea/parser/tidb-types/parser_driver"
 	"github.com/XiaoMi/Gaea/proxy/router"
 	"github.com/XiaoMi/Gaea/util"
 )
 
+// GROUP BY, ORDER BY中的表达式补列时使用的别名前缀
+const byItemFieldAliasPrefix = "gaea_by_"
+
 // SelectPlan is the plan for select statement
 type SelectPlan struct {
 	basePlan
@@ -40,6 +45,12 @@ type SelectPlan struct {
 	columnCount       int    // 补列后的列长度
 
 	aggregateFuncs map[int]AggregateFuncMerger // key = column index
+	avgColumn      []int                       // AVG 列索引, 多分片执行时需要补充SUM和COUNT列
+	distinctColumn []int                       // COUNT/SUM/AVG(DISTINCT) 列索引, 多分片执行时需要在Gaea中去重计算
+
+	distinctAggregates []*distinctAggregate // 多分片执行时, 需要在Gaea中去重计算的聚合函数
+	having             *havingFilter        // 多分片聚合时, 在Gaea中计算的HAVING条件
+	byItemFieldCount   int                  // GROUP BY, ORDER BY中的表达式补充列数量, 用于生成补充列别名
 
 	offset int64 // LIMIT offset
 	count  int64 // LIMIT count, 未设置则为-1
@@ -74,14 +85,13 @@ func (s *SelectPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mys
 
 	rs, err := sess.ExecuteSQLs(reqCtx, sqls)
 	if err != nil {
-		return nil, fmt.Errorf("execute in SelectPlan error: %v", err)
+		return nil, fmt.Errorf("execute in SelectPlan error: %w", err)
 	}
-	// fix: 修复全局表或分片表 order by/group by等情况下单分片执行时多一列的问题, 修复由于 limit offset 语句改写导致结果行数不正确问题
-	if s.isExecOnSingleNode() && s.noAddColumns() && !s.HasLimit() {
+	if !s.needMergeResult() {
 		return rs[0], nil
 	}
 
-	r, err := MergeSelectResult(s, s.stmt, rs)
+	r, err := MergeSelectResult(reqCtx, s, s.stmt, rs)
 	if err != nil {
 		return nil, fmt.Errorf("merge select result error: %v", err)
 	}
@@ -89,6 +99,42 @@ func (s *SelectPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mys
 
 }
 
+// fix: 修复全局表或分片表 order by/group by等情况下单分片执行时多一列的问题, 修复由于 limit offset 语句改写导致结果行数不正确问题
+func (s *SelectPlan) needMergeResult() bool {
+	return !s.isExecOnSingleNode() || !s.noAddColumns() || s.HasLimit()
+}
+
+// CanExecuteInStream 在多个分片执行的ORDER BY查询, 如果合并结果时只需要排序和LIMIT, 可以流式归并各分片的结果
+func (s *SelectPlan) CanExecuteInStream() bool {
+	if !s.HasOrderBy() || s.distinct || s.HasGroupBy() || len(s.aggregateFuncs) != 0 {
+		return false
+	}
+	if s.stmt == nil || s.stmt.GroupBy != nil || s.stmt.Having != nil || s.having != nil {
+		return false
+	}
+
+	sqlCount := 0
+	for _, dbSQLs := range s.sqls {
+		for _, sqls := range dbSQLs {
+			sqlCount += len(sqls)
+		}
+	}
+	return sqlCount > 1
+}
+
+// ExecuteInStream 以游标的方式在各分片执行SQL, 返回按ORDER BY归并结果的StreamMerger
+func (s *SelectPlan) ExecuteInStream(reqCtx *util.RequestContext, sess StreamExecutor) (*StreamMerger, error) {
+	cursors, err := sess.ExecuteSQLsInStream(reqCtx, s.GetSQLs())
+	if err != nil {
+		return nil, fmt.Errorf("execute in SelectPlan error: %w", err)
+	}
+	m, err := NewStreamMerger(s, cursors)
+	if err != nil {
+		return nil, fmt.Errorf("merge select result in stream error: %v", err)
+	}
+	return m, nil
+}
+
 // GetStmt SelectStmt
 func (s *SelectPlan) GetStmt() *ast.SelectStmt {
 	return s.stmt
@@ -186,6 +232,10 @@ func HandleSelectStmt(p *SelectPlan, stmt *ast.SelectStmt) error {
 		return fmt.Errorf("handle Hint error: %v", err)
 	}
 
+	if err := postHandleRouteHint(p.StmtInfo); err != nil {
+		return fmt.Errorf("handle route hint error: %v", err)
+	}
+
 	//如果是多节点执行，特殊处理groupby orderby having limit
 	if !p.isExecOnSingleNode() {
 		// group by的处理必须在table处理之后
@@ -201,15 +251,26 @@ func HandleSelectStmt(p *SelectPlan, stmt *ast.SelectStmt) error {
 
 		handleExtraFieldList(p, stmt)
 
+		// HAVING中的聚合函数和列补在group by, order by补列之后, 其中的AVG在handleAvgFunc中继续补列
+		if err := handleHaving(p, stmt); err != nil {
+			return fmt.Errorf("handle Having error: %v", err)
+		}
+
+		// AVG的补列放在group by, order by补列之后, 合并结果后与其他补列一起去掉
+		if err := handleAvgFunc(p, stmt); err != nil {
+			return fmt.Errorf("handle Avg error: %v", err)
+		}
+
+		// DISTINCT聚合函数会把参数追加到GROUP BY中, 必须在group by补列之后处理
+		if err := handleDistinctAggregateFunc(p, stmt); err != nil {
+			return fmt.Errorf("handle distinct aggregate function error: %v", err)
+		}
+
 		// 记录补列后的Fields长度, 后面的handler不会补列了
 		if stmt.Fields != nil {
 			p.columnCount = len(stmt.Fields.Fields)
 		}
 
-		if err := handleHaving(p, stmt); err != nil {
-			return fmt.Errorf("handle Having error: %v", err)
-		}
-
 		if err := handleLimit(p, stmt); err != nil {
 			return fmt.Errorf("handle Limit error: %v", err)
 		}
@@ -323,6 +384,97 @@ func handleExtraFieldList(p *SelectPlan, stmt *ast.SelectStmt) {
 	}
 }
 
+// 处理AVG聚合函数, 把AVG(x)拆分成SUM(x)和COUNT(x)补到FieldList中, 合并结果时根据补充列重新计算平均值
+func handleAvgFunc(p *SelectPlan, stmt *ast.SelectStmt) error {
+	for _, idx := range p.avgColumn {
+		avgExpr := stmt.Fields.Fields[idx].Expr.(*ast.AggregateFuncExpr)
+		sumIndex := len(stmt.Fields.Fields)
+		countIndex := sumIndex + 1
+		sumField := &ast.SelectField{
+			Expr: &ast.AggregateFuncExpr{F: ast.AggFuncSum, Args: avgExpr.Args},
+		}
+		countField := &ast.SelectField{
+			Expr: &ast.AggregateFuncExpr{F: ast.AggFuncCount, Args: avgExpr.Args},
+		}
+		stmt.Fields.Fields = append(stmt.Fields.Fields, sumField, countField)
+
+		merger := NewAggregateFuncAvgMerger(idx, sumIndex, countIndex)
+		if err := p.setAggregateFuncMerger(idx, merger); err != nil {
+			return fmt.Errorf("set avg function merger error, column index: %d, err: %v", idx, err)
+		}
+	}
+	return nil
+}
+
+// 处理COUNT(DISTINCT x), SUM(DISTINCT x), AVG(DISTINCT x)
+// 把聚合列替换为参数列, 并把参数追加到GROUP BY中, 使每个分片只返回去重后的参数值, 由Gaea按原有的GROUP BY列去重后计算结果
+func handleDistinctAggregateFunc(p *SelectPlan, stmt *ast.SelectStmt) error {
+	if len(p.distinctColumn) == 0 {
+		return nil
+	}
+
+	if stmt.Having != nil {
+		return fmt.Errorf("HAVING with DISTINCT aggregate function in multiple shards is not support")
+	}
+	// 补充列中的DISTINCT聚合函数无法在分片上计算, 如ORDER BY COUNT(DISTINCT x), 需要使用列别名
+	for i := p.originColumnCount; i < len(stmt.Fields.Fields); i++ {
+		if isDistinctAggregateFuncMergeByGaea(stmt.Fields.Fields[i].Expr) {
+			return fmt.Errorf("DISTINCT aggregate function in ORDER BY must use the alias of field")
+		}
+	}
+
+	groupBy := stmt.GroupBy
+	if groupBy == nil {
+		groupBy = &ast.GroupByClause{}
+	}
+
+	for _, idx := range p.distinctColumn {
+		field := stmt.Fields.Fields[idx]
+		aggExpr := field.Expr.(*ast.AggregateFuncExpr)
+
+		d := &distinctAggregate{
+			funcType:   strings.ToLower(aggExpr.F),
+			fieldIndex: idx,
+			fieldName:  field.AsName.O,
+		}
+		if d.fieldName == "" {
+			d.fieldName = field.Text()
+		}
+
+		// 第一个参数复用聚合列的位置, 其他参数补到FieldList最后
+		for i, arg := range aggExpr.Args {
+			argIndex := idx
+			if i == 0 {
+				field.Expr = arg
+			} else {
+				argIndex = len(stmt.Fields.Fields)
+				stmt.Fields.Fields = append(stmt.Fields.Fields, &ast.SelectField{Expr: arg})
+			}
+			d.argIndexes = append(d.argIndexes, argIndex)
+			groupBy.Items = append(groupBy.Items, &ast.ByItem{Expr: arg})
+		}
+
+		delete(p.aggregateFuncs, idx)
+		p.distinctAggregates = append(p.distinctAggregates, d)
+	}
+
+	stmt.GroupBy = groupBy
+	return nil
+}
+
+func isDistinctAggregateFuncMergeByGaea(expr ast.ExprNode) bool {
+	aggExpr, ok := expr.(*ast.AggregateFuncExpr)
+	if !ok || !aggExpr.Distinct {
+		return false
+	}
+	switch strings.ToLower(aggExpr.F) {
+	case ast.AggFuncCount, ast.AggFuncSum, ast.AggFuncAvg:
+		return true
+	default:
+		return false
+	}
+}
+
 func createSelectFieldsFromByItems(p *SelectPlan, items []*ast.ByItem) ([]*ast.SelectField, error) {
 	var ret []*ast.SelectField
 	for _, item := range items {
@@ -349,7 +501,7 @@ func createSelectFieldFromByItem(p *SelectPlan, item *ast.ByItem) (*ast.SelectFi
 			}
 			return ret, nil
 		}
-		return nil, fmt.Errorf("ByItem.Expr is a FuncCallExpr but not DATABASE()")
+		return createExprSelectFieldFromByItem(p, item)
 	case *driver.ValueExpr:
 		return &ast.SelectField{Expr: item.Expr}, nil
 	case *ast.PositionExpr:
@@ -360,7 +512,7 @@ func createSelectFieldFromByItem(p *SelectPlan, item *ast.ByItem) (*ast.SelectFi
 	case *ast.ColumnNameExpr:
 		columnExpr = item.Expr.(*ast.ColumnNameExpr)
 	default:
-		return nil, fmt.Errorf("ByItem.Expr is not a ColumnNameExpr")
+		return createExprSelectFieldFromByItem(p, item)
 	}
 
 	rule, need, isAlias, err := NeedCreateColumnNameExprDecoratorInField(p.TableAliasStmtInfo, columnExpr)
@@ -379,6 +531,34 @@ func createSelectFieldFromByItem(p *SelectPlan, item *ast.ByItem) (*ast.SelectFi
 	return ret, nil
 }
 
+// createExprSelectFieldFromByItem 处理ORDER BY DATE(c), GROUP BY a DIV 100等表达式,
+// 表达式作为带生成别名的补充列下推到分片, 合并结果时按补充列的值分组和排序, 返回结果前去掉.
+// 表达式中的聚合函数无法在合并时重新计算, 不支持.
+func createExprSelectFieldFromByItem(p *SelectPlan, item *ast.ByItem) (field *ast.SelectField, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("rewrite ByItem expression panic: %v", e)
+		}
+	}()
+
+	detector := &aggregateFuncDetector{}
+	item.Expr.Accept(detector)
+	if detector.found {
+		return nil, fmt.Errorf("aggregate function in ByItem expression is not supported in multiple shards")
+	}
+
+	// ByItem与补充列共用同一个表达式, 改写表名后分片SQL中的ORDER BY, GROUP BY也是改写后的表达式
+	// 这里如果出错, 只能通过panic返回err
+	item.Accept(NewColumnNameRewriteVisitor(p.TableAliasStmtInfo))
+
+	field = &ast.SelectField{
+		Expr:   item.Expr,
+		AsName: model.NewCIStr(fmt.Sprintf("%s%d", byItemFieldAliasPrefix, p.byItemFieldCount)),
+	}
+	p.byItemFieldCount++
+	return field, nil
+}
+
 // 处理from table和join on部分
 // 主要是改写table ExprNode, 并找到路由条件
 func handleTableRefs(p *SelectPlan, stmt *ast.SelectStmt) error {
@@ -617,6 +797,18 @@ func handleFieldList(p *SelectPlan, stmt *ast.SelectStmt) (err error) {
 	for i, f := range fields.Fields {
 		switch field := f.Expr.(type) {
 		case *ast.AggregateFuncExpr:
+			// DISTINCT聚合函数只有在多分片执行时才需要去重, 在handleDistinctAggregateFunc中处理
+			if isDistinctAggregateFuncMergeByGaea(field) {
+				p.distinctColumn = append(p.distinctColumn, i)
+				if strings.ToLower(field.F) == ast.AggFuncAvg {
+					continue
+				}
+			}
+			// AVG只有在多分片执行时才需要合并, 在handleAvgFunc中处理
+			if strings.ToLower(field.F) == ast.AggFuncAvg {
+				p.avgColumn = append(p.avgColumn, i)
+				continue
+			}
 			merger, err := CreateAggregateFunctionMerger(field, i)
 			if err != nil {
 				return fmt.Errorf("create aggregate function merger error, column index: %d, err: %v", i, err)
@@ -631,6 +823,9 @@ func handleFieldList(p *SelectPlan, stmt *ast.SelectStmt) (err error) {
 	return nil
 }
 
+// 处理HAVING
+// HAVING中没有聚合函数时直接下推到分片. 否则下推的HAVING只能过滤分片上的部分聚合结果,
+// 因此去掉分片SQL中的HAVING, 把其中的聚合函数和列补到FieldList中, 合并结果后由Gaea计算HAVING条件.
 func handleHaving(p *SelectPlan, stmt *ast.SelectStmt) (err error) {
 	defer func() {
 		if e := recover(); e != nil {
@@ -643,13 +838,145 @@ func handleHaving(p *SelectPlan, stmt *ast.SelectStmt) (err error) {
 		return nil
 	}
 
-	// 先用一个Visitor生成一个替换表名的装饰器
-	// 这里如果出错, 只能通过panic返回err
-	columnNameRewriter := NewColumnNameRewriteVisitor(p.TableAliasStmtInfo)
-	having.Accept(columnNameRewriter)
+	// HAVING中只有分组列等非聚合列时, 各分片的过滤结果与合并后一致
+	collector := &havingRefCollector{}
+	having.Expr.Accept(collector)
+	if !collector.hasAggregate && !hasAggregateFieldAlias(p, stmt, collector.refs) {
+		// 先用一个Visitor生成一个替换表名的装饰器
+		// 这里如果出错, 只能通过panic返回err
+		columnNameRewriter := NewColumnNameRewriteVisitor(p.TableAliasStmtInfo)
+		having.Accept(columnNameRewriter)
+		return nil
+	}
+
+	if collector.err != nil {
+		return collector.err
+	}
+	if len(p.distinctColumn) != 0 {
+		return fmt.Errorf("HAVING with DISTINCT aggregate function in multiple shards is not support")
+	}
+
+	filter := &havingFilter{
+		expr:    having.Expr,
+		columns: make(map[ast.ExprNode]int, len(collector.refs)),
+	}
+	for _, ref := range collector.refs {
+		idx, err := createHavingField(p, stmt, ref)
+		if err != nil {
+			return err
+		}
+		filter.columns[ref] = idx
+	}
+	p.having = filter
+	stmt.Having = nil
 	return nil
 }
 
+// createHavingField 返回HAVING中的列或聚合函数在FieldList中的位置, 不存在时补到FieldList最后.
+// HAVING中的列优先匹配SELECT中的列别名, 聚合函数总是补列.
+func createHavingField(p *SelectPlan, stmt *ast.SelectStmt, ref ast.ExprNode) (int, error) {
+	if column, ok := ref.(*ast.ColumnNameExpr); ok {
+		if idx, ok := findHavingColumn(p, stmt, column.Name); ok {
+			return idx, nil
+		}
+	}
+
+	idx := len(stmt.Fields.Fields)
+	field := &ast.SelectField{Expr: ref}
+	// 这里如果出错, 只能通过panic返回err
+	field.Accept(NewColumnNameRewriteVisitor(p.TableAliasStmtInfo))
+	stmt.Fields.Fields = append(stmt.Fields.Fields, field)
+
+	aggExpr, ok := ref.(*ast.AggregateFuncExpr)
+	if !ok {
+		return idx, nil
+	}
+	if isDistinctAggregateFuncMergeByGaea(aggExpr) {
+		return 0, fmt.Errorf("HAVING with DISTINCT aggregate function in multiple shards is not support")
+	}
+	if strings.ToLower(aggExpr.F) == ast.AggFuncAvg {
+		p.avgColumn = append(p.avgColumn, idx)
+		return idx, nil
+	}
+	merger, err := CreateAggregateFunctionMerger(aggExpr, idx)
+	if err != nil {
+		return 0, fmt.Errorf("create aggregate function merger error, column index: %d, err: %v", idx, err)
+	}
+	if err := p.setAggregateFuncMerger(idx, merger); err != nil {
+		return 0, fmt.Errorf("set aggregate function merger error, column index: %d, err: %v", idx, err)
+	}
+	return idx, nil
+}
+
+// HAVING中的列是否引用了包含聚合函数的列别名, 如SELECT SUM(x) AS total ... HAVING total > 10
+func hasAggregateFieldAlias(p *SelectPlan, stmt *ast.SelectStmt, refs []ast.ExprNode) bool {
+	for _, ref := range refs {
+		column, ok := ref.(*ast.ColumnNameExpr)
+		if !ok || column.Name.Table.L != "" {
+			continue
+		}
+		for i := 0; i < p.originColumnCount; i++ {
+			field := stmt.Fields.Fields[i]
+			if field.AsName.L != column.Name.Name.L || field.Expr == nil {
+				continue
+			}
+			detector := &aggregateFuncDetector{}
+			field.Expr.Accept(detector)
+			if detector.found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// aggregateFuncDetector 检查表达式中是否包含聚合函数
+type aggregateFuncDetector struct {
+	found bool
+}
+
+// Enter implement ast.Visitor
+func (d *aggregateFuncDetector) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if _, ok := n.(*ast.AggregateFuncExpr); ok {
+		d.found = true
+	}
+	return n, d.found
+}
+
+// Leave implement ast.Visitor
+func (d *aggregateFuncDetector) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+func findHavingColumn(p *SelectPlan, stmt *ast.SelectStmt, name *ast.ColumnName) (int, bool) {
+	if name.Table.L == "" {
+		for i := 0; i < p.originColumnCount; i++ {
+			if stmt.Fields.Fields[i].AsName.L == name.Name.L {
+				return i, true
+			}
+		}
+	}
+	for i := 0; i < p.originColumnCount; i++ {
+		var fieldName *ast.ColumnName
+		switch expr := stmt.Fields.Fields[i].Expr.(type) {
+		case *ast.ColumnNameExpr:
+			fieldName = expr.Name
+		case *ColumnNameExprDecorator:
+			fieldName = expr.ColumnNameExpr.Name
+		default:
+			continue
+		}
+		if fieldName.Name.L != name.Name.L {
+			continue
+		}
+		if name.Table.L != "" && fieldName.Table.L != "" && name.Table.L != fieldName.Table.L {
+			continue
+		}
+		return i, true
+	}
+	return 0, false
+}
+
 func handleComparisonExpr(p *TableAliasStmtInfo, comp ast.ExprNode) (bool, []int, ast.ExprNode, error) {
 	switch expr := comp.(type) {
 	case *ast.BinaryOperationExpr:
@@ -1039,6 +1366,12 @@ func handleLimit(p *SelectPlan, stmt *ast.SelectStmt) error {
 	need, originOffset, originCount, newLimit := NeedRewriteLimitOrCreateRewrite(stmt)
 	p.offset = originOffset
 	p.count = originCount
+	// DISTINCT聚合函数下推之后分片返回的是去重前的分组, 不能在分片上做LIMIT
+	// HAVING在Gaea中计算时, 分片返回的分组也可能被过滤掉
+	if len(p.distinctAggregates) != 0 || p.having != nil {
+		stmt.Limit = nil
+		return nil
+	}
 	if need {
 		stmt.Limit = newLimit
 	}
@@ -1752,6 +1752,132 @@ func TestMycatSelectAggregationFunctionSum(t *testing.T) {
 	}
 }
 
+func TestMycatSelectAggregationFunctionAvg(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []SQLTestcase{
+		{
+			db:  "db_mycat",
+			sql: "select avg(id) from tbl_mycat",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT AVG(`id`),SUM(`id`),COUNT(`id`) FROM `tbl_mycat`"},
+					"db_mycat_1": {"SELECT AVG(`id`),SUM(`id`),COUNT(`id`) FROM `tbl_mycat`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT AVG(`id`),SUM(`id`),COUNT(`id`) FROM `tbl_mycat`"},
+					"db_mycat_3": {"SELECT AVG(`id`),SUM(`id`),COUNT(`id`) FROM `tbl_mycat`"},
+				},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "select avg(user) from tbl_mycat where id = 1",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_1": {"SELECT AVG(`user`) FROM `tbl_mycat` WHERE `id`=1"},
+				},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "select user, avg(tbl_mycat.id) from tbl_mycat group by user order by user",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT `user`,AVG(`tbl_mycat`.`id`),SUM(`tbl_mycat`.`id`),COUNT(`tbl_mycat`.`id`) FROM `tbl_mycat` GROUP BY `user` ORDER BY `user`"},
+					"db_mycat_1": {"SELECT `user`,AVG(`tbl_mycat`.`id`),SUM(`tbl_mycat`.`id`),COUNT(`tbl_mycat`.`id`) FROM `tbl_mycat` GROUP BY `user` ORDER BY `user`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT `user`,AVG(`tbl_mycat`.`id`),SUM(`tbl_mycat`.`id`),COUNT(`tbl_mycat`.`id`) FROM `tbl_mycat` GROUP BY `user` ORDER BY `user`"},
+					"db_mycat_3": {"SELECT `user`,AVG(`tbl_mycat`.`id`),SUM(`tbl_mycat`.`id`),COUNT(`tbl_mycat`.`id`) FROM `tbl_mycat` GROUP BY `user` ORDER BY `user`"},
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, getTestFunc(ns, test))
+	}
+}
+
+func TestMycatSelectAggregationFunctionDistinct(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []SQLTestcase{
+		{
+			db:  "db_mycat",
+			sql: "select count(distinct user) from tbl_mycat",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT `user` FROM `tbl_mycat` GROUP BY `user`"},
+					"db_mycat_1": {"SELECT `user` FROM `tbl_mycat` GROUP BY `user`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT `user` FROM `tbl_mycat` GROUP BY `user`"},
+					"db_mycat_3": {"SELECT `user` FROM `tbl_mycat` GROUP BY `user`"},
+				},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "select count(distinct user) from tbl_mycat where id = 1",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_1": {"SELECT COUNT(DISTINCT `user`) FROM `tbl_mycat` WHERE `id`=1"},
+				},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "select id, sum(distinct score), count(*) from tbl_mycat group by id limit 10",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT `id`,`score`,COUNT(1) FROM `tbl_mycat` GROUP BY `id`,`score`"},
+					"db_mycat_1": {"SELECT `id`,`score`,COUNT(1) FROM `tbl_mycat` GROUP BY `id`,`score`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT `id`,`score`,COUNT(1) FROM `tbl_mycat` GROUP BY `id`,`score`"},
+					"db_mycat_3": {"SELECT `id`,`score`,COUNT(1) FROM `tbl_mycat` GROUP BY `id`,`score`"},
+				},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "select avg(distinct id), count(distinct id, user) from tbl_mycat",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT `id`,`id`,`user` FROM `tbl_mycat` GROUP BY `id`,`id`,`user`"},
+					"db_mycat_1": {"SELECT `id`,`id`,`user` FROM `tbl_mycat` GROUP BY `id`,`id`,`user`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT `id`,`id`,`user` FROM `tbl_mycat` GROUP BY `id`,`id`,`user`"},
+					"db_mycat_3": {"SELECT `id`,`id`,`user` FROM `tbl_mycat` GROUP BY `id`,`id`,`user`"},
+				},
+			},
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select user, count(distinct id) from tbl_mycat group by user having count(distinct id) > 1",
+			hasErr: true, // having with distinct aggregate in multiple shards is not support
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select user, count(distinct id) from tbl_mycat group by user order by count(distinct id)",
+			hasErr: true, // must use alias in order by
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, getTestFunc(ns, test))
+	}
+}
+
 func TestMycatSelectGroupBy(t *testing.T) {
 	ns, err := preparePlanInfo()
 	if err != nil {
@@ -1838,6 +1964,20 @@ func TestMycatSelectGroupBy(t *testing.T) {
 				},
 			},
 		},
+		{
+			db:  "db_mycat",
+			sql: "select count(*) from tbl_mycat group by amount div 100, (col1)",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT COUNT(1),`amount` DIV 100 AS `gaea_by_0`,(`col1`) AS `gaea_by_1` FROM `tbl_mycat` GROUP BY `amount` DIV 100,(`col1`)"},
+					"db_mycat_1": {"SELECT COUNT(1),`amount` DIV 100 AS `gaea_by_0`,(`col1`) AS `gaea_by_1` FROM `tbl_mycat` GROUP BY `amount` DIV 100,(`col1`)"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT COUNT(1),`amount` DIV 100 AS `gaea_by_0`,(`col1`) AS `gaea_by_1` FROM `tbl_mycat` GROUP BY `amount` DIV 100,(`col1`)"},
+					"db_mycat_3": {"SELECT COUNT(1),`amount` DIV 100 AS `gaea_by_0`,(`col1`) AS `gaea_by_1` FROM `tbl_mycat` GROUP BY `amount` DIV 100,(`col1`)"},
+				},
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -1889,6 +2029,47 @@ func TestMycatSelectHaving(t *testing.T) {
 				},
 			},
 		},
+		{
+			db:  "db_mycat",
+			sql: "select user, sum(id) as total from tbl_mycat where id in (0, 2) group by user having total > 10", // evaluate having in gaea
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT `user`,SUM(`id`) AS `total` FROM `tbl_mycat` WHERE `id` IN (0) GROUP BY `user`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT `user`,SUM(`id`) AS `total` FROM `tbl_mycat` WHERE `id` IN (2) GROUP BY `user`"},
+				},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "select user from tbl_mycat where id in (0, 2) group by user having sum(id) > 10 and avg(id) < 5 order by user limit 1",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT `user`,SUM(`id`),AVG(`id`),SUM(`id`),COUNT(`id`) FROM `tbl_mycat` WHERE `id` IN (0) GROUP BY `user` ORDER BY `user`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT `user`,SUM(`id`),AVG(`id`),SUM(`id`),COUNT(`id`) FROM `tbl_mycat` WHERE `id` IN (2) GROUP BY `user` ORDER BY `user`"},
+				},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "select user, count(*) from tbl_mycat where id in (0, 2) group by user having user like 'a%'", // no aggregate, push down
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT `user`,COUNT(1) FROM `tbl_mycat` WHERE `id` IN (0) GROUP BY `user` HAVING `user` LIKE 'a%'"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT `user`,COUNT(1) FROM `tbl_mycat` WHERE `id` IN (2) GROUP BY `user` HAVING `user` LIKE 'a%'"},
+				},
+			},
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select user, count(*) from tbl_mycat group by user having count(*) > 1 and user like 'a%'",
+			hasErr: true, // LIKE in having evaluated by gaea is not supported
+		},
 	}
 
 	for _, test := range tests {
@@ -1954,6 +2135,26 @@ func TestMycatSelectOrderBy(t *testing.T) {
 				},
 			},
 		},
+		// order by expression will add hidden column with generated alias to select list
+		{
+			db:  "db_mycat",
+			sql: "select id, user from tbl_mycat order by date(create_time) desc, id",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT `id`,`user`,DATE(`create_time`) AS `gaea_by_0` FROM `tbl_mycat` ORDER BY DATE(`create_time`) DESC,`id`"},
+					"db_mycat_1": {"SELECT `id`,`user`,DATE(`create_time`) AS `gaea_by_0` FROM `tbl_mycat` ORDER BY DATE(`create_time`) DESC,`id`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT `id`,`user`,DATE(`create_time`) AS `gaea_by_0` FROM `tbl_mycat` ORDER BY DATE(`create_time`) DESC,`id`"},
+					"db_mycat_3": {"SELECT `id`,`user`,DATE(`create_time`) AS `gaea_by_0` FROM `tbl_mycat` ORDER BY DATE(`create_time`) DESC,`id`"},
+				},
+			},
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select user from tbl_mycat group by user order by count(id) + 1",
+			hasErr: true, // aggregate function in order by expression can not be merged
+		},
 		// order by will auto add column to select list
 		{
 			db:  "db_mycat",
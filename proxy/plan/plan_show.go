@@ -0,0 +1,519 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+const showTableTypeBase = "BASE TABLE"
+
+// ShowPlan 有分片表的逻辑库中的SHOW TABLES, SHOW TABLE STATUS和分片表的SHOW CREATE TABLE.
+// 后端只有物理表, 由Gaea根据分片规则把物理表替换为逻辑表, SHOW TABLE STATUS中的行数和大小为所有物理表之和.
+type ShowPlan struct {
+	basePlan
+
+	tp      ast.ShowStmtType
+	db      string
+	full    bool
+	like    string         // LIKE条件原文, 用于结果集的列名
+	pattern *regexp.Regexp // LIKE条件, 匹配逻辑表名
+
+	defaultSlice string
+	defaultSQL   string                         // 在默认分片上执行的SQL, 查询非分片表
+	shardSQLs    map[string]map[string][]string // SHOW TABLE STATUS在各分片上查询物理表的SQL
+
+	logicalTables  []string          // 逻辑库中的分片表, 按表名排序
+	physicalTables map[string]string // key: 物理表名, value: 逻辑表名
+
+	// SHOW CREATE TABLE
+	table    string
+	phyTable physicalTable
+	phyDB    string // 物理表所在的库, 用于Executor.ExecuteSQL
+}
+
+// physicalTable 分片表的一张物理表
+type physicalTable struct {
+	slice   string
+	db      string // 物理库名
+	table   string
+	replica bool // 全局表除第一张外的物理表, 数据与第一张相同
+}
+
+// BuildShowPlan 生成逻辑库中SHOW语句的执行计划, 不需要Gaea处理时返回nil, 由调用方发送到默认分片.
+// 不支持SHOW TABLES和SHOW TABLE STATUS的WHERE条件.
+func BuildShowPlan(stmt *ast.ShowStmt, phyDBs map[string]string, db string, r *router.Router) (*ShowPlan, error) {
+	switch stmt.Tp {
+	case ast.ShowTables, ast.ShowTableStatus:
+		if stmt.DBName != "" {
+			db = stmt.DBName
+		}
+		rules := r.GetAllRules()[db]
+		if len(rules) == 0 || stmt.Where != nil {
+			return nil, nil
+		}
+		return buildShowTablesPlan(stmt, phyDBs, db, r, rules)
+	case ast.ShowCreateTable:
+		if stmt.Table == nil {
+			return nil, nil
+		}
+		if stmt.Table.Schema.O != "" {
+			db = stmt.Table.Schema.O
+		}
+		rule, ok := r.GetShardRule(db, stmt.Table.Name.L)
+		if !ok {
+			return nil, nil
+		}
+		return buildShowCreateTablePlan(stmt, phyDBs, db, rule)
+	default:
+		return nil, nil
+	}
+}
+
+func buildShowTablesPlan(stmt *ast.ShowStmt, phyDBs map[string]string, db string, r *router.Router, rules map[string]router.Rule) (*ShowPlan, error) {
+	p := &ShowPlan{
+		tp:             stmt.Tp,
+		db:             db,
+		full:           stmt.Full,
+		defaultSlice:   r.GetDefaultRule().GetSlice(0),
+		physicalTables: make(map[string]string),
+		shardSQLs:      make(map[string]map[string][]string),
+	}
+	if stmt.Pattern != nil {
+		like, pattern, err := compileShowPattern(stmt.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		p.like, p.pattern = like, pattern
+	}
+
+	// 同一个库中的物理表合并为一条SQL
+	dbTables := make(map[string]map[string][]string)
+	for table, rule := range rules {
+		p.logicalTables = append(p.logicalTables, table)
+		tables, err := getPhysicalTables(rule, phyDBs)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tables {
+			p.physicalTables[t.table] = table
+			if t.replica {
+				continue
+			}
+			if dbTables[t.slice] == nil {
+				dbTables[t.slice] = make(map[string][]string)
+			}
+			dbTables[t.slice][t.db] = append(dbTables[t.slice][t.db], t.table)
+		}
+	}
+	sort.Strings(p.logicalTables)
+
+	if p.tp == ast.ShowTables {
+		p.defaultSQL = "SHOW TABLES"
+		if p.full {
+			p.defaultSQL = "SHOW FULL TABLES"
+		}
+		return p, nil
+	}
+
+	p.defaultSQL = "SHOW TABLE STATUS"
+	for slice, dbs := range dbTables {
+		p.shardSQLs[slice] = make(map[string][]string)
+		for phyDB, tables := range dbs {
+			sort.Strings(tables)
+			p.shardSQLs[slice][phyDB] = []string{"SHOW TABLE STATUS WHERE `Name` IN (" + quoteStringList(tables) + ")"}
+		}
+	}
+	return p, nil
+}
+
+func buildShowCreateTablePlan(stmt *ast.ShowStmt, phyDBs map[string]string, db string, rule router.Rule) (*ShowPlan, error) {
+	indexes := rule.GetSubTableIndexes()
+	if len(indexes) == 0 {
+		return nil, fmt.Errorf("no physical table of %s.%s", db, stmt.Table.Name.O)
+	}
+	phyDB, err := rule.GetDatabaseNameByTableIndex(indexes[0])
+	if err != nil {
+		return nil, fmt.Errorf("get database name error, index: %d, err: %v", indexes[0], err)
+	}
+	return &ShowPlan{
+		tp:    stmt.Tp,
+		db:    db,
+		table: stmt.Table.Name.O,
+		phyTable: physicalTable{
+			slice: rule.GetSlice(rule.GetSliceIndexFromTableIndex(indexes[0])),
+			table: getPhysicalTableName(rule, rule.GetTable(), indexes[0]),
+		},
+		phyDB: phyDB,
+	}, nil
+}
+
+// getPhysicalTables 返回分片表的所有物理表, 物理库名为后端的库名
+func getPhysicalTables(rule router.Rule, phyDBs map[string]string) ([]physicalTable, error) {
+	var ret []physicalTable
+	for i, index := range rule.GetSubTableIndexes() {
+		db, err := rule.GetDatabaseNameByTableIndex(index)
+		if err != nil {
+			return nil, fmt.Errorf("get database name error, table: %s, index: %d, err: %v", rule.GetTable(), index, err)
+		}
+		if phyDB, ok := phyDBs[db]; ok {
+			db = phyDB
+		}
+		ret = append(ret, physicalTable{
+			slice:   rule.GetSlice(rule.GetSliceIndexFromTableIndex(index)),
+			db:      db,
+			table:   getPhysicalTableName(rule, rule.GetTable(), index),
+			replica: i > 0 && rule.GetType() == router.GlobalTableRuleType,
+		})
+	}
+	return ret, nil
+}
+
+// ExecuteIn implement Plan
+func (p *ShowPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	switch p.tp {
+	case ast.ShowCreateTable:
+		return p.executeShowCreateTable(reqCtx, sess)
+	case ast.ShowTables:
+		return p.executeShowTables(reqCtx, sess)
+	default:
+		return p.executeShowTableStatus(reqCtx, sess)
+	}
+}
+
+// 返回第一张物理表的建表语句, 表名替换为逻辑表名
+func (p *ShowPlan) executeShowCreateTable(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	sql := "SHOW CREATE TABLE `" + strings.ReplaceAll(p.phyTable.table, "`", "``") + "`"
+	r, err := sess.ExecuteSQL(reqCtx, p.phyTable.slice, p.phyDB, sql)
+	if err != nil {
+		return nil, err
+	}
+	if r.Resultset == nil || len(r.Values) == 0 || len(r.Values[0]) < 2 {
+		return nil, fmt.Errorf("invalid result of show create table %s", p.phyTable.table)
+	}
+
+	row := r.Values[0]
+	row[0] = p.table
+	createSQL := showValueString(row[1])
+	origin := fmt.Sprintf("TABLE `%s`", strings.ReplaceAll(p.phyTable.table, "`", "``"))
+	logical := fmt.Sprintf("TABLE `%s`", strings.ReplaceAll(p.table, "`", "``"))
+	row[1] = strings.Replace(createSQL, origin, logical, 1)
+	if err := GenerateSelectResultRowData(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 默认分片上的物理表替换为逻辑表, 并补充其他分片上的分片表
+func (p *ShowPlan) executeShowTables(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	r, err := sess.ExecuteSQL(reqCtx, p.defaultSlice, p.db, p.defaultSQL)
+	if err != nil {
+		return nil, err
+	}
+	if r.Resultset == nil || len(r.Fields) == 0 {
+		return nil, fmt.Errorf("invalid result of %s", p.defaultSQL)
+	}
+
+	name := "Tables_in_" + p.db
+	if p.pattern != nil {
+		name += " (" + p.like + ")"
+	}
+	r.Fields[0].Name = []byte(name)
+	r.FieldNames = nil
+
+	values := make([][]any, 0, len(r.Values)+len(p.logicalTables))
+	for _, row := range r.Values {
+		if _, ok := p.physicalTables[showValueString(row[0])]; !ok {
+			values = append(values, row)
+		}
+	}
+	for _, table := range p.logicalTables {
+		row := []any{table}
+		if len(r.Fields) > 1 {
+			row = append(row, showTableTypeBase)
+		}
+		values = append(values, row)
+	}
+	r.Values = p.filterAndSort(values, 0)
+	r.AffectedRows = uint64(len(r.Values))
+	if err := GenerateSelectResultRowData(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 默认分片上的物理表替换为各分片上物理表合并后的逻辑表
+func (p *ShowPlan) executeShowTableStatus(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	r, err := sess.ExecuteSQL(reqCtx, p.defaultSlice, p.db, p.defaultSQL)
+	if err != nil {
+		return nil, err
+	}
+	if r.Resultset == nil || len(r.Fields) == 0 {
+		return nil, fmt.Errorf("invalid result of %s", p.defaultSQL)
+	}
+	m := newTableStatusMerger(r.Fields, showTableStatusColumns)
+	if m.name < 0 {
+		return nil, fmt.Errorf("column %s not found in result of %s", showTableStatusColumns.name, p.defaultSQL)
+	}
+
+	values := make([][]any, 0, len(r.Values))
+	for _, row := range r.Values {
+		if _, ok := p.physicalTables[showValueString(row[m.name])]; !ok {
+			values = append(values, row)
+		}
+	}
+
+	if len(p.shardSQLs) != 0 {
+		rs, err := sess.ExecuteSQLs(reqCtx, p.shardSQLs)
+		if err != nil {
+			return nil, err
+		}
+		merged := make(map[string][]any)
+		var order []string
+		for _, sr := range rs {
+			if sr == nil || sr.Resultset == nil {
+				continue
+			}
+			for _, row := range sr.Values {
+				if len(row) != len(r.Fields) {
+					return nil, fmt.Errorf("column count of show table status not match, expect: %d, actual: %d", len(r.Fields), len(row))
+				}
+				table, ok := p.physicalTables[showValueString(row[m.name])]
+				if !ok {
+					continue
+				}
+				if dst, ok := merged[table]; ok {
+					m.merge(dst, row)
+					continue
+				}
+				dst := append([]any(nil), row...)
+				dst[m.name] = table
+				merged[table] = dst
+				order = append(order, table)
+			}
+		}
+		for _, table := range order {
+			m.finish(merged[table])
+			values = append(values, merged[table])
+		}
+	}
+
+	r.Values = p.filterAndSort(values, m.name)
+	r.AffectedRows = uint64(len(r.Values))
+	if err := GenerateSelectResultRowData(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// 按LIKE条件过滤, 并与MySQL一样按表名排序
+func (p *ShowPlan) filterAndSort(values [][]any, nameIndex int) [][]any {
+	ret := values[:0]
+	for _, row := range values {
+		if p.pattern == nil || p.pattern.MatchString(showValueString(row[nameIndex])) {
+			ret = append(ret, row)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return showValueString(ret[i][nameIndex]) < showValueString(ret[j][nameIndex])
+	})
+	return ret
+}
+
+// compileShowPattern 把LIKE的模式转换为正则表达式, 与默认的排序规则一致, 不区分大小写
+func compileShowPattern(like *ast.PatternLikeExpr) (string, *regexp.Regexp, error) {
+	if like.Not {
+		return "", nil, fmt.Errorf("NOT LIKE in SHOW statement is not supported")
+	}
+	v, ok := like.Pattern.(ast.ValueExpr)
+	if !ok {
+		return "", nil, fmt.Errorf("pattern of LIKE must be a string")
+	}
+	pattern := showValueString(v.GetValue())
+
+	escape := like.Escape
+	if escape == 0 {
+		escape = '\\'
+	}
+	b := &strings.Builder{}
+	b.WriteString("(?is)^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == escape && i+1 < len(pattern):
+			i++
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case c == '%':
+			b.WriteString(".*")
+		case c == '_':
+			b.WriteString(".")
+		default:
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return "", nil, err
+	}
+	return pattern, re, nil
+}
+
+func quoteStringList(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		quoted = append(quoted, "'"+mysql.Escape(v)+"'")
+	}
+	return strings.Join(quoted, ",")
+}
+
+func showValueString(v any) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case []byte:
+		return string(x)
+	default:
+		return fmt.Sprintf("%v", x)
+	}
+}
+
+// tableStatusColumns 表状态中需要合并的列名, SHOW TABLE STATUS与information_schema.TABLES中的列名不同
+type tableStatusColumns struct {
+	name          string
+	rows          string
+	avgRowLength  string
+	dataLength    string
+	indexLength   string
+	dataFree      string
+	autoIncrement string
+}
+
+var showTableStatusColumns = tableStatusColumns{
+	name:          "Name",
+	rows:          "Rows",
+	avgRowLength:  "Avg_row_length",
+	dataLength:    "Data_length",
+	indexLength:   "Index_length",
+	dataFree:      "Data_free",
+	autoIncrement: "Auto_increment",
+}
+
+var informationSchemaTablesColumns = tableStatusColumns{
+	name:          "TABLE_NAME",
+	rows:          "TABLE_ROWS",
+	avgRowLength:  "AVG_ROW_LENGTH",
+	dataLength:    "DATA_LENGTH",
+	indexLength:   "INDEX_LENGTH",
+	dataFree:      "DATA_FREE",
+	autoIncrement: "AUTO_INCREMENT",
+}
+
+// tableStatusMerger 把同一个逻辑表的多张物理表的状态合并为一行, 不在结果中的列位置为-1.
+// 行数和大小相加, AUTO_INCREMENT取最大值, 平均行长度根据合并后的大小和行数重新计算.
+type tableStatusMerger struct {
+	name          int
+	rows          int
+	avgRowLength  int
+	dataLength    int
+	indexLength   int
+	dataFree      int
+	autoIncrement int
+}
+
+func newTableStatusMerger(fields []*mysql.Field, columns tableStatusColumns) *tableStatusMerger {
+	index := func(name string) int {
+		for i, f := range fields {
+			if bytes.EqualFold(f.Name, []byte(name)) {
+				return i
+			}
+		}
+		return -1
+	}
+	return &tableStatusMerger{
+		name:          index(columns.name),
+		rows:          index(columns.rows),
+		avgRowLength:  index(columns.avgRowLength),
+		dataLength:    index(columns.dataLength),
+		indexLength:   index(columns.indexLength),
+		dataFree:      index(columns.dataFree),
+		autoIncrement: index(columns.autoIncrement),
+	}
+}
+
+func (m *tableStatusMerger) merge(dst, src []any) {
+	for _, idx := range []int{m.rows, m.dataLength, m.indexLength, m.dataFree} {
+		if idx < 0 {
+			continue
+		}
+		a, aok := tableStatusUint(dst[idx])
+		b, bok := tableStatusUint(src[idx])
+		if aok || bok {
+			dst[idx] = a + b
+		}
+	}
+	if m.autoIncrement >= 0 {
+		a, aok := tableStatusUint(dst[m.autoIncrement])
+		b, bok := tableStatusUint(src[m.autoIncrement])
+		if !aok || (bok && b > a) {
+			dst[m.autoIncrement] = src[m.autoIncrement]
+		}
+	}
+}
+
+func (m *tableStatusMerger) finish(row []any) {
+	if m.avgRowLength < 0 || m.rows < 0 || m.dataLength < 0 {
+		return
+	}
+	rows, rok := tableStatusUint(row[m.rows])
+	length, lok := tableStatusUint(row[m.dataLength])
+	if rok && lok && rows != 0 {
+		row[m.avgRowLength] = length / rows
+	}
+}
+
+func tableStatusUint(v any) (uint64, bool) {
+	switch x := v.(type) {
+	case uint64:
+		return x, true
+	case int64:
+		if x < 0 {
+			return 0, true
+		}
+		return uint64(x), true
+	case float64:
+		if x < 0 {
+			return 0, true
+		}
+		return uint64(x), true
+	case string, []byte:
+		n, err := strconv.ParseUint(showValueString(x), 10, 64)
+		return n, err == nil
+	default:
+		return 0, false
+	}
+}
@@ -0,0 +1,232 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// showExecutor 根据分片和库返回预设的结果, 并记录执行过的SQL
+type showExecutor struct {
+	mockExecutor
+	results  map[string]*mysql.Result // key: slice/db
+	executed []string
+}
+
+func (e *showExecutor) ExecuteSQL(ctx *util.RequestContext, slice, db, sql string) (*mysql.Result, error) {
+	e.executed = append(e.executed, slice+"/"+db+": "+sql)
+	r, ok := e.results[slice+"/"+db]
+	if !ok {
+		return nil, fmt.Errorf("unexpected sql: %s", sql)
+	}
+	return r, nil
+}
+
+func (e *showExecutor) ExecuteSQLs(ctx *util.RequestContext, sqls map[string]map[string][]string) ([]*mysql.Result, error) {
+	var keys []string
+	for slice, dbSQLs := range sqls {
+		for db, ss := range dbSQLs {
+			for _, sql := range ss {
+				keys = append(keys, slice+"/"+db)
+				e.executed = append(e.executed, slice+"/"+db+": "+sql)
+			}
+		}
+	}
+	sort.Strings(keys)
+	var rs []*mysql.Result
+	for _, key := range keys {
+		r, ok := e.results[key]
+		if !ok {
+			return nil, fmt.Errorf("unexpected sql on %s", key)
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+func buildTestShowPlan(t *testing.T, db, sql string) *ShowPlan {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	p, err := BuildShowPlan(stmt.(*ast.ShowStmt), ns.phyDBs, db, ns.rt)
+	if err != nil {
+		t.Fatalf("BuildShowPlan error: %v", err)
+	}
+	return p
+}
+
+func TestBuildShowPlanNotNeeded(t *testing.T) {
+	sqls := []string{
+		"show tables from db_unshard",
+		"show tables where Tables_in_db_ks = 'tbl_ks'",
+		"show create table tbl_unshard",
+		"show variables like 'read_only'",
+	}
+	for _, sql := range sqls {
+		t.Run(sql, func(t *testing.T) {
+			if p := buildTestShowPlan(t, "db_ks", sql); p != nil {
+				t.Errorf("expect nil plan, sql: %s", sql)
+			}
+		})
+	}
+}
+
+func TestShowPlanShowTables(t *testing.T) {
+	tests := []struct {
+		sql    string
+		result *mysql.Result
+		expect [][]any
+		field  string
+	}{
+		{
+			sql: "show full tables like 'TBL\\_KS\\_U%'",
+			result: createTestSelectResult([]string{"Tables_in_db_ks", "Table_type"}, [][]any{
+				{"tbl_ks_0000", "BASE TABLE"}, {"tbl_ks_user_child_0001", "BASE TABLE"}, {"tbl_ks_unshard", "VIEW"}, {"tbl_other", "BASE TABLE"},
+			}),
+			expect: [][]any{
+				{"tbl_ks_unshard", "VIEW"}, {"tbl_ks_uppercase", "BASE TABLE"}, {"tbl_ks_uppercase_child", "BASE TABLE"}, {"tbl_ks_user_child", "BASE TABLE"},
+			},
+			field: "Tables_in_db_ks (TBL\\_KS\\_U%)",
+		},
+		{
+			sql: "show tables like 'tbl_ks_%d%'",
+			result: createTestSelectResult([]string{"Tables_in_db_ks"}, [][]any{
+				{"tbl_ks_0000"}, {"tbl_ks_child_0000"}, {"tbl_ks_old"},
+			}),
+			expect: [][]any{{"tbl_ks_child"}, {"tbl_ks_day"}, {"tbl_ks_old"}, {"tbl_ks_uppercase_child"}, {"tbl_ks_user_child"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			p := buildTestShowPlan(t, "db_ks", test.sql)
+			if p == nil {
+				t.Fatalf("expect show plan, sql: %s", test.sql)
+			}
+			e := &showExecutor{results: map[string]*mysql.Result{"slice-0/db_ks": test.result}}
+			r, err := p.ExecuteIn(util.NewRequestContext(), e)
+			if err != nil {
+				t.Fatalf("ExecuteIn error: %v", err)
+			}
+			if fmt.Sprint(r.Values) != fmt.Sprint(test.expect) {
+				t.Errorf("values not equal, expect: %v, actual: %v", test.expect, r.Values)
+			}
+			if test.field != "" && string(r.Fields[0].Name) != test.field {
+				t.Errorf("field name not equal, expect: %s, actual: %s", test.field, r.Fields[0].Name)
+			}
+			if len(r.RowDatas) != len(test.expect) {
+				t.Errorf("row data count not equal, expect: %d, actual: %d", len(test.expect), len(r.RowDatas))
+			}
+		})
+	}
+}
+
+func TestShowPlanShowCreateTable(t *testing.T) {
+	tests := []struct {
+		db       string
+		sql      string
+		key      string
+		executed string
+		create   string
+		expect   string
+	}{
+		{
+			db:       "db_ks",
+			sql:      "show create table tbl_ks",
+			key:      "slice-0/db_ks",
+			executed: "slice-0/db_ks: SHOW CREATE TABLE `tbl_ks_0000`",
+			create:   "CREATE TABLE `tbl_ks_0000` (\n  `id` int NOT NULL\n) ENGINE=InnoDB",
+			expect:   "CREATE TABLE `tbl_ks` (\n  `id` int NOT NULL\n) ENGINE=InnoDB",
+		},
+		{
+			db:       "db_ks",
+			sql:      "show create table db_mycat.tbl_mycat_child",
+			key:      "slice-0/db_mycat_0",
+			executed: "slice-0/db_mycat_0: SHOW CREATE TABLE `tbl_mycat_child`",
+			create:   "CREATE TABLE `tbl_mycat_child` (\n  `id` int NOT NULL\n) ENGINE=InnoDB",
+			expect:   "CREATE TABLE `tbl_mycat_child` (\n  `id` int NOT NULL\n) ENGINE=InnoDB",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			p := buildTestShowPlan(t, test.db, test.sql)
+			if p == nil {
+				t.Fatalf("expect show plan, sql: %s", test.sql)
+			}
+			result := createTestSelectResult([]string{"Table", "Create Table"}, [][]any{{"phy", test.create}})
+			e := &showExecutor{results: map[string]*mysql.Result{test.key: result}}
+			r, err := p.ExecuteIn(util.NewRequestContext(), e)
+			if err != nil {
+				t.Fatalf("ExecuteIn error: %v", err)
+			}
+			if len(e.executed) != 1 || e.executed[0] != test.executed {
+				t.Errorf("executed sql not equal, expect: %s, actual: %v", test.executed, e.executed)
+			}
+			if r.Values[0][1] != test.expect {
+				t.Errorf("create table not equal, expect: %s, actual: %v", test.expect, r.Values[0][1])
+			}
+		})
+	}
+}
+
+func TestShowPlanShowTableStatus(t *testing.T) {
+	p := buildTestShowPlan(t, "db_ks", "show table status from db_mycat like 'tbl\\_mycat%'")
+	if p == nil {
+		t.Fatalf("expect show plan")
+	}
+
+	names := []string{"Name", "Engine", "Rows", "Avg_row_length", "Data_length", "Auto_increment"}
+	e := &showExecutor{results: map[string]*mysql.Result{
+		"slice-0/db_mycat": createTestSelectResult(names, [][]any{
+			{"tbl_mycat", "InnoDB", uint64(1), uint64(16), uint64(16), uint64(5)},
+			{"tbl_mycat_unshard", "InnoDB", uint64(2), uint64(8), uint64(16), nil},
+			{"other", "InnoDB", uint64(2), uint64(8), uint64(16), nil},
+		}),
+		"slice-0/db_mycat_0": createTestSelectResult(names, [][]any{{"tbl_mycat", "InnoDB", uint64(1), uint64(16), uint64(16), uint64(5)}}),
+		"slice-0/db_mycat_1": createTestSelectResult(names, [][]any{{"tbl_mycat", "InnoDB", uint64(2), uint64(16), uint64(32), uint64(9)}}),
+		"slice-1/db_mycat_2": createTestSelectResult(names, [][]any{{"tbl_mycat", "InnoDB", uint64(3), uint64(16), uint64(48), nil}}),
+		"slice-1/db_mycat_3": createTestSelectResult(names, [][]any{{"tbl_mycat", "InnoDB", uint64(2), uint64(4), uint64(8), uint64(7)}}),
+	}}
+	r, err := p.ExecuteIn(util.NewRequestContext(), e)
+	if err != nil {
+		t.Fatalf("ExecuteIn error: %v", err)
+	}
+	expect := [][]any{
+		{"tbl_mycat", "InnoDB", uint64(8), uint64(13), uint64(104), uint64(9)},
+		{"tbl_mycat_unshard", "InnoDB", uint64(2), uint64(8), uint64(16), nil},
+	}
+	if fmt.Sprint(r.Values) != fmt.Sprint(expect) {
+		t.Errorf("values not equal, expect: %v, actual: %v", expect, r.Values)
+	}
+	for _, sql := range e.executed {
+		if strings.HasPrefix(sql, "slice-1/db_mycat_2: ") && !strings.Contains(sql, "SHOW TABLE STATUS WHERE `Name` IN (") {
+			t.Errorf("unexpected sql: %s", sql)
+		}
+	}
+}
@@ -0,0 +1,354 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/proxy/sequence"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// SubqueryPlan is the plan for statement which contains uncorrelated IN (SELECT ...) or EXISTS subqueries.
+// 先执行子查询, 把结果替换为常量列表或常量, 再对替换后的SQL生成执行计划,
+// 这样外层查询可以按IN中的值计算路由.
+type SubqueryPlan struct {
+	basePlan
+
+	sql        string
+	stmt       ast.StmtNode // 外层查询的语法树, 子查询的执行计划只改写子查询内部的节点, 执行时被替换
+	phyDBs     map[string]string
+	db         string
+	router     *router.Router
+	grayRouter *router.GrayRouter
+	sequences  *sequence.SequenceManager
+
+	subqueryPlans []Plan // 按遍历语法树的顺序
+}
+
+// 收集需要先执行的子查询, 子查询中嵌套的子查询由子查询的执行计划处理
+type subqueryCollector struct {
+	subqueries []ast.ExprNode
+}
+
+// Enter implement ast.Visitor
+func (v *subqueryCollector) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	switch x := n.(type) {
+	case *ast.PatternInExpr:
+		if x.Sel != nil {
+			v.subqueries = append(v.subqueries, x)
+			return n, true
+		}
+	case *ast.ExistsSubqueryExpr:
+		v.subqueries = append(v.subqueries, x)
+		return n, true
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *subqueryCollector) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+func collectSubqueries(stmt ast.StmtNode) []ast.ExprNode {
+	v := &subqueryCollector{}
+	stmt.Accept(v)
+	return v.subqueries
+}
+
+func getSubqueryStmt(expr ast.ExprNode) (ast.StmtNode, error) {
+	var sel ast.ExprNode
+	switch x := expr.(type) {
+	case *ast.PatternInExpr:
+		sel = x.Sel
+	case *ast.ExistsSubqueryExpr:
+		sel = x.Sel
+	}
+	subquery, ok := sel.(*ast.SubqueryExpr)
+	if !ok {
+		return nil, fmt.Errorf("invalid subquery type: %T", sel)
+	}
+	stmt, ok := subquery.Query.(ast.StmtNode)
+	if !ok {
+		return nil, fmt.Errorf("invalid subquery type: %T", subquery.Query)
+	}
+	return stmt, nil
+}
+
+func buildSubqueryPlan(stmt ast.StmtNode, phyDBs map[string]string, db, sql string, r *router.Router, grayRouter *router.GrayRouter, seq *sequence.SequenceManager) (Plan, error) {
+	p := &SubqueryPlan{
+		sql:        sql,
+		stmt:       stmt,
+		phyDBs:     phyDBs,
+		db:         db,
+		router:     r,
+		grayRouter: grayRouter,
+		sequences:  seq,
+	}
+
+	for _, expr := range collectSubqueries(stmt) {
+		subStmt, err := getSubqueryStmt(expr)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkUncorrelatedSubquery(subStmt); err != nil {
+			return nil, err
+		}
+		// EXISTS只需要判断是否有结果
+		if _, ok := expr.(*ast.ExistsSubqueryExpr); ok {
+			if sel, ok := subStmt.(*ast.SelectStmt); ok && sel.Limit == nil {
+				sel.Limit = &ast.Limit{Count: ast.NewValueExpr(1)}
+			}
+		}
+
+		subSQL, err := generateUnshardingSQL(subStmt)
+		if err != nil {
+			return nil, fmt.Errorf("generate subquery sql error: %v", err)
+		}
+		subPlan, err := BuildPlan(subStmt, phyDBs, db, subSQL, r, grayRouter, seq, nil)
+		if err != nil {
+			return nil, fmt.Errorf("build subquery plan error: %v", err)
+		}
+		p.subqueryPlans = append(p.subqueryPlans, subPlan)
+	}
+	return p, nil
+}
+
+// 子查询中带有表名的列必须引用子查询自身的表, 否则认为是关联子查询
+func checkUncorrelatedSubquery(stmt ast.StmtNode) error {
+	tables := &subqueryTableVisitor{tables: make(map[string]bool)}
+	stmt.Accept(tables)
+	v := &correlatedColumnVisitor{tables: tables.tables}
+	stmt.Accept(v)
+	if v.column != nil {
+		return fmt.Errorf("correlated subquery is not supported, column: %s.%s", v.column.Table.O, v.column.Name.O)
+	}
+	return nil
+}
+
+// subqueryTableVisitor 收集子查询中的表名和表别名
+type subqueryTableVisitor struct {
+	tables map[string]bool
+}
+
+// Enter implement ast.Visitor
+func (v *subqueryTableVisitor) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if tableSource, ok := n.(*ast.TableSource); ok {
+		if tableSource.AsName.L != "" {
+			v.tables[tableSource.AsName.L] = true
+		}
+		if tableName, ok := tableSource.Source.(*ast.TableName); ok {
+			v.tables[tableName.Name.L] = true
+		}
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *subqueryTableVisitor) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+// correlatedColumnVisitor 查找引用了子查询以外的表的列
+type correlatedColumnVisitor struct {
+	tables map[string]bool
+	column *ast.ColumnName
+}
+
+// Enter implement ast.Visitor
+func (v *correlatedColumnVisitor) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if v.column != nil {
+		return n, true
+	}
+	if column, ok := n.(*ast.ColumnName); ok && column.Table.L != "" {
+		if !v.tables[column.Table.L] {
+			v.column = column
+		}
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *correlatedColumnVisitor) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+// ExecuteIn implement Plan
+// 执行计划只执行一次, 子查询的结果直接替换到生成计划时的语法树中
+func (p *SubqueryPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	if p.stmt == nil {
+		return nil, fmt.Errorf("subquery plan has been executed")
+	}
+	stmt := p.stmt
+	p.stmt = nil
+
+	results := make([]*mysql.Result, 0, len(p.subqueryPlans))
+	raws := make([]bool, 0, len(p.subqueryPlans))
+	for i, subPlan := range p.subqueryPlans {
+		r, err := subPlan.ExecuteIn(reqCtx, sess)
+		if err != nil {
+			// 子查询单独执行, 引用外层查询的列时后端返回未知列的错误
+			var sqlErr *mysql.SQLError
+			if errors.As(err, &sqlErr) && sqlErr.Code == mysql.ErrBadField {
+				return nil, fmt.Errorf("execute subquery %d error, correlated subquery is not supported: %v", i+1, err)
+			}
+			return nil, fmt.Errorf("execute subquery %d error: %v", i+1, err)
+		}
+		if r == nil || r.Resultset == nil {
+			return nil, fmt.Errorf("subquery %d returns no result set", i+1)
+		}
+		results = append(results, r)
+		raws = append(raws, isBackendResult(subPlan))
+	}
+
+	v := &subqueryReplacer{results: results, raws: raws, maxValues: reqCtx.GetMaxSubqueryInValues()}
+	stmt.Accept(v)
+	if v.err != nil {
+		return nil, v.err
+	}
+	if v.index != len(results) {
+		return nil, fmt.Errorf("subquery count not match, expect: %d, actual: %d", len(results), v.index)
+	}
+
+	sql, err := generateUnshardingSQL(stmt)
+	if err != nil {
+		return nil, fmt.Errorf("generate sql error: %v", err)
+	}
+	plan, err := BuildPlan(stmt, p.phyDBs, p.db, sql, p.router, p.grayRouter, p.sequences, nil)
+	if err != nil {
+		return nil, fmt.Errorf("build plan with subquery result error: %v", err)
+	}
+	return plan.ExecuteIn(reqCtx, sess)
+}
+
+// subqueryReplacer 按收集子查询时的顺序, 把子查询替换为执行结果
+type subqueryReplacer struct {
+	results   []*mysql.Result
+	raws      []bool // 结果直接来自后端, 可以使用每行的原始文本
+	maxValues int
+	index     int
+	err       error
+}
+
+// Enter implement ast.Visitor
+func (v *subqueryReplacer) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	switch x := n.(type) {
+	case *ast.PatternInExpr:
+		if x.Sel != nil {
+			return n, true
+		}
+	case *ast.ExistsSubqueryExpr:
+		return n, true
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *subqueryReplacer) Leave(n ast.Node) (node ast.Node, ok bool) {
+	if v.err != nil {
+		return n, false
+	}
+
+	switch x := n.(type) {
+	case *ast.PatternInExpr:
+		if x.Sel == nil {
+			return n, true
+		}
+		r, err := v.next()
+		if err != nil {
+			v.err = err
+			return n, false
+		}
+		if len(r.Fields) != 1 {
+			v.err = fmt.Errorf("operand should contain 1 column(s), subquery: %d", v.index)
+			return n, false
+		}
+		// IN ()不是合法的SQL, 空列表时直接替换为结果
+		if len(r.Values) == 0 {
+			return newBoolValueExpr(x.Not), true
+		}
+		list, err := createInValueList(r, v.raws[v.index-1], v.maxValues)
+		if err != nil {
+			v.err = err
+			return n, false
+		}
+		x.Sel = nil
+		x.List = list
+		return x, true
+	case *ast.ExistsSubqueryExpr:
+		r, err := v.next()
+		if err != nil {
+			v.err = err
+			return n, false
+		}
+		return newBoolValueExpr((len(r.Values) != 0) != x.Not), true
+	}
+	return n, true
+}
+
+func (v *subqueryReplacer) next() (*mysql.Result, error) {
+	if v.index >= len(v.results) {
+		return nil, fmt.Errorf("subquery count not match, expect: %d", len(v.results))
+	}
+	r := v.results[v.index]
+	v.index++
+	return r, nil
+}
+
+// 子查询结果去重后作为IN的常量列表, NULL保留, 与MySQL的语义一致.
+// 结果直接来自后端时使用原始文本, DECIMAL不经过float64
+func createInValueList(r *mysql.Result, raw bool, maxValues int) ([]ast.ExprNode, error) {
+	list := make([]ast.ExprNode, 0, len(r.Values))
+	seen := make(map[string]bool, len(r.Values))
+	var hasNull bool
+	for i, row := range r.Values {
+		if row[0] == nil {
+			if !hasNull {
+				hasNull = true
+				list = append(list, ast.NewValueExpr(nil))
+			}
+			continue
+		}
+		values, err := createResultRowValueExprs(r, i, raw)
+		if err != nil {
+			return nil, err
+		}
+		key, err := restoreNode(values[0])
+		if err != nil {
+			return nil, err
+		}
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if maxValues > 0 && len(seen) > maxValues {
+			return nil, fmt.Errorf("subquery returns more than %d distinct values, max_subquery_in_values: %d", maxValues, maxValues)
+		}
+		list = append(list, values[0])
+	}
+	return list, nil
+}
+
+func newBoolValueExpr(b bool) ast.ExprNode {
+	if b {
+		return ast.NewValueExpr(int64(1))
+	}
+	return ast.NewValueExpr(int64(0))
+}
@@ -0,0 +1,239 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// subqueryExecutor 子查询读取tbl_mycat_child, 只有db_mycat_1和db_mycat_2上各有一行, id为分片的序号,
+// 并记录外层查询的SQL
+type subqueryExecutor struct {
+	mockExecutor
+	subquerySQLs []string
+	sqls         map[string]map[string][]string
+}
+
+func (e *subqueryExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]*mysql.Result, error) {
+	var rs []*mysql.Result
+	for slice, dbSQLs := range sqls {
+		for db, sqlList := range dbSQLs {
+			for _, sql := range sqlList {
+				if strings.Contains(sql, "`tbl_mycat_child`") {
+					e.subquerySQLs = append(e.subquerySQLs, sql)
+					var idx int
+					fmt.Sscanf(db, "db_mycat_%d", &idx)
+					var values [][]any
+					if idx == 1 || idx == 2 {
+						values = append(values, []any{int64(idx)})
+					}
+					rs = append(rs, createTestSelectResult([]string{"id"}, values))
+					continue
+				}
+				e.record(slice, db, sql)
+				rs = append(rs, createTestSelectResult([]string{"id"}, nil))
+			}
+		}
+	}
+	return rs, nil
+}
+
+func (e *subqueryExecutor) ExecuteSQL(reqCtx *util.RequestContext, slice, db, sql string) (*mysql.Result, error) {
+	e.record(slice, db, sql)
+	return createTestSelectResult([]string{"id"}, nil), nil
+}
+
+func (e *subqueryExecutor) record(slice, db, sql string) {
+	if e.sqls[slice] == nil {
+		e.sqls[slice] = make(map[string][]string)
+	}
+	e.sqls[slice][db] = append(e.sqls[slice][db], sql)
+}
+
+func TestSubqueryPlan(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	grayRouter := router.NewGrayRouter(&models.Namespace{})
+
+	tests := []struct {
+		sql          string
+		subquerySQLs []string
+		sqls         map[string]map[string][]string
+		hasErr       bool
+	}{
+		{
+			// 按子查询的结果计算路由
+			sql: "select * from tbl_mycat where id in (select id from tbl_mycat_child where a = 1) and a > 0",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat_1": {"SELECT * FROM `tbl_mycat` WHERE `id` IN (1) AND `a`>0"}},
+				"slice-1": {"db_mycat_2": {"SELECT * FROM `tbl_mycat` WHERE `id` IN (2) AND `a`>0"}},
+			},
+		},
+		{
+			sql:          "select * from tbl_mycat where id not in (select id from tbl_mycat_child where id = 3)",
+			subquerySQLs: []string{"SELECT `id` FROM `tbl_mycat_child` WHERE `id`=3"},
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat_0": {"SELECT * FROM `tbl_mycat` WHERE 1"}, "db_mycat_1": {"SELECT * FROM `tbl_mycat` WHERE 1"}},
+				"slice-1": {"db_mycat_2": {"SELECT * FROM `tbl_mycat` WHERE 1"}, "db_mycat_3": {"SELECT * FROM `tbl_mycat` WHERE 1"}},
+			},
+		},
+		{
+			sql:          "select * from tbl_mycat where id = 1 and exists (select 1 from tbl_mycat_child c where c.id = 2)",
+			subquerySQLs: []string{"SELECT 1 FROM `tbl_mycat_child` AS `c` WHERE `c`.`id`=2 LIMIT 1"},
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat_1": {"SELECT * FROM `tbl_mycat` WHERE `id`=1 AND 1"}},
+			},
+		},
+		{
+			// 外层查询为非分片表
+			sql: "select * from tbl_unshard where id in (select id from tbl_mycat_child order by id)",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat": {"SELECT * FROM `tbl_unshard` WHERE `id` IN (1,2)"}},
+			},
+		},
+		{
+			sql: "delete from tbl_mycat where id in (select id from tbl_mycat_child where a = 1)",
+			sqls: map[string]map[string][]string{
+				"slice-0": {"db_mycat_1": {"DELETE FROM `tbl_mycat` WHERE `id` IN (1)"}},
+				"slice-1": {"db_mycat_2": {"DELETE FROM `tbl_mycat` WHERE `id` IN (2)"}},
+			},
+		},
+		{
+			sql:    "select * from tbl_mycat where id in (select id from tbl_mycat_child where tbl_mycat_child.a = tbl_mycat.a)",
+			hasErr: true, // correlated subquery
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", test.sql, ns.rt, grayRouter, ns.seqs, nil)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, actual plan: %T", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			if _, ok := p.(*SubqueryPlan); !ok {
+				t.Fatalf("plan type not equal, expect: *SubqueryPlan, actual: %T", p)
+			}
+
+			reqCtx := util.NewRequestContext()
+			reqCtx.SetDefaultSlice("slice-0")
+			executor := &subqueryExecutor{sqls: make(map[string]map[string][]string)}
+			if _, err := p.ExecuteIn(reqCtx, executor); err != nil {
+				t.Fatalf("ExecuteIn error: %v", err)
+			}
+			if test.subquerySQLs != nil && strings.Join(executor.subquerySQLs, ";") != strings.Join(test.subquerySQLs, ";") {
+				t.Errorf("subquery sqls not equal, expect: %v, actual: %v", test.subquerySQLs, executor.subquerySQLs)
+			}
+			if !checkSQLs(test.sqls, executor.sqls) {
+				t.Errorf("sqls not equal, expect: %v, actual: %v", test.sqls, executor.sqls)
+			}
+		})
+	}
+}
+
+func TestCreateInValueList(t *testing.T) {
+	fields := []*mysql.Field{{Name: []byte("amount"), Type: mysql.TypeNewDecimal, Decimal: 4, ColumnLength: 20}}
+	r := createTestSelectResultWithValues(t, fields, [][]any{
+		{"12345678901234.5678"}, {"12345678901234.5679"}, {"12345678901234.5678"}, {nil}, {nil},
+	})
+
+	tests := []struct {
+		name      string
+		raw       bool
+		maxValues int
+		expect    string
+		hasErr    bool
+	}{
+		// 超过15位有效数字的DECIMAL解析为float64后相同, 使用原始文本时不会被错误去重
+		{name: "raw", raw: true, expect: "12345678901234.5678,12345678901234.5679,NULL"},
+		{name: "merged", raw: false, hasErr: true},
+		{name: "max values", raw: true, maxValues: 2, expect: "12345678901234.5678,12345678901234.5679,NULL"},
+		{name: "too many values", raw: true, maxValues: 1, hasErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			list, err := createInValueList(r, test.raw, test.maxValues)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, actual list: %v", list)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createInValueList error: %v", err)
+			}
+			var values []string
+			for _, v := range list {
+				s, err := restoreNode(v)
+				if err != nil {
+					t.Fatalf("restore value error: %v", err)
+				}
+				values = append(values, s)
+			}
+			if actual := strings.Join(values, ","); actual != test.expect {
+				t.Errorf("in list not equal, expect: %s, actual: %s", test.expect, actual)
+			}
+		})
+	}
+}
+
+// badFieldExecutor 子查询中的列不存在时, 后端返回未知列的错误
+type badFieldExecutor struct {
+	mockExecutor
+}
+
+func (e *badFieldExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]*mysql.Result, error) {
+	return nil, mysql.NewError(mysql.ErrBadField, "Unknown column 'b' in 'where clause'")
+}
+
+func TestSubqueryPlanUnknownColumn(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	// 没有表名的列引用外层查询时, 子查询单独执行找不到该列
+	sql := "select * from tbl_mycat where id in (select id from tbl_mycat_child where a = b)"
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", sql, ns.rt, router.NewGrayRouter(&models.Namespace{}), ns.seqs, nil)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	_, err = p.ExecuteIn(util.NewRequestContext(), &badFieldExecutor{})
+	if err == nil || !strings.Contains(err.Error(), "correlated subquery is not supported") {
+		t.Errorf("expect correlated subquery error, actual: %v", err)
+	}
+}
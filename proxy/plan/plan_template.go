@@ -0,0 +1,629 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/format"
+	"github.com/XiaoMi/Gaea/parser/opcode"
+	"github.com/XiaoMi/Gaea/parser/tidb-types"
+	driver "github.com/XiaoMi/Gaea/parser/tidb-types/parser_driver"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/proxy/sequence"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// 生成探测SQL时各类型常量的起始值, 保证与SQL中原有的常量区分开
+const (
+	probeIntBase    = 1000000000
+	probeUintBase   = uint64(18000000000000000000)
+	probeDecBase    = 2000000000
+	probeFloatBase  = 3000000000
+	probeStringBase = "gaea_param_"
+)
+
+// PlanTemplate 参数化SQL的执行计划模板, 缓存在namespace中.
+// 只有按分片列等值条件路由到一张分表的单表SELECT, UPDATE, DELETE可以使用模板: 命中缓存时不解析SQL, 也不重新生成执行计划,
+// 只根据分片列的参数重新计算路由, 再把参数填入该分表的SQL模板. 分表的SQL模板在第一次路由到该分表时生成.
+// 不能使用模板的SQL也会缓存, 记录原因, 避免每次重新生成.
+type PlanTemplate struct {
+	err error // 不能使用模板的原因
+
+	plan       templatePlan
+	stmt       ast.StmtNode // 生成执行计划后的语法树, 参数已替换为paramExpr
+	result     *RouteResult // 语法树中装饰器使用的路由结果, 生成分表的SQL模板时修改
+	rule       router.Rule
+	route      *paramExpr // 分片列等值条件中的参数
+	paramCount int
+
+	mu     sync.Mutex // 保护result和语法树的Restore
+	shards sync.Map   // table index -> *shardSQL
+}
+
+// Size implement cache.Value
+func (t *PlanTemplate) Size() int {
+	return 1
+}
+
+// templatePlan 可以生成模板的执行计划
+type templatePlan interface {
+	Plan
+	getStmtInfo() *TableAliasStmtInfo
+	getShardSQLs() map[string]map[string][]string
+	// withRoute 复制执行计划并替换语句信息和分片SQL, 语法树等只读的部分与原执行计划共享
+	withRoute(info *TableAliasStmtInfo, sqls map[string]map[string][]string) Plan
+}
+
+func (s *SelectPlan) getStmtInfo() *TableAliasStmtInfo {
+	return s.TableAliasStmtInfo
+}
+
+func (s *SelectPlan) getShardSQLs() map[string]map[string][]string {
+	return s.sqls
+}
+
+func (s *SelectPlan) withRoute(info *TableAliasStmtInfo, sqls map[string]map[string][]string) Plan {
+	ret := *s
+	ret.TableAliasStmtInfo = info
+	ret.sqls = sqls
+	return &ret
+}
+
+func (s *UpdatePlan) getStmtInfo() *TableAliasStmtInfo {
+	return s.TableAliasStmtInfo
+}
+
+func (s *UpdatePlan) getShardSQLs() map[string]map[string][]string {
+	return s.sqls
+}
+
+func (s *UpdatePlan) withRoute(info *TableAliasStmtInfo, sqls map[string]map[string][]string) Plan {
+	ret := *s
+	ret.TableAliasStmtInfo = info
+	ret.sqls = sqls
+	return &ret
+}
+
+func (p *DeletePlan) getStmtInfo() *TableAliasStmtInfo {
+	return p.TableAliasStmtInfo
+}
+
+func (p *DeletePlan) getShardSQLs() map[string]map[string][]string {
+	return p.sqls
+}
+
+func (p *DeletePlan) withRoute(info *TableAliasStmtInfo, sqls map[string]map[string][]string) Plan {
+	ret := *p
+	ret.TableAliasStmtInfo = info
+	ret.sqls = sqls
+	return &ret
+}
+
+// cloneWithRoute 复制语句信息并替换SQL原文和路由结果, 使用到的表和别名共享
+func (t *TableAliasStmtInfo) cloneWithRoute(sql string, result *RouteResult) *TableAliasStmtInfo {
+	info := *t.StmtInfo
+	info.sql = sql
+	info.result = result
+	return &TableAliasStmtInfo{
+		StmtInfo:   &info,
+		tableAlias: t.tableAlias,
+		hintPhyDB:  t.hintPhyDB,
+	}
+}
+
+// BuildPlanTemplate 生成参数化SQL的执行计划, 同时生成执行计划模板.
+// 只解析一次SQL: 把参数替换为互不相同的探测值后解析, 根据探测值找到每个参数对应的ValueExpr, 换回当前SQL中的值后生成执行计划.
+// 参数没有解析为ValueExpr (如ORDER BY 1, CHAR(10)), 或者同一个参数对应多个ValueExpr时, 返回的执行计划为nil, 需要按原SQL解析.
+// 返回的模板不为nil时可以放入缓存.
+func BuildPlanTemplate(ps *parser.ParameterizedSQL, phyDBs map[string]string, db, sql string, router *router.Router, grayRouter *router.GrayRouter, seq *sequence.SequenceManager) (Plan, *PlanTemplate, error) {
+	stmt, values, err := parseTemplateStmt(ps)
+	if err != nil {
+		return nil, &PlanTemplate{err: err}, nil
+	}
+	probes := make([]interface{}, len(values))
+	for i, v := range values {
+		probes[i] = v.GetValue()
+		setParamValue(v, ps.Params[i])
+	}
+	stmt.SetText(sql)
+
+	// 装饰器会替换条件中的节点, 需要在生成执行计划前找到分片列的等值条件
+	conds, err := checkTemplateStmt(stmt, values)
+	p, planErr := BuildPlan(stmt, phyDBs, db, sql, router, grayRouter, seq, nil)
+	if planErr != nil {
+		return nil, nil, planErr
+	}
+	if err != nil {
+		return p, &PlanTemplate{err: err}, nil
+	}
+
+	t, err := newPlanTemplate(p, stmt, values, probes, conds, sql, ps.Params)
+	if err != nil {
+		return p, &PlanTemplate{err: err}, nil
+	}
+	bound, err := t.Bind(sql, ps.Params)
+	if err != nil {
+		return p, &PlanTemplate{err: err}, nil
+	}
+	return bound, t, nil
+}
+
+// parseTemplateStmt 解析参数替换为探测值的SQL, 返回语法树和每个参数对应的ValueExpr
+func parseTemplateStmt(p *parser.ParameterizedSQL) (ast.StmtNode, []*driver.ValueExpr, error) {
+	literals := make([]string, len(p.Kinds))
+	keys := make(map[string]int, len(p.Kinds))
+	for i := 0; i < len(p.Kinds); i++ {
+		literal, value, err := probeParam(p.Kinds[i], i)
+		if err != nil {
+			return nil, nil, err
+		}
+		literals[i] = literal
+		keys[valueKey(value)] = i
+	}
+	sql, err := p.Fill(literals)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse probe sql error: %v", err)
+	}
+	switch stmt.(type) {
+	case *ast.SelectStmt, *ast.InsertStmt, *ast.UpdateStmt, *ast.DeleteStmt, *ast.UnionStmt:
+	default:
+		return nil, nil, fmt.Errorf("statement type %T is not cacheable", stmt)
+	}
+
+	v := &probeVisitor{keys: keys, values: make([]*driver.ValueExpr, len(p.Kinds))}
+	stmt.Accept(v)
+	if v.err != nil {
+		return nil, nil, v.err
+	}
+	for i, value := range v.values {
+		if value == nil {
+			return nil, nil, fmt.Errorf("param %d is not a value expression", i)
+		}
+	}
+	return stmt, v.values, nil
+}
+
+// probeParam 返回第i个参数的探测值和词法分析得到的值
+func probeParam(kind byte, i int) (string, interface{}, error) {
+	switch kind {
+	case parser.ParamKindInt:
+		return strconv.Itoa(probeIntBase + i), int64(probeIntBase + i), nil
+	case parser.ParamKindUint:
+		return strconv.FormatUint(probeUintBase+uint64(i), 10), probeUintBase + uint64(i), nil
+	case parser.ParamKindDecimal:
+		literal := strconv.Itoa(probeDecBase+i) + ".5"
+		value, err := ast.NewDecimal(literal)
+		return literal, value, err
+	case parser.ParamKindFloat:
+		return strconv.Itoa(probeFloatBase+i) + "e0", float64(probeFloatBase + i), nil
+	case parser.ParamKindString:
+		value := probeStringBase + strconv.Itoa(i)
+		return "'" + value + "'", value, nil
+	case parser.ParamKindHex:
+		literal := fmt.Sprintf("x'%08x'", i)
+		value, err := ast.NewHexLiteral(literal)
+		return literal, value, err
+	default:
+		literal := fmt.Sprintf("b'1%031b'", i)
+		value, err := ast.NewBitLiteral(literal)
+		return literal, value, err
+	}
+}
+
+// valueKey 用于比较ValueExpr中的值与探测值, LIMIT中的整数会被转换为uint64, 因此整数不区分符号
+func valueKey(value interface{}) string {
+	switch x := value.(type) {
+	case int64:
+		return "n" + strconv.FormatInt(x, 10)
+	case uint64:
+		return "n" + strconv.FormatUint(x, 10)
+	case float64:
+		return "f" + strconv.FormatFloat(x, 'e', -1, 64)
+	case *types.MyDecimal:
+		return "d" + x.String()
+	case string:
+		return "s" + x
+	case types.HexLiteral:
+		return "b" + types.BinaryLiteral(x).ToString()
+	case types.BitLiteral:
+		return "b" + types.BinaryLiteral(x).ToString()
+	case types.BinaryLiteral:
+		return "b" + x.ToString()
+	}
+	return ""
+}
+
+// setParamValue 把参数设置到ValueExpr中, LIMIT中的整数解析为uint64
+func setParamValue(x ast.ValueExpr, value interface{}) {
+	if _, ok := x.GetValue().(uint64); ok {
+		if i, ok := value.(int64); ok {
+			value = uint64(i)
+		}
+	}
+	x.SetValue(value)
+}
+
+type probeVisitor struct {
+	keys   map[string]int
+	values []*driver.ValueExpr
+
+	noAliasFields int // 所在的没有别名的SelectField数量
+	err           error
+}
+
+// Enter implement ast.Visitor
+func (v *probeVisitor) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if v.err != nil {
+		return n, true
+	}
+	switch x := n.(type) {
+	case *ast.SelectField:
+		if x.AsName.L == "" {
+			v.noAliasFields++
+		}
+	case *driver.ValueExpr:
+		idx, ok := v.keys[valueKey(x.GetValue())]
+		if !ok {
+			break
+		}
+		if v.values[idx] != nil {
+			v.err = fmt.Errorf("param %d is used more than once", idx)
+			break
+		}
+		// 没有别名的列名取自SQL原文, 替换参数后与原文不一致
+		if v.noAliasFields > 0 {
+			v.err = fmt.Errorf("param %d is used in select field without alias", idx)
+			break
+		}
+		v.values[idx] = x
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *probeVisitor) Leave(n ast.Node) (node ast.Node, ok bool) {
+	if field, ok := n.(*ast.SelectField); ok && field.AsName.L == "" {
+		v.noAliasFields--
+	}
+	return n, true
+}
+
+// equalCondition WHERE中AND连接的`列 = 参数`条件
+type equalCondition struct {
+	column string
+	param  int
+}
+
+// checkTemplateStmt 检查语句是否为不含子查询的单表SELECT, UPDATE, DELETE, 返回WHERE中AND连接的等值条件
+func checkTemplateStmt(stmt ast.StmtNode, values []*driver.ValueExpr) ([]equalCondition, error) {
+	var where ast.ExprNode
+	switch s := stmt.(type) {
+	case *ast.SelectStmt:
+		where = s.Where
+	case *ast.UpdateStmt:
+		where = s.Where
+	case *ast.DeleteStmt:
+		where = s.Where
+	default:
+		return nil, fmt.Errorf("statement type %T is not cacheable", stmt)
+	}
+
+	v := &tableCountVisitor{root: stmt}
+	stmt.Accept(v)
+	if v.subquery {
+		return nil, fmt.Errorf("statement with subquery is not cacheable")
+	}
+	if v.tables != 1 {
+		return nil, fmt.Errorf("statement with %d tables is not cacheable", v.tables)
+	}
+
+	params := make(map[*driver.ValueExpr]int, len(values))
+	for i, value := range values {
+		params[value] = i
+	}
+	return collectEqualConditions(where, params, nil), nil
+}
+
+func collectEqualConditions(expr ast.ExprNode, params map[*driver.ValueExpr]int, conds []equalCondition) []equalCondition {
+	switch x := expr.(type) {
+	case *ast.ParenthesesExpr:
+		return collectEqualConditions(x.Expr, params, conds)
+	case *ast.BinaryOperationExpr:
+		switch x.Op {
+		case opcode.LogicAnd:
+			conds = collectEqualConditions(x.L, params, conds)
+			return collectEqualConditions(x.R, params, conds)
+		case opcode.EQ:
+			column, ok := x.L.(*ast.ColumnNameExpr)
+			value, isValue := x.R.(*driver.ValueExpr)
+			if !ok {
+				column, ok = x.R.(*ast.ColumnNameExpr)
+				value, isValue = x.L.(*driver.ValueExpr)
+			}
+			if !ok || !isValue {
+				return conds
+			}
+			if idx, ok := params[value]; ok {
+				conds = append(conds, equalCondition{column: column.Name.Name.L, param: idx})
+			}
+		}
+	}
+	return conds
+}
+
+type tableCountVisitor struct {
+	root     ast.Node
+	tables   int
+	subquery bool
+}
+
+// Enter implement ast.Visitor
+func (v *tableCountVisitor) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	switch n.(type) {
+	case *ast.TableName:
+		v.tables++
+	case *ast.SubqueryExpr, *ast.ExistsSubqueryExpr, *ast.SelectStmt, *ast.UnionStmt:
+		if n != v.root {
+			v.subquery = true
+			return n, true
+		}
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *tableCountVisitor) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
+
+// newPlanTemplate 检查执行计划是否只按分片列的等值条件路由到一张分表, 并把语法树中的参数替换为paramExpr
+func newPlanTemplate(p Plan, stmt ast.StmtNode, values []*driver.ValueExpr, probes []interface{}, conds []equalCondition, sql string, params []interface{}) (*PlanTemplate, error) {
+	tp, ok := p.(templatePlan)
+	if !ok {
+		return nil, fmt.Errorf("plan type %T is not cacheable", p)
+	}
+	if sp, ok := p.(*SelectPlan); ok && sp.needMergeResult() {
+		return nil, fmt.Errorf("select plan which needs to merge result is not cacheable")
+	}
+	info := tp.getStmtInfo()
+	if info.routeHint != nil || info.hintPhyDB != "" {
+		return nil, fmt.Errorf("plan with hint is not cacheable")
+	}
+	if len(info.tableRules) != 1 || len(info.globalTableRules) != 0 {
+		return nil, fmt.Errorf("plan using %d sharding tables and %d global tables is not cacheable", len(info.tableRules), len(info.globalTableRules))
+	}
+	if len(info.result.GetShardIndexes()) != 1 {
+		return nil, fmt.Errorf("plan routed to %d tables is not cacheable", len(info.result.GetShardIndexes()))
+	}
+
+	var rule router.Rule
+	for _, r := range info.tableRules {
+		rule = r
+	}
+	routeParam := -1
+	for _, cond := range conds {
+		if cond.column != rule.GetShardingColumn() {
+			continue
+		}
+		if routeParam != -1 {
+			return nil, fmt.Errorf("more than one equal condition on sharding column %s", cond.column)
+		}
+		routeParam = cond.param
+	}
+	if routeParam == -1 {
+		return nil, fmt.Errorf("no equal condition on sharding column %s", rule.GetShardingColumn())
+	}
+
+	v := &paramReplaceVisitor{params: make(map[*driver.ValueExpr]int, len(values)), exprs: make([]*paramExpr, len(values))}
+	for i, value := range values {
+		v.params[value] = i
+	}
+	stmt.Accept(v)
+	for i, expr := range v.exprs {
+		if expr == nil {
+			return nil, fmt.Errorf("param %d is not found in plan", i)
+		}
+	}
+	// 替换后原来的ValueExpr改回探测值, 执行计划中没有被替换的引用会使生成的SQL与执行计划不一致
+	for i, value := range values {
+		value.SetValue(probes[i])
+	}
+
+	t := &PlanTemplate{
+		plan:       tp,
+		stmt:       stmt,
+		result:     info.result,
+		rule:       rule,
+		route:      v.exprs[routeParam],
+		paramCount: len(values),
+	}
+	bound, err := t.Bind(sql, params)
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(bound.(templatePlan).getShardSQLs(), tp.getShardSQLs()) {
+		return nil, fmt.Errorf("sqls of template not equal to plan")
+	}
+	return t, nil
+}
+
+type paramReplaceVisitor struct {
+	params map[*driver.ValueExpr]int
+	exprs  []*paramExpr
+}
+
+// Enter implement ast.Visitor
+func (v *paramReplaceVisitor) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *paramReplaceVisitor) Leave(n ast.Node) (node ast.Node, ok bool) {
+	x, ok := n.(*driver.ValueExpr)
+	if !ok {
+		return n, true
+	}
+	idx, ok := v.params[x]
+	if !ok {
+		return n, true
+	}
+	if v.exprs[idx] == nil {
+		v.exprs[idx] = &paramExpr{ValueExpr: *x, index: idx}
+	}
+	return v.exprs[idx], true
+}
+
+// Bind 按参数生成执行计划: 根据分片列的参数重新计算路由, 把参数填入对应分表的SQL模板
+func (t *PlanTemplate) Bind(sql string, params []interface{}) (Plan, error) {
+	if t.err != nil {
+		return nil, fmt.Errorf("sql is not cacheable: %v", t.err)
+	}
+	if len(params) != t.paramCount {
+		return nil, fmt.Errorf("param count not match, expect: %d, actual: %d", t.paramCount, len(params))
+	}
+
+	value, err := util.GetValueExprResult(t.route.bind(params[t.route.index]))
+	if err != nil {
+		return nil, fmt.Errorf("get route value error: %v", err)
+	}
+	index, err := t.rule.FindTableIndex(value)
+	if err != nil {
+		return nil, fmt.Errorf("find table index error: %v", err)
+	}
+	shard, err := t.getShardSQL(index)
+	if err != nil {
+		return nil, err
+	}
+	s, err := shard.fill(params)
+	if err != nil {
+		return nil, err
+	}
+
+	info := t.plan.getStmtInfo().cloneWithRoute(sql, NewRouteResult(t.result.db, t.result.table, []int{index}))
+	return t.plan.withRoute(info, map[string]map[string][]string{shard.slice: {shard.db: {s}}}), nil
+}
+
+// getShardSQL 返回分表的SQL模板, 第一次使用时按该分表的路由Restore语法树生成
+func (t *PlanTemplate) getShardSQL(index int) (*shardSQL, error) {
+	if s, ok := t.shards.Load(index); ok {
+		return s.(*shardSQL), nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if s, ok := t.shards.Load(index); ok {
+		return s.(*shardSQL), nil
+	}
+	t.result.indexes = []int{index}
+	t.result.Reset()
+	w := &shardSQLWriter{}
+	if err := t.stmt.Restore(format.NewRestoreCtx(format.EscapeRestoreFlags, w)); err != nil {
+		return nil, fmt.Errorf("restore template of table %d error: %v", index, err)
+	}
+	dbName, _ := t.rule.GetDatabaseNameByTableIndex(index)
+	s := w.finish(t.rule.GetSlice(t.rule.GetSliceIndexFromTableIndex(index)), dbName)
+	t.shards.Store(index, s)
+	return s, nil
+}
+
+// paramExpr 执行计划模板中的参数, 生成分表的SQL模板时只记录位置, 其他情况与原来的ValueExpr相同
+type paramExpr struct {
+	driver.ValueExpr
+	index int // 参数序号
+}
+
+// Restore implement ast.Node
+func (p *paramExpr) Restore(ctx *format.RestoreCtx) error {
+	if w, ok := ctx.In.(*shardSQLWriter); ok {
+		w.addParam(p)
+		return nil
+	}
+	return p.ValueExpr.Restore(ctx)
+}
+
+// Accept implement ast.Node
+func (p *paramExpr) Accept(v ast.Visitor) (ast.Node, bool) {
+	node, _ := v.Enter(p)
+	return v.Leave(node)
+}
+
+// bind 返回类型与模板中相同, 值为param的ValueExpr
+func (p *paramExpr) bind(param interface{}) *driver.ValueExpr {
+	v := p.ValueExpr
+	setParamValue(&v, param)
+	return &v
+}
+
+// shardSQL 分表的SQL模板, 由参数分隔为len(params)+1段
+type shardSQL struct {
+	slice    string
+	db       string
+	segments []string
+	params   []*paramExpr
+	size     int
+}
+
+func (s *shardSQL) fill(params []interface{}) (string, error) {
+	var sb strings.Builder
+	sb.Grow(s.size + 16*len(s.params))
+	ctx := format.NewRestoreCtx(format.EscapeRestoreFlags, &sb)
+	for i, p := range s.params {
+		sb.WriteString(s.segments[i])
+		if err := p.bind(params[p.index]).Restore(ctx); err != nil {
+			return "", fmt.Errorf("restore param %d error: %v", p.index, err)
+		}
+	}
+	sb.WriteString(s.segments[len(s.params)])
+	return sb.String(), nil
+}
+
+// shardSQLWriter Restore语法树时按参数的位置把SQL分段
+type shardSQLWriter struct {
+	strings.Builder
+	segments []string
+	params   []*paramExpr
+	last     int
+}
+
+func (w *shardSQLWriter) addParam(p *paramExpr) {
+	s := w.String()
+	w.segments = append(w.segments, s[w.last:])
+	w.params = append(w.params, p)
+	w.last = len(s)
+}
+
+func (w *shardSQLWriter) finish(slice, db string) *shardSQL {
+	s := w.String()
+	w.segments = append(w.segments, s[w.last:])
+	return &shardSQL{
+		slice:    slice,
+		db:       db,
+		segments: w.segments,
+		params:   w.params,
+		size:     len(s),
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+)
+
+func getPlanSQLs(t *testing.T, ns *PlanInfo, stmt ast.StmtNode, db, sql string) map[string]map[string][]string {
+	p, err := BuildPlan(stmt, ns.phyDBs, db, sql, ns.rt, nil, ns.seqs, nil)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+	return planSQLs(t, p)
+}
+
+func planSQLs(t *testing.T, p Plan) map[string]map[string][]string {
+	switch x := p.(type) {
+	case *SelectPlan:
+		return x.GetSQLs()
+	case *InsertPlan:
+		return x.sqls
+	case *UpdatePlan:
+		return x.sqls
+	case *DeletePlan:
+		return x.sqls
+	}
+	t.Fatalf("unexpected plan type: %T", p)
+	return nil
+}
+
+func TestPlanTemplateBind(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		db    string
+		first string   // 生成模板的SQL
+		sqls  []string // 与first的模板相同
+	}{
+		{
+			db:    "db_mycat",
+			first: "select * from tbl_mycat where id = 1 and a = 'x' order by a limit 10",
+			sqls: []string{
+				"select * from tbl_mycat where id = 2 and a = 'y' order by a limit 5",
+				"select * from tbl_mycat where id = 7 and a = 'it''s' order by a limit 0",
+			},
+		},
+		{
+			db:    "db_ks",
+			first: "select name as n from tbl_ks t where t.id = 1 and name > 'a' limit 1",
+			sqls: []string{
+				"select name as n from tbl_ks t where t.id = 2 and name > 'b' limit 2",
+				"select name as n from tbl_ks t where t.id = 7 and name > 'c' limit 3",
+			},
+		},
+		{
+			db:    "db_ks",
+			first: "select * from tbl_ks where id = 1 and name in ('a', 'b')",
+			sqls: []string{
+				"select * from tbl_ks where id = 2 and name in ('c', 'd')",
+			},
+		},
+		{
+			db:    "db_ks",
+			first: "select * from tbl_ks where 3 = id",
+			sqls: []string{
+				"select * from tbl_ks where 4 = id",
+			},
+		},
+		{
+			db:    "db_ks",
+			first: "update tbl_ks set name = 'a' where id = 1",
+			sqls: []string{
+				"update tbl_ks set name = 'b' where id = 2",
+				"update tbl_ks set name = 'c' where id = 3",
+			},
+		},
+		{
+			db:    "db_ks",
+			first: "delete from tbl_ks where id = 1 and name = 'x' limit 5",
+			sqls: []string{
+				"delete from tbl_ks where id = 6 and name = 'y' limit 1",
+			},
+		},
+		{
+			db:    "db_ks",
+			first: "select * from tbl_ks_range where id = 1",
+			sqls: []string{
+				"select * from tbl_ks_range where id = 150",
+				"select * from tbl_ks_range where id = 399",
+			},
+		},
+		{
+			db:    "db_ks",
+			first: "select * from tbl_ks_day where create_time = '2014-09-01'",
+			sqls: []string{
+				"select * from tbl_ks_day where create_time = '2014-09-08'",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.first, func(t *testing.T) {
+			p, err := parser.ParameterizeSQL(test.first)
+			if err != nil {
+				t.Fatalf("parameterize sql error: %v", err)
+			}
+			bound, pt, err := BuildPlanTemplate(p, ns.phyDBs, test.db, test.first, ns.rt, nil, ns.seqs)
+			if err != nil {
+				t.Fatalf("BuildPlanTemplate error: %v", err)
+			}
+			if pt == nil || pt.err != nil {
+				t.Fatalf("template should be cacheable, template: %v", pt)
+			}
+			checkPlanSQLs(t, ns, bound, test.db, test.first)
+
+			for _, sql := range test.sqls {
+				sp, err := parser.ParameterizeSQL(sql)
+				if err != nil {
+					t.Fatalf("parameterize sql error: %v", err)
+				}
+				if sp.Template != p.Template || sp.Kinds != p.Kinds {
+					t.Fatalf("template not equal, expect: %s %s, actual: %s %s", p.Template, p.Kinds, sp.Template, sp.Kinds)
+				}
+				bound, err := pt.Bind(sql, sp.Params)
+				if err != nil {
+					t.Fatalf("Bind error: %v", err)
+				}
+				checkPlanSQLs(t, ns, bound, test.db, sql)
+			}
+		})
+	}
+}
+
+// checkPlanSQLs 检查p的分片SQL与解析sql生成的执行计划相同
+func checkPlanSQLs(t *testing.T, ns *PlanInfo, p Plan, db, sql string) {
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	expect := getPlanSQLs(t, ns, stmt, db, sql)
+	actual := planSQLs(t, p)
+	if !reflect.DeepEqual(expect, actual) {
+		t.Errorf("sqls not equal, sql: %s, expect: %v, actual: %v", sql, expect, actual)
+	}
+}
+
+func TestPlanTemplateNotCacheable(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	// 参数没有解析为ValueExpr, 不能生成执行计划
+	sqls := []string{
+		"select id + 1 from tbl_mycat",                             // 列名取自SQL原文
+		"select (select a as b from t limit 1) + 1 from tbl_mycat", // 外层列没有别名
+		"select * from tbl_mycat order by 1",                       // 列序号不是ValueExpr
+		"select * from tbl_mycat where a = 'a' 'b'",                // 两个字符串合并为一个值
+		"select cast(a as char(10)) as c from tbl_mycat",           // 类型长度不是ValueExpr
+		"show tables like 'a'",
+	}
+	for _, sql := range sqls {
+		t.Run(sql, func(t *testing.T) {
+			p, err := parser.ParameterizeSQL(sql)
+			if err != nil {
+				t.Fatalf("parameterize sql error: %v", err)
+			}
+			bound, pt, err := BuildPlanTemplate(p, ns.phyDBs, "db_mycat", sql, ns.rt, nil, ns.seqs)
+			if err != nil {
+				t.Fatalf("BuildPlanTemplate error: %v", err)
+			}
+			if bound != nil || pt == nil || pt.err == nil {
+				t.Errorf("expect no plan and template with error, sql: %s", sql)
+			}
+			if _, err := pt.Bind(sql, p.Params); err == nil {
+				t.Errorf("expect bind error, sql: %s", sql)
+			}
+		})
+	}
+
+	// 可以生成执行计划, 但是路由与分片列的等值条件无关或者不止一张分表
+	sqls = []string{
+		"select * from tbl_ks where id in (1, 2)",
+		"select * from tbl_ks where id > 1",
+		"select * from tbl_ks where id = 1 or id = 2",
+		"select * from tbl_ks where id = 1 and id = 2",
+		"select count(*) as c from tbl_ks where name = 'a'",
+		"update tbl_ks set name = 'a' where name = 'b'",
+	}
+	for _, sql := range sqls {
+		t.Run(sql, func(t *testing.T) {
+			p, err := parser.ParameterizeSQL(sql)
+			if err != nil {
+				t.Fatalf("parameterize sql error: %v", err)
+			}
+			bound, pt, err := BuildPlanTemplate(p, ns.phyDBs, "db_ks", sql, ns.rt, nil, ns.seqs)
+			if err != nil {
+				t.Fatalf("BuildPlanTemplate error: %v", err)
+			}
+			if pt == nil || pt.err == nil {
+				t.Fatalf("expect template with error, sql: %s", sql)
+			}
+			checkPlanSQLs(t, ns, bound, "db_ks", sql)
+		})
+	}
+}
+
+func TestPlanTemplateBindConcurrently(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	sql := "select name from tbl_ks where id = 0 and name = 'a'"
+	p, err := parser.ParameterizeSQL(sql)
+	if err != nil {
+		t.Fatalf("parameterize sql error: %v", err)
+	}
+	_, pt, err := BuildPlanTemplate(p, ns.phyDBs, "db_ks", sql, ns.rt, nil, ns.seqs)
+	if err != nil || pt.err != nil {
+		t.Fatalf("build template error: %v, %v", err, pt.err)
+	}
+
+	// 多个会话同时命中缓存时, 各分表的SQL只生成一次, 并且互不影响
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			sql := fmt.Sprintf("select name from tbl_ks where id = %d and name = 'n%d'", id, id)
+			sp, err := parser.ParameterizeSQL(sql)
+			if err != nil {
+				t.Errorf("parameterize sql error: %v", err)
+				return
+			}
+			bound, err := pt.Bind(sql, sp.Params)
+			if err != nil {
+				t.Errorf("Bind error: %v", err)
+				return
+			}
+			expect := fmt.Sprintf("SELECT `name` FROM `tbl_ks_%04d` WHERE `id`=%d AND `name`='n%d'", id%4, id, id)
+			for _, dbSQLs := range bound.(*SelectPlan).GetSQLs() {
+				for _, sqls := range dbSQLs {
+					if len(sqls) != 1 || sqls[0] != expect {
+						t.Errorf("sql not equal, expect: %s, actual: %v", expect, sqls)
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkPlanTemplate(b *testing.B) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		b.Fatalf("prepare namespace error: %v", err)
+	}
+	sql := "select id, name from tbl_ks where id = 3 and name = 'a' limit 10"
+
+	b.Run("BuildPlan", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			stmt, err := parser.ParseSQL(sql)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := BuildPlan(stmt, ns.phyDBs, "db_ks", sql, ns.rt, nil, ns.seqs, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Bind", func(b *testing.B) {
+		p, err := parser.ParameterizeSQL(sql)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, pt, err := BuildPlanTemplate(p, ns.phyDBs, "db_ks", sql, ns.rt, nil, ns.seqs)
+		if err != nil || pt.err != nil {
+			b.Fatalf("build template error: %v, %v", err, pt.err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			p, err := parser.ParameterizeSQL(sql)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := pt.Bind(sql, p.Params); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -96,6 +96,19 @@ func getTestFunc(info *PlanInfo, test SQLTestcase) func(t *testing.T) {
 			actualSQLs = plan.sqls
 		case *DeletePlan:
 			actualSQLs = plan.sqls
+		case *UpdateShardKeyPlan:
+			// 修改分片列时先执行SELECT ... FOR UPDATE, 再执行DELETE, INSERT在执行时根据锁定的行生成
+			actualSQLs = make(map[string]map[string][]string)
+			for _, sqls := range []map[string]map[string][]string{plan.selectPlan.GetSQLs(), plan.deletePlan.sqls} {
+				for slice, dbSQLs := range sqls {
+					if actualSQLs[slice] == nil {
+						actualSQLs[slice] = make(map[string][]string)
+					}
+					for db, s := range dbSQLs {
+						actualSQLs[slice][db] = append(actualSQLs[slice][db], s...)
+					}
+				}
+			}
 		case *ExplainPlan:
 			actualSQLs = plan.sqls
 		case *SelectLastInsertIDPlan:
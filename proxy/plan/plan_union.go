@@ -0,0 +1,264 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	driver "github.com/XiaoMi/Gaea/parser/tidb-types/parser_driver"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/proxy/sequence"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// UnionPlan is the plan for UNION statement which contains sharding tables.
+// 每个SELECT单独生成执行计划, 由Gaea拼接结果, 然后去重并处理最外层的ORDER BY和LIMIT.
+type UnionPlan struct {
+	basePlan
+
+	stmt        *ast.UnionStmt
+	selectPlans []Plan
+
+	// 最后一个UNION DISTINCT的位置, 它左侧的所有SELECT的结果需要一起去重, -1表示全部为UNION ALL
+	distinctIndex int
+
+	orderByItems []*resultOrderByItem
+	offset       int64
+	count        int64 // -1表示没有LIMIT
+}
+
+// resultOrderByItem 由Gaea在合并后的结果集上处理的ORDER BY, 如UNION最外层的ORDER BY, 只能引用结果集的列名或位置
+type resultOrderByItem struct {
+	name     string
+	position int // 从1开始, 为0时使用列名
+	desc     bool
+}
+
+// NewUnionPlan constructor of UnionPlan
+func NewUnionPlan(stmt *ast.UnionStmt) *UnionPlan {
+	return &UnionPlan{
+		stmt:          stmt,
+		distinctIndex: -1,
+		count:         -1,
+	}
+}
+
+// HandleUnionStmt build a UnionPlan
+func HandleUnionStmt(p *UnionPlan, phyDBs map[string]string, db string, r *router.Router, grayRouter *router.GrayRouter, seq *sequence.SequenceManager) error {
+	if p.stmt.SelectList == nil || len(p.stmt.SelectList.Selects) == 0 {
+		return fmt.Errorf("no select in union")
+	}
+
+	for i, sel := range p.stmt.SelectList.Selects {
+		if i != 0 && sel.IsAfterUnionDistinct {
+			p.distinctIndex = i
+		}
+
+		// 先生成每个SELECT的SQL, 再生成执行计划, 生成执行计划时会改写SelectStmt
+		sql, err := generateUnshardingSQL(sel)
+		if err != nil {
+			return fmt.Errorf("generate select sql in union error: %v", err)
+		}
+		selectPlan, err := BuildPlan(sel, phyDBs, db, sql, r, grayRouter, seq, nil)
+		if err != nil {
+			return fmt.Errorf("build select plan in union error: %v", err)
+		}
+		p.selectPlans = append(p.selectPlans, selectPlan)
+	}
+
+	if err := handleUnionOrderBy(p); err != nil {
+		return fmt.Errorf("handle OrderBy error: %v", err)
+	}
+
+	if p.stmt.Limit != nil {
+		offset, count, err := getLimitValue(p.stmt.Limit)
+		if err != nil {
+			return fmt.Errorf("handle Limit error: %v", err)
+		}
+		p.offset, p.count = offset, count
+	}
+	return nil
+}
+
+func handleUnionOrderBy(p *UnionPlan) error {
+	if p.stmt.OrderBy == nil {
+		return nil
+	}
+
+	items, err := getResultOrderByItems(p.stmt.OrderBy)
+	if err != nil {
+		return err
+	}
+	p.orderByItems = items
+	return nil
+}
+
+func getResultOrderByItems(orderBy *ast.OrderByClause) ([]*resultOrderByItem, error) {
+	var items []*resultOrderByItem
+	for _, item := range orderBy.Items {
+		orderByItem := &resultOrderByItem{desc: item.Desc}
+		switch x := item.Expr.(type) {
+		case *ast.ColumnNameExpr:
+			if x.Name.Table.L != "" {
+				return nil, fmt.Errorf("table name is not allowed in ORDER BY of result set: %s", x.Name.Table.O)
+			}
+			orderByItem.name = x.Name.Name.L
+		case *ast.PositionExpr:
+			if x.P != nil {
+				return nil, fmt.Errorf("param marker is not allowed in ORDER BY of result set")
+			}
+			orderByItem.position = x.N
+		default:
+			return nil, fmt.Errorf("ORDER BY of result set only supports column name or position, type: %T", item.Expr)
+		}
+		items = append(items, orderByItem)
+	}
+	return items, nil
+}
+
+// 获取最外层LIMIT的offset和count, 由Gaea处理
+func getLimitValue(limit *ast.Limit) (int64, int64, error) {
+	var offset int64
+	if limit.Offset != nil {
+		v, ok := limit.Offset.(*driver.ValueExpr)
+		if !ok {
+			return 0, 0, fmt.Errorf("offset in LIMIT is not a value")
+		}
+		offset = v.GetInt64()
+	}
+	count, ok := limit.Count.(*driver.ValueExpr)
+	if !ok {
+		return 0, 0, fmt.Errorf("count in LIMIT is not a value")
+	}
+	return offset, count.GetInt64(), nil
+}
+
+// ExecuteIn implement Plan
+func (p *UnionPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	var rs []*mysql.Result
+	for i, selectPlan := range p.selectPlans {
+		r, err := selectPlan.ExecuteIn(reqCtx, sess)
+		if err != nil {
+			return nil, fmt.Errorf("execute select %d in union error: %v", i+1, err)
+		}
+		if r == nil || r.Resultset == nil {
+			return nil, fmt.Errorf("select %d in union returns no result set", i+1)
+		}
+		if i != 0 && len(r.Fields) != len(rs[0].Fields) {
+			return nil, fmt.Errorf("the used SELECT statements have a different number of columns")
+		}
+		rs = append(rs, r)
+	}
+
+	ret := mysql.ResultPool.Get()
+	ret.Resultset = &mysql.Resultset{
+		Fields:     rs[0].Fields,
+		FieldNames: rs[0].FieldNames,
+	}
+	for i, r := range rs {
+		ret.Status |= r.Status
+		ret.Values = append(ret.Values, r.Values...)
+		if i == p.distinctIndex {
+			if err := removeDuplicateRows(ret, newUnionKeyColumns(rs)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// 复用SELECT合并结果时的排序和LIMIT处理, 最外层的ORDER BY和LIMIT不会补列
+	sp, err := p.createMergePlan(ret)
+	if err != nil {
+		return nil, err
+	}
+	if err := sortSelectResult(sp, nil, ret); err != nil {
+		return nil, fmt.Errorf("sort union result error: %v", err)
+	}
+	if err := limitSelectResult(sp, ret); err != nil {
+		return nil, fmt.Errorf("limit union result error: %v", err)
+	}
+
+	if err := GenerateSelectResultRowData(ret); err != nil {
+		return nil, fmt.Errorf("generate RowData error: %v", err)
+	}
+	return ret, nil
+}
+
+// UNION的结果列只有在所有SELECT中都是数值类型时才按数值比较, 否则按第一个字符串列的排序规则比较
+func newUnionKeyColumns(rs []*mysql.Result) []keyColumn {
+	columns := newKeyColumns(rs[0].Fields)
+	for i := range columns {
+		for _, r := range rs {
+			if column := newKeyColumn(r.Fields[i]); !column.numeric {
+				columns[i] = column
+				break
+			}
+		}
+	}
+	return columns
+}
+
+// UNION DISTINCT按整行去重, 不同SELECT返回的值类型可能不同, 需要归一化后比较
+func removeDuplicateRows(r *mysql.Result, columns []keyColumn) error {
+	keys := make(map[string]bool, len(r.Values))
+	values := r.Values[:0]
+	for _, row := range r.Values {
+		key, err := generateNormalizedMapKey(row, columns)
+		if err != nil {
+			return err
+		}
+		if keys[key] {
+			continue
+		}
+		keys[key] = true
+		values = append(values, row)
+	}
+	r.Values = values
+	return nil
+}
+
+// 根据结果集的列信息计算ORDER BY的列位置, 生成用于排序和LIMIT的SelectPlan
+func (p *UnionPlan) createMergePlan(r *mysql.Result) (*SelectPlan, error) {
+	return createResultMergePlan(r, p.orderByItems, p.offset, p.count)
+}
+
+func createResultMergePlan(r *mysql.Result, items []*resultOrderByItem, offset, count int64) (*SelectPlan, error) {
+	sp := &SelectPlan{
+		originColumnCount: len(r.Fields),
+		columnCount:       len(r.Fields),
+		offset:            offset,
+		count:             count,
+	}
+
+	for _, item := range items {
+		index := item.position - 1
+		if item.position == 0 {
+			for i, field := range r.Fields {
+				if strings.ToLower(string(field.Name)) == item.name {
+					index = i
+					break
+				}
+			}
+		}
+		if index < 0 || index >= len(r.Fields) {
+			return nil, fmt.Errorf("unknown column in ORDER BY, name: %s, position: %d", item.name, item.position)
+		}
+		sp.orderByColumn = append(sp.orderByColumn, index)
+		sp.orderByDirections = append(sp.orderByDirections, item.desc)
+	}
+	return sp, nil
+}
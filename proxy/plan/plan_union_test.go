@@ -0,0 +1,229 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+func TestUnionPlan(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		db            string
+		sql           string
+		sqls          []map[string]map[string][]string
+		distinctIndex int
+		hasErr        bool
+	}{
+		{
+			db:  "db_mycat",
+			sql: "select id, a from tbl_mycat where id = 1 union all select id, a from tbl_mycat_child where id = 2",
+			sqls: []map[string]map[string][]string{
+				{"slice-0": {"db_mycat_1": {"SELECT `id`,`a` FROM `tbl_mycat` WHERE `id`=1"}}},
+				{"slice-1": {"db_mycat_2": {"SELECT `id`,`a` FROM `tbl_mycat_child` WHERE `id`=2"}}},
+			},
+			distinctIndex: -1,
+		},
+		{
+			db:  "db_ks",
+			sql: "select id from tbl_ks where id in (1, 2) union select id from tbl_ks where id = 3 union all (select id from tbl_ks where id = 4 order by id limit 1) order by id desc limit 2",
+			sqls: []map[string]map[string][]string{
+				{
+					"slice-0": {"db_ks": {"SELECT `id` FROM `tbl_ks_0001` WHERE `id` IN (1)"}},
+					"slice-1": {"db_ks": {"SELECT `id` FROM `tbl_ks_0002` WHERE `id` IN (2)"}},
+				},
+				{"slice-1": {"db_ks": {"SELECT `id` FROM `tbl_ks_0003` WHERE `id`=3"}}},
+				{"slice-0": {"db_ks": {"SELECT `id` FROM `tbl_ks_0000` WHERE `id`=4 ORDER BY `id` LIMIT 1"}}},
+			},
+			distinctIndex: 1,
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select id, a from tbl_mycat union select id, a from tbl_mycat_child order by a + 1",
+			hasErr: true, // ORDER BY only supports column name or position
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select id, a from tbl_mycat union select id, a from tbl_mycat_child order by tbl_mycat.id",
+			hasErr: true, // ORDER BY does not support table name
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, test.db, test.sql, ns.rt, nil, ns.seqs, nil)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, actual plan: %T", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			up, ok := p.(*UnionPlan)
+			if !ok {
+				t.Fatalf("plan type not equal, expect: *UnionPlan, actual: %T", p)
+			}
+			if up.distinctIndex != test.distinctIndex {
+				t.Errorf("distinct index not equal, expect: %d, actual: %d", test.distinctIndex, up.distinctIndex)
+			}
+			if len(up.selectPlans) != len(test.sqls) {
+				t.Fatalf("select plan count not equal, expect: %d, actual: %d", len(test.sqls), len(up.selectPlans))
+			}
+			for i, selectPlan := range up.selectPlans {
+				sp, ok := selectPlan.(*SelectPlan)
+				if !ok {
+					t.Fatalf("plan type not equal, expect: *SelectPlan, actual: %T", selectPlan)
+				}
+				if !checkSQLs(test.sqls[i], sp.GetSQLs()) {
+					t.Errorf("select %d sqls not equal, expect: %v, actual: %v", i+1, test.sqls[i], sp.GetSQLs())
+				}
+			}
+		})
+	}
+}
+
+// unionExecutor 分片db_mycat_N上的SELECT返回一行(N, "vN")
+type unionExecutor struct {
+	mockExecutor
+}
+
+func (e *unionExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]*mysql.Result, error) {
+	var rs []*mysql.Result
+	for _, dbSQLs := range sqls {
+		for db, sqlList := range dbSQLs {
+			for range sqlList {
+				var idx int
+				fmt.Sscanf(db, "db_mycat_%d", &idx)
+				rs = append(rs, createTestSelectResult([]string{"id", "a"}, [][]any{{int64(idx), fmt.Sprintf("v%d", idx)}}))
+			}
+		}
+	}
+	return rs, nil
+}
+
+func TestUnionPlanExecuteIn(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		sql    string
+		expect [][]any
+		hasErr bool
+	}{
+		{
+			sql:    "select id, a from tbl_mycat union select id, a from tbl_mycat_child order by id",
+			expect: [][]any{{int64(0), "v0"}, {int64(1), "v1"}, {int64(2), "v2"}, {int64(3), "v3"}},
+		},
+		{
+			sql:    "select id, a from tbl_mycat union all select id, a from tbl_mycat_child order by ID desc limit 1, 3",
+			expect: [][]any{{int64(3), "v3"}, {int64(2), "v2"}, {int64(2), "v2"}},
+		},
+		{
+			// 只有最后一个UNION DISTINCT左侧的结果去重
+			sql:    "select id, a from tbl_mycat union select id, a from tbl_mycat_child union all select id, a from tbl_mycat where id = 1 order by 2 desc limit 3",
+			expect: [][]any{{int64(3), "v3"}, {int64(2), "v2"}, {int64(1), "v1"}},
+		},
+		{
+			sql:    "select id, a from tbl_mycat union all select id, a from tbl_mycat where id = 1 union select id, a from tbl_mycat_child where id = 1",
+			expect: [][]any{{int64(0), "v0"}, {int64(1), "v1"}, {int64(2), "v2"}, {int64(3), "v3"}},
+		},
+		{
+			sql:    "select id, a from tbl_mycat union select id, a from tbl_mycat_child order by b",
+			hasErr: true, // unknown column
+		},
+		{
+			sql:    "select id, a from tbl_mycat union select id, a from tbl_mycat_child order by 3",
+			hasErr: true, // unknown column
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", test.sql, ns.rt, nil, ns.seqs, nil)
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			r, err := p.ExecuteIn(util.NewRequestContext(), &unionExecutor{})
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, actual result: %v", r.Values)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExecuteIn error: %v", err)
+			}
+			values := r.Values
+			// 没有ORDER BY时结果的顺序不确定
+			if p.(*UnionPlan).orderByItems == nil {
+				sort.Slice(values, func(i, j int) bool { return values[i][0].(int64) < values[j][0].(int64) })
+			}
+			if !reflect.DeepEqual(values, test.expect) {
+				t.Errorf("result not equal, expect: %v, actual: %v", test.expect, values)
+			}
+			if len(r.RowDatas) != len(test.expect) {
+				t.Errorf("row data count not equal, expect: %d, actual: %d", len(test.expect), len(r.RowDatas))
+			}
+		})
+	}
+}
+
+func TestRemoveDuplicateRows(t *testing.T) {
+	// 不同SELECT返回的值类型不同, 第二个SELECT的id列为DECIMAL
+	r1 := createTestSelectResult([]string{"id", "name"}, [][]any{
+		{int64(1), "a"},
+		{int64(2), "NULL"},
+		{int64(2), nil},
+	})
+	r2 := createTestSelectResult([]string{"id", "name"}, [][]any{
+		{uint64(1), "a"},
+		{[]byte("2.0"), nil},
+		{float64(3), "a"},
+	})
+	r2.Fields[0].Type = mysql.TypeNewDecimal
+
+	ret := &mysql.Result{Resultset: &mysql.Resultset{Fields: r1.Fields}}
+	ret.Values = append(append(ret.Values, r1.Values...), r2.Values...)
+	if err := removeDuplicateRows(ret, newUnionKeyColumns([]*mysql.Result{r1, r2})); err != nil {
+		t.Fatalf("removeDuplicateRows error: %v", err)
+	}
+	expect := [][]any{{int64(1), "a"}, {int64(2), "NULL"}, {int64(2), nil}, {float64(3), "a"}}
+	if !reflect.DeepEqual(ret.Values, expect) {
+		t.Errorf("values not equal, expect: %v, actual: %v", expect, ret.Values)
+	}
+}
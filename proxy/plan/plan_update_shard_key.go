@@ -0,0 +1,336 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/XiaoMi/Gaea/core/errors"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/format"
+	"github.com/XiaoMi/Gaea/parser/model"
+	"github.com/XiaoMi/Gaea/proxy/router"
+	"github.com/XiaoMi/Gaea/proxy/sequence"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// UpdateShardKeyPlan is the plan for update statement which changes the value of sharding column.
+// 分片列的值改变后行可能属于其他分片, 因此在事务中转换为以下操作:
+// 1. SELECT *, 新值 FROM tbl WHERE ... FOR UPDATE, 锁定旧分片上的行并计算更新后的值
+// 2. DELETE FROM tbl WHERE ..., 删除旧分片上的行
+// 3. INSERT INTO tbl (...) VALUES (...), 按新的分片列的值插入到新分片
+type UpdateShardKeyPlan struct {
+	basePlan
+
+	db     string
+	sql    string
+	router *router.Router
+
+	table      *ast.TableName
+	columns    []string // SET中被更新的列, 与SELECT中补充的新值列一一对应
+	selectPlan *SelectPlan
+	deletePlan *DeletePlan
+}
+
+// 只有一个分片表, 且SET中更新了该表的分片列
+func isUpdateShardKey(stmt *ast.UpdateStmt, db string, r *router.Router) bool {
+	if stmt.MultipleTable || stmt.TableRefs == nil || stmt.TableRefs.TableRefs == nil {
+		return false
+	}
+	join := stmt.TableRefs.TableRefs
+	if join.Right != nil {
+		return false
+	}
+	tableSource, ok := join.Left.(*ast.TableSource)
+	if !ok {
+		return false
+	}
+	tableName, ok := tableSource.Source.(*ast.TableName)
+	if !ok {
+		return false
+	}
+
+	tableDB, table := getTableInfoFromTableName(tableName)
+	if tableDB == "" {
+		tableDB = db
+	}
+	rule, ok := r.GetShardRule(tableDB, table)
+	if !ok || rule.GetType() == router.GlobalTableRuleType {
+		return false
+	}
+
+	for _, assignment := range stmt.List {
+		column := assignment.Column
+		if column.Name.L != rule.GetShardingColumn() {
+			continue
+		}
+		if column.Table.L == "" || column.Table.L == table || column.Table.L == tableSource.AsName.L {
+			return true
+		}
+	}
+	return false
+}
+
+func buildUpdateShardKeyPlan(stmt *ast.UpdateStmt, db, sql string, r *router.Router) (Plan, error) {
+	if stmt.Order != nil || stmt.Limit != nil {
+		return nil, fmt.Errorf("update of sharding column does not support ORDER BY or LIMIT")
+	}
+	tableSource := stmt.TableRefs.TableRefs.Left.(*ast.TableSource)
+	if tableSource.AsName.L != "" {
+		return nil, fmt.Errorf("update of sharding column does not support table alias")
+	}
+	tableName := tableSource.Source.(*ast.TableName)
+
+	p := &UpdateShardKeyPlan{
+		db:     db,
+		sql:    sql,
+		router: r,
+		table:  &ast.TableName{Schema: tableName.Schema, Name: tableName.Name},
+	}
+
+	// 由MySQL计算更新后的值, 避免在Gaea中求值SET中的表达式
+	tableSQL, err := restoreNode(tableSource)
+	if err != nil {
+		return nil, err
+	}
+	fields := []string{"*"}
+	assigned := make(map[string]ast.ExprNode, len(stmt.List))
+	for _, assignment := range stmt.List {
+		expr, err := substituteAssignedColumns(assignment.Expr, assigned, tableName)
+		if err != nil {
+			return nil, err
+		}
+		exprSQL, err := restoreNode(expr)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, exprSQL)
+		p.columns = append(p.columns, assignment.Column.Name.L)
+		assigned[assignment.Column.Name.L] = expr
+	}
+	var where string
+	if stmt.Where != nil {
+		where, err = restoreNode(stmt.Where)
+		if err != nil {
+			return nil, err
+		}
+		where = " WHERE " + where
+	}
+
+	selectSQL := fmt.Sprintf("SELECT %s FROM %s%s FOR UPDATE", strings.Join(fields, ","), tableSQL, where)
+	selectStmt, err := parser.ParseSQL(selectSQL)
+	if err != nil {
+		return nil, fmt.Errorf("parse select sql error: %v", err)
+	}
+	p.selectPlan = NewSelectPlan(db, selectSQL, r)
+	if err := HandleSelectStmt(p.selectPlan, selectStmt.(*ast.SelectStmt)); err != nil {
+		return nil, fmt.Errorf("build select plan error: %v", err)
+	}
+
+	deleteSQL := fmt.Sprintf("DELETE FROM %s%s", tableSQL, where)
+	deleteStmt, err := parser.ParseSQL(deleteSQL)
+	if err != nil {
+		return nil, fmt.Errorf("parse delete sql error: %v", err)
+	}
+	p.deletePlan = NewDeletePlan(deleteStmt.(*ast.DeleteStmt), db, deleteSQL, r)
+	if err := HandleDeletePlan(p.deletePlan); err != nil {
+		return nil, fmt.Errorf("build delete plan error: %v", err)
+	}
+
+	return p, nil
+}
+
+// 与MySQL单表UPDATE一致, SET从左到右执行, 表达式中引用的列如果在前面已经被赋值, 使用赋值后的值
+// 例如SET a=a+1, b=a中b的新值为a+1. 在表达式的副本中把这些列替换为前面的赋值表达式, 不修改原语句
+func substituteAssignedColumns(expr ast.ExprNode, assigned map[string]ast.ExprNode, table *ast.TableName) (ast.ExprNode, error) {
+	if len(assigned) == 0 {
+		return expr, nil
+	}
+	exprSQL, err := restoreNode(expr)
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := parser.ParseSQL("SELECT " + exprSQL)
+	if err != nil {
+		return nil, fmt.Errorf("parse assignment expr error: %v", err)
+	}
+	copied := stmt.(*ast.SelectStmt).Fields.Fields[0].Expr
+
+	v := &assignedColumnReplacer{assigned: assigned, table: table}
+	node, _ := copied.Accept(v)
+	return node.(ast.ExprNode), nil
+}
+
+// assignedColumnReplacer 把引用了已赋值列的ColumnNameExpr替换为赋值表达式
+type assignedColumnReplacer struct {
+	assigned map[string]ast.ExprNode
+	table    *ast.TableName
+}
+
+// Enter implement ast.Visitor
+func (v *assignedColumnReplacer) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	// 子查询中的列不属于被更新的表
+	if _, ok := n.(*ast.SubqueryExpr); ok {
+		return n, true
+	}
+	return n, false
+}
+
+// Leave implement ast.Visitor
+func (v *assignedColumnReplacer) Leave(n ast.Node) (node ast.Node, ok bool) {
+	column, ok := n.(*ast.ColumnNameExpr)
+	if !ok {
+		return n, true
+	}
+	name := column.Name
+	if name.Table.L != "" && name.Table.L != v.table.Name.L {
+		return n, true
+	}
+	if name.Schema.L != "" && v.table.Schema.L != "" && name.Schema.L != v.table.Schema.L {
+		return n, true
+	}
+	if expr, ok := v.assigned[name.Name.L]; ok {
+		return &ast.ParenthesesExpr{Expr: expr}, true
+	}
+	return n, true
+}
+
+func restoreNode(node ast.Node) (string, error) {
+	s := &strings.Builder{}
+	if err := node.Restore(format.NewRestoreCtx(format.EscapeRestoreFlags, s)); err != nil {
+		return "", fmt.Errorf("restore node error: %v", err)
+	}
+	return s.String(), nil
+}
+
+// ExecuteIn implement Plan
+func (p *UpdateShardKeyPlan) ExecuteIn(reqCtx *util.RequestContext, sess Executor) (*mysql.Result, error) {
+	if !reqCtx.IsSupportUpdateShardKey() {
+		return nil, fmt.Errorf("cannot update shard column value")
+	}
+	// 移动数据由多条SQL完成, 只有在事务中才能保证原子性
+	if !reqCtx.IsInTransaction() {
+		return nil, errors.ErrUpdateKeyNotInTrans
+	}
+
+	// 直接合并各分片的结果, 保留分片返回的原始文本, 生成INSERT时DECIMAL不损失精度
+	results, err := sess.ExecuteSQLs(reqCtx, p.selectPlan.GetSQLs())
+	if err != nil {
+		return nil, fmt.Errorf("lock rows error: %v", err)
+	}
+	var rs *mysql.Result
+	var rows [][]any
+	if len(results) != 0 {
+		rs = mergeMultiResultSet(results)
+	}
+	if rs != nil && rs.Resultset != nil {
+		rows = rs.Values
+	}
+	if maxRows := reqCtx.GetMaxUpdateShardKeyRows(); maxRows > 0 && len(rows) > maxRows {
+		return nil, fmt.Errorf("%v, max_update_shard_key_rows: %d, rows: %d", errors.ErrUpdateKeyRowsExceeded, maxRows, len(rows))
+	}
+
+	ret := mysql.ResultPool.GetWithoutResultSet()
+	if len(rows) == 0 {
+		return ret, nil
+	}
+
+	insertStmt, err := p.createInsertStmt(rs)
+	if err != nil {
+		return nil, err
+	}
+
+	// 删除的行数必须与锁定的行数一致, 否则说明条件不是只匹配锁定的行, 需要业务回滚事务
+	dr, err := p.deletePlan.ExecuteIn(reqCtx, sess)
+	if err != nil {
+		return nil, fmt.Errorf("delete rows error: %v", err)
+	}
+	if dr == nil || dr.AffectedRows != uint64(len(rows)) {
+		var deleted uint64
+		if dr != nil {
+			deleted = dr.AffectedRows
+		}
+		return nil, fmt.Errorf("rows changed when moving rows, locked: %d, deleted: %d, transaction should be rolled back", len(rows), deleted)
+	}
+
+	// 移动的行保留原有的值, 即使为NULL也不使用全局序列号生成新值
+	ip := NewInsertPlan(p.db, p.sql, p.router, sequence.NewSequenceManager())
+	if err := HandleInsertStmt(ip, insertStmt); err != nil {
+		return nil, fmt.Errorf("build insert plan error: %v", err)
+	}
+	// 不通过InsertPlan执行, UPDATE不修改LAST_INSERT_ID
+	irs, err := sess.ExecuteSQLs(reqCtx, ip.sqls)
+	if err != nil {
+		return nil, fmt.Errorf("insert rows error: %v", err)
+	}
+	ir, err := MergeExecResult(irs)
+	if err != nil {
+		return nil, err
+	}
+
+	ret.Status = ir.Status
+	ret.AffectedRows = uint64(len(rows))
+	return ret, nil
+}
+
+// 用锁定的行和新值生成插入到新分片的INSERT
+func (p *UpdateShardKeyPlan) createInsertStmt(rs *mysql.Result) (*ast.InsertStmt, error) {
+	columnCount := len(rs.Fields) - len(p.columns)
+	if columnCount <= 0 {
+		return nil, fmt.Errorf("invalid column count of locked rows: %d", len(rs.Fields))
+	}
+
+	columns := make([]*ast.ColumnName, columnCount)
+	for i := 0; i < columnCount; i++ {
+		columns[i] = &ast.ColumnName{Name: model.NewCIStr(string(rs.Fields[i].Name))}
+	}
+	assignIndexes := make([]int, len(p.columns))
+	for i, name := range p.columns {
+		assignIndexes[i] = -1
+		for j, column := range columns {
+			if column.Name.L == name {
+				assignIndexes[i] = j
+				break
+			}
+		}
+		if assignIndexes[i] == -1 {
+			return nil, fmt.Errorf("unknown column %s in field list", name)
+		}
+	}
+
+	lists := make([][]ast.ExprNode, 0, len(rs.Values))
+	for i := range rs.Values {
+		// 锁定的行由分片直接返回, 使用原始文本避免DECIMAL精度损失
+		row, err := createResultRowValueExprs(rs, i, true)
+		if err != nil {
+			return nil, err
+		}
+		values := row[:columnCount]
+		// 多次更新同一列时以最后一次为准, 与MySQL一致
+		for j, idx := range assignIndexes {
+			values[idx] = row[columnCount+j]
+		}
+		lists = append(lists, values)
+	}
+
+	return &ast.InsertStmt{
+		Table:   &ast.TableRefsClause{TableRefs: &ast.Join{Left: &ast.TableSource{Source: &ast.TableName{Schema: p.table.Schema, Name: p.table.Name}}}},
+		Columns: columns,
+		Lists:   lists,
+	}, nil
+}
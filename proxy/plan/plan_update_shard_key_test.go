@@ -0,0 +1,241 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/core/errors"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+func TestUpdateShardKeyPlan(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+
+	tests := []struct {
+		db         string
+		sql        string
+		selectSQLs map[string]map[string][]string
+		deleteSQLs map[string]map[string][]string
+		hasErr     bool
+	}{
+		{
+			db:  "db_mycat",
+			sql: "update tbl_mycat set id = 5, a = concat(a, 'x') where id = 6",
+			selectSQLs: map[string]map[string][]string{
+				"slice-1": {"db_mycat_2": {"SELECT *,5,CONCAT(`a`, 'x') FROM `tbl_mycat` WHERE `id`=6 FOR UPDATE"}},
+			},
+			deleteSQLs: map[string]map[string][]string{
+				"slice-1": {"db_mycat_2": {"DELETE FROM `tbl_mycat` WHERE `id`=6"}},
+			},
+		},
+		{
+			db:  "db_mycat",
+			sql: "update tbl_mycat set ID = 5",
+			selectSQLs: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE"},
+					"db_mycat_1": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE"},
+					"db_mycat_3": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE"},
+				},
+			},
+			deleteSQLs: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"DELETE FROM `tbl_mycat`"},
+					"db_mycat_1": {"DELETE FROM `tbl_mycat`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"DELETE FROM `tbl_mycat`"},
+					"db_mycat_3": {"DELETE FROM `tbl_mycat`"},
+				},
+			},
+		},
+		{
+			db:  "db_ks",
+			sql: "update db_ks.tbl_ks set tbl_ks.id = id + 1 where id in (1,2)",
+			selectSQLs: map[string]map[string][]string{
+				"slice-0": {"db_ks": {"SELECT *,`id`+1 FROM `db_ks`.`tbl_ks_0001` WHERE `id` IN (1) FOR UPDATE"}},
+				"slice-1": {"db_ks": {"SELECT *,`id`+1 FROM `db_ks`.`tbl_ks_0002` WHERE `id` IN (2) FOR UPDATE"}},
+			},
+			deleteSQLs: map[string]map[string][]string{
+				"slice-0": {"db_ks": {"DELETE FROM `db_ks`.`tbl_ks_0001` WHERE `id` IN (1)"}},
+				"slice-1": {"db_ks": {"DELETE FROM `db_ks`.`tbl_ks_0002` WHERE `id` IN (2)"}},
+			},
+		},
+		{
+			// SET从左到右执行, a的新值使用id更新后的值, 子查询中的列不替换
+			db:  "db_ks",
+			sql: "update tbl_ks set id = id + 1, a = id * 2, b = (select max(id) from tbl_unshard) where id = 1",
+			selectSQLs: map[string]map[string][]string{
+				"slice-0": {"db_ks": {"SELECT *,`id`+1,(`id`+1)*2,(SELECT MAX(`id`) FROM `tbl_unshard`) FROM `tbl_ks_0001` WHERE `id`=1 FOR UPDATE"}},
+			},
+			deleteSQLs: map[string]map[string][]string{
+				"slice-0": {"db_ks": {"DELETE FROM `tbl_ks_0001` WHERE `id`=1"}},
+			},
+		},
+		{
+			db:     "db_ks",
+			sql:    "update tbl_ks t set t.id = 3 where t.id = 1",
+			hasErr: true, // does not support table alias
+		},
+		{
+			db:     "db_ks",
+			sql:    "update tbl_ks set id = 3 where id = 1 limit 1",
+			hasErr: true, // does not support ORDER BY or LIMIT
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			p, err := BuildPlan(stmt, ns.phyDBs, test.db, test.sql, ns.rt, nil, ns.seqs, nil)
+			if test.hasErr {
+				if err == nil {
+					t.Fatalf("expect error, actual plan: %T", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("BuildPlan error: %v", err)
+			}
+			up, ok := p.(*UpdateShardKeyPlan)
+			if !ok {
+				t.Fatalf("plan type not equal, expect: *UpdateShardKeyPlan, actual: %T", p)
+			}
+			if !checkSQLs(test.selectSQLs, up.selectPlan.GetSQLs()) {
+				t.Errorf("select sqls not equal, expect: %v, actual: %v", test.selectSQLs, up.selectPlan.GetSQLs())
+			}
+			if !checkSQLs(test.deleteSQLs, up.deletePlan.sqls) {
+				t.Errorf("delete sqls not equal, expect: %v, actual: %v", test.deleteSQLs, up.deletePlan.sqls)
+			}
+		})
+	}
+}
+
+// updateShardKeyExecutor SELECT返回指定的锁定行, DELETE返回指定的影响行数, 并记录插入的SQL
+type updateShardKeyExecutor struct {
+	mockExecutor
+	lockedRows   [][]any
+	deletedRows  uint64
+	inserts      map[string][]string
+	lastInsertID uint64
+}
+
+func (e *updateShardKeyExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]*mysql.Result, error) {
+	var rs []*mysql.Result
+	for _, dbSQLs := range sqls {
+		for db, sqlList := range dbSQLs {
+			for _, sql := range sqlList {
+				switch {
+				case strings.HasPrefix(sql, "SELECT"):
+					rs = append(rs, createTestSelectResult([]string{"id", "a", "5", "CONCAT(a, 'x')"}, e.lockedRows))
+				case strings.HasPrefix(sql, "DELETE"):
+					rs = append(rs, &mysql.Result{AffectedRows: e.deletedRows})
+				default:
+					e.inserts[db] = append(e.inserts[db], sql)
+					rs = append(rs, &mysql.Result{AffectedRows: 1, InsertID: 5})
+				}
+			}
+		}
+	}
+	return rs, nil
+}
+
+func (e *updateShardKeyExecutor) SetLastInsertID(id uint64) {
+	e.lastInsertID = id
+}
+
+func TestUpdateShardKeyPlanExecuteIn(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	sql := "update tbl_mycat set id = 5, a = concat(a, 'x') where id = 6"
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	p, err := BuildPlan(stmt, ns.phyDBs, "db_mycat", sql, ns.rt, nil, ns.seqs, nil)
+	if err != nil {
+		t.Fatalf("BuildPlan error: %v", err)
+	}
+
+	lockedRows := [][]any{{int64(6), "hi", int64(5), "hix"}}
+	tests := []struct {
+		name        string
+		support     bool
+		inTrans     bool
+		maxRows     int
+		rows        [][]any
+		deletedRows uint64
+		err         string
+	}{
+		{name: "not support", support: false, inTrans: true, maxRows: 10, rows: lockedRows, deletedRows: 1, err: "cannot update shard column value"},
+		{name: "not in transaction", support: true, inTrans: false, maxRows: 10, rows: lockedRows, deletedRows: 1, err: errors.ErrUpdateKeyNotInTrans.Error()},
+		{name: "rows exceeded", support: true, inTrans: true, maxRows: 1, rows: append(lockedRows, []any{int64(10), "hello", int64(5), "hellox"}), deletedRows: 2, err: errors.ErrUpdateKeyRowsExceeded.Error()},
+		{name: "rows changed", support: true, inTrans: true, maxRows: 10, rows: lockedRows, deletedRows: 2, err: "rows changed"},
+		{name: "move row", support: true, inTrans: true, maxRows: 10, rows: lockedRows, deletedRows: 1},
+		{name: "move row without limit", support: true, inTrans: true, maxRows: -1, rows: lockedRows, deletedRows: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			executor := &updateShardKeyExecutor{lockedRows: test.rows, deletedRows: test.deletedRows, inserts: make(map[string][]string)}
+			reqCtx := util.NewRequestContext()
+			reqCtx.SetSupportUpdateShardKey(test.support)
+			reqCtx.SetInTransaction(test.inTrans)
+			reqCtx.SetMaxUpdateShardKeyRows(test.maxRows)
+
+			r, err := p.ExecuteIn(reqCtx, executor)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expect error: %s, actual: %v", test.err, err)
+				}
+				if len(executor.inserts) != 0 {
+					t.Errorf("rows should not be inserted, actual: %v", executor.inserts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExecuteIn error: %v", err)
+			}
+			expect := map[string][]string{
+				"db_mycat_1": {"INSERT INTO `tbl_mycat` (`id`,`a`) VALUES (5,'hix')"},
+			}
+			if !reflect.DeepEqual(executor.inserts, expect) {
+				t.Errorf("insert sqls not equal, expect: %v, actual: %v", expect, executor.inserts)
+			}
+			if r.AffectedRows != 1 {
+				t.Errorf("affected rows not equal, expect: 1, actual: %d", r.AffectedRows)
+			}
+			if executor.lastInsertID != 0 {
+				t.Errorf("last insert id should not be changed, actual: %d", executor.lastInsertID)
+			}
+		})
+	}
+}
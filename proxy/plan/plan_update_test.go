@@ -38,14 +38,33 @@ func TestMycatShardSimpleUpdate(t *testing.T) {
 			},
 		},
 		{
-			db:     "db_mycat",
-			sql:    "update tbl_mycat set id = 5",
-			hasErr: true, // cannot update shard column value
+			// 修改分片列时先锁定并删除旧分片上的行, 再按新值插入
+			db:  "db_mycat",
+			sql: "update tbl_mycat set id = 5",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+					"db_mycat_1": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+					"db_mycat_3": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+				},
+			},
 		},
 		{
-			db:     "db_mycat",
-			sql:    "update tbl_mycat set ID = 5",
-			hasErr: true, // cannot update shard column value
+			db:  "db_mycat",
+			sql: "update tbl_mycat set ID = 5",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+					"db_mycat_1": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+					"db_mycat_3": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+				},
+			},
 		},
 		{
 			db:  "db_mycat",
@@ -75,9 +94,18 @@ func TestMycatShardUpdateColumnCaseInsensitive(t *testing.T) {
 
 	tests := []SQLTestcase{
 		{
-			db:     "db_mycat",
-			sql:    "update tbl_mycat set ID = 5",
-			hasErr: true, // cannot update shard column value
+			db:  "db_mycat",
+			sql: "update tbl_mycat set ID = 5",
+			sqls: map[string]map[string][]string{
+				"slice-0": {
+					"db_mycat_0": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+					"db_mycat_1": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+				},
+				"slice-1": {
+					"db_mycat_2": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+					"db_mycat_3": {"SELECT *,5 FROM `tbl_mycat` FOR UPDATE", "DELETE FROM `tbl_mycat`"},
+				},
+			},
 		},
 		{
 			db:  "db_mycat",
@@ -186,9 +214,13 @@ func TestMycatShardUpdateWithWhere(t *testing.T) {
 			},
 		},
 		{
-			db:     "db_mycat",
-			sql:    "update tbl_mycat set id = 5 where id = 6",
-			hasErr: true,
+			db:  "db_mycat",
+			sql: "update tbl_mycat set id = 5 where id = 6",
+			sqls: map[string]map[string][]string{
+				"slice-1": {
+					"db_mycat_2": {"SELECT *,5 FROM `tbl_mycat` WHERE `id`=6 FOR UPDATE", "DELETE FROM `tbl_mycat` WHERE `id`=6"},
+				},
+			},
 		},
 	}
 	for _, test := range tests {
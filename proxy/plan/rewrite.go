@@ -0,0 +1,293 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/model"
+)
+
+// SQLRewriter 按namespace配置的改写规则, 在生成执行计划前修改解析后的语句
+type SQLRewriter struct {
+	rules []*rewriteRule
+}
+
+type rewriteRule struct {
+	name         string
+	md5          string // 指纹的md5, 为空时不按指纹匹配
+	db           string
+	table        string
+	stmtType     string
+	forceIndex   []model.CIStr
+	maxLimit     uint64
+	selectFields string
+}
+
+// NewSQLRewriter constructor of SQLRewriter, 配置已经由models校验过, 这里检查select_fields能否解析
+func NewSQLRewriter(cfgs []*models.RewriteRule) (*SQLRewriter, error) {
+	r := &SQLRewriter{}
+	for _, cfg := range cfgs {
+		rule := &rewriteRule{
+			name:         cfg.Name,
+			db:           strings.ToLower(cfg.DB),
+			table:        strings.ToLower(cfg.Table),
+			stmtType:     strings.ToLower(cfg.StmtType),
+			maxLimit:     uint64(cfg.MaxLimit),
+			selectFields: strings.TrimSpace(cfg.SelectFields),
+		}
+		if fp := strings.TrimSpace(cfg.Fingerprint); fp != "" {
+			rule.md5 = mysql.GetMd5(mysql.GetFingerprint(fp))
+		}
+		for _, index := range cfg.ForceIndex {
+			rule.forceIndex = append(rule.forceIndex, model.NewCIStr(index))
+		}
+		// 没有force_index时其他改写只对SELECT生效, 不限制语句类型时只匹配SELECT, 避免统计到没有修改的语句
+		if rule.stmtType == "" && len(rule.forceIndex) == 0 {
+			rule.stmtType = models.RewriteStmtSelect
+		}
+		if rule.selectFields != "" {
+			if _, err := rule.parseSelectFields(); err != nil {
+				return nil, fmt.Errorf("rewrite rule %s: %v", rule.name, err)
+			}
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// IsEmpty 没有配置改写规则
+func (r *SQLRewriter) IsEmpty() bool {
+	return r == nil || len(r.rules) == 0
+}
+
+// GetRuleNames 返回所有规则的名称
+func (r *SQLRewriter) GetRuleNames() []string {
+	if r.IsEmpty() {
+		return nil
+	}
+	names := make([]string, 0, len(r.rules))
+	for _, rule := range r.rules {
+		names = append(names, rule.name)
+	}
+	return names
+}
+
+// MayMatch 不解析SQL判断是否可能命中规则, 可能命中时需要解析SQL, 不能直接生成非分片执行计划
+func (r *SQLRewriter) MayMatch(sql, md5 string) bool {
+	if r.IsEmpty() {
+		return false
+	}
+	var lower string
+	for _, rule := range r.rules {
+		if rule.md5 != "" {
+			if rule.md5 == md5 {
+				return true
+			}
+			continue
+		}
+		if lower == "" {
+			lower = strings.ToLower(sql)
+		}
+		if strings.Contains(lower, rule.table) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rewrite 对语句依次应用命中的规则, 返回命中的规则名称. db为会话的库, md5为SQL指纹的md5
+func (r *SQLRewriter) Rewrite(stmt ast.StmtNode, db, md5 string) ([]string, error) {
+	if r.IsEmpty() {
+		return nil, nil
+	}
+	var hits []string
+	for _, rule := range r.rules {
+		if !rule.match(stmt, db, md5) {
+			continue
+		}
+		if err := rule.apply(stmt, db); err != nil {
+			return hits, fmt.Errorf("apply rewrite rule %s error: %v", rule.name, err)
+		}
+		hits = append(hits, rule.name)
+	}
+	return hits, nil
+}
+
+func (r *rewriteRule) match(stmt ast.StmtNode, db, md5 string) bool {
+	if r.md5 != "" && r.md5 != md5 {
+		return false
+	}
+	switch r.stmtType {
+	case models.RewriteStmtSelect:
+		if _, ok := stmt.(*ast.SelectStmt); !ok {
+			return false
+		}
+	case models.RewriteStmtUpdate:
+		if _, ok := stmt.(*ast.UpdateStmt); !ok {
+			return false
+		}
+	case models.RewriteStmtDelete:
+		if _, ok := stmt.(*ast.DeleteStmt); !ok {
+			return false
+		}
+	}
+	if r.table == "" {
+		return true
+	}
+	v := &rewriteTableVisitor{rule: r, db: db}
+	stmt.Accept(v)
+	return len(v.tables) != 0
+}
+
+func (r *rewriteRule) apply(stmt ast.StmtNode, db string) error {
+	if len(r.forceIndex) != 0 {
+		v := &rewriteTableVisitor{rule: r, db: db}
+		stmt.Accept(v)
+		for _, t := range v.tables {
+			hints := []*ast.IndexHint{{IndexNames: r.forceIndex, HintType: ast.HintForce, HintScope: ast.HintForScan}}
+			// USE INDEX和FORCE INDEX不能同时使用, 保留IGNORE INDEX
+			for _, h := range t.IndexHints {
+				if h.HintType == ast.HintIgnore {
+					hints = append(hints, h)
+				}
+			}
+			t.IndexHints = hints
+		}
+	}
+
+	if r.maxLimit != 0 {
+		switch s := stmt.(type) {
+		case *ast.SelectStmt:
+			s.Limit = capLimit(s.Limit, r.maxLimit)
+		case *ast.UpdateStmt:
+			// UPDATE, DELETE需要显式配置stmt_type, 多表UPDATE, DELETE不支持LIMIT
+			if r.stmtType == models.RewriteStmtUpdate && !s.MultipleTable {
+				s.Limit = capLimit(s.Limit, r.maxLimit)
+			}
+		case *ast.DeleteStmt:
+			if r.stmtType == models.RewriteStmtDelete && !s.IsMultiTable {
+				s.Limit = capLimit(s.Limit, r.maxLimit)
+			}
+		}
+	}
+
+	if r.selectFields != "" {
+		if s, ok := stmt.(*ast.SelectStmt); ok && s.Fields != nil {
+			if err := r.replaceWildCard(s.Fields); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// capLimit 没有LIMIT时加上LIMIT, 超过上限时改为上限. LIMIT为参数时无法判断, 不修改
+func capLimit(limit *ast.Limit, max uint64) *ast.Limit {
+	if limit == nil {
+		return &ast.Limit{Count: ast.NewValueExpr(max)}
+	}
+	v, ok := limit.Count.(ast.ValueExpr)
+	if !ok {
+		return limit
+	}
+	switch count := v.GetValue().(type) {
+	case uint64:
+		if count > max {
+			limit.Count = ast.NewValueExpr(max)
+		}
+	case int64:
+		if count < 0 || uint64(count) > max {
+			limit.Count = ast.NewValueExpr(max)
+		}
+	}
+	return limit
+}
+
+// replaceWildCard 把*和t.*替换为配置的列, 多个*时只在第一个*的位置替换
+func (r *rewriteRule) replaceWildCard(fields *ast.FieldList) error {
+	var hasWildCard bool
+	for _, f := range fields.Fields {
+		if f.WildCard != nil {
+			hasWildCard = true
+			break
+		}
+	}
+	if !hasWildCard {
+		return nil
+	}
+	replaced, err := r.parseSelectFields()
+	if err != nil {
+		return err
+	}
+	ret := make([]*ast.SelectField, 0, len(fields.Fields)+len(replaced))
+	for _, f := range fields.Fields {
+		if f.WildCard == nil {
+			ret = append(ret, f)
+			continue
+		}
+		ret = append(ret, replaced...)
+		replaced = nil
+	}
+	fields.Fields = ret
+	return nil
+}
+
+// parseSelectFields 每次解析生成新的节点, 生成执行计划时会修改语法树, 不能复用
+func (r *rewriteRule) parseSelectFields() ([]*ast.SelectField, error) {
+	stmt, err := parser.ParseSQL("SELECT " + r.selectFields)
+	if err != nil {
+		return nil, fmt.Errorf("parse select_fields error: %v", err)
+	}
+	s, ok := stmt.(*ast.SelectStmt)
+	if !ok || s.Fields == nil || s.From != nil || s.Where != nil || s.Limit != nil {
+		return nil, fmt.Errorf("invalid select_fields: %s", r.selectFields)
+	}
+	for _, f := range s.Fields.Fields {
+		if f.WildCard != nil {
+			return nil, fmt.Errorf("select_fields must not contain *")
+		}
+	}
+	return s.Fields.Fields, nil
+}
+
+// rewriteTableVisitor 查找语句中与规则的库名和表名相同的表
+type rewriteTableVisitor struct {
+	rule   *rewriteRule
+	db     string
+	tables []*ast.TableName
+}
+
+func (v *rewriteTableVisitor) Enter(n ast.Node) (node ast.Node, skipChildren bool) {
+	if t, ok := n.(*ast.TableName); ok && t.Name.L == v.rule.table {
+		db := t.Schema.L
+		if db == "" {
+			db = strings.ToLower(v.db)
+		}
+		if v.rule.db == "" || v.rule.db == db {
+			v.tables = append(v.tables, t)
+		}
+	}
+	return n, false
+}
+
+func (v *rewriteTableVisitor) Leave(n ast.Node) (node ast.Node, ok bool) {
+	return n, true
+}
@@ -0,0 +1,203 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/parser/format"
+)
+
+func TestSQLRewriter(t *testing.T) {
+	rules := []*models.RewriteRule{
+		{Name: "force_idx", Table: "tbl_a", StmtType: "select", ForceIndex: []string{"idx_b"}},
+		{Name: "cap_limit", DB: "db_ks", Table: "tbl_b", MaxLimit: 100},
+		{Name: "fields", Fingerprint: "select * from tbl_c where id = 1", SelectFields: "id, name"},
+		{Name: "cap_delete", Table: "tbl_e", StmtType: "delete", MaxLimit: 100},
+		{Name: "idx_limit", Table: "tbl_f", ForceIndex: []string{"idx_a"}, MaxLimit: 100},
+	}
+	r, err := NewSQLRewriter(rules)
+	if err != nil {
+		t.Fatalf("new sql rewriter error: %v", err)
+	}
+	if !reflect.DeepEqual(r.GetRuleNames(), []string{"force_idx", "cap_limit", "fields", "cap_delete", "idx_limit"}) {
+		t.Fatalf("rule names not equal, actual: %v", r.GetRuleNames())
+	}
+
+	tests := []struct {
+		db     string
+		sql    string
+		expect string
+		hits   []string
+	}{
+		{
+			db:     "db_ks",
+			sql:    "select * from tbl_a use index (idx_a) ignore index (idx_c) where b = 1",
+			expect: "SELECT * FROM `tbl_a` FORCE INDEX (`idx_b`) IGNORE INDEX (`idx_c`) WHERE `b`=1",
+			hits:   []string{"force_idx"},
+		},
+		{
+			db:     "db_ks",
+			sql:    "select a.id from tbl_a a join tbl_d d on a.id = d.id",
+			expect: "SELECT `a`.`id` FROM `tbl_a` AS `a` FORCE INDEX (`idx_b`) JOIN `tbl_d` AS `d` ON `a`.`id`=`d`.`id`",
+			hits:   []string{"force_idx"},
+		},
+		{
+			// 语句类型不匹配
+			db:     "db_ks",
+			sql:    "update tbl_a set b = 1",
+			expect: "UPDATE `tbl_a` SET `b`=1",
+		},
+		{
+			db:     "db_ks",
+			sql:    "select * from tbl_b",
+			expect: "SELECT * FROM `tbl_b` LIMIT 100",
+			hits:   []string{"cap_limit"},
+		},
+		{
+			db:     "db_ks",
+			sql:    "select * from tbl_b limit 10, 1000",
+			expect: "SELECT * FROM `tbl_b` LIMIT 10,100",
+			hits:   []string{"cap_limit"},
+		},
+		{
+			db:     "db_ks",
+			sql:    "select * from tbl_b limit 10",
+			expect: "SELECT * FROM `tbl_b` LIMIT 10",
+			hits:   []string{"cap_limit"},
+		},
+		{
+			// 没有配置stmt_type时不修改DELETE的LIMIT
+			db:     "db_ks",
+			sql:    "delete from tbl_b where a > 1",
+			expect: "DELETE FROM `tbl_b` WHERE `a`>1",
+		},
+		{
+			db:     "db_ks",
+			sql:    "delete from tbl_e where a > 1",
+			expect: "DELETE FROM `tbl_e` WHERE `a`>1 LIMIT 100",
+			hits:   []string{"cap_delete"},
+		},
+		{
+			db:     "db_ks",
+			sql:    "update tbl_f set a = 1 limit 1000",
+			expect: "UPDATE `tbl_f` FORCE INDEX (`idx_a`) SET `a`=1 LIMIT 1000",
+			hits:   []string{"idx_limit"},
+		},
+		{
+			// 库名不匹配
+			db:     "db_mycat",
+			sql:    "select * from tbl_b",
+			expect: "SELECT * FROM `tbl_b`",
+		},
+		{
+			db:     "db_mycat",
+			sql:    "select * from db_ks.tbl_b",
+			expect: "SELECT * FROM `db_ks`.`tbl_b` LIMIT 100",
+			hits:   []string{"cap_limit"},
+		},
+		{
+			db:     "db_ks",
+			sql:    "select * from tbl_c where id = 10",
+			expect: "SELECT `id`,`name` FROM `tbl_c` WHERE `id`=10",
+			hits:   []string{"fields"},
+		},
+		{
+			// 指纹不匹配
+			db:     "db_ks",
+			sql:    "select * from tbl_c where name = 'a'",
+			expect: "SELECT * FROM `tbl_c` WHERE `name`='a'",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			md5 := mysql.GetMd5(mysql.GetFingerprint(test.sql))
+			if test.hits != nil && !r.MayMatch(test.sql, md5) {
+				t.Fatalf("expect may match")
+			}
+			stmt, err := parser.ParseSQL(test.sql)
+			if err != nil {
+				t.Fatalf("parse sql error: %v", err)
+			}
+			hits, err := r.Rewrite(stmt, test.db, md5)
+			if err != nil {
+				t.Fatalf("rewrite error: %v", err)
+			}
+			if !reflect.DeepEqual(hits, test.hits) {
+				t.Errorf("hits not equal, expect: %v, actual: %v", test.hits, hits)
+			}
+			var sb strings.Builder
+			if err := stmt.Restore(format.NewRestoreCtx(format.EscapeRestoreFlags, &sb)); err != nil {
+				t.Fatalf("restore error: %v", err)
+			}
+			if sb.String() != test.expect {
+				t.Errorf("sql not equal, expect: %s, actual: %s", test.expect, sb.String())
+			}
+		})
+	}
+
+	if r.MayMatch("select * from tbl_d", mysql.GetMd5(mysql.GetFingerprint("select * from tbl_d"))) {
+		t.Errorf("expect not match")
+	}
+	var empty *SQLRewriter
+	if !empty.IsEmpty() || empty.MayMatch("select * from tbl_a", "") {
+		t.Errorf("nil rewriter should be empty")
+	}
+}
+
+func TestNewSQLRewriterError(t *testing.T) {
+	invalids := []string{"id,", "*", "id from t", "t.*"}
+	for _, fields := range invalids {
+		_, err := NewSQLRewriter([]*models.RewriteRule{{Name: "r", Table: "t", SelectFields: fields}})
+		if err == nil {
+			t.Errorf("expect error for select_fields: %s", fields)
+		}
+	}
+}
+
+func TestSQLRewriterShardPlan(t *testing.T) {
+	ns, err := preparePlanInfo()
+	if err != nil {
+		t.Fatalf("prepare namespace error: %v", err)
+	}
+	r, err := NewSQLRewriter([]*models.RewriteRule{{Name: "r", Table: "tbl_ks", ForceIndex: []string{"idx_a"}, MaxLimit: 10}})
+	if err != nil {
+		t.Fatalf("new sql rewriter error: %v", err)
+	}
+	sql := "select * from tbl_ks where id = 2"
+	stmt, err := parser.ParseSQL(sql)
+	if err != nil {
+		t.Fatalf("parse sql error: %v", err)
+	}
+	if _, err := r.Rewrite(stmt, "db_ks", ""); err != nil {
+		t.Fatalf("rewrite error: %v", err)
+	}
+	p, err := BuildPlan(stmt, ns.phyDBs, "db_ks", sql, ns.rt, nil, ns.seqs, nil)
+	if err != nil {
+		t.Fatalf("build plan error: %v", err)
+	}
+	expect := map[string]map[string][]string{
+		"slice-1": {"db_ks": {"SELECT * FROM `tbl_ks_0002` FORCE INDEX (`idx_a`) WHERE `id`=2 LIMIT 10"}},
+	}
+	if actual := p.(*SelectPlan).GetSQLs(); !checkSQLs(expect, actual) {
+		t.Errorf("sqls not equal, expect: %v, actual: %v", expect, actual)
+	}
+}
@@ -124,6 +124,9 @@ func (r *GrayRouter) GetAllRules() map[string]map[string]*GrayRule {
 }
 
 func (r *GrayRouter) GetRule(db, table string) (*GrayRule, bool) {
+	if r == nil {
+		return nil, false
+	}
 	arry := strings.Split(table, ".")
 	if len(arry) == 2 {
 		table = strings.Trim(arry[1], "`")
@@ -25,6 +25,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/XiaoMi/Gaea/backend"
 	"github.com/XiaoMi/Gaea/log"
 	"github.com/XiaoMi/Gaea/models"
 	"github.com/XiaoMi/Gaea/util"
@@ -110,6 +111,7 @@ func NewAdminServer(proxy *Server, cfg *models.Proxy) (*AdminServer, error) {
 	if err = s.registerProxy(); err != nil {
 		return nil, err
 	}
+	s.proxy.manager.SetProxyToken(proxyInfo.Token)
 
 	log.Notice("[server] NewAdminServer, Api Server running, netProto: http, addr: %s", cfg.AdminAddr)
 	return s, nil
@@ -158,6 +160,8 @@ func (s *AdminServer) registerURL() {
 	adminGroup.GET("/stats/backendsqlfingerprint/:namespace", s.getNamespaceBackendSQLFingerprint)
 	adminGroup.DELETE("/stats/sessionsqlfingerprint/:namespace", s.clearNamespaceSessionSQLFingerprint)
 	adminGroup.DELETE("/stats/backendsqlfingerprint/:namespace", s.clearNamespaceBackendSQLFingerprint)
+	adminGroup.GET("/stats/rewriterule/:namespace", s.getNamespaceRewriteRuleHits)
+	adminGroup.GET("/stats/outlier/:namespace", s.getNamespaceOutlierStatus)
 
 	adminGroup.Use(gzip.Gzip(gzip.DefaultCompression))
 	adminGroup.Use(gin.Recovery())
@@ -414,6 +418,49 @@ func (s *AdminServer) getNamespaceBackendSQLFingerprint(c *gin.Context) {
 	c.JSON(http.StatusOK, ret)
 }
 
+// @Summary 获取SQL改写规则命中次数
+// @Description 通过管理接口获取namespace中每条SQL改写规则的命中次数, key为规则名称
+// @Produce  json
+// @Param namespace path string true "namespace name"
+// @Success 200 {object} map[string]int64
+// @Security BasicAuth
+// @Router /api/proxy/stats/rewriterule/{namespace} [get]
+func (s *AdminServer) getNamespaceRewriteRuleHits(c *gin.Context) {
+	ns := strings.TrimSpace(c.Param("namespace"))
+	namespace := s.proxy.manager.GetNamespace(ns)
+	if namespace == nil {
+		c.JSON(selfDefinedInternalError, "namespace not found")
+		return
+	}
+
+	ret := s.proxy.manager.GetStatisticManager().GetRewriteRuleHits(ns, namespace.GetSQLRewriter().GetRuleNames())
+	c.JSON(http.StatusOK, ret)
+}
+
+// @Summary 获取从库被动健康检查状态
+// @Description 通过管理接口获取namespace中开启outlier_detection的slice的从库熔断状态和摘除次数, key为slice名称
+// @Produce  json
+// @Param namespace path string true "namespace name"
+// @Success 200 {object} map[string][]backend.OutlierStatus
+// @Security BasicAuth
+// @Router /api/proxy/stats/outlier/{namespace} [get]
+func (s *AdminServer) getNamespaceOutlierStatus(c *gin.Context) {
+	ns := strings.TrimSpace(c.Param("namespace"))
+	namespace := s.proxy.manager.GetNamespace(ns)
+	if namespace == nil {
+		c.JSON(selfDefinedInternalError, "namespace not found")
+		return
+	}
+
+	ret := make(map[string][]backend.OutlierStatus)
+	for _, name := range namespace.GetSliceNames() {
+		if status := namespace.GetSlice(name).Outliers.Status(); status != nil {
+			ret[name] = status
+		}
+	}
+	c.JSON(http.StatusOK, ret)
+}
+
 // @Summary 清空Porxy节点慢SQL、错误SQL信息
 // @Description 通过管理接口清空Porxy慢SQL、错误SQL信息
 // @Produce  json
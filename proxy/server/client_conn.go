@@ -15,10 +15,12 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
 	"github.com/XiaoMi/Gaea/backend"
 	"github.com/XiaoMi/Gaea/log"
 	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/proxy/plan"
 	"github.com/XiaoMi/Gaea/util/sync2"
 )
 
@@ -32,6 +34,9 @@ type ClientConn struct {
 
 	capability uint32
 
+	// 握手时使用的TLS配置, 为nil时不支持TLS
+	tlsConfig *tls.Config
+
 	namespace string // TODO: remove it when refactor is done
 
 	proxy *Server
@@ -81,6 +86,13 @@ func (cc *ClientConn) writeInitialHandshakeV10() error {
 		length += mysql.LenNullString(cc.proxy.AuthPlugin)
 	}
 
+	// 配置了证书时支持TLS, 握手期间证书重新加载不影响当前连接
+	capability := DefaultCapability
+	cc.tlsConfig = cc.proxy.GetTLSConfig()
+	if cc.tlsConfig != nil {
+		capability |= mysql.ClientSSL
+	}
+
 	data := cc.StartEphemeralPacket(length)
 	pos := 0
 
@@ -102,7 +114,7 @@ func (cc *ClientConn) writeInitialHandshakeV10() error {
 	pos = mysql.WriteByte(data, pos, 0)
 
 	// Lower part of the capability flags, lower 2 bytes.
-	pos = mysql.WriteUint16(data, pos, uint16(DefaultCapability))
+	pos = mysql.WriteUint16(data, pos, uint16(capability))
 
 	// Character set.
 	pos = mysql.WriteByte(data, pos, byte(mysql.DefaultCollationID))
@@ -111,7 +123,7 @@ func (cc *ClientConn) writeInitialHandshakeV10() error {
 	pos = mysql.WriteUint16(data, pos, initClientConnStatus)
 
 	// Upper part of the capability flags.
-	pos = mysql.WriteUint16(data, pos, uint16(DefaultCapability>>16))
+	pos = mysql.WriteUint16(data, pos, uint16(capability>>16))
 
 	// Length of auth plugin data.
 	// Always 21 (8 + 13).
@@ -169,6 +181,25 @@ func (cc *ClientConn) readHandshakeResponse() (HandshakeResponseInfo, error) {
 		return info, fmt.Errorf("readHandshakeResponse: only support protocol 4.1")
 	}
 
+	// SSLRequest只包含握手响应的前32字节, 升级为TLS后客户端再发送完整的握手响应
+	if capability&mysql.ClientSSL > 0 {
+		if cc.tlsConfig == nil {
+			return info, fmt.Errorf("readHandshakeResponse: client requests SSL but SSL is not enabled")
+		}
+		if err = cc.UpgradeToServerTLS(cc.tlsConfig); err != nil {
+			return info, fmt.Errorf("readHandshakeResponse: %v", err)
+		}
+		cc.RecycleReadPacket()
+		data, err = cc.ReadEphemeralPacketDirect()
+		if err != nil {
+			return info, err
+		}
+		capability, pos, ok = mysql.ReadUint32(data, 0)
+		if !ok {
+			return info, fmt.Errorf("readHandshakeResponse: can't read client flags")
+		}
+	}
+
 	cc.capability = capability
 	// Max packet size. Don't do anything with this now.
 	_, pos, ok = mysql.ReadUint32(data, pos)
@@ -310,6 +341,58 @@ func (cc *ClientConn) writeOKResultStream(status uint16, rs *mysql.Result, conti
 	return nil
 }
 
+// writeResultStream 先写入列信息, 再分批从StreamMerger中读取归并后的行写入客户端
+func (cc *ClientConn) writeResultStream(status uint16, rs *mysql.Result, stream *plan.StreamMerger, isBinary bool) error {
+	defer rs.Free()
+	if err := cc.writeFields(status, rs.Resultset); err != nil {
+		return err
+	}
+
+	fields := stream.Fields()
+	for {
+		// 不使用ResultPool, 避免复用Fields的底层数组
+		result := &mysql.Result{Resultset: &mysql.Resultset{Fields: fields}}
+		var done bool
+		for len(result.Values) < streamWriteBatchRows {
+			row, err := stream.Next()
+			if err != nil {
+				// 列信息已经写入, 用错误包结束结果集
+				log.Warn("read rows in stream failed, %v", err)
+				if err := cc.writeErrorPacket(err); err != nil {
+					return err
+				}
+				return cc.Flush()
+			}
+			if row == nil {
+				done = true
+				break
+			}
+			result.Values = append(result.Values, row)
+		}
+
+		var err error
+		if isBinary {
+			err = result.BuildBinaryResultSet()
+		} else {
+			err = plan.GenerateSelectResultRowData(result)
+		}
+		if err != nil {
+			return err
+		}
+		for _, v := range result.RowDatas {
+			if err := cc.writeRow(v); err != nil {
+				return err
+			}
+		}
+		if done {
+			return cc.writeEndResult(status)
+		}
+		if err := cc.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
 // 写入结果集后，不能再引用结果集
 func (cc *ClientConn) writeOKResult(status uint16, moreRows bool, r *mysql.Result) error {
 	defer r.Free()
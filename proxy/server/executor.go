@@ -47,6 +47,7 @@ const (
 	standardMasterHint = "/*+ master */"
 	// general query log variable
 	gaeaGeneralLogVariable   = "gaea_general_log"
+	gaeaDDLResumeVariable    = "gaea_ddl_resume" // skip tables on which DDL of sharded table succeeded last time
 	readonlyVariable         = "read_only"
 	globalReadonlyVariable   = "global.read_only"
 	TxReadonlyLT5720         = "@@tx_read_only"
@@ -91,6 +92,9 @@ type SessionExecutor struct {
 	nsChangeIndexOld uint32
 	savepoints       []string
 	txLock           sync.Mutex
+	xa               *xaTransaction // xa transaction in progress, only used when namespace support xa
+	ddlResume        bool           // 分片表DDL是否跳过上一次已经成功的物理表
+	gtids            *gtidTracker   // 读写分离时记录本会话写入的GTID
 
 	stmtID uint32
 	stmts  map[uint32]*Stmt //prepare相关,client端到proxy的stmt
@@ -194,6 +198,7 @@ func newSessionExecutor(manager *Manager) *SessionExecutor {
 		txConns:          make(map[string]backend.PooledConnect),
 		ksConns:          make(map[string]backend.PooledConnect),
 		stmts:            make(map[uint32]*Stmt),
+		gtids:            newGTIDTracker(),
 		status:           initClientConnStatus,
 		manager:          manager,
 	}
@@ -434,6 +439,11 @@ func (se *SessionExecutor) getBackendConn(sliceName string, fromSlave bool) (pc
 func (se *SessionExecutor) getBackendNoKsConn(sliceName string, fromSlave bool) (pc backend.PooledConnect, err error) {
 	if !se.isInTransaction() {
 		slice := se.GetNamespace().GetSlice(sliceName)
+		if fromSlave {
+			if pc, ok, err := se.getConsistentConn(slice); ok {
+				return pc, err
+			}
+		}
 		return slice.GetConn(fromSlave, se.GetNamespace().GetUserProperty(se.user), se.GetNamespace().localSlaveReadPriority)
 	}
 	return se.getTransactionConn(sliceName)
@@ -495,7 +505,15 @@ func (se *SessionExecutor) getTransactionConn(sliceName string) (pc backend.Pool
 		pc.Recycle()
 		return
 	}
-	if !se.isAutoCommit() {
+	if se.isXAEnabled() {
+		// every branch is started as xa, so that the transaction can be committed in two phases
+		// when it spans multiple slices
+		if err = se.startXABranch(pc, sliceName); err != nil {
+			pc.Close()
+			pc.Recycle()
+			return
+		}
+	} else if !se.isAutoCommit() {
 		if err = pc.SetAutoCommit(0); err != nil {
 			pc.Close()
 			pc.Recycle()
@@ -559,6 +577,18 @@ func (se *SessionExecutor) recycleBackendConns(pcs map[string]backend.PooledConn
 	}
 }
 
+// initSliceConn 初始化slice上的后端连接, 失败时计入从库的被动健康检查
+func (se *SessionExecutor) initSliceConn(sliceName string, pc backend.PooledConnect, phyDB string) error {
+	startTime := time.Now()
+	err := initBackendConn(pc, phyDB, se.GetCharset(), se.GetCollationID(), se.GetVariables())
+	if err != nil {
+		if slice := se.GetNamespace().GetSlice(sliceName); slice != nil {
+			slice.ReportResult(pc.GetAddr(), time.Since(startTime), err)
+		}
+	}
+	return err
+}
+
 // initBackendConn tries to initialize the database connection with the specified database,
 // charset, and session variables.
 func initBackendConn(pc backend.PooledConnect, phyDB string, charset string, collation mysql.CollationID, sessionVariables *mysql.SessionVariables) error {
@@ -640,7 +670,7 @@ func (se *SessionExecutor) executeInMultiSlices(reqCtx *util.RequestContext, pcs
 			return dbs[i] < dbs[j]
 		})
 		for _, db := range dbs {
-			err := initBackendConn(pc, db, se.GetCharset(), se.GetCollationID(), se.GetVariables())
+			err := se.initSliceConn(sliceName, pc, db)
 			if err != nil {
 				rs[i] = err
 				break
@@ -684,21 +714,12 @@ func (se *SessionExecutor) executeInMultiSlices(reqCtx *util.RequestContext, pcs
 			delete(pcsUnCompleted, sliceName)
 		case <-ctx.Done():
 			for sliceName, pc := range pcsUnCompleted {
-				connID := pc.GetConnectionID()
-				dc, err := se.manager.GetNamespace(se.namespace).GetSlice(sliceName).GetDirectConn(pc.GetAddr())
-				if err != nil {
-					log.Warn("kill thread id: %d failed, get connection err: %v", connID, err.Error())
-					continue
-				}
-				if _, err = dc.Execute(fmt.Sprintf("KILL QUERY %d", connID), 0); err != nil {
-					log.Warn("kill thread id: %d failed, err: %v", connID, err.Error())
-				}
-				dc.Close()
+				se.killBackendQuery(sliceName, pc)
 			}
 			for j := 0; j < len(pcsUnCompleted); j++ {
 				<-done
 			}
-			return nil, fmt.Errorf("%v %dms", errors.ErrTimeLimitExceeded, maxExecuteTime)
+			return nil, timeLimitExceededError(maxExecuteTime)
 		}
 	}
 
@@ -716,6 +737,24 @@ func (se *SessionExecutor) executeInMultiSlices(reqCtx *util.RequestContext, pcs
 	return r, err
 }
 
+// killBackendQuery 使用新的连接kill后端连接上正在执行的SQL
+func (se *SessionExecutor) killBackendQuery(sliceName string, pc backend.PooledConnect) {
+	connID := pc.GetConnectionID()
+	dc, err := se.manager.GetNamespace(se.namespace).GetSlice(sliceName).GetDirectConn(pc.GetAddr())
+	if err != nil {
+		log.Warn("kill thread id: %d failed, get connection err: %v", connID, err.Error())
+		return
+	}
+	if _, err = dc.Execute(fmt.Sprintf("KILL QUERY %d", connID), 0); err != nil {
+		log.Warn("kill thread id: %d failed, err: %v", connID, err.Error())
+	}
+	dc.Close()
+}
+
+func timeLimitExceededError(maxExecuteTime int) error {
+	return fmt.Errorf("%v %dms", errors.ErrTimeLimitExceeded, maxExecuteTime)
+}
+
 func (se *SessionExecutor) executeInSlice(reqCtx *util.RequestContext, pc backend.PooledConnect, phyDb, sql string) (*mysql.Result, error) {
 	var ctx = context.Background()
 	var cancel context.CancelFunc
@@ -737,7 +776,7 @@ func (se *SessionExecutor) executeInSlice(reqCtx *util.RequestContext, pc backen
 			done <- struct{}{}
 			return
 		}
-		err = initBackendConn(pc, phyDb, se.GetCharset(), se.GetCollationID(), se.GetVariables())
+		err = se.initSliceConn("slice0", pc, phyDb)
 		if err != nil {
 			done <- struct{}{}
 			return
@@ -752,7 +791,7 @@ func (se *SessionExecutor) executeInSlice(reqCtx *util.RequestContext, pc backen
 	select {
 	case <-ctx.Done():
 		log.Warn("exec sql: %s, error: %s", sql, errors.ErrTimeLimitExceeded.Error())
-		return nil, fmt.Errorf("%v %dms", errors.ErrTimeLimitExceeded, maxExecuteTime)
+		return nil, timeLimitExceededError(maxExecuteTime)
 	case <-done:
 		return rs, err
 	}
@@ -1021,6 +1060,27 @@ func (se *SessionExecutor) handleShow(reqCtx *util.RequestContext, sql string) (
 	if strings.Contains(sql, readonlyVariable) && se.GetNamespace().IsAllowWrite(se.user) {
 		reqCtx.SetFromSlave(0)
 	}
+
+	// 有分片表的逻辑库中的SHOW TABLES等由Gaea返回逻辑表, 解析失败时仍然发送到默认分片
+	if len(se.GetNamespace().GetRouter().GetAllRules()) != 0 {
+		if stmt, err := se.Parse(sql); err == nil {
+			if showStmt, ok := stmt.(*ast.ShowStmt); ok {
+				p, err := plan.BuildShowPlan(showStmt, se.GetNamespace().GetPhysicalDBs(), se.db, se.GetNamespace().GetRouter())
+				if err != nil {
+					return nil, fmt.Errorf("build show plan error, sql: %s, err: %v", sql, err)
+				}
+				if p != nil {
+					r, err := p.ExecuteIn(reqCtx, se)
+					if err != nil {
+						return nil, fmt.Errorf("execute sql error, sql: %s, err: %v", sql, err)
+					}
+					modifyResultStatus(r, se)
+					return r, nil
+				}
+			}
+		}
+	}
+
 	r, err := se.ExecuteSQL(reqCtx, se.GetNamespace().GetDefaultSlice(), se.db, sql)
 	if err != nil {
 		return nil, fmt.Errorf("execute sql error, sql: %s, err: %v", sql, err)
@@ -1034,6 +1094,15 @@ func (se *SessionExecutor) handleBegin() error {
 	se.txLock.Lock()
 	defer se.txLock.Unlock()
 
+	// begin commits the current transaction implicitly
+	if se.xa != nil {
+		err := se.commitXA()
+		se.txConns = make(map[string]backend.PooledConnect)
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, co := range se.txConns {
 		if err := co.Begin(); err != nil {
 			return err
@@ -1075,13 +1144,19 @@ func (se *SessionExecutor) commit() (err error) {
 
 	se.status &= ^mysql.ServerStatusInTrans
 
-	for _, pc := range se.txConns {
-		if e := pc.Commit(); e != nil {
-			err = e
+	if se.xa != nil {
+		err = se.commitXA()
+	} else {
+		for sliceName, pc := range se.txConns {
+			if e := pc.Commit(); e != nil {
+				err = e
+			} else {
+				se.trackCommitGTIDs(sliceName, pc)
+			}
+			pc.Recycle()
 		}
-		pc.Recycle()
-
 	}
+	se.gtids.clearPending()
 
 	for _, pc := range se.ksConns {
 		if e := pc.Commit(); e != nil {
@@ -1097,10 +1172,15 @@ func (se *SessionExecutor) rollback() (err error) {
 	se.txLock.Lock()
 	defer se.txLock.Unlock()
 	se.status &= ^mysql.ServerStatusInTrans
-	for _, pc := range se.txConns {
-		err = pc.Rollback()
-		pc.Recycle()
+	if se.xa != nil {
+		err = se.rollbackXA()
+	} else {
+		for _, pc := range se.txConns {
+			err = pc.Rollback()
+			pc.Recycle()
+		}
 	}
+	se.gtids.clearPending()
 
 	for _, pc := range se.ksConns {
 		err = pc.Rollback()
@@ -1161,6 +1241,7 @@ func (se *SessionExecutor) recycleTx() {
 	se.txLock.Lock()
 	defer se.txLock.Unlock()
 	se.txConns = make(map[string]backend.PooledConnect)
+	se.xa = nil
 }
 
 // handleKQuit close backend connection and recycle, only called when client exit
@@ -1179,7 +1260,8 @@ func (se *SessionExecutor) ExecuteSQL(reqCtx *util.RequestContext, slice, db, sq
 		return nil, err
 	}
 
-	pc, err := se.getBackendConn(slice, getFromSlave(reqCtx))
+	fromSlave := getFromSlave(reqCtx)
+	pc, err := se.getBackendConn(slice, fromSlave)
 	defer se.recycleBackendConn(pc)
 
 	if err != nil {
@@ -1194,6 +1276,9 @@ func (se *SessionExecutor) ExecuteSQL(reqCtx *util.RequestContext, slice, db, sq
 	if err != nil {
 		return nil, err
 	}
+	if !fromSlave {
+		se.trackGTIDs(slice, pc, isWriteStmt(reqCtx.GetStmtType()))
+	}
 
 	if pc.MoreRowsExist() || pc.MoreResultsExist() {
 		se.session.continueConn = pc
@@ -1207,7 +1292,8 @@ func (se *SessionExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[str
 		return nil, fmt.Errorf("no sql to execute")
 	}
 
-	pcs, err := se.getBackendConns(sqls, getFromSlave(reqCtx))
+	fromSlave := getFromSlave(reqCtx)
+	pcs, err := se.getBackendConns(sqls, fromSlave)
 	defer se.recycleBackendConns(pcs, false)
 	if err != nil {
 		log.Warn("getShardConns failed: %v", err)
@@ -1218,5 +1304,11 @@ func (se *SessionExecutor) ExecuteSQLs(reqCtx *util.RequestContext, sqls map[str
 	if err != nil {
 		return nil, err
 	}
+	if !fromSlave {
+		isWrite := isWriteStmt(reqCtx.GetStmtType())
+		for sliceName, pc := range pcs {
+			se.trackGTIDs(sliceName, pc, isWrite)
+		}
+	}
 	return rs, nil
 }
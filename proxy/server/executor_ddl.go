@@ -0,0 +1,94 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/XiaoMi/Gaea/log"
+	"github.com/XiaoMi/Gaea/proxy/plan"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+// GetDDLProgress implement plan.DDLExecutor
+func (se *SessionExecutor) GetDDLProgress() *plan.DDLProgress {
+	return se.GetNamespace().GetDDLProgress()
+}
+
+// ExecuteDDLs implement plan.DDLExecutor
+// 每个slice最多同时执行GetDDLParallelism()条DDL, 每条DDL使用一个独立的主库连接
+func (se *SessionExecutor) ExecuteDDLs(reqCtx *util.RequestContext, tasks []*plan.DDLTask) error {
+	// DDL会隐式提交事务, 且事务中每个分片只有一个连接
+	if se.isInTransaction() {
+		return fmt.Errorf("DDL on sharded table is not allowed in transaction")
+	}
+
+	ns := se.GetNamespace()
+	sliceTasks := make(map[string][]*plan.DDLTask)
+	for _, task := range tasks {
+		if ns.GetSlice(task.Slice) == nil {
+			return fmt.Errorf("slice %s not found", task.Slice)
+		}
+		sliceTasks[task.Slice] = append(sliceTasks[task.Slice], task)
+	}
+
+	var wg sync.WaitGroup
+	for _, ts := range sliceTasks {
+		parallelism := ns.GetDDLParallelism()
+		if parallelism > len(ts) {
+			parallelism = len(ts)
+		}
+		ch := make(chan *plan.DDLTask, len(ts))
+		for _, task := range ts {
+			ch <- task
+		}
+		close(ch)
+
+		wg.Add(parallelism)
+		for i := 0; i < parallelism; i++ {
+			go func() {
+				defer wg.Done()
+				for task := range ch {
+					task.Err = se.executeDDL(reqCtx, task)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	return nil
+}
+
+func (se *SessionExecutor) executeDDL(reqCtx *util.RequestContext, task *plan.DDLTask) error {
+	ns := se.GetNamespace()
+	pc, err := ns.GetSlice(task.Slice).GetConn(false, ns.GetUserProperty(se.user), ns.localSlaveReadPriority)
+	if err != nil {
+		return fmt.Errorf("get connection error: %v", err)
+	}
+	defer pc.Recycle()
+
+	if err := se.initSliceConn(task.Slice, pc, task.DB); err != nil {
+		return err
+	}
+	startTime := time.Now()
+	_, err = pc.Execute(task.SQL, ns.GetMaxResultSize())
+	se.manager.RecordBackendSQLMetrics(reqCtx, se, task.Slice, task.SQL, pc.GetAddr(), startTime, err)
+	if err != nil {
+		log.Warn("[ns:%s] execute ddl error, slice: %s, db: %s, sql: %s, err: %v", ns.GetName(), task.Slice, task.DB, task.SQL, err)
+		return err
+	}
+	return nil
+}
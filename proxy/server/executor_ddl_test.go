@@ -0,0 +1,90 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/backend"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/proxy/plan"
+	"github.com/XiaoMi/Gaea/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExecuteDDLs(t *testing.T) {
+	se, err := prepareSessionExecutor()
+	if err != nil {
+		t.Fatal("prepare session executer error:", err)
+	}
+	// 记录执行失败的SQL时需要客户端连接
+	se.session.c = &ClientConn{Conn: &mysql.Conn{}}
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	slice0MasterPool := backend.NewMockConnectionPool(mockCtl)
+	slice1MasterPool := backend.NewMockConnectionPool(mockCtl)
+	slice0Status := &sync.Map{}
+	slice0Status.Store(0, backend.StatusUp)
+	slice1Status := &sync.Map{}
+	slice1Status.Store(0, backend.StatusUp)
+	ns := se.manager.GetNamespace("test_executor_namespace")
+	// namespace在测试间共享, 结束后恢复原来的连接池
+	for _, slice := range []string{"slice-0", "slice-1"} {
+		master := ns.slices[slice].Master
+		defer func(slice string) {
+			ns.slices[slice].Master = master
+		}(slice)
+	}
+	ns.slices["slice-0"].Master = &backend.DBInfo{ConnPool: []backend.ConnectionPool{slice0MasterPool}, StatusMap: slice0Status}
+	ns.slices["slice-1"].Master = &backend.DBInfo{ConnPool: []backend.ConnectionPool{slice1MasterPool}, StatusMap: slice1Status}
+
+	tasks := []*plan.DDLTask{
+		{Slice: "slice-0", DB: "db_mycat_0", Table: "tbl_mycat", SQL: "ALTER TABLE `tbl_mycat` ADD COLUMN `c` INT"},
+		{Slice: "slice-0", DB: "db_mycat_1", Table: "tbl_mycat", SQL: "ALTER TABLE `tbl_mycat` ADD COLUMN `c` INT "},
+		{Slice: "slice-1", DB: "db_mycat_2", Table: "tbl_mycat", SQL: "ALTER TABLE `tbl_mycat` ADD COLUMN `c` INT"},
+	}
+
+	// slice-0上的两条DDL并发执行, 各使用一个连接, 第二条执行失败
+	slice0MasterConn := backend.NewMockPooledConnect(mockCtl)
+	slice0MasterConn.EXPECT().GetAddr().Return("127.0.0.1:3306").AnyTimes()
+	slice0MasterConn.EXPECT().UseDB("db_mycat_0").Return(nil)
+	slice0MasterConn.EXPECT().UseDB("db_mycat_1").Return(nil)
+	slice0MasterConn.EXPECT().SetCharset("utf8", mysql.CharsetIds["utf8"]).Return(false, nil).Times(2)
+	slice0MasterConn.EXPECT().SetSessionVariables(mysql.NewSessionVariables()).Return(false, nil).Times(2)
+	slice0MasterConn.EXPECT().Execute(tasks[0].SQL, defaultMaxSqlResultSize).Return(&mysql.Result{}, nil)
+	slice0MasterConn.EXPECT().Execute(tasks[1].SQL, defaultMaxSqlResultSize).Return(nil, fmt.Errorf("lock wait timeout"))
+	slice0MasterConn.EXPECT().Recycle().Return().Times(2)
+
+	slice1MasterConn := backend.NewMockPooledConnect(mockCtl)
+	slice1MasterConn.EXPECT().GetAddr().Return("127.0.0.1:3307").AnyTimes()
+	slice1MasterConn.EXPECT().UseDB("db_mycat_2").Return(nil)
+	slice1MasterConn.EXPECT().SetCharset("utf8", mysql.CharsetIds["utf8"]).Return(false, nil)
+	slice1MasterConn.EXPECT().SetSessionVariables(mysql.NewSessionVariables()).Return(false, nil)
+	slice1MasterConn.EXPECT().Execute(tasks[2].SQL, defaultMaxSqlResultSize).Return(&mysql.Result{}, nil)
+	slice1MasterConn.EXPECT().Recycle().Return()
+
+	slice0MasterPool.EXPECT().Get(context.TODO()).Return(slice0MasterConn, nil).Times(2)
+	slice1MasterPool.EXPECT().Get(context.TODO()).Return(slice1MasterConn, nil)
+
+	err = se.ExecuteDDLs(util.NewRequestContext(), tasks)
+	assert.Nil(t, err)
+	assert.Nil(t, tasks[0].Err)
+	assert.EqualError(t, tasks[1].Err, "lock wait timeout")
+	assert.Nil(t, tasks[2].Err)
+}
@@ -0,0 +1,204 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/XiaoMi/Gaea/backend"
+	"github.com/XiaoMi/Gaea/log"
+	"github.com/XiaoMi/Gaea/parser"
+)
+
+// 每个slice记录的GTID数量超过该值时, 读之前使用master的gtid_executed代替
+const maxTrackedGTIDs = 64
+
+// gtidTracker 记录会话在每个slice的master上写入产生的GTID.
+// 读写分离时, 之后的读请求只发往已经执行了这些GTID的slave, 保证会话能读到自己写入的数据.
+type gtidTracker struct {
+	gtids     map[string][]string // key: slice name
+	stale     map[string]bool     // 写入没有返回GTID的slice, 读之前需要查询master的gtid_executed
+	pending   map[string]bool     // 事务中有写入的slice, 提交后才能获取GTID
+	writeTime time.Time           // 最后一次记录GTID的时间
+}
+
+func newGTIDTracker() *gtidTracker {
+	return &gtidTracker{
+		gtids:   make(map[string][]string),
+		stale:   make(map[string]bool),
+		pending: make(map[string]bool),
+	}
+}
+
+func (t *gtidTracker) add(sliceName, gtids string, now time.Time) {
+	t.gtids[sliceName] = append(t.gtids[sliceName], gtids)
+	t.writeTime = now
+}
+
+// markStale 记录slice上有写入但不知道写入的GTID, 读的时候再查询, 避免每次写入后都多一次查询
+func (t *gtidTracker) markStale(sliceName string, now time.Time) {
+	delete(t.gtids, sliceName)
+	t.stale[sliceName] = true
+	t.writeTime = now
+}
+
+// reset 用包含了之前所有写入的GTID集合代替已记录的GTID
+func (t *gtidTracker) reset(sliceName, gtids string) {
+	t.gtids[sliceName] = []string{gtids}
+	delete(t.stale, sliceName)
+}
+
+func (t *gtidTracker) count(sliceName string) int {
+	return len(t.gtids[sliceName])
+}
+
+// get 返回读slice时slave需要执行的GTID, 以及是否需要先查询master的gtid_executed.
+// window大于0且距离最后一次写入超过window时不再保证读到写入的数据
+func (t *gtidTracker) get(sliceName string, window time.Duration, now time.Time) (string, bool) {
+	if len(t.gtids) == 0 && len(t.stale) == 0 {
+		return "", false
+	}
+	if window > 0 && now.Sub(t.writeTime) > window {
+		t.gtids = make(map[string][]string)
+		t.stale = make(map[string]bool)
+		return "", false
+	}
+	return strings.Join(t.gtids[sliceName], ","), t.stale[sliceName]
+}
+
+func (t *gtidTracker) markPending(sliceName string) {
+	t.pending[sliceName] = true
+}
+
+func (t *gtidTracker) takePending(sliceName string) bool {
+	ok := t.pending[sliceName]
+	delete(t.pending, sliceName)
+	return ok
+}
+
+func (t *gtidTracker) clearPending() {
+	if len(t.pending) != 0 {
+		t.pending = make(map[string]bool)
+	}
+}
+
+// isWriteStmt 会产生GTID的语句
+func isWriteStmt(stmtType int) bool {
+	switch stmtType {
+	case parser.StmtInsert, parser.StmtReplace, parser.StmtUpdate, parser.StmtDelete, parser.StmtDDL:
+		return true
+	}
+	return false
+}
+
+// isReadYourWrites 会话是否需要读到自己写入的数据, 只对读写分离的用户生效, 会话保持时读写使用同一个连接, 不需要处理
+func (se *SessionExecutor) isReadYourWrites() bool {
+	ns := se.GetNamespace()
+	return ns != nil && ns.readYourWrites && ns.IsRWSplit(se.user) && !se.IsKeepSession()
+}
+
+// getConsistentConn 本会话在slice上有写入时, 从已经执行了写入GTID的slave获取连接, 没有写入时返回false
+func (se *SessionExecutor) getConsistentConn(slice *backend.Slice) (backend.PooledConnect, bool, error) {
+	if !se.isReadYourWrites() {
+		return nil, false, nil
+	}
+	ns := se.GetNamespace()
+	sliceName := slice.GetSliceName()
+	gtids, stale := se.gtids.get(sliceName, ns.readYourWritesWindow, time.Now())
+	if gtids == "" && !stale {
+		return nil, false, nil
+	}
+	if stale {
+		executed, err := getMasterExecutedGTIDs(slice)
+		if err != nil {
+			// 无法确定slave是否执行了写入时读master
+			log.Warn("[ns:%s, %s] get gtid_executed failed, err: %v", se.namespace, sliceName, err)
+			pc, err := slice.GetMasterConn()
+			return pc, true, err
+		}
+		se.gtids.reset(sliceName, executed)
+		gtids = executed
+	}
+	pc, err := slice.GetConsistentConn(ns.GetUserProperty(se.user), ns.localSlaveReadPriority, gtids, ns.gtidWaitTimeout)
+	return pc, true, err
+}
+
+// trackGTIDs 在master上执行SQL后调用. 事务中的写入在提交时才产生GTID, 先记录有写入的slice
+func (se *SessionExecutor) trackGTIDs(sliceName string, pc backend.PooledConnect, isWrite bool) {
+	if pc == nil || !se.isReadYourWrites() {
+		return
+	}
+	if se.isInTransaction() {
+		if isWrite {
+			se.gtids.markPending(sliceName)
+		}
+		return
+	}
+	se.recordGTIDs(sliceName, pc, isWrite)
+}
+
+// trackCommitGTIDs 提交事务后调用, 记录事务产生的GTID
+func (se *SessionExecutor) trackCommitGTIDs(sliceName string, pc backend.PooledConnect) {
+	written := se.gtids.takePending(sliceName)
+	if pc == nil || !se.isReadYourWrites() {
+		return
+	}
+	se.recordGTIDs(sliceName, pc, written)
+}
+
+// recordGTIDs 优先使用OK包中返回的GTID. 后端没有开启session_track_gtids时, 下一次读slice前使用master的gtid_executed, 其中包含了本次写入
+func (se *SessionExecutor) recordGTIDs(sliceName string, pc backend.PooledConnect, written bool) {
+	gtids := pc.TakeGTIDs()
+	if (gtids == "" && written) || (gtids != "" && se.gtids.count(sliceName) >= maxTrackedGTIDs) {
+		se.gtids.markStale(sliceName, time.Now())
+		return
+	}
+	if gtids != "" {
+		se.gtids.add(sliceName, gtids, time.Now())
+	}
+}
+
+func getMasterExecutedGTIDs(slice *backend.Slice) (string, error) {
+	pc, err := slice.GetMasterConn()
+	if err != nil {
+		return "", err
+	}
+	defer pc.Recycle()
+	gtids, err := queryExecutedGTIDs(pc)
+	if err != nil {
+		pc.Close()
+	}
+	return gtids, err
+}
+
+func queryExecutedGTIDs(pc backend.PooledConnect) (string, error) {
+	r, err := pc.Execute("SELECT @@GLOBAL.gtid_executed", 0)
+	if err != nil {
+		return "", err
+	}
+	if r.Resultset == nil || r.RowNumber() == 0 {
+		return "", fmt.Errorf("empty result of gtid_executed")
+	}
+	gtids, err := r.GetString(0, 0)
+	if err != nil {
+		return "", err
+	}
+	if gtids == "" {
+		return "", fmt.Errorf("gtid is not enabled")
+	}
+	return gtids, nil
+}
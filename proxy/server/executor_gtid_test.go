@@ -0,0 +1,142 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/Gaea/backend"
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGTIDTrackerWindow(t *testing.T) {
+	tracker := newGTIDTracker()
+	now := time.Now()
+	assertGTIDs(t, tracker, "slice-0", time.Second, now, "", false)
+
+	tracker.add("slice-0", "uuid:1", now)
+	tracker.add("slice-0", "uuid:3", now)
+	tracker.markStale("slice-1", now)
+	assertGTIDs(t, tracker, "slice-0", time.Second, now.Add(500*time.Millisecond), "uuid:1,uuid:3", false)
+	assertGTIDs(t, tracker, "slice-1", time.Second, now, "", true)
+
+	// 超过窗口后不再保证读到写入的数据
+	assertGTIDs(t, tracker, "slice-0", time.Second, now.Add(2*time.Second), "", false)
+	assertGTIDs(t, tracker, "slice-1", time.Second, now, "", false)
+	assert.Equal(t, 0, tracker.count("slice-0"))
+
+	// 窗口为0时一直保证
+	tracker.add("slice-0", "uuid:5", now)
+	assertGTIDs(t, tracker, "slice-0", 0, now.Add(time.Hour), "uuid:5", false)
+
+	// 查询到gtid_executed后不再需要查询
+	tracker.markStale("slice-0", now)
+	assertGTIDs(t, tracker, "slice-0", 0, now, "", true)
+	tracker.reset("slice-0", "uuid:1-5")
+	assertGTIDs(t, tracker, "slice-0", 0, now, "uuid:1-5", false)
+}
+
+func assertGTIDs(t *testing.T, tracker *gtidTracker, sliceName string, window time.Duration, now time.Time, expectGTIDs string, expectStale bool) {
+	gtids, stale := tracker.get(sliceName, window, now)
+	assert.Equal(t, expectGTIDs, gtids)
+	assert.Equal(t, expectStale, stale)
+}
+
+func newGTIDTestExecutor() *SessionExecutor {
+	se := newSessionExecutor(nil)
+	se.user = "test_rw"
+	se.contextNamespace = &Namespace{
+		readYourWrites: true,
+		userProperties: map[string]*UserProperty{"test_rw": {RWSplit: models.ReadWriteSplit}},
+	}
+	return se
+}
+
+func TestTrackGTIDs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	se := newGTIDTestExecutor()
+	pc := backend.NewMockPooledConnect(ctrl)
+
+	// OK包中返回了GTID
+	pc.EXPECT().TakeGTIDs().Return("uuid:1")
+	se.trackGTIDs("slice-0", pc, true)
+	assertGTIDs(t, se.gtids, "slice-0", 0, time.Now(), "uuid:1", false)
+
+	// 读请求不记录
+	pc.EXPECT().TakeGTIDs().Return("")
+	se.trackGTIDs("slice-0", pc, false)
+	assertGTIDs(t, se.gtids, "slice-0", 0, time.Now(), "uuid:1", false)
+
+	// 后端没有开启session_track_gtids时不在写入后查询, 读之前再查询gtid_executed
+	pc.EXPECT().TakeGTIDs().Return("")
+	se.trackGTIDs("slice-0", pc, true)
+	assertGTIDs(t, se.gtids, "slice-0", 0, time.Now(), "", true)
+
+	// 事务中的写入在提交后记录
+	se.status |= mysql.ServerStatusInTrans
+	se.trackGTIDs("slice-1", pc, true)
+	assertGTIDs(t, se.gtids, "slice-1", 0, time.Now(), "", false)
+	se.status &= ^mysql.ServerStatusInTrans
+	pc.EXPECT().TakeGTIDs().Return("uuid:3")
+	se.trackCommitGTIDs("slice-1", pc)
+	assertGTIDs(t, se.gtids, "slice-1", 0, time.Now(), "uuid:3", false)
+
+	// 没有开启读写分离的用户不记录
+	se.contextNamespace.userProperties["test_rw"].RWSplit = models.NoReadWriteSplit
+	se.trackGTIDs("slice-2", pc, true)
+	assertGTIDs(t, se.gtids, "slice-2", 0, time.Now(), "", false)
+}
+
+func TestGetConsistentConnQueryExecutedGTIDs(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	masterPool := backend.NewMockConnectionPool(ctrl)
+	status := &sync.Map{}
+	status.Store(0, backend.StatusUp)
+	slice := &backend.Slice{
+		Cfg:    models.Slice{Name: "slice-0"},
+		Master: &backend.DBInfo{ConnPool: []backend.ConnectionPool{masterPool}, StatusMap: status},
+		Slave:  &backend.DBInfo{},
+	}
+
+	se := newGTIDTestExecutor()
+	se.gtids.markStale("slice-0", time.Now())
+
+	// 从master查询gtid_executed, 没有可用的slave时读master
+	master := backend.NewMockPooledConnect(ctrl)
+	master.EXPECT().Execute("SELECT @@GLOBAL.gtid_executed", 0).Return(&mysql.Result{
+		Resultset: &mysql.Resultset{
+			Fields:     []*mysql.Field{{Name: []byte("@@GLOBAL.gtid_executed")}},
+			FieldNames: map[string]int{"@@GLOBAL.gtid_executed": 0},
+			Values:     [][]any{{"uuid:1-2"}},
+		},
+	}, nil)
+	master.EXPECT().Recycle()
+	masterPool.EXPECT().Get(gomock.Any()).Return(master, nil).Times(2)
+
+	pc, ok, err := se.getConsistentConn(slice)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, master, pc)
+	assertGTIDs(t, se.gtids, "slice-0", 0, time.Now(), "uuid:1-2", false)
+}
@@ -30,6 +30,7 @@ import (
 	"github.com/XiaoMi/Gaea/mysql"
 	"github.com/XiaoMi/Gaea/parser"
 	"github.com/XiaoMi/Gaea/parser/ast"
+	"github.com/XiaoMi/Gaea/parser/format"
 	"github.com/XiaoMi/Gaea/proxy/plan"
 	"github.com/XiaoMi/Gaea/util"
 )
@@ -178,7 +179,20 @@ func (se *SessionExecutor) doQuery(reqCtx *util.RequestContext, sql string) (*my
 	}
 
 	reqCtx.SetDefaultSlice(se.GetNamespace().GetDefaultSlice())
-	r, err := p.ExecuteIn(reqCtx, se)
+	reqCtx.SetMaxResultSize(se.GetNamespace().GetMaxResultSize())
+	reqCtx.SetMaxDistinctMemory(se.GetNamespace().GetMaxDistinctMemory())
+	reqCtx.SetMaxInsertSelectRows(se.GetNamespace().GetMaxInsertSelectRows())
+	reqCtx.SetSupportUpdateShardKey(se.GetNamespace().IsSupportUpdateShardKey())
+	reqCtx.SetMaxUpdateShardKeyRows(se.GetNamespace().GetMaxUpdateShardKeyRows())
+	reqCtx.SetMaxSubqueryInValues(se.GetNamespace().GetMaxSubqueryInValues())
+	reqCtx.SetDDLResume(se.ddlResume)
+	reqCtx.SetInTransaction(se.isInTransaction())
+	var r *mysql.Result
+	if sp, ok := p.(*plan.SelectPlan); ok && se.canExecuteInStream(sp) {
+		r, err = se.executeSelectInStream(reqCtx, sp)
+	} else {
+		r, err = p.ExecuteIn(reqCtx, se)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -262,10 +276,43 @@ func (se *SessionExecutor) handleUseDB(dbName string) error {
 }
 
 func (se *SessionExecutor) getPlan(reqCtx *util.RequestContext, ns *Namespace, db string, sql string, checkHint bool) (plan.Plan, error) {
-	p, isUnshardPlan := se.preBuildUnshardPlan(reqCtx, db, sql)
-	if isUnshardPlan {
+	if checkHint {
+		if p, ok, err := se.getRouteHintPlan(reqCtx, ns, db, sql); ok {
+			return p, err
+		}
+	}
+
+	if p, ok, err := se.getInformationSchemaPlan(ns, db, sql); ok {
+		return p, err
+	}
+
+	// 可能命中改写规则时需要解析SQL, 不能直接生成非分片执行计划
+	mayRewrite := ns.GetSQLRewriter().MayMatch(sql, getSQLFingerprintMd5(reqCtx, sql))
+	if mayRewrite {
+		// to be used to check master hint
+		reqCtx.SetTokens(parser.Tokenize(sql))
+	} else if p, isUnshardPlan := se.preBuildUnshardPlan(reqCtx, db, sql); isUnshardPlan {
 		return p, nil
 	}
+
+	var hintPlan plan.Plan
+	var err error
+	if checkHint {
+		//TODO: 获取 token 没有处理 `/* !mycat:sql=` hint，所以需要在这里处理下
+		_, comments := extractPrefixCommentsAndRewrite(sql, se.session.proxy.ServerVersionCompareStatus)
+		hintPlan, err = checkMyCatHintPlan(reqCtx, se, db, comments)
+		// get MyCat hint plan error,will only log
+		if err != nil {
+			log.Notice("check MyCat hint plan err:%s", err)
+		}
+	}
+
+	if hintPlan == nil && !mayRewrite && ns.IsPlanCacheEnabled() {
+		if p, ok, err := se.getPlanWithCache(ns, db, sql); ok {
+			return p, err
+		}
+	}
+
 	n, err := se.Parse(sql)
 	if err != nil {
 		// 如果是注释的情况，则忽略
@@ -277,18 +324,13 @@ func (se *SessionExecutor) getPlan(reqCtx *util.RequestContext, ns *Namespace, d
 		return nil, fmt.Errorf("parse sql error, sql: %s, err: %v", sql, err)
 	}
 
-	var hintPlan plan.Plan
-	if checkHint {
-		//TODO: 获取 token 没有处理 `/* !mycat:sql=` hint，所以需要在这里处理下
-		_, comments := extractPrefixCommentsAndRewrite(sql, se.session.proxy.ServerVersionCompareStatus)
-		hintPlan, err = checkMyCatHintPlan(reqCtx, se, db, comments)
-		// get MyCat hint plan error,will only log
-		if err != nil {
-			log.Notice("check MyCat hint plan err:%s", err)
+	if mayRewrite {
+		if sql, err = se.rewriteSQL(reqCtx, ns, db, sql, n); err != nil {
+			return nil, err
 		}
 	}
 
-	p, err = plan.BuildPlan(n, ns.GetPhysicalDBs(), db, sql, ns.GetRouter(), ns.GetGrayRouter(), ns.GetSequences(), hintPlan)
+	p, err := plan.BuildPlan(n, ns.GetPhysicalDBs(), db, sql, ns.GetRouter(), ns.GetGrayRouter(), ns.GetSequences(), hintPlan)
 	if err != nil {
 		return nil, fmt.Errorf("build plan error: %v", err)
 	}
@@ -296,6 +338,101 @@ func (se *SessionExecutor) getPlan(reqCtx *util.RequestContext, ns *Namespace, d
 	return p, nil
 }
 
+// rewriteSQL 按namespace的改写规则修改语句, 命中时返回改写后的SQL, 子查询等执行计划会重新解析SQL文本
+func (se *SessionExecutor) rewriteSQL(reqCtx *util.RequestContext, ns *Namespace, db string, sql string, n ast.StmtNode) (string, error) {
+	hits, err := ns.GetSQLRewriter().Rewrite(n, db, getSQLFingerprintMd5(reqCtx, sql))
+	for _, rule := range hits {
+		se.manager.GetStatisticManager().RecordRewriteRuleHit(ns.GetName(), rule)
+	}
+	if err != nil {
+		return "", fmt.Errorf("rewrite sql error, sql: %s, err: %v", sql, err)
+	}
+	if len(hits) == 0 {
+		return sql, nil
+	}
+
+	var sb strings.Builder
+	if err := n.Restore(format.NewRestoreCtx(format.EscapeRestoreFlags, &sb)); err != nil {
+		return "", fmt.Errorf("restore rewritten sql error, sql: %s, err: %v", sql, err)
+	}
+	rewritten := sb.String()
+	n.SetText(rewritten)
+	return rewritten, nil
+}
+
+// getInformationSchemaPlan 有分片表时, information_schema.TABLES中的物理库和物理表由Gaea转换为逻辑库和逻辑表
+func (se *SessionExecutor) getInformationSchemaPlan(ns *Namespace, db string, sql string) (plan.Plan, bool, error) {
+	if len(ns.GetRouter().GetAllRules()) == 0 || !strings.Contains(strings.ToLower(sql), "information_schema") {
+		return nil, false, nil
+	}
+	n, err := se.Parse(sql)
+	if err != nil || !plan.IsInformationSchemaTablesStmt(n) {
+		return nil, false, nil
+	}
+	p, err := plan.BuildInformationSchemaTablesPlan(n, ns.GetPhysicalDBs(), db, ns.GetRouter())
+	if err != nil {
+		return nil, true, fmt.Errorf("build information_schema plan error: %v", err)
+	}
+	return p, true, nil
+}
+
+// getRouteHintPlan SQL中有GAEA_ROUTE或GAEA_BROADCAST hint时, 按hint指定的路由生成执行计划, 只允许admin用户使用
+func (se *SessionExecutor) getRouteHintPlan(reqCtx *util.RequestContext, ns *Namespace, db string, sql string) (plan.Plan, bool, error) {
+	hint, err := plan.ParseRouteHint(sql)
+	if err != nil {
+		return nil, true, fmt.Errorf("parse route hint error: %v", err)
+	}
+	if hint == nil {
+		return nil, false, nil
+	}
+	reqCtx.SetRouteHint(hint.String())
+	if !ns.IsAdmin(se.user) {
+		return nil, true, fmt.Errorf("route hint %s is only allowed for admin user", hint)
+	}
+
+	// to be used to check master hint
+	reqCtx.SetTokens(parser.Tokenize(sql))
+
+	// 解析器不支持hint注释, 去掉首尾的注释后再解析
+	query, _ := parser.SplitMarginComments(sql)
+	n, err := se.Parse(query)
+	if err != nil {
+		return nil, true, fmt.Errorf("parse sql error, sql: %s, err: %v", sql, err)
+	}
+	p, err := plan.BuildRouteHintPlan(n, ns.GetPhysicalDBs(), db, sql, ns.GetRouter(), ns.GetGrayRouter(), ns.GetSequences(), hint, ns.GetSliceNames())
+	if err != nil {
+		return nil, true, fmt.Errorf("build route hint plan error: %v", err)
+	}
+	return p, true, nil
+}
+
+// getPlanWithCache 点查语句命中namespace中缓存的执行计划模板时, 只按当前SQL中分片列的取值计算路由并填充分表SQL, 不需要解析SQL和生成执行计划.
+// 未命中时解析一次SQL, 同时生成执行计划和模板. 不能缓存的SQL也缓存模板, 之后命中时直接返回false, 由调用方按原流程解析.
+func (se *SessionExecutor) getPlanWithCache(ns *Namespace, db string, sql string) (plan.Plan, bool, error) {
+	statistics := se.manager.GetStatisticManager()
+	ps, err := parser.ParameterizeSQL(sql)
+	if err != nil {
+		statistics.RecordPlanCache(ns.GetName(), false)
+		return nil, false, nil
+	}
+
+	if t, ok := ns.GetCachedPlan(db, ps); ok {
+		p, err := t.Bind(sql, ps.Params)
+		statistics.RecordPlanCache(ns.GetName(), err == nil)
+		return p, err == nil, nil
+	}
+
+	statistics.RecordPlanCache(ns.GetName(), false)
+	p, t, err := plan.BuildPlanTemplate(ps, ns.GetPhysicalDBs(), db, sql, ns.GetRouter(), ns.GetGrayRouter(), ns.GetSequences())
+	if err != nil {
+		return nil, true, fmt.Errorf("build plan error: %v", err)
+	}
+	if t != nil {
+		ns.SetCachedPlan(db, ps, t)
+	}
+	return p, p != nil, nil
+}
+
 // preBuildUnshardPlan pre-build unshard plan by shard rules or tokens
 func (se *SessionExecutor) preBuildUnshardPlan(reqCtx *util.RequestContext, db string, sql string) (plan.Plan, bool) {
 	rt := se.GetNamespace().GetRouter()
@@ -491,6 +628,14 @@ func (se *SessionExecutor) handleSetVariable(sql string, v *ast.VariableAssignme
 			return mysql.NewDefaultError(mysql.ErrWrongValueForVar, name, value)
 		}
 		return se.setGeneralLogVariable(onOffValue)
+	case gaeaDDLResumeVariable:
+		value := getVariableExprResult(v.Value)
+		onOffValue, err := getOnOffVariable(value)
+		if err != nil {
+			return mysql.NewDefaultError(mysql.ErrWrongValueForVar, name, value)
+		}
+		se.ddlResume = onOffValue == "1"
+		return nil
 	default:
 		// 从命名空间获取允许用户配置的会话变量
 		allowedVariables := se.GetNamespace().GetAllowedSessionVariables()
@@ -534,6 +679,12 @@ func (se *SessionExecutor) handleSetAutoCommit(autocommit bool) (err error) {
 		if se.status&mysql.ServerStatusInTrans > 0 {
 			se.status &= ^mysql.ServerStatusInTrans
 		}
+		// xa branches never change autocommit of backend connections, just commit them
+		if se.xa != nil {
+			err = se.commitXA()
+			se.txConns = make(map[string]backend.PooledConnect)
+			return
+		}
 		for _, pc := range se.txConns {
 			if e := pc.SetAutoCommit(1); e != nil {
 				err = fmt.Errorf("set autocommit error, %v", e)
@@ -604,7 +755,7 @@ func (se *SessionExecutor) handleFieldList(data []byte) ([]*mysql.Field, error)
 		return nil, err
 	}
 
-	if err = initBackendConn(pc, phyDB, se.GetCharset(), se.GetCollationID(), se.GetVariables()); err != nil {
+	if err = se.initSliceConn(sliceName, pc, phyDB); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,292 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/XiaoMi/Gaea/backend"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/proxy/plan"
+	"github.com/XiaoMi/Gaea/util"
+)
+
+const (
+	// 流式归并时每次写入客户端的行数
+	streamWriteBatchRows = 256
+)
+
+// backendRowCursor 在独占的后端连接上执行一条SQL, 每次最多读取fetchSize字节的行
+type backendRowCursor struct {
+	slice string
+	db    string
+	sql   string
+	pc    backend.PooledConnect
+
+	maxRows   int
+	fetchSize int
+
+	result     *mysql.Result
+	index      int
+	bufferSize int
+
+	// 超过max_execute_time时kill仍在执行的SQL, 与Close互斥, 避免kill已经放回连接池的连接
+	mu             sync.Mutex
+	timer          *time.Timer
+	maxExecuteTime int
+	finished       bool // 所有的行都已经读取, 不需要kill
+	timedOut       bool
+}
+
+// Fields implement plan.RowCursor
+func (c *backendRowCursor) Fields() []*mysql.Field {
+	return c.result.Fields
+}
+
+// Next implement plan.RowCursor
+func (c *backendRowCursor) Next() ([]any, error) {
+	for c.index >= len(c.result.Values) {
+		if !c.pc.MoreRowsExist() {
+			return nil, nil
+		}
+		// 已经返回的行可能仍被引用, 不复用切片
+		c.result.RowDatas = nil
+		c.result.Values = nil
+		c.index = 0
+		if err := c.pc.FetchMoreRowsWithFetchSize(c.result, c.maxRows, c.fetchSize); err != nil {
+			if c.isTimedOut() {
+				return nil, timeLimitExceededError(c.maxExecuteTime)
+			}
+			return nil, fmt.Errorf("fetch rows error, slice: %s, db: %s, err: %v", c.slice, c.db, err)
+		}
+		c.bufferSize = rowDatasSize(c.result.RowDatas)
+		if !c.pc.MoreRowsExist() {
+			c.finish()
+		}
+	}
+	row := c.result.Values[c.index]
+	c.index++
+	return row, nil
+}
+
+// BufferSize implement plan.RowCursor
+func (c *backendRowCursor) BufferSize() int {
+	return c.bufferSize
+}
+
+// Close implement plan.RowCursor
+func (c *backendRowCursor) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if c.pc == nil {
+		return
+	}
+	// 没有读完的结果无法复用连接, 直接关闭, 避免读取剩余的行
+	if c.pc.MoreRowsExist() || c.pc.MoreResultsExist() {
+		c.pc.Close()
+	}
+	c.pc.Recycle()
+	c.pc = nil
+}
+
+// startTimer 超过maxExecuteTime后SQL仍在执行或者结果没有读完时, kill正在执行的SQL
+func (c *backendRowCursor) startTimer(se *SessionExecutor, maxExecuteTime int) {
+	c.maxExecuteTime = maxExecuteTime
+	c.timer = time.AfterFunc(time.Duration(maxExecuteTime)*time.Millisecond, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.pc == nil || c.finished {
+			return
+		}
+		c.timedOut = true
+		se.killBackendQuery(c.slice, c.pc)
+	})
+}
+
+func (c *backendRowCursor) finish() {
+	c.mu.Lock()
+	c.finished = true
+	c.mu.Unlock()
+}
+
+func (c *backendRowCursor) isTimedOut() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timedOut
+}
+
+func rowDatasSize(rows []mysql.RowData) int {
+	size := 0
+	for _, row := range rows {
+		size += len(row)
+	}
+	return size
+}
+
+// 事务和会话保持中每个分片只有一个连接, 无法同时读取多条SQL的结果
+// 流式归并时每条SQL独占一个连接, 一个slice上的SQL超过stream_merge_max_conns时不使用流式归并, 避免占满连接池
+func (se *SessionExecutor) canExecuteInStream(p *plan.SelectPlan) bool {
+	ns := se.GetNamespace()
+	if ns.GetStreamMergeFetchSize() == -1 {
+		return false
+	}
+	if se.isInTransaction() || se.IsKeepSession() {
+		return false
+	}
+	if !p.CanExecuteInStream() {
+		return false
+	}
+	if maxConns := ns.GetStreamMergeMaxConns(); maxConns > 0 {
+		for _, dbSQLs := range p.GetSQLs() {
+			count := 0
+			for _, sqls := range dbSQLs {
+				count += len(sqls)
+			}
+			if count > maxConns {
+				se.manager.GetStatisticManager().RecordStreamMergeSkipped(se.namespace)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// executeSelectInStream 返回只包含列信息的结果, 行在写入客户端时从StreamMerger中读取
+func (se *SessionExecutor) executeSelectInStream(reqCtx *util.RequestContext, p *plan.SelectPlan) (*mysql.Result, error) {
+	m, err := p.ExecuteInStream(reqCtx, se)
+	if err != nil {
+		return nil, err
+	}
+	se.session.resultStream = m
+
+	r := mysql.ResultPool.Get()
+	r.Fields = m.Fields()
+	return r, nil
+}
+
+// ExecuteSQLsInStream implement plan.StreamExecutor
+// 每条SQL使用一个独立的连接, 并发执行并读取第一批行, 其余的行在归并时按需读取.
+// 从执行SQL到读完所有的行超过max_execute_time时, kill仍在执行的SQL并返回错误
+func (se *SessionExecutor) ExecuteSQLsInStream(reqCtx *util.RequestContext, sqls map[string]map[string][]string) ([]plan.RowCursor, error) {
+	if len(sqls) == 0 {
+		return nil, fmt.Errorf("no sql to execute")
+	}
+
+	ns := se.GetNamespace()
+	sliceNames := make([]string, 0, len(sqls))
+	for sliceName := range sqls {
+		sliceNames = append(sliceNames, sliceName)
+	}
+	sort.Strings(sliceNames)
+
+	var cursors []*backendRowCursor
+	closeCursors := func() {
+		for _, c := range cursors {
+			c.Close()
+		}
+	}
+	for _, sliceName := range sliceNames {
+		dbs := make([]string, 0, len(sqls[sliceName]))
+		for db := range sqls[sliceName] {
+			dbs = append(dbs, db)
+		}
+		sort.Strings(dbs)
+		for _, db := range dbs {
+			for _, sql := range sqls[sliceName][db] {
+				pc, err := se.getBackendConn(sliceName, getFromSlave(reqCtx))
+				if err != nil {
+					closeCursors()
+					return nil, err
+				}
+				cursors = append(cursors, &backendRowCursor{
+					slice:     sliceName,
+					db:        db,
+					sql:       sql,
+					pc:        pc,
+					maxRows:   ns.GetMaxResultSize(),
+					fetchSize: ns.GetStreamMergeFetchSize(),
+				})
+			}
+		}
+	}
+	if len(cursors) == 0 {
+		return nil, fmt.Errorf("no sql to execute")
+	}
+	se.backendAddr = multiBackendAddrMark + cursors[len(cursors)-1].pc.GetAddr()
+	se.backendConnectionId = cursors[len(cursors)-1].pc.GetConnectionID()
+
+	if maxExecuteTime := ns.GetMaxExecuteTime(); maxExecuteTime > 0 {
+		for _, c := range cursors {
+			c.startTimer(se, maxExecuteTime)
+		}
+	}
+	errs := make([]error, len(cursors))
+	var wg sync.WaitGroup
+	for i, c := range cursors {
+		wg.Add(1)
+		go func(i int, c *backendRowCursor) {
+			defer wg.Done()
+			errs[i] = se.openRowCursor(reqCtx, c)
+		}(i, c)
+	}
+	wg.Wait()
+
+	// SQL被kill后即使返回了结果也认为执行超时
+	for _, c := range cursors {
+		if c.isTimedOut() {
+			closeCursors()
+			return nil, timeLimitExceededError(c.maxExecuteTime)
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			closeCursors()
+			return nil, err
+		}
+	}
+
+	ret := make([]plan.RowCursor, len(cursors))
+	for i, c := range cursors {
+		ret[i] = c
+	}
+	return ret, nil
+}
+
+func (se *SessionExecutor) openRowCursor(reqCtx *util.RequestContext, c *backendRowCursor) error {
+	if err := se.initSliceConn(c.slice, c.pc, c.db); err != nil {
+		return err
+	}
+	startTime := time.Now()
+	r, err := c.pc.ExecuteWithFetchSize(c.sql, c.maxRows, c.fetchSize)
+	se.manager.RecordBackendSQLMetrics(reqCtx, se, c.slice, c.sql, c.pc.GetAddr(), startTime, err)
+	if err != nil {
+		return err
+	}
+	if r.Resultset == nil {
+		return fmt.Errorf("sql does not return result set, slice: %s, db: %s", c.slice, c.db)
+	}
+	c.result = r
+	c.bufferSize = rowDatasSize(r.RowDatas)
+	if !c.pc.MoreRowsExist() {
+		c.finish()
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//	http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package server
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/Gaea/backend"
+	"github.com/XiaoMi/Gaea/core/errors"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
+	"github.com/XiaoMi/Gaea/proxy/plan"
+	"github.com/XiaoMi/Gaea/util"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func createStreamTestResult(values ...int64) *mysql.Result {
+	r := &mysql.Result{Resultset: &mysql.Resultset{Fields: []*mysql.Field{{Name: []byte("id")}}}}
+	for _, v := range values {
+		r.Values = append(r.Values, []any{v})
+		r.RowDatas = append(r.RowDatas, mysql.RowData{1, byte('0' + v)})
+	}
+	return r
+}
+
+func TestExecuteSQLsInStream(t *testing.T) {
+	se, err := prepareSessionExecutor()
+	if err != nil {
+		t.Fatal("prepare session executer error:", err)
+	}
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	slice0MasterPool := backend.NewMockConnectionPool(mockCtl)
+	slice1MasterPool := backend.NewMockConnectionPool(mockCtl)
+	slice0Status := &sync.Map{}
+	slice0Status.Store(0, backend.StatusUp)
+	slice1Status := &sync.Map{}
+	slice1Status.Store(0, backend.StatusUp)
+	ns := se.manager.GetNamespace("test_executor_namespace")
+	// namespace在测试间共享, 结束后恢复原来的连接池
+	for _, slice := range []string{"slice-0", "slice-1"} {
+		master, slave := ns.slices[slice].Master, ns.slices[slice].Slave
+		defer func(slice string) {
+			ns.slices[slice].Master, ns.slices[slice].Slave = master, slave
+		}(slice)
+	}
+	ns.slices["slice-0"].Master = &backend.DBInfo{ConnPool: []backend.ConnectionPool{slice0MasterPool}, StatusMap: slice0Status}
+	ns.slices["slice-0"].Slave = &backend.DBInfo{}
+	ns.slices["slice-1"].Master = &backend.DBInfo{ConnPool: []backend.ConnectionPool{slice1MasterPool}, StatusMap: slice1Status}
+	ns.slices["slice-1"].Slave = &backend.DBInfo{}
+
+	sql := "SELECT `id` FROM `tbl_mycat` ORDER BY `id`"
+
+	// slice-0的结果分两批读取, 第二批读取后仍有未读取的行
+	slice0MasterConn := backend.NewMockPooledConnect(mockCtl)
+	slice0MasterConn.EXPECT().GetConnectionID().Return(int64(1)).AnyTimes()
+	slice0MasterConn.EXPECT().GetAddr().Return("127.0.0.1:3306").AnyTimes()
+	slice0MasterConn.EXPECT().UseDB("db_mycat_0").Return(nil)
+	slice0MasterConn.EXPECT().SetCharset("utf8", mysql.CharsetIds["utf8"]).Return(false, nil)
+	slice0MasterConn.EXPECT().SetSessionVariables(mysql.NewSessionVariables()).Return(false, nil)
+	slice0MasterConn.EXPECT().ExecuteWithFetchSize(sql, defaultMaxSqlResultSize, defaultStreamMergeFetchSize).Return(createStreamTestResult(1, 3), nil)
+	slice0MasterConn.EXPECT().MoreRowsExist().Return(true).AnyTimes()
+	slice0MasterConn.EXPECT().FetchMoreRowsWithFetchSize(gomock.Any(), defaultMaxSqlResultSize, defaultStreamMergeFetchSize).DoAndReturn(
+		func(r *mysql.Result, maxRows, fetchSize int) error {
+			next := createStreamTestResult(5)
+			r.Values, r.RowDatas = next.Values, next.RowDatas
+			return nil
+		})
+	slice0MasterConn.EXPECT().Close().Return()
+	slice0MasterConn.EXPECT().Recycle().Return()
+
+	// slice-1的结果一次读完
+	slice1MasterConn := backend.NewMockPooledConnect(mockCtl)
+	slice1MasterConn.EXPECT().GetConnectionID().Return(int64(2)).AnyTimes()
+	slice1MasterConn.EXPECT().GetAddr().Return("127.0.0.1:3307").AnyTimes()
+	slice1MasterConn.EXPECT().UseDB("db_mycat_2").Return(nil)
+	slice1MasterConn.EXPECT().SetCharset("utf8", mysql.CharsetIds["utf8"]).Return(false, nil)
+	slice1MasterConn.EXPECT().SetSessionVariables(mysql.NewSessionVariables()).Return(false, nil)
+	slice1MasterConn.EXPECT().ExecuteWithFetchSize(sql, defaultMaxSqlResultSize, defaultStreamMergeFetchSize).Return(createStreamTestResult(2), nil)
+	slice1MasterConn.EXPECT().MoreRowsExist().Return(false).AnyTimes()
+	slice1MasterConn.EXPECT().MoreResultsExist().Return(false).AnyTimes()
+	slice1MasterConn.EXPECT().Recycle().Return()
+
+	slice0MasterPool.EXPECT().Get(context.TODO()).Return(slice0MasterConn, nil)
+	slice1MasterPool.EXPECT().Get(context.TODO()).Return(slice1MasterConn, nil)
+
+	sqls := map[string]map[string][]string{
+		"slice-0": {"db_mycat_0": {sql}},
+		"slice-1": {"db_mycat_2": {sql}},
+	}
+	reqCtx := util.NewRequestContext()
+	cursors, err := se.ExecuteSQLsInStream(reqCtx, sqls)
+	if err != nil {
+		t.Fatalf("ExecuteSQLsInStream error: %v", err)
+	}
+	assert.Equal(t, 2, len(cursors))
+
+	var rows []any
+	for i := 0; i < 3; i++ {
+		row, err := cursors[0].Next()
+		assert.Nil(t, err)
+		rows = append(rows, row[0])
+	}
+	assert.Equal(t, []any{int64(1), int64(3), int64(5)}, rows)
+	assert.Equal(t, 2, cursors[0].BufferSize())
+
+	row, err := cursors[1].Next()
+	assert.Nil(t, err)
+	assert.Equal(t, []any{int64(2)}, row)
+	row, err = cursors[1].Next()
+	assert.Nil(t, err)
+	assert.Nil(t, row)
+
+	// 未读完的连接被关闭, 读完的连接放回连接池
+	for _, c := range cursors {
+		c.Close()
+		c.Close()
+	}
+}
+
+func TestExecuteSQLsInStreamTimeLimit(t *testing.T) {
+	se, err := prepareSessionExecutor()
+	if err != nil {
+		t.Fatal("prepare session executer error:", err)
+	}
+
+	mockCtl := gomock.NewController(t)
+	defer mockCtl.Finish()
+	masterPool := backend.NewMockConnectionPool(mockCtl)
+	status := &sync.Map{}
+	status.Store(0, backend.StatusUp)
+	ns := se.manager.GetNamespace("test_executor_namespace")
+	master, slave, maxExecuteTime := ns.slices["slice-0"].Master, ns.slices["slice-0"].Slave, ns.maxSqlExecuteTime
+	defer func() {
+		ns.slices["slice-0"].Master, ns.slices["slice-0"].Slave, ns.maxSqlExecuteTime = master, slave, maxExecuteTime
+	}()
+	ns.slices["slice-0"].Master = &backend.DBInfo{ConnPool: []backend.ConnectionPool{masterPool}, StatusMap: status}
+	ns.slices["slice-0"].Slave = &backend.DBInfo{}
+	ns.maxSqlExecuteTime = 10
+
+	// SQL执行超过max_execute_time时被kill, 连接没有读完结果时被关闭
+	sql := "SELECT `id` FROM `tbl_mycat` ORDER BY `id`"
+	conn := backend.NewMockPooledConnect(mockCtl)
+	conn.EXPECT().GetConnectionID().Return(int64(1)).AnyTimes()
+	conn.EXPECT().GetAddr().Return("127.0.0.1:1").AnyTimes()
+	conn.EXPECT().UseDB("db_mycat_0").Return(nil)
+	conn.EXPECT().SetCharset("utf8", mysql.CharsetIds["utf8"]).Return(false, nil)
+	conn.EXPECT().SetSessionVariables(mysql.NewSessionVariables()).Return(false, nil)
+	conn.EXPECT().ExecuteWithFetchSize(sql, defaultMaxSqlResultSize, defaultStreamMergeFetchSize).DoAndReturn(
+		func(sql string, maxRows, fetchSize int) (*mysql.Result, error) {
+			time.Sleep(50 * time.Millisecond)
+			return createStreamTestResult(1), nil
+		})
+	conn.EXPECT().MoreRowsExist().Return(true).AnyTimes()
+	conn.EXPECT().Close().Return()
+	conn.EXPECT().Recycle().Return()
+	masterPool.EXPECT().Get(context.TODO()).Return(conn, nil)
+
+	_, err = se.ExecuteSQLsInStream(util.NewRequestContext(), map[string]map[string][]string{"slice-0": {"db_mycat_0": {sql}}})
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), errors.ErrTimeLimitExceeded.Error())
+}
+
+func TestCanExecuteInStream(t *testing.T) {
+	se, err := prepareSessionExecutor()
+	if err != nil {
+		t.Fatal("prepare session executer error:", err)
+	}
+	ns := se.GetNamespace()
+	maxConns := ns.streamMergeMaxConns
+	defer func() {
+		ns.streamMergeMaxConns = maxConns
+	}()
+
+	// tbl_ks在每个slice上有两个分表
+	sql := "select id from tbl_ks order by id"
+	reqCtx := util.NewRequestContext()
+	reqCtx.SetStmtType(parser.Preview(sql))
+	p, err := se.getPlan(reqCtx, ns, "db_ks", sql, false)
+	assert.Nil(t, err)
+	sp, ok := p.(*plan.SelectPlan)
+	if !ok {
+		t.Fatalf("plan type not equal, expect: *plan.SelectPlan, actual: %T", p)
+	}
+	assert.True(t, se.canExecuteInStream(sp))
+
+	skipped := func() int64 {
+		var count int64
+		for _, v := range se.manager.GetStatisticManager().streamMergeSkippedCounts.Counts() {
+			count += v
+		}
+		return count
+	}
+	before := skipped()
+	ns.streamMergeMaxConns = 1
+	assert.False(t, se.canExecuteInStream(sp))
+	assert.Equal(t, before+1, skipped())
+
+	ns.streamMergeMaxConns = -1
+	assert.True(t, se.canExecuteInStream(sp))
+	assert.Equal(t, before+1, skipped())
+}
@@ -389,7 +389,7 @@ encrypt_key=1234abcd5678efg*
 	// init namespace
 	current, _, _ := m.switchIndex.Get()
 	namespaceConfigs := map[string]*models.Namespace{namespaceName: namespaceConfig}
-	m.namespaces[current] = CreateNamespaceManager(namespaceConfigs)
+	m.namespaces[current] = CreateNamespaceManager(namespaceConfigs, nil)
 	user, err := CreateUserManager(namespaceConfigs)
 	if err != nil {
 		return nil, err
@@ -1351,3 +1351,140 @@ func BenchmarkGetNamespace(b *testing.B) {
 		}
 	}
 }
+
+func TestGetPlanWithPlanCache(t *testing.T) {
+	se, err := newDefaultSessionExecutor(nil)
+	if err != nil {
+		t.Fatal("prepare session executer error:", err)
+	}
+	ns := se.GetNamespace()
+	if !ns.IsPlanCacheEnabled() {
+		t.Fatal("plan cache should be enabled by default")
+	}
+
+	tests := []struct {
+		sql    string
+		hit    bool
+		expect map[string]map[string][]string
+	}{
+		{
+			sql:    "select name from tbl_ks where id = 1 and name = 'a'",
+			hit:    false,
+			expect: map[string]map[string][]string{"slice-0": {"db_ks": {"SELECT `name` FROM `tbl_ks_0001` WHERE `id`=1 AND `name`='a'"}}},
+		},
+		{
+			sql:    "select name from tbl_ks where id = 2 and name = 'b'",
+			hit:    true,
+			expect: map[string]map[string][]string{"slice-1": {"db_ks": {"SELECT `name` FROM `tbl_ks_0002` WHERE `id`=2 AND `name`='b'"}}},
+		},
+		{
+			sql:    "select name from tbl_ks where id = 3 and name = 'c'",
+			hit:    true,
+			expect: map[string]map[string][]string{"slice-1": {"db_ks": {"SELECT `name` FROM `tbl_ks_0003` WHERE `id`=3 AND `name`='c'"}}},
+		},
+		{
+			// 路由到多张分表, 不能缓存
+			sql:    "select name from tbl_ks where id in (1, 2)",
+			hit:    false,
+			expect: map[string]map[string][]string{"slice-0": {"db_ks": {"SELECT `name` FROM `tbl_ks_0001` WHERE `id` IN (1)"}}, "slice-1": {"db_ks": {"SELECT `name` FROM `tbl_ks_0002` WHERE `id` IN (2)"}}},
+		},
+		{
+			sql:    "select name from tbl_ks where id in (3, 4)",
+			hit:    false,
+			expect: map[string]map[string][]string{"slice-1": {"db_ks": {"SELECT `name` FROM `tbl_ks_0003` WHERE `id` IN (3)"}}, "slice-0": {"db_ks": {"SELECT `name` FROM `tbl_ks_0000` WHERE `id` IN (4)"}}},
+		},
+	}
+	statsKey := strings.Join([]string{se.manager.GetStatisticManager().clusterName, ns.GetName()}, ".")
+	for _, test := range tests {
+		t.Run(test.sql, func(t *testing.T) {
+			hits := se.manager.GetStatisticManager().planCacheHitCounts.Counts()[statsKey]
+			reqCtx := util.NewRequestContext()
+			reqCtx.SetStmtType(parser.Preview(test.sql))
+			p, err := se.getPlan(reqCtx, ns, se.db, test.sql, false)
+			if err != nil {
+				t.Fatalf("getPlan error: %v", err)
+			}
+			sp, ok := p.(*plan.SelectPlan)
+			if !ok {
+				t.Fatalf("plan type not equal, expect: *plan.SelectPlan, actual: %T", p)
+			}
+			assert.Equal(t, test.expect, sp.GetSQLs())
+			hit := se.manager.GetStatisticManager().planCacheHitCounts.Counts()[statsKey] > hits
+			assert.Equal(t, test.hit, hit)
+		})
+	}
+
+	// namespace重新加载后缓存失效
+	se, err = newDefaultSessionExecutor(nil)
+	if err != nil {
+		t.Fatal("prepare session executer error:", err)
+	}
+	ps, err := parser.ParameterizeSQL(tests[0].sql)
+	if err != nil {
+		t.Fatalf("parameterize sql error: %v", err)
+	}
+	_, ok := se.GetNamespace().GetCachedPlan(se.db, ps)
+	assert.False(t, ok)
+}
+
+func TestGetPlanWithRouteHint(t *testing.T) {
+	sql := "/*+ GAEA_ROUTE(table_index=2) */ select name from tbl_ks where id = 1"
+
+	se, err := newDefaultSessionExecutor(nil)
+	if err != nil {
+		t.Fatal("prepare session executer error:", err)
+	}
+	reqCtx := util.NewRequestContext()
+	reqCtx.SetStmtType(parser.Preview(sql))
+	_, err = se.getPlan(reqCtx, se.GetNamespace(), se.db, sql, true)
+	assert.Error(t, err, "route hint is only allowed for admin user")
+	assert.Equal(t, "GAEA_ROUTE(table_index=2)", reqCtx.GetRouteHint())
+
+	se, err = newDefaultSessionExecutor(func(ns *models.Namespace) {
+		for _, u := range ns.Users {
+			u.Admin = true
+		}
+	})
+	if err != nil {
+		t.Fatal("prepare session executer error:", err)
+	}
+	reqCtx = util.NewRequestContext()
+	reqCtx.SetStmtType(parser.Preview(sql))
+	p, err := se.getPlan(reqCtx, se.GetNamespace(), se.db, sql, true)
+	if err != nil {
+		t.Fatalf("getPlan error: %v", err)
+	}
+	sp, ok := p.(*plan.SelectPlan)
+	if !ok {
+		t.Fatalf("plan type not equal, expect: *plan.SelectPlan, actual: %T", p)
+	}
+	assert.Equal(t, map[string]map[string][]string{"slice-1": {"db_ks": {"SELECT `name` FROM `tbl_ks_0002` WHERE `id`=1"}}}, sp.GetSQLs())
+}
+
+func TestGetPlanWithRewriteRules(t *testing.T) {
+	se, err := newDefaultSessionExecutor(func(ns *models.Namespace) {
+		ns.RewriteRules = []*models.RewriteRule{
+			{Name: "tbl_ks_limit", Table: "tbl_ks", StmtType: "select", ForceIndex: []string{"idx_name"}, MaxLimit: 10},
+		}
+	})
+	if err != nil {
+		t.Fatal("prepare session executer error:", err)
+	}
+
+	sql := "select name from tbl_ks where id = 1 limit 100"
+	reqCtx := util.NewRequestContext()
+	reqCtx.SetStmtType(parser.Preview(sql))
+	p, err := se.getPlan(reqCtx, se.GetNamespace(), se.db, sql, false)
+	if err != nil {
+		t.Fatalf("getPlan error: %v", err)
+	}
+	sp, ok := p.(*plan.SelectPlan)
+	if !ok {
+		t.Fatalf("plan type not equal, expect: *plan.SelectPlan, actual: %T", p)
+	}
+	assert.Equal(t, map[string]map[string][]string{"slice-0": {"db_ks": {"SELECT `name` FROM `tbl_ks_0001` FORCE INDEX (`idx_name`) WHERE `id`=1 LIMIT 10"}}}, sp.GetSQLs())
+
+	ns := se.GetNamespace()
+	hits := se.manager.GetStatisticManager().GetRewriteRuleHits(ns.GetName(), ns.GetSQLRewriter().GetRuleNames())
+	assert.Equal(t, map[string]int64{"tbl_ks_limit": 1}, hits)
+}
@@ -0,0 +1,191 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/XiaoMi/Gaea/log"
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/util/requests"
+	"github.com/XiaoMi/Gaea/util/sync2"
+)
+
+const (
+	// 投票需要在每次检查master时刷新, proxy退出后投票自动失效
+	failoverVoteTTL = 30 * time.Second
+	// 租约在切换完成后不主动释放, 避免其他proxy在重新加载配置前再次切换
+	failoverLeaseTTL = 120 * time.Second
+)
+
+// failoverCoordinator 通过配置中心中的投票和租约保证只有一个proxy切换主库:
+// 1. 每个proxy探测到master不可用超过down_after_no_alive后写入投票
+// 2. 所有注册的proxy都投票给同一个master后, 取得租约的proxy执行切换
+// 3. 切换后通过gaea-cc写回新的拓扑, 由gaea-cc通知所有proxy重新加载namespace
+type failoverCoordinator struct {
+	cfg   *models.Proxy
+	token sync2.AtomicString // 注册到配置中心的proxy标识, 注册前不参与投票
+
+	mu    sync.Mutex
+	store *models.Store // 第一次使用时创建, 之后复用同一个配置中心的客户端
+}
+
+// newFailoverCoordinator 没有配置gaea-cc时返回nil, 开启enable_failover的slice只标记master不可用
+func newFailoverCoordinator(cfg *models.Proxy) *failoverCoordinator {
+	if !cfg.IsFailoverEnabled() {
+		return nil
+	}
+	return &failoverCoordinator{cfg: cfg}
+}
+
+func (f *failoverCoordinator) getStore() (*models.Store, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.store == nil {
+		client := models.NewClient(f.cfg.ConfigType, f.cfg.CoordinatorAddr, f.cfg.UserName, f.cfg.Password, f.cfg.CoordinatorRoot)
+		if client == nil {
+			return nil, fmt.Errorf("create client of %s failed", f.cfg.CoordinatorAddr)
+		}
+		f.store = models.NewStore(client)
+	}
+	return f.store, nil
+}
+
+// Close close client of coordinator, called when proxy exits
+func (f *failoverCoordinator) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.store != nil {
+		f.store.Close()
+		f.store = nil
+	}
+}
+
+// Vote implement backend.FailoverCoordinator
+func (f *failoverCoordinator) Vote(namespace, slice, master string) (bool, error) {
+	token := f.token.Get()
+	if token == "" {
+		return false, errors.New("proxy is not registered")
+	}
+	store, err := f.getStore()
+	if err != nil {
+		return false, err
+	}
+
+	if err := store.VoteMasterDown(namespace, slice, token, master, failoverVoteTTL); err != nil {
+		return false, err
+	}
+	proxies, err := store.ListProxyMonitorMetrics()
+	if err != nil {
+		return false, err
+	}
+	votes, err := store.ListMasterDownVotes(namespace, slice)
+	if err != nil {
+		return false, err
+	}
+	if !allProxiesAgree(proxies, votes, master) {
+		return false, nil
+	}
+	return store.AcquireFailoverLease(namespace, slice, token, failoverLeaseTTL)
+}
+
+// allProxiesAgree 所有注册的proxy都认为同一个master不可用
+func allProxiesAgree(proxies map[string]*models.ProxyMonitorMetric, votes map[string]string, master string) bool {
+	if len(proxies) == 0 {
+		return false
+	}
+	for token := range proxies {
+		if votes[token] != master {
+			log.Debug("proxy %s does not agree that master %s is down, vote: %s", token, master, votes[token])
+			return false
+		}
+	}
+	return true
+}
+
+// Revoke implement backend.FailoverCoordinator
+func (f *failoverCoordinator) Revoke(namespace, slice string) error {
+	token := f.token.Get()
+	store, err := f.getStore()
+	if err != nil {
+		return err
+	}
+
+	if err := store.RevokeMasterDownVote(namespace, slice, token); err != nil {
+		return err
+	}
+	return store.ReleaseFailoverLease(namespace, slice, token)
+}
+
+// GetCandidate implement backend.FailoverCoordinator
+func (f *failoverCoordinator) GetCandidate(namespace, slice string) (string, error) {
+	store, err := f.getStore()
+	if err != nil {
+		return "", err
+	}
+	return store.GetFailoverCandidate(namespace, slice)
+}
+
+// SetCandidate implement backend.FailoverCoordinator
+func (f *failoverCoordinator) SetCandidate(namespace, slice, master string) error {
+	store, err := f.getStore()
+	if err != nil {
+		return err
+	}
+	return store.SetFailoverCandidate(namespace, slice, master, failoverLeaseTTL)
+}
+
+// Commit implement backend.FailoverCoordinator
+func (f *failoverCoordinator) Commit(namespace, slice, oldMaster, newMaster string) error {
+	data, err := json.Marshal(&models.SliceFailover{Slice: slice, OldMaster: oldMaster, NewMaster: newMaster})
+	if err != nil {
+		return err
+	}
+	url := requests.EncodeURL(f.cfg.CCAddr, "/api/cc/namespace/failover/%s", namespace)
+	req := requests.NewRequest(url, requests.Put, nil, map[string]string{"cluster": f.cfg.Cluster}, data)
+	req.SetBasicAuth(f.cfg.CCAdminUser, f.cfg.CCAdminPassword)
+	resp, err := requests.Send(req)
+	if err != nil {
+		return err
+	}
+	var ret struct {
+		RetCode    int    `json:"ret_code"`
+		RetMessage string `json:"ret_message"`
+	}
+	if err := json.Unmarshal(resp.Body, &ret); err != nil || resp.StatusCode != http.StatusOK || ret.RetCode != 0 {
+		return fmt.Errorf("gaea-cc response status: %d, body: %s", resp.StatusCode, string(resp.Body))
+	}
+
+	// 新的拓扑已经生效, 清理所有proxy的投票
+	store, err := f.getStore()
+	if err != nil {
+		return err
+	}
+	votes, err := store.ListMasterDownVotes(namespace, slice)
+	if err != nil {
+		return err
+	}
+	for token := range votes {
+		if err := store.RevokeMasterDownVote(namespace, slice, token); err != nil {
+			log.Warn("[ns:%s, %s] revoke master down vote of proxy %s error: %v", namespace, slice, token, err)
+		}
+	}
+	return nil
+}
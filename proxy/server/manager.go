@@ -155,6 +155,10 @@ type Manager struct {
 	namespaces     [2]*NamespaceManager
 	users          [2]*UserManager
 	statistics     *StatisticManager
+	xaCfg          *models.Proxy // 有namespace开启XA时用于创建决策日志
+	xaLogLock      sync.Mutex
+	xaLog          atomic.Value         // *XALog, 没有namespace开启XA时为nil
+	failover       *failoverCoordinator // 为nil时不自动切换主库
 }
 
 // NewManager return empty Manager
@@ -177,7 +181,12 @@ func CreateManager(cfg *models.Proxy, namespaceConfigs map[string]*models.Namesp
 	current, _, _ := m.switchIndex.Get()
 
 	// init namespace
-	m.namespaces[current] = CreateNamespaceManager(namespaceConfigs)
+	// 不能将nil指针赋值给接口, 否则slice会认为开启了自动切换
+	var failover backend.FailoverCoordinator
+	if m.failover = newFailoverCoordinator(cfg); m.failover != nil {
+		failover = m.failover
+	}
+	m.namespaces[current] = CreateNamespaceManager(namespaceConfigs, failover)
 
 	// init user
 	user, err := CreateUserManager(namespaceConfigs)
@@ -186,6 +195,19 @@ func CreateManager(cfg *models.Proxy, namespaceConfigs map[string]*models.Namesp
 	}
 	m.users[current] = user
 
+	// init xa decision log only if some namespace supports xa, then resolve in-doubt xa branches left by last run
+	m.xaCfg = cfg
+	for _, namespaceConfig := range namespaceConfigs {
+		if !namespaceConfig.SupportXA {
+			continue
+		}
+		if err = m.enableXALog(); err != nil {
+			log.Warn("init xa log failed, %v", err)
+			return nil, err
+		}
+		break
+	}
+
 	m.startConnectPoolMetricsTask(cfg.StatsInterval)
 	return m, nil
 }
@@ -199,6 +221,14 @@ func (m *Manager) Close() {
 		ns.Close(false)
 	}
 
+	if l := m.getXALog(); l != nil {
+		l.Close()
+	}
+
+	if m.failover != nil {
+		m.failover.Close()
+	}
+
 	m.statistics.Close()
 	if m.statistics.generalLogger != nil {
 		// 日志落盘
@@ -219,6 +249,13 @@ func (m *Manager) ReloadNamespacePrepare(namespaceConfig *models.Namespace) erro
 		nsChangeIndexOld = nsOld.namespaceChangeIndex
 	}
 
+	if namespaceConfig.SupportXA {
+		if err := m.enableXALog(); err != nil {
+			log.Warn("prepare config of namespace: %s failed, init xa log error: %v", name, err)
+			return err
+		}
+	}
+
 	newNamespaceManager := ShallowCopyNamespaceManager(currentNamespaceManager)
 	if err := newNamespaceManager.RebuildNamespace(namespaceConfig); err != nil {
 		log.Warn("prepare config of namespace: %s failed, err: %v", name, err)
@@ -293,6 +330,13 @@ func (m *Manager) DeleteNamespace(name string) error {
 	return nil
 }
 
+// SetProxyToken 注册到配置中心后设置, 自动切换主库时作为proxy的投票标识
+func (m *Manager) SetProxyToken(token string) {
+	if m.failover != nil {
+		m.failover.token.Set(token)
+	}
+}
+
 // GetNamespace return specific namespace
 func (m *Manager) GetNamespace(name string) *Namespace {
 	current, _, _ := m.switchIndex.Get()
@@ -365,15 +409,21 @@ func (m *Manager) RecordSessionSQLMetrics(reqCtx *util.RequestContext, se *Sessi
 
 	durationFloat := float64(time.Since(startTime).Microseconds()) / 1000.0
 
+	// 使用路由hint的SQL在general log中记录hint, 便于审计
+	logSQL := sql
+	if hint := reqCtx.GetRouteHint(); hint != "" {
+		logSQL = fmt.Sprintf("%s. route_hint=%s", sql, hint)
+	}
+
 	if err == nil {
 		se.manager.statistics.generalLogger.Notice("%s - %.1fms - ns=%s, %s@%s->%s/%s, connect_id=%d, mysql_connect_id=%d, transaction=%t|%v",
 			SQLExecStatusOk, durationFloat, se.namespace, se.user, se.clientAddr, se.backendAddr, se.db,
-			se.session.c.GetConnectionID(), se.backendConnectionId, se.isInTransaction(), sql)
+			se.session.c.GetConnectionID(), se.backendConnectionId, se.isInTransaction(), logSQL)
 	} else {
 		// record error sql
 		se.manager.statistics.generalLogger.Warn("%s - %.1fms - ns=%s, %s@%s->%s/%s, connect_id=%d, mysql_connect_id=%d, transaction=%t|%v. err:%s",
 			SQLExecStatusErr, durationFloat, se.namespace, se.user, se.clientAddr, se.backendAddr, se.db,
-			se.session.c.GetConnectionID(), se.backendConnectionId, se.isInTransaction(), sql, err)
+			se.session.c.GetConnectionID(), se.backendConnectionId, se.isInTransaction(), logSQL, err)
 		fingerprint := getSQLFingerprint(reqCtx, sql)
 		md5 := getSQLFingerprintMd5(reqCtx, sql)
 		ns.SetErrorSQLFingerprint(md5, fingerprint)
@@ -384,7 +434,7 @@ func (m *Manager) RecordSessionSQLMetrics(reqCtx *util.RequestContext, se *Sessi
 	if ns.getSessionSlowSQLTime() > 0 && int64(durationFloat) > ns.getSessionSlowSQLTime() {
 		se.manager.statistics.generalLogger.Warn("%s - %.1fms - ns=%s, %s@%s->%s/%s, connect_id=%d, mysql_connect_id=%d, transaction=%t|%v",
 			SQLExecStatusSlow, durationFloat, se.namespace, se.user, se.clientAddr, se.backendAddr, se.db,
-			se.session.c.GetConnectionID(), se.backendConnectionId, se.isInTransaction(), sql)
+			se.session.c.GetConnectionID(), se.backendConnectionId, se.isInTransaction(), logSQL)
 		fingerprint := getSQLFingerprint(reqCtx, sql)
 		md5 := getSQLFingerprintMd5(reqCtx, sql)
 		ns.SetSlowSQLFingerprint(md5, fingerprint)
@@ -412,6 +462,11 @@ func (m *Manager) RecordBackendSQLMetrics(reqCtx *util.RequestContext, se *Sessi
 	// record sql timing
 	go m.statistics.recordBackendSQLTiming(se.namespace, operation, sliceName, backendAddr, startTime)
 
+	// passive health check of slaves
+	if slice := ns.GetSlice(sliceName); slice != nil {
+		slice.ReportResult(backendAddr, time.Since(startTime), err)
+	}
+
 	// record backend slow sql
 	duration := time.Since(startTime).Milliseconds()
 	if m.statistics.isBackendSlowSQL(duration) {
@@ -492,28 +547,40 @@ func (m *Manager) recordBackendConnectPoolMetrics(namespace string) {
 	}
 
 	for sliceName, slice := range ns.slices {
-		m.statistics.recordInstanceDownCount(namespace, sliceName, slice.Master.ConnPool[0].Addr(), getStatusDownCounts(slice.Master.StatusMap, 0), MasterRole)
-		m.statistics.recordConnectPoolInuseCount(namespace, sliceName, slice.Master.ConnPool[0].Addr(), slice.Master.ConnPool[0].InUse(), MasterRole)
-		m.statistics.recordConnectPoolIdleCount(namespace, sliceName, slice.Master.ConnPool[0].Addr(), slice.Master.ConnPool[0].Available(), MasterRole)
-		m.statistics.recordConnectPoolWaitCount(namespace, sliceName, slice.Master.ConnPool[0].Addr(), slice.Master.ConnPool[0].WaitCount(), MasterRole)
-		m.statistics.recordConnectPoolActiveCount(namespace, sliceName, slice.Master.ConnPool[0].Addr(), slice.Master.ConnPool[0].Active(), MasterRole)
-		m.statistics.recordConnectPoolCount(namespace, sliceName, slice.Master.ConnPool[0].Addr(), slice.Master.ConnPool[0].Capacity(), MasterRole)
-
-		for i, slave := range slice.Slave.ConnPool {
-			m.statistics.recordInstanceDownCount(namespace, sliceName, slave.Addr(), getStatusDownCounts(slice.Slave.StatusMap, i), SlaveRole)
+		master, slaves, statisticSlaves := slice.GetMaster(), slice.GetSlave(), slice.GetStatisticSlave()
+		m.statistics.recordInstanceDownCount(namespace, sliceName, master.ConnPool[0].Addr(), getStatusDownCounts(master.StatusMap, 0), MasterRole)
+		m.statistics.recordConnectPoolInuseCount(namespace, sliceName, master.ConnPool[0].Addr(), master.ConnPool[0].InUse(), MasterRole)
+		m.statistics.recordConnectPoolIdleCount(namespace, sliceName, master.ConnPool[0].Addr(), master.ConnPool[0].Available(), MasterRole)
+		m.statistics.recordConnectPoolWaitCount(namespace, sliceName, master.ConnPool[0].Addr(), master.ConnPool[0].WaitCount(), MasterRole)
+		m.statistics.recordConnectPoolActiveCount(namespace, sliceName, master.ConnPool[0].Addr(), master.ConnPool[0].Active(), MasterRole)
+		m.statistics.recordConnectPoolCount(namespace, sliceName, master.ConnPool[0].Addr(), master.ConnPool[0].Capacity(), MasterRole)
+		m.statistics.recordConnectPoolLatency(namespace, sliceName, master.ConnPool[0].Addr(), master.ConnPool[0].Latency(), MasterRole)
+
+		for i, slave := range slaves.ConnPool {
+			m.statistics.recordInstanceDownCount(namespace, sliceName, slave.Addr(), getStatusDownCounts(slaves.StatusMap, i), SlaveRole)
 			m.statistics.recordConnectPoolInuseCount(namespace, sliceName, slave.Addr(), slave.InUse(), SlaveRole)
 			m.statistics.recordConnectPoolIdleCount(namespace, sliceName, slave.Addr(), slave.Available(), SlaveRole)
 			m.statistics.recordConnectPoolWaitCount(namespace, sliceName, slave.Addr(), slave.WaitCount(), SlaveRole)
 			m.statistics.recordConnectPoolActiveCount(namespace, sliceName, slave.Addr(), slave.Active(), SlaveRole)
 			m.statistics.recordConnectPoolCount(namespace, sliceName, slave.Addr(), slave.Capacity(), SlaveRole)
+			m.statistics.recordConnectPoolLatency(namespace, sliceName, slave.Addr(), slave.Latency(), SlaveRole)
+			m.statistics.recordSlaveSelectedCount(namespace, sliceName, slave.Addr(), slaves.TakeSelectedCount(i), SlaveRole)
+			if status, ok := slice.Outliers.GetStatus(slave.Addr()); ok {
+				m.statistics.recordOutlierStatus(namespace, sliceName, status, slice.Outliers.TakeEjections(slave.Addr()), SlaveRole)
+			}
 		}
-		for i, statisticSlave := range slice.StatisticSlave.ConnPool {
-			m.statistics.recordInstanceDownCount(namespace, sliceName, statisticSlave.Addr(), getStatusDownCounts(slice.StatisticSlave.StatusMap, i), StatisticSlaveRole)
+		for i, statisticSlave := range statisticSlaves.ConnPool {
+			m.statistics.recordInstanceDownCount(namespace, sliceName, statisticSlave.Addr(), getStatusDownCounts(statisticSlaves.StatusMap, i), StatisticSlaveRole)
 			m.statistics.recordConnectPoolInuseCount(namespace, sliceName, statisticSlave.Addr(), statisticSlave.InUse(), StatisticSlaveRole)
 			m.statistics.recordConnectPoolIdleCount(namespace, sliceName, statisticSlave.Addr(), statisticSlave.Available(), StatisticSlaveRole)
 			m.statistics.recordConnectPoolWaitCount(namespace, sliceName, statisticSlave.Addr(), statisticSlave.WaitCount(), StatisticSlaveRole)
 			m.statistics.recordConnectPoolActiveCount(namespace, sliceName, statisticSlave.Addr(), statisticSlave.Active(), StatisticSlaveRole)
 			m.statistics.recordConnectPoolCount(namespace, sliceName, statisticSlave.Addr(), statisticSlave.Capacity(), StatisticSlaveRole)
+			m.statistics.recordConnectPoolLatency(namespace, sliceName, statisticSlave.Addr(), statisticSlave.Latency(), StatisticSlaveRole)
+			m.statistics.recordSlaveSelectedCount(namespace, sliceName, statisticSlave.Addr(), statisticSlaves.TakeSelectedCount(i), StatisticSlaveRole)
+			if status, ok := slice.Outliers.GetStatus(statisticSlave.Addr()); ok {
+				m.statistics.recordOutlierStatus(namespace, sliceName, status, slice.Outliers.TakeEjections(statisticSlave.Addr()), StatisticSlaveRole)
+			}
 		}
 	}
 }
@@ -521,6 +588,7 @@ func (m *Manager) recordBackendConnectPoolMetrics(namespace string) {
 // NamespaceManager is the manager that holds all namespaces
 type NamespaceManager struct {
 	namespaces map[string]*Namespace
+	failover   backend.FailoverCoordinator
 }
 
 // NewNamespaceManager constructor of NamespaceManager
@@ -531,8 +599,9 @@ func NewNamespaceManager() *NamespaceManager {
 }
 
 // CreateNamespaceManager create NamespaceManager
-func CreateNamespaceManager(namespaceConfigs map[string]*models.Namespace) *NamespaceManager {
+func CreateNamespaceManager(namespaceConfigs map[string]*models.Namespace, failover backend.FailoverCoordinator) *NamespaceManager {
 	nsMgr := NewNamespaceManager()
+	nsMgr.failover = failover
 	proxyDatacenter, err := util.GetLocalDatacenter()
 	if err != nil {
 		log.Fatal("get proxy datacenter err,will use default datacenter,err:%s", err)
@@ -540,7 +609,7 @@ func CreateNamespaceManager(namespaceConfigs map[string]*models.Namespace) *Name
 	}
 
 	for _, config := range namespaceConfigs {
-		namespace, err := NewNamespace(config, proxyDatacenter)
+		namespace, err := NewNamespace(config, proxyDatacenter, failover)
 		if err != nil {
 			log.Warn("create namespace %s failed, err: %v", config.Name, err)
 			continue
@@ -553,6 +622,7 @@ func CreateNamespaceManager(namespaceConfigs map[string]*models.Namespace) *Name
 // ShallowCopyNamespaceManager copy NamespaceManager
 func ShallowCopyNamespaceManager(nsMgr *NamespaceManager) *NamespaceManager {
 	newNsMgr := NewNamespaceManager()
+	newNsMgr.failover = nsMgr.failover
 	maps.Copy(newNsMgr.namespaces, nsMgr.namespaces)
 	return newNsMgr
 }
@@ -563,7 +633,7 @@ func (n *NamespaceManager) RebuildNamespace(config *models.Namespace) error {
 	if err != nil {
 		log.Fatal("get local proxy datacenter err:%s", err)
 	}
-	namespace, err := NewNamespace(config, proxyDatacenter)
+	namespace, err := NewNamespace(config, proxyDatacenter, n.failover)
 	if err != nil {
 		log.Warn("create namespace %s failed, err: %v", config.Name, err)
 		return err
@@ -743,6 +813,7 @@ const (
 	statsLabelSlice         = "Slice"
 	statsLabelIPAddr        = "IPAddr"
 	statsLabelRole          = "role"
+	statsLabelRewriteRule   = "RewriteRule"
 )
 
 // StatisticManager statistics manager
@@ -774,12 +845,22 @@ type StatisticManager struct {
 	backendConnectPoolActiveCounts   *stats.GaugesWithMultiLabels   // 后端活跃连接数统计
 	backendConnectPoolWaitCounts     *stats.GaugesWithMultiLabels   // 后端等待队列统计
 	backendConnectPoolCapacityCounts *stats.GaugesWithMultiLabels   // 当前连接池大小
+	backendConnectPoolLatency        *stats.GaugesWithMultiLabels   // 后端执行SQL延迟的峰值EWMA, 单位us
+	backendSlaveSelectedCounts       *stats.CountersWithMultiLabels // 从库被负载均衡选中的次数
+	backendOutlierEjectionCounts     *stats.CountersWithMultiLabels // 从库被被动健康检查摘除的次数
+	backendOutlierStates             *stats.GaugesWithMultiLabels   // 从库的熔断状态: 0 closed, 1 open, 2 half-open
 	backendInstanceDownCounts        *stats.GaugesWithMultiLabels   // 后端实例状态统计
 	uptimeCounts                     *stats.GaugesWithMultiLabels   // 启动时间记录
 	backendSQLResponse99MaxCounts    *stats.GaugesWithMultiLabels   // 后端 SQL 耗时 P99 最大响应时间
 	backendSQLResponse99AvgCounts    *stats.GaugesWithMultiLabels   // 后端 SQL 耗时 P99 平均响应时间
 	backendSQLResponse95MaxCounts    *stats.GaugesWithMultiLabels   // 后端 SQL 耗时 P95 最大响应时间
 	backendSQLResponse95AvgCounts    *stats.GaugesWithMultiLabels   // 后端 SQL 耗时 P95 平均响应时间
+	streamMergeCounts                *stats.CountersWithMultiLabels // 流式归并的查询数
+	streamMergeSkippedCounts         *stats.CountersWithMultiLabels // 分片SQL超过stream_merge_max_conns而没有使用流式归并的查询数
+	streamMergePeakMemory            *stats.GaugesWithMultiLabels   // 最近一次流式归并缓存的行占用的最大内存
+	planCacheHitCounts               *stats.CountersWithMultiLabels // 命中执行计划缓存的查询数
+	planCacheMissCounts              *stats.CountersWithMultiLabels // 未命中执行计划缓存的查询数
+	rewriteRuleHitCounts             *stats.CountersWithMultiLabels // 每条SQL改写规则命中的查询数
 
 	SQLResponsePercentile map[string]*SQLResponse // 用于记录 P99/P95 Max/AVG 响应时间
 	slowSQLTime           int64
@@ -942,6 +1023,14 @@ func (s *StatisticManager) Init(cfg *models.Proxy) error {
 		"gaea proxy backend active connect counts", []string{statsLabelCluster, statsLabelNamespace, statsLabelSlice, statsLabelIPAddr, statsLabelRole})
 	s.backendConnectPoolCapacityCounts = stats.NewGaugesWithMultiLabels("backendConnectPoolCapacityCounts",
 		"gaea proxy backend capacity connect counts", []string{statsLabelCluster, statsLabelNamespace, statsLabelSlice, statsLabelIPAddr, statsLabelRole})
+	s.backendConnectPoolLatency = stats.NewGaugesWithMultiLabels("backendConnectPoolLatency",
+		"gaea proxy backend peak ewma latency in microseconds", []string{statsLabelCluster, statsLabelNamespace, statsLabelSlice, statsLabelIPAddr, statsLabelRole})
+	s.backendSlaveSelectedCounts = stats.NewCountersWithMultiLabels("backendSlaveSelectedCounts",
+		"gaea proxy backend slave selected counts", []string{statsLabelCluster, statsLabelNamespace, statsLabelSlice, statsLabelIPAddr, statsLabelRole})
+	s.backendOutlierEjectionCounts = stats.NewCountersWithMultiLabels("backendOutlierEjectionCounts",
+		"gaea proxy backend slave ejection counts of outlier detection", []string{statsLabelCluster, statsLabelNamespace, statsLabelSlice, statsLabelIPAddr, statsLabelRole})
+	s.backendOutlierStates = stats.NewGaugesWithMultiLabels("backendOutlierStates",
+		"gaea proxy backend slave circuit breaker state, 0: closed, 1: open, 2: half-open", []string{statsLabelCluster, statsLabelNamespace, statsLabelSlice, statsLabelIPAddr, statsLabelRole})
 	s.backendInstanceDownCounts = stats.NewGaugesWithMultiLabels("backendInstanceDownCounts",
 		"gaea proxy backend DB status down counts", []string{statsLabelCluster, statsLabelNamespace, statsLabelSlice, statsLabelIPAddr, statsLabelRole})
 	s.backendSQLResponse99MaxCounts = stats.NewGaugesWithMultiLabels("backendSQLResponse99MaxCounts",
@@ -954,6 +1043,18 @@ func (s *StatisticManager) Init(cfg *models.Proxy) error {
 		"gaea proxy backend sql sqlTimings P95 avg", []string{statsLabelCluster, statsLabelNamespace, statsLabelIPAddr})
 	s.uptimeCounts = stats.NewGaugesWithMultiLabels("UptimeCounts",
 		"gaea proxy uptime counts", []string{statsLabelCluster})
+	s.streamMergeCounts = stats.NewCountersWithMultiLabels("StreamMergeCounts",
+		"gaea proxy stream merge query counts", []string{statsLabelCluster, statsLabelNamespace})
+	s.streamMergeSkippedCounts = stats.NewCountersWithMultiLabels("StreamMergeSkippedCounts",
+		"gaea proxy query counts which exceed stream merge max conns and read all results before merging", []string{statsLabelCluster, statsLabelNamespace})
+	s.streamMergePeakMemory = stats.NewGaugesWithMultiLabels("StreamMergePeakMemory",
+		"gaea proxy peak memory in bytes of the last stream merge query", []string{statsLabelCluster, statsLabelNamespace})
+	s.planCacheHitCounts = stats.NewCountersWithMultiLabels("PlanCacheHitCounts",
+		"gaea proxy plan cache hit counts", []string{statsLabelCluster, statsLabelNamespace})
+	s.planCacheMissCounts = stats.NewCountersWithMultiLabels("PlanCacheMissCounts",
+		"gaea proxy plan cache miss counts", []string{statsLabelCluster, statsLabelNamespace})
+	s.rewriteRuleHitCounts = stats.NewCountersWithMultiLabels("RewriteRuleHitCounts",
+		"gaea proxy sql rewrite rule hit counts", []string{statsLabelCluster, statsLabelNamespace, statsLabelRewriteRule})
 	s.clientConnecions = sync.Map{}
 	s.startClearTask()
 	return nil
@@ -1136,6 +1237,30 @@ func (s *StatisticManager) recordConnectPoolCount(namespace string, slice string
 	s.backendConnectPoolCapacityCounts.Set(statsKey, count)
 }
 
+// recordConnectPoolLatency records the peak ewma latency of a backend instance
+func (s *StatisticManager) recordConnectPoolLatency(namespace string, slice string, addr string, latency time.Duration, role string) {
+	statsKey := []string{s.clusterName, namespace, slice, addr, role}
+	s.backendConnectPoolLatency.Set(statsKey, latency.Microseconds())
+}
+
+// recordSlaveSelectedCount adds how many times the slave is selected by balancer since last record
+func (s *StatisticManager) recordSlaveSelectedCount(namespace string, slice string, addr string, count int64, role string) {
+	if count <= 0 {
+		return
+	}
+	statsKey := []string{s.clusterName, namespace, slice, addr, role}
+	s.backendSlaveSelectedCounts.Add(statsKey, count)
+}
+
+// recordOutlierStatus adds ejections since last record and records circuit breaker state of a slave
+func (s *StatisticManager) recordOutlierStatus(namespace string, slice string, status backend.OutlierStatus, ejections int64, role string) {
+	statsKey := []string{s.clusterName, namespace, slice, status.Addr, role}
+	if ejections > 0 {
+		s.backendOutlierEjectionCounts.Add(statsKey, ejections)
+	}
+	s.backendOutlierStates.Set(statsKey, int64(status.State))
+}
+
 // record wait queue length
 func (s *StatisticManager) recordInstanceDownCount(namespace string, slice string, addr string, count int64, role string) {
 	statsKey := []string{s.clusterName, namespace, slice, addr, role}
@@ -1163,6 +1288,46 @@ func (s *StatisticManager) recordBackendSQLTimingP95Avg(namespace, backendAddr s
 	s.backendSQLResponse95AvgCounts.Set(statsKey, count)
 }
 
+// RecordStreamMerge record stream merge query and the peak memory of rows buffered in it
+func (s *StatisticManager) RecordStreamMerge(namespace string, peakMemory int64) {
+	statsKey := []string{s.clusterName, namespace}
+	s.streamMergeCounts.Add(statsKey, 1)
+	s.streamMergePeakMemory.Set(statsKey, peakMemory)
+}
+
+// RecordStreamMergeSkipped record query which can be merged in stream but has too many shard sqls in one slice
+func (s *StatisticManager) RecordStreamMergeSkipped(namespace string) {
+	statsKey := []string{s.clusterName, namespace}
+	s.streamMergeSkippedCounts.Add(statsKey, 1)
+}
+
+// RecordPlanCache record hit or miss of plan cache
+func (s *StatisticManager) RecordPlanCache(namespace string, hit bool) {
+	statsKey := []string{s.clusterName, namespace}
+	if hit {
+		s.planCacheHitCounts.Add(statsKey, 1)
+	} else {
+		s.planCacheMissCounts.Add(statsKey, 1)
+	}
+}
+
+// RecordRewriteRuleHit record query count of rewrite rule
+func (s *StatisticManager) RecordRewriteRuleHit(namespace, rule string) {
+	s.rewriteRuleHitCounts.Add([]string{s.clusterName, namespace, rule}, 1)
+}
+
+// GetRewriteRuleHits return hit counts of rewrite rules in namespace, key: rule name
+func (s *StatisticManager) GetRewriteRuleHits(namespace string, rules []string) map[string]int64 {
+	// Counts的key为以.连接的label, label中的.被替换为_
+	prefix := strings.Replace(s.clusterName, ".", "_", -1) + "." + strings.Replace(namespace, ".", "_", -1) + "."
+	counts := s.rewriteRuleHitCounts.Counts()
+	ret := make(map[string]int64, len(rules))
+	for _, rule := range rules {
+		ret[rule] = counts[prefix+rule]
+	}
+	return ret
+}
+
 // AddUptimeCount add uptime count
 func (s *StatisticManager) AddUptimeCount(count int64) {
 	statsKey := []string{s.clusterName}
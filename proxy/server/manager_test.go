@@ -335,3 +335,22 @@ func createNamespaceUsers(ns string, users []*userinfo) *models.Namespace {
 		Users: userList,
 	}
 }
+
+func TestAllProxiesAgree(t *testing.T) {
+	proxies := map[string]*models.ProxyMonitorMetric{"10.0.0.1:13306": {}, "10.0.0.2:13306": {}}
+	tests := []struct {
+		proxies map[string]*models.ProxyMonitorMetric
+		votes   map[string]string
+		expect  bool
+	}{
+		{nil, map[string]string{}, false},
+		{proxies, map[string]string{"10.0.0.1:13306": "m:3306"}, false},
+		{proxies, map[string]string{"10.0.0.1:13306": "m:3306", "10.0.0.2:13306": "s:3306"}, false},
+		{proxies, map[string]string{"10.0.0.1:13306": "m:3306", "10.0.0.2:13306": "m:3306"}, true},
+	}
+	for _, test := range tests {
+		if actual := allProxiesAgree(test.proxies, test.votes, "m:3306"); actual != test.expect {
+			t.Errorf("allProxiesAgree error, votes: %v, expect: %t, actual: %t", test.votes, test.expect, actual)
+		}
+	}
+}
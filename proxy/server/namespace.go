@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -28,6 +29,7 @@ import (
 	"github.com/XiaoMi/Gaea/log"
 	"github.com/XiaoMi/Gaea/models"
 	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/parser"
 	"github.com/XiaoMi/Gaea/proxy/plan"
 	"github.com/XiaoMi/Gaea/proxy/router"
 	"github.com/XiaoMi/Gaea/proxy/sequence"
@@ -50,6 +52,14 @@ const (
 	defaultTimeAfterNoAlive  = 32    // 每间隔4秒进行一次检查， 默认 32秒后会探测到实例失败
 	// 认为Slave已下线，如果需要快速判定状态，可减少该值
 	defaultMaxClientConnections = 100000000 //Big enough
+	defaultMaxDistinctMemory    = 64 << 20  // 默认为64MB, 限制跨分片DISTINCT聚合去重使用的内存
+	defaultMaxInsertSelectRows  = 100000    // 默认为100000, 限制由Gaea转发的INSERT ... SELECT插入的行数
+	defaultMaxShardKeyRows      = 1000      // 默认为1000, 限制UPDATE分片列时移动的行数
+	defaultMaxSubqueryInValues  = 10000     // 默认为10000, 限制IN (SELECT ...)子查询替换为常量列表时的数量
+	defaultStreamMergeFetchSize = 64 << 10  // 默认为64KB, 流式归并时每次从每个分片读取的行的大小
+	defaultStreamMergeMaxConns  = 16        // 流式归并时每个slice默认最多使用的后端连接数
+	defaultDDLParallelism       = 4         // 默认为4, 分片表DDL在每个slice上同时执行的数量
+	defaultGTIDWaitTimeout      = 50        // 默认为50ms, 读写分离读取本会话写入的数据时, 等待slave执行GTID的最长时间
 
 )
 
@@ -58,6 +68,8 @@ type UserProperty struct {
 	RWFlag        int
 	RWSplit       int
 	OtherProperty int
+	Admin         bool
+	RequireSSL    bool
 }
 
 // Namespace is struct driected used by server
@@ -70,6 +82,7 @@ type Namespace struct {
 	allowips               []util.IPInfo
 	router                 *router.Router
 	grayRouter             *router.GrayRouter
+	sqlRewriter            *plan.SQLRewriter
 	sequences              *sequence.SequenceManager
 	slices                 map[string]*backend.Slice // key: slice name
 	userProperties         map[string]*UserProperty  // key: user name ,value: user's properties
@@ -88,6 +101,19 @@ type Namespace struct {
 	setForKeepSession      bool
 	clientQPSLimit         uint32
 	supportLimitTx         bool
+	supportXA              bool
+	maxDistinctMemory      int
+	maxInsertSelectRows    int
+	supportUpdateShardKey  bool
+	maxUpdateShardKeyRows  int
+	maxSubqueryInValues    int
+	streamMergeFetchSize   int
+	streamMergeMaxConns    int
+	ddlParallelism         int
+	ddlProgress            *plan.DDLProgress // 未全部成功的分片表DDL的执行进度, 用于断点续做
+	readYourWrites         bool
+	readYourWritesWindow   time.Duration // 0表示会话结束前一直保证
+	gtidWaitTimeout        time.Duration // 0表示不等待
 
 	slowSQLCache            *cache.LRUCache
 	errorSQLCache           *cache.LRUCache
@@ -106,7 +132,7 @@ func (n *Namespace) DumpToJSON() []byte {
 }
 
 // NewNamespace init namespace
-func NewNamespace(namespaceConfig *models.Namespace, proxyDatacenter string) (*Namespace, error) {
+func NewNamespace(namespaceConfig *models.Namespace, proxyDatacenter string, failover backend.FailoverCoordinator) (*Namespace, error) {
 	var err error
 	namespace := &Namespace{
 		name:                    namespaceConfig.Name,
@@ -117,7 +143,6 @@ func NewNamespace(namespaceConfig *models.Namespace, proxyDatacenter string) (*N
 		errorSQLCache:           cache.NewLRUCache(defaultSQLCacheCapacity),
 		backendSlowSQLCache:     cache.NewLRUCache(defaultSQLCacheCapacity),
 		backendErrorSQLCache:    cache.NewLRUCache(defaultSQLCacheCapacity),
-		planCache:               cache.NewLRUCache(defaultPlanCacheCapacity),
 		defaultSlice:            namespaceConfig.DefaultSlice,
 		allowedSessionVariables: namespaceConfig.AllowedSessionVariables,
 	}
@@ -165,6 +190,73 @@ func NewNamespace(namespaceConfig *models.Namespace, proxyDatacenter string) (*N
 		namespace.maxSqlResultSize = namespaceConfig.MaxSqlResultSize
 	}
 
+	// init max memory of distinct aggregate in multiple shards
+	if namespaceConfig.MaxDistinctMemory <= 0 && namespaceConfig.MaxDistinctMemory != -1 {
+		namespace.maxDistinctMemory = defaultMaxDistinctMemory
+	} else {
+		namespace.maxDistinctMemory = namespaceConfig.MaxDistinctMemory
+	}
+
+	// init max rows of insert ... select which can not be pushed down
+	if namespaceConfig.MaxInsertSelectRows <= 0 && namespaceConfig.MaxInsertSelectRows != -1 {
+		namespace.maxInsertSelectRows = defaultMaxInsertSelectRows
+	} else {
+		namespace.maxInsertSelectRows = namespaceConfig.MaxInsertSelectRows
+	}
+
+	// init update of sharding column, which moves rows between shards in transaction
+	namespace.supportUpdateShardKey = namespaceConfig.SupportUpdateShardKey
+	if namespaceConfig.MaxUpdateShardKeyRows <= 0 && namespaceConfig.MaxUpdateShardKeyRows != -1 {
+		namespace.maxUpdateShardKeyRows = defaultMaxShardKeyRows
+	} else {
+		namespace.maxUpdateShardKeyRows = namespaceConfig.MaxUpdateShardKeyRows
+	}
+
+	// init max values of IN list replaced from subquery result
+	if namespaceConfig.MaxSubqueryInValues <= 0 && namespaceConfig.MaxSubqueryInValues != -1 {
+		namespace.maxSubqueryInValues = defaultMaxSubqueryInValues
+	} else {
+		namespace.maxSubqueryInValues = namespaceConfig.MaxSubqueryInValues
+	}
+
+	// init fetch size of streaming merge for multi-shard ORDER BY query
+	if namespaceConfig.StreamMergeFetchSize <= 0 && namespaceConfig.StreamMergeFetchSize != -1 {
+		namespace.streamMergeFetchSize = defaultStreamMergeFetchSize
+	} else {
+		namespace.streamMergeFetchSize = namespaceConfig.StreamMergeFetchSize
+	}
+	if namespaceConfig.StreamMergeMaxConns <= 0 && namespaceConfig.StreamMergeMaxConns != -1 {
+		namespace.streamMergeMaxConns = defaultStreamMergeMaxConns
+	} else {
+		namespace.streamMergeMaxConns = namespaceConfig.StreamMergeMaxConns
+	}
+
+	// init parallelism of DDL on sharded table in each slice
+	if namespaceConfig.DDLParallelismPerSlice <= 0 {
+		namespace.ddlParallelism = defaultDDLParallelism
+	} else {
+		namespace.ddlParallelism = namespaceConfig.DDLParallelismPerSlice
+	}
+	namespace.ddlProgress = plan.NewDDLProgress()
+
+	// init plan cache, namespace重新加载时会创建新的缓存
+	if namespaceConfig.PlanCacheCapacity <= 0 && namespaceConfig.PlanCacheCapacity != -1 {
+		namespace.planCache = cache.NewLRUCache(defaultPlanCacheCapacity)
+	} else if namespaceConfig.PlanCacheCapacity > 0 {
+		namespace.planCache = cache.NewLRUCache(int64(namespaceConfig.PlanCacheCapacity))
+	}
+
+	// init read your writes of rw split, which reads from slaves executed gtids of writes in session
+	namespace.readYourWrites = namespaceConfig.ReadYourWrites
+	if namespaceConfig.ReadYourWritesWindow > 0 {
+		namespace.readYourWritesWindow = time.Duration(namespaceConfig.ReadYourWritesWindow) * time.Millisecond
+	}
+	if namespaceConfig.GTIDWaitTimeout <= 0 && namespaceConfig.GTIDWaitTimeout != -1 {
+		namespace.gtidWaitTimeout = defaultGTIDWaitTimeout * time.Millisecond
+	} else if namespaceConfig.GTIDWaitTimeout > 0 {
+		namespace.gtidWaitTimeout = time.Duration(namespaceConfig.GTIDWaitTimeout) * time.Millisecond
+	}
+
 	allowDBs := make(map[string]bool, len(namespaceConfig.AllowedDBS))
 	for db, allowed := range namespaceConfig.AllowedDBS {
 		allowDBs[strings.TrimSpace(db)] = allowed
@@ -195,7 +287,7 @@ func NewNamespace(namespaceConfig *models.Namespace, proxyDatacenter string) (*N
 
 	// init user properties
 	for _, user := range namespaceConfig.Users {
-		up := &UserProperty{RWFlag: user.RWFlag, RWSplit: user.RWSplit, OtherProperty: user.OtherProperty}
+		up := &UserProperty{RWFlag: user.RWFlag, RWSplit: user.RWSplit, OtherProperty: user.OtherProperty, Admin: user.Admin, RequireSSL: user.RequireSSL}
 		namespace.userProperties[user.UserName] = up
 	}
 
@@ -227,10 +319,21 @@ func NewNamespace(namespaceConfig *models.Namespace, proxyDatacenter string) (*N
 	}
 
 	// init backend slices
-	namespace.slices, err = parseSlices(namespaceConfig.Slices, namespace.defaultCharset, namespace.defaultCollationID, proxyDatacenter)
+	namespace.slices, err = parseSlices(namespaceConfig.Slices, namespace.defaultCharset, namespace.defaultCollationID, proxyDatacenter, namespace.readYourWrites)
 	if err != nil {
 		return nil, fmt.Errorf("init slices of namespace: %s failed, err: %v", namespaceConfig.Name, err)
 	}
+	for _, cfg := range namespaceConfig.Slices {
+		namespace.slices[cfg.Name].Outliers = backend.NewOutlierDetector(namespaceConfig.Name, cfg)
+		if !cfg.EnableFailover {
+			continue
+		}
+		if failover == nil {
+			log.Warn("[ns:%s, %s] enable_failover is ignored, cc_addr of proxy is not configured", namespaceConfig.Name, cfg.Name)
+			continue
+		}
+		namespace.slices[cfg.Name].Failover = failover
+	}
 
 	//Check slice master and slave status and mark them as unavailable when detect down
 	if namespace.downAfterNoAlive > 0 {
@@ -246,6 +349,11 @@ func NewNamespace(namespaceConfig *models.Namespace, proxyDatacenter string) (*N
 	namespace.grayRouter = router.NewGrayRouter(namespaceConfig)
 	slog.Info("init gray router of namespace: %s, gray rules: %v", namespace.name, namespace.grayRouter.GetAllRules())
 
+	namespace.sqlRewriter, err = plan.NewSQLRewriter(namespaceConfig.RewriteRules)
+	if err != nil {
+		return nil, fmt.Errorf("init rewrite rules of namespace: %s failed, err: %v", namespace.name, err)
+	}
+
 	// init global sequences config
 	// 目前只支持基于mysql的序列号
 	sequences := sequence.NewSequenceManager()
@@ -263,6 +371,9 @@ func NewNamespace(namespaceConfig *models.Namespace, proxyDatacenter string) (*N
 	// init global keepSession in namespace
 	namespace.setForKeepSession = namespaceConfig.SetForKeepSession
 
+	// init xa transaction, only works when keep session is off
+	namespace.supportXA = namespaceConfig.SupportXA
+
 	// init client qps limit config
 	if namespaceConfig.ClientQPSLimit > 0 {
 		namespace.clientQPSLimit = namespaceConfig.ClientQPSLimit
@@ -283,6 +394,16 @@ func (n *Namespace) GetSlice(name string) *backend.Slice {
 	return n.slices[name]
 }
 
+// GetSliceNames return names of all slices
+func (n *Namespace) GetSliceNames() []string {
+	names := make([]string, 0, len(n.slices))
+	for name := range n.slices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // GetDefaultSessionVariables return default session variables of namespace
 func (n *Namespace) GetAllowedSessionVariables() map[string]string {
 	return n.allowedSessionVariables
@@ -297,6 +418,11 @@ func (n *Namespace) GetGrayRouter() *router.GrayRouter {
 	return n.grayRouter
 }
 
+// GetSQLRewriter return rewriter of namespace's rewrite rules
+func (n *Namespace) GetSQLRewriter() *plan.SQLRewriter {
+	return n.sqlRewriter
+}
+
 func (n *Namespace) GetSequences() *sequence.SequenceManager {
 	return n.sequences
 }
@@ -333,6 +459,17 @@ func (n *Namespace) IsStatisticUser(user string) bool {
 	return n.userProperties[user].OtherProperty == models.StatisticUser
 }
 
+// IsAdmin check if user is allowed to use route hint
+func (n *Namespace) IsAdmin(user string) bool {
+	return n.userProperties[user].Admin
+}
+
+// IsRequireSSL check if user is only allowed to connect with TLS
+func (n *Namespace) IsRequireSSL(user string) bool {
+	up, ok := n.userProperties[user]
+	return ok && up.RequireSSL
+}
+
 // GetUserProperty return user information
 func (n *Namespace) GetUserProperty(user string) int {
 	return n.userProperties[user].OtherProperty
@@ -346,6 +483,56 @@ func (n *Namespace) GetMaxResultSize() int {
 	return n.maxSqlResultSize
 }
 
+// GetMaxDistinctMemory return max memory in bytes used by distinct aggregate in multiple shards
+func (n *Namespace) GetMaxDistinctMemory() int {
+	return n.maxDistinctMemory
+}
+
+// GetMaxInsertSelectRows return max rows inserted by insert ... select which can not be pushed down
+func (n *Namespace) GetMaxInsertSelectRows() int {
+	return n.maxInsertSelectRows
+}
+
+// IsSupportUpdateShardKey check if update of sharding column is allowed
+func (n *Namespace) IsSupportUpdateShardKey() bool {
+	return n.supportUpdateShardKey
+}
+
+// GetMaxUpdateShardKeyRows return max rows moved by update of sharding column
+func (n *Namespace) GetMaxUpdateShardKeyRows() int {
+	return n.maxUpdateShardKeyRows
+}
+
+// GetMaxSubqueryInValues return max values of IN list replaced from subquery result
+func (n *Namespace) GetMaxSubqueryInValues() int {
+	return n.maxSubqueryInValues
+}
+
+// GetStreamMergeFetchSize return max bytes of rows read from each shard at a time in streaming merge, -1 means streaming merge is disabled
+func (n *Namespace) GetStreamMergeFetchSize() int {
+	return n.streamMergeFetchSize
+}
+
+// GetStreamMergeMaxConns return max backend connections of each slice used by streaming merge, -1 means no limit
+func (n *Namespace) GetStreamMergeMaxConns() int {
+	return n.streamMergeMaxConns
+}
+
+// GetDDLParallelism return max number of DDL executed at the same time in each slice
+func (n *Namespace) GetDDLParallelism() int {
+	return n.ddlParallelism
+}
+
+// GetDDLProgress return progress of DDL on sharded table which has not succeeded on all tables
+func (n *Namespace) GetDDLProgress() *plan.DDLProgress {
+	return n.ddlProgress
+}
+
+// IsSupportXA check if transactions of namespace use xa two-phase commit
+func (n *Namespace) IsSupportXA() bool {
+	return n.supportXA
+}
+
 // IsSQLAllowed check black sql
 func (n *Namespace) IsSQLAllowed(reqCtx *util.RequestContext, sql string) bool {
 	if len(n.sqls) == 0 {
@@ -404,18 +591,33 @@ func (n *Namespace) GetDefaultCollationID() mysql.CollationID {
 	return n.defaultCollationID
 }
 
-// GetCachedPlan get plan in cache
-func (n *Namespace) GetCachedPlan(db, sql string) (plan.Plan, bool) {
-	v, ok := n.planCache.Get(db + "|" + sql)
+// IsPlanCacheEnabled return true if plan cache is enabled
+func (n *Namespace) IsPlanCacheEnabled() bool {
+	return n.planCache != nil
+}
+
+// GetCachedPlan get plan template in cache, key is db, template and param kinds of parameterized sql
+func (n *Namespace) GetCachedPlan(db string, p *parser.ParameterizedSQL) (*plan.PlanTemplate, bool) {
+	if n.planCache == nil {
+		return nil, false
+	}
+	v, ok := n.planCache.Get(planCacheKey(db, p))
 	if !ok {
 		return nil, false
 	}
-	return v.(plan.Plan), true
+	return v.(*plan.PlanTemplate), true
 }
 
-// SetCachedPlan set plan in cache
-func (n *Namespace) SetCachedPlan(db, sql string, p plan.Plan) {
-	n.planCache.SetIfAbsent(db+"|"+sql, p)
+// SetCachedPlan set plan template in cache
+func (n *Namespace) SetCachedPlan(db string, p *parser.ParameterizedSQL, t *plan.PlanTemplate) {
+	if n.planCache == nil {
+		return
+	}
+	n.planCache.SetIfAbsent(planCacheKey(db, p), t)
+}
+
+func planCacheKey(db string, p *parser.ParameterizedSQL) string {
+	return db + "|" + p.Template + "|" + p.Kinds
 }
 
 // SetSlowSQLFingerprint store slow sql fingerprint
@@ -555,7 +757,9 @@ func (n *Namespace) Close(delay bool) {
 	n.errorSQLCache.Clear()
 	n.backendSlowSQLCache.Clear()
 	n.backendErrorSQLCache.Clear()
-	n.planCache.Clear()
+	if n.planCache != nil {
+		n.planCache.Clear()
+	}
 	_ = log.Warn("close ns:%s", n.name)
 }
 
@@ -571,13 +775,18 @@ func (n *Namespace) CheckSliceStatus(ctx context.Context) {
 	}
 }
 
-func parseSlice(cfg *models.Slice, charset string, collationID mysql.CollationID, dc string) (*backend.Slice, error) {
+func parseSlice(cfg *models.Slice, charset string, collationID mysql.CollationID, dc string, sessionTrack bool) (*backend.Slice, error) {
 	var err error
 	s := new(backend.Slice)
 	s.Cfg = *cfg
 	s.ProxyDatacenter = dc
 	s.SetCharsetInfo(charset, collationID)
 	s.HealthCheckSql = cfg.HealthCheckSql
+	s.SessionTrack = sessionTrack
+	// tls config must be set before creating connection pools
+	if s.TLSConfig, err = backend.NewTLSConfig(cfg.SSLMode, cfg.SSLCA, cfg.SSLCert, cfg.SSLKey); err != nil {
+		return nil, fmt.Errorf("init tls config of slice %s error: %v", cfg.Name, err)
+	}
 	// parse master
 	err = s.ParseMaster(cfg.Master)
 	if err != nil {
@@ -600,7 +809,7 @@ func parseSlice(cfg *models.Slice, charset string, collationID mysql.CollationID
 	return s, nil
 }
 
-func parseSlices(cfgSlices []*models.Slice, charset string, collationID mysql.CollationID, dc string) (map[string]*backend.Slice, error) {
+func parseSlices(cfgSlices []*models.Slice, charset string, collationID mysql.CollationID, dc string, sessionTrack bool) (map[string]*backend.Slice, error) {
 	slices := make(map[string]*backend.Slice, len(cfgSlices))
 	for _, v := range cfgSlices {
 		v.Name = strings.TrimSpace(v.Name) // modify origin slice name, trim space
@@ -608,7 +817,7 @@ func parseSlices(cfgSlices []*models.Slice, charset string, collationID mysql.Co
 			return nil, fmt.Errorf("duplicate slice [%s]", v.Name)
 		}
 
-		s, err := parseSlice(v, charset, collationID, dc)
+		s, err := parseSlice(v, charset, collationID, dc, sessionTrack)
 		if err != nil {
 			return nil, err
 		}
@@ -15,10 +15,12 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
 	"net"
 	"runtime"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"fmt"
@@ -48,6 +50,9 @@ type Server struct {
 	ServerVersionCompareStatus *util.VersionCompareStatus
 	AuthPlugin                 string
 	ServerConfig               *models.Proxy
+
+	// 客户端连接使用的TLS配置, 为nil时不支持TLS, 收到SIGUSR1时重新加载
+	tlsConfig atomic.Pointer[tls.Config]
 }
 
 // NewServer create new server
@@ -80,6 +85,10 @@ func NewServer(cfg *models.Proxy, manager *Manager) (*Server, error) {
 
 	s.closed = sync2.NewAtomicBool(false)
 
+	if err = s.reloadTLSConfig(cfg); err != nil {
+		return nil, err
+	}
+
 	s.listener, err = net.Listen(cfg.ProtoType, cfg.ProxyAddr)
 	if err != nil {
 		return nil, err
@@ -266,5 +275,12 @@ func (s *Server) ReloadProxyConfig() error {
 	}
 	oldGeneralLogger.Close()
 
+	// reload tls certificates, 失败时继续使用原来的证书
+	if err = s.reloadTLSConfig(newCfg); err != nil {
+		return fmt.Errorf("reload tls config error:%s", err)
+	}
+	cfg.SSLCert = newCfg.SSLCert
+	cfg.SSLKey = newCfg.SSLKey
+	cfg.SSLCA = newCfg.SSLCA
 	return nil
 }
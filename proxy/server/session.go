@@ -25,6 +25,7 @@ import (
 	"github.com/XiaoMi/Gaea/backend"
 	"github.com/XiaoMi/Gaea/log"
 	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/XiaoMi/Gaea/proxy/plan"
 	"github.com/XiaoMi/Gaea/util"
 	uber_atomic "go.uber.org/atomic"
 )
@@ -59,6 +60,9 @@ type Session struct {
 	closed atomic.Value
 
 	continueConn backend.PooledConnect
+
+	// 多分片ORDER BY查询流式归并时, 在写入结果时读取归并后的行
+	resultStream *plan.StreamMerger
 }
 
 // create session between client<->proxy
@@ -231,6 +235,12 @@ func (cc *Session) handleHandshakeResponse(info HandshakeResponseInfo) error {
 
 	// set namespace
 	namespace := cc.manager.GetNamespaceByUser(user, password)
+
+	// check if user requires ssl
+	if ns := cc.manager.GetNamespace(namespace); ns != nil && ns.IsRequireSSL(user) && !cc.c.IsTLS() {
+		log.Warn("[server] Session user %s requires ssl, connId: %d", user, cc.c.GetConnectionID())
+		return mysql.NewDefaultError(mysql.ErrAccessDenied, user, cc.c.RemoteAddr().String(), "Yes")
+	}
 	cc.namespace = namespace
 	cc.executor.namespace = namespace
 	cc.c.namespace = namespace // TODO: remove it when refactor is done
@@ -324,6 +334,7 @@ func (cc *Session) writeResponse(r Response) error {
 	defer func() {
 		cc.executor.recycleBackendConn(cc.continueConn)
 		cc.continueConn = nil
+		cc.closeResultStream()
 	}()
 	switch r.RespType {
 	case RespEOF:
@@ -333,6 +344,9 @@ func (cc *Session) writeResponse(r Response) error {
 		if rs == nil {
 			return cc.c.writeOK(r.Status)
 		}
+		if cc.resultStream != nil {
+			return cc.c.writeResultStream(r.Status, rs, cc.resultStream, r.IsBinary)
+		}
 		if cc.continueConn != nil {
 			return cc.c.writeOKResultStream(r.Status, r.Data.(*mysql.Result), cc.continueConn,
 				cc.manager.GetNamespace(cc.namespace).GetMaxResultSize(), r.IsBinary)
@@ -381,6 +395,16 @@ func (cc *Session) writeResponse(r Response) error {
 	}
 }
 
+// 关闭流式归并使用的连接, 并记录归并过程中缓存的行占用的最大内存
+func (cc *Session) closeResultStream() {
+	if cc.resultStream == nil {
+		return
+	}
+	cc.resultStream.Close()
+	cc.manager.GetStatisticManager().RecordStreamMerge(cc.namespace, int64(cc.resultStream.PeakBufferSize()))
+	cc.resultStream = nil
+}
+
 // clearKsConns clear ksConns after namespace changed
 func (cc *Session) clearKsConns(nsChangeIndex uint32) {
 	if cc.executor.IsKeepSession() && cc.getNamespace().namespaceChangeIndex > nsChangeIndex && !cc.executor.isInTransaction() {
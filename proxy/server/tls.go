@@ -0,0 +1,72 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/XiaoMi/Gaea/log"
+	"github.com/XiaoMi/Gaea/models"
+)
+
+// loadServerTLSConfig 加载客户端连接使用的证书, 没有配置证书时返回nil
+func loadServerTLSConfig(cfg *models.Proxy) (*tls.Config, error) {
+	if !cfg.IsSSLEnabled() {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.SSLCert, cfg.SSLKey)
+	if err != nil {
+		return nil, fmt.Errorf("load ssl_cert %s and ssl_key %s error: %v", cfg.SSLCert, cfg.SSLKey, err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.SSLCA != "" {
+		ca, err := os.ReadFile(cfg.SSLCA)
+		if err != nil {
+			return nil, fmt.Errorf("read ssl_ca %s error: %v", cfg.SSLCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no valid certificate in ssl_ca %s", cfg.SSLCA)
+		}
+		// 配置CA后要求客户端提供证书, 与MySQL的REQUIRE X509一致
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// reloadTLSConfig 重新加载证书, 加载失败时继续使用原来的证书. 只影响新建立的连接
+func (s *Server) reloadTLSConfig(cfg *models.Proxy) error {
+	tlsConfig, err := loadServerTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	s.tlsConfig.Store(tlsConfig)
+	log.Notice("load tls config of client connections, enabled: %t, ssl_cert: %s, ssl_ca: %s", tlsConfig != nil, cfg.SSLCert, cfg.SSLCA)
+	return nil
+}
+
+// GetTLSConfig return tls config of client connections, nil means TLS is disabled
+func (s *Server) GetTLSConfig() *tls.Config {
+	return s.tlsConfig.Load()
+}
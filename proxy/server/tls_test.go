@@ -0,0 +1,217 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/XiaoMi/Gaea/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCert 生成自签名证书, 返回证书和私钥的文件路径
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gaea"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate error: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key error: %v", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("write cert error: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatalf("write key error: %v", err)
+	}
+	return certFile, keyFile
+}
+
+func readTestPacket(t *testing.T, c net.Conn) []byte {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c, header); err != nil {
+		t.Fatalf("read packet header error: %v", err)
+	}
+	length := int(uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16)
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c, data); err != nil {
+		t.Fatalf("read packet error: %v", err)
+	}
+	return data
+}
+
+func writeTestPacket(t *testing.T, c net.Conn, seq byte, data []byte) {
+	header := []byte{byte(len(data)), byte(len(data) >> 8), byte(len(data) >> 16), seq}
+	if _, err := c.Write(append(header, data...)); err != nil {
+		t.Fatalf("write packet error: %v", err)
+	}
+}
+
+// handshakeCapability 解析初始握手包中的capability
+func handshakeCapability(data []byte) uint32 {
+	pos := 1
+	for data[pos] != 0 {
+		pos++
+	}
+	pos += 1 + 4 + 8 + 1
+	lower := binary.LittleEndian.Uint16(data[pos:])
+	upper := binary.LittleEndian.Uint16(data[pos+2+1+2:])
+	return uint32(lower) | uint32(upper)<<16
+}
+
+func TestLoadServerTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir)
+
+	tlsConfig, err := loadServerTLSConfig(&models.Proxy{})
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+
+	tlsConfig, err = loadServerTLSConfig(&models.Proxy{SSLCert: certFile, SSLKey: keyFile})
+	assert.Nil(t, err)
+	assert.Equal(t, tls.NoClientCert, tlsConfig.ClientAuth)
+
+	tlsConfig, err = loadServerTLSConfig(&models.Proxy{SSLCert: certFile, SSLKey: keyFile, SSLCA: certFile})
+	assert.Nil(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, tlsConfig.ClientAuth)
+
+	_, err = loadServerTLSConfig(&models.Proxy{SSLCert: certFile, SSLKey: filepath.Join(dir, "not_exist.pem")})
+	assert.NotNil(t, err)
+	_, err = loadServerTLSConfig(&models.Proxy{SSLCert: certFile, SSLKey: keyFile, SSLCA: keyFile})
+	assert.NotNil(t, err)
+
+	// 重新加载失败时继续使用原来的证书
+	s := &Server{}
+	assert.Nil(t, s.reloadTLSConfig(&models.Proxy{SSLCert: certFile, SSLKey: keyFile}))
+	old := s.GetTLSConfig()
+	assert.NotNil(t, old)
+	assert.NotNil(t, s.reloadTLSConfig(&models.Proxy{SSLCert: certFile, SSLKey: certFile}))
+	assert.Equal(t, old, s.GetTLSConfig())
+	assert.Nil(t, s.reloadTLSConfig(&models.Proxy{}))
+	assert.Nil(t, s.GetTLSConfig())
+}
+
+func TestHandshakeWithSSL(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	s := &Server{ServerVersion: "5.7.25-gaea"}
+
+	tests := []struct {
+		name      string
+		enableSSL bool
+		clientSSL bool
+	}{
+		{name: "ssl", enableSSL: true, clientSSL: true},
+		{name: "ssl enabled but client plain", enableSSL: true},
+		{name: "ssl disabled"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := &models.Proxy{}
+			if test.enableSSL {
+				cfg.SSLCert, cfg.SSLKey = certFile, keyFile
+			}
+			if err := s.reloadTLSConfig(cfg); err != nil {
+				t.Fatalf("load tls config error: %v", err)
+			}
+
+			serverConn, clientConn := net.Pipe()
+			cc := NewClientConn(mysql.NewConn(serverConn), nil)
+			cc.proxy = s
+			defer cc.Close()
+			// 先关闭客户端, 避免关闭TLS连接时发送close_notify阻塞
+			defer clientConn.Close()
+
+			type result struct {
+				info HandshakeResponseInfo
+				err  error
+			}
+			done := make(chan result, 1)
+			go func() {
+				if err := cc.writeInitialHandshakeV10(); err != nil {
+					done <- result{err: err}
+					return
+				}
+				info, err := cc.readHandshakeResponse()
+				done <- result{info: info, err: err}
+			}()
+
+			capability := handshakeCapability(readTestPacket(t, clientConn))
+			assert.Equal(t, test.enableSSL, capability&mysql.ClientSSL > 0)
+
+			// 握手响应: capability, max packet size, charset, 23字节保留, 用户名, 空密码
+			flags := mysql.ClientProtocol41 | mysql.ClientSecureConnection
+			if test.clientSSL {
+				flags |= mysql.ClientSSL
+			}
+			response := make([]byte, 32)
+			binary.LittleEndian.PutUint32(response, flags)
+			binary.LittleEndian.PutUint32(response[4:], 1<<24)
+			response[8] = byte(mysql.DefaultCollationID)
+
+			var conn net.Conn = clientConn
+			seq := byte(1)
+			if test.clientSSL {
+				writeTestPacket(t, clientConn, seq, response)
+				seq++
+				tlsConn := tls.Client(clientConn, &tls.Config{InsecureSkipVerify: true})
+				if err := tlsConn.Handshake(); err != nil {
+					t.Fatalf("client tls handshake error: %v", err)
+				}
+				conn = tlsConn
+			}
+			response = append(response, "test_user\x00\x00"...)
+			writeTestPacket(t, conn, seq, response)
+
+			ret := <-done
+			if ret.err != nil {
+				t.Fatalf("read handshake response error: %v", ret.err)
+			}
+			assert.Equal(t, "test_user", ret.info.User)
+			assert.Equal(t, test.clientSSL, cc.IsTLS())
+		})
+	}
+}
@@ -0,0 +1,644 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/XiaoMi/Gaea/backend"
+	"github.com/XiaoMi/Gaea/log"
+	"github.com/XiaoMi/Gaea/models"
+)
+
+const (
+	xaGtridPrefix    = "gaea-"
+	xaLogDir         = "xa"
+	xaLogFileName    = "xa_decision.log"
+	xaLogCompactSize = 64 * 1024 * 1024
+	xaProxyIDFile    = "proxy_id"
+	// 定时恢复提交失败或回滚失败后仍处于prepared状态的分支
+	xaRecoverInterval = time.Minute
+
+	xaStateCommit = "commit"
+	xaStateDone   = "done"
+)
+
+// xaTransaction is a distributed transaction of one session, every slice joined is a branch,
+// the branch xid is (gtrid, slice name).
+type xaTransaction struct {
+	gtrid  string
+	slices []string
+}
+
+func newXATransaction(gtrid string) *xaTransaction {
+	return &xaTransaction{gtrid: gtrid}
+}
+
+func (t *xaTransaction) addBranch(sliceName string) {
+	t.slices = append(t.slices, sliceName)
+}
+
+// xid return xid of the branch on slice, use hex literal to avoid escaping slice name
+func (t *xaTransaction) xid(sliceName string) string {
+	return formatXid(t.gtrid, sliceName)
+}
+
+func formatXid(gtrid, bqual string) string {
+	return fmt.Sprintf("X'%s',X'%s'", hex.EncodeToString([]byte(gtrid)), hex.EncodeToString([]byte(bqual)))
+}
+
+// xaProxyIDPattern limit proxy id to 16 alphanumeric characters, the gtrid of xid is no longer than 64 bytes
+var xaProxyIDPattern = regexp.MustCompile(`^[0-9a-zA-Z_]{1,16}$`)
+
+type xaLogEntry struct {
+	Gtrid     string   `json:"gtrid"`
+	Namespace string   `json:"namespace,omitempty"`
+	Slices    []string `json:"slices,omitempty"`
+	State     string   `json:"state"`
+
+	// inDoubt is true if some branches failed to commit or the decision is loaded on startup,
+	// otherwise the transaction may still be committing and must not be touched by recovery
+	inDoubt bool
+}
+
+// XALog is the durable decision log of xa transactions. A distributed transaction is committed
+// only after its commit decision is flushed to disk, so branches left prepared by a crash can be
+// resolved by XA RECOVER: commit if the decision exists, otherwise rollback.
+type XALog struct {
+	sync.Mutex
+	proxyID   string
+	bootTime  int64
+	seq       uint64
+	path      string
+	file      *os.File
+	size      int64
+	pending   map[string]*xaLogEntry // key: gtrid, committed but not all branches finished
+	aborted   map[string]string      // key: gtrid, value: namespace, branches failed to rollback in this run
+	closeOnce sync.Once
+}
+
+// NewXALog open decision log in dir and load undone decisions
+func NewXALog(dir string, proxyID string) (*XALog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("create xa log dir error: %v", err)
+	}
+
+	l := &XALog{
+		proxyID:  proxyID,
+		bootTime: time.Now().UnixNano(),
+		path:     filepath.Join(dir, xaLogFileName),
+		pending:  make(map[string]*xaLogEntry),
+		aborted:  make(map[string]string),
+	}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open xa log error: %v", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stat xa log error: %v", err)
+	}
+	l.file = f
+	l.size = st.Size()
+	return l, nil
+}
+
+func (l *XALog) load() error {
+	f, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open xa log error: %v", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		entry := &xaLogEntry{}
+		// the last line may be partially written when crashed, its decision was never acknowledged
+		if err := json.Unmarshal(line, entry); err != nil {
+			log.Warn("skip broken xa log record: %s, err: %v", string(line), err)
+			continue
+		}
+		switch entry.State {
+		case xaStateCommit:
+			entry.inDoubt = true
+			l.pending[entry.Gtrid] = entry
+		case xaStateDone:
+			delete(l.pending, entry.Gtrid)
+		}
+	}
+	return scanner.Err()
+}
+
+// NextGtrid return a global transaction id which is unique across proxies and restarts
+func (l *XALog) NextGtrid() string {
+	seq := atomic.AddUint64(&l.seq, 1)
+	return fmt.Sprintf("%s%s-%x-%x", xaGtridPrefix, l.proxyID, l.bootTime, seq)
+}
+
+// IsOwnedGtrid check if gtrid is generated by this proxy
+func (l *XALog) IsOwnedGtrid(gtrid string) bool {
+	return strings.HasPrefix(gtrid, xaGtridPrefix+l.proxyID+"-")
+}
+
+// LogCommit write commit decision and flush it to disk
+func (l *XALog) LogCommit(namespace string, t *xaTransaction) error {
+	entry := &xaLogEntry{Gtrid: t.gtrid, Namespace: namespace, Slices: t.slices, State: xaStateCommit}
+	l.Lock()
+	defer l.Unlock()
+	if err := l.write(entry, true); err != nil {
+		return err
+	}
+	l.pending[entry.Gtrid] = entry
+	return nil
+}
+
+// MarkInDoubt mark committed transaction whose branches failed to commit, they are committed by recovery
+func (l *XALog) MarkInDoubt(gtrid string) {
+	l.Lock()
+	defer l.Unlock()
+	if entry, ok := l.pending[gtrid]; ok {
+		entry.inDoubt = true
+	}
+}
+
+// MarkAborted mark transaction whose branches failed to rollback, they are rolled back by recovery
+func (l *XALog) MarkAborted(namespace, gtrid string) {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.pending[gtrid]; !ok {
+		l.aborted[gtrid] = namespace
+	}
+}
+
+// LogDone mark all branches of transaction finished, the decision is not needed anymore
+func (l *XALog) LogDone(gtrid string) error {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.aborted, gtrid)
+	if _, ok := l.pending[gtrid]; !ok {
+		return nil
+	}
+	if err := l.write(&xaLogEntry{Gtrid: gtrid, State: xaStateDone}, false); err != nil {
+		return err
+	}
+	delete(l.pending, gtrid)
+	if l.size > xaLogCompactSize {
+		if err := l.compact(); err != nil {
+			log.Warn("compact xa log error: %v", err)
+		}
+	}
+	return nil
+}
+
+// IsCommitted check if commit decision of gtrid is logged
+func (l *XALog) IsCommitted(gtrid string) bool {
+	l.Lock()
+	defer l.Unlock()
+	_, ok := l.pending[gtrid]
+	return ok
+}
+
+// InDoubtGtrids return in-doubt and aborted gtrids of namespace, which are resolved by recovery
+func (l *XALog) InDoubtGtrids(namespace string) []string {
+	l.Lock()
+	defer l.Unlock()
+	var ret []string
+	for gtrid, entry := range l.pending {
+		if entry.inDoubt && entry.Namespace == namespace {
+			ret = append(ret, gtrid)
+		}
+	}
+	for gtrid, ns := range l.aborted {
+		if ns == namespace {
+			ret = append(ret, gtrid)
+		}
+	}
+	return ret
+}
+
+// recoverAction return the statement to resolve a prepared branch found by XA RECOVER, empty if the
+// branch is not generated by this proxy or its transaction is still in progress. Branches without
+// commit decision are rolled back only if they are left by last run or failed to rollback in this run.
+func (l *XALog) recoverAction(gtrid string) string {
+	if !l.IsOwnedGtrid(gtrid) {
+		return ""
+	}
+	l.Lock()
+	defer l.Unlock()
+	if entry, ok := l.pending[gtrid]; ok {
+		if entry.inDoubt {
+			return "XA COMMIT"
+		}
+		return ""
+	}
+	if _, ok := l.aborted[gtrid]; ok {
+		return "XA ROLLBACK"
+	}
+	if strings.HasPrefix(gtrid, fmt.Sprintf("%s%s-%x-", xaGtridPrefix, l.proxyID, l.bootTime)) {
+		return ""
+	}
+	return "XA ROLLBACK"
+}
+
+func (l *XALog) write(entry *xaLogEntry, flush bool) error {
+	if l.file == nil {
+		return fmt.Errorf("xa log is closed")
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write xa log error: %v", err)
+	}
+	if flush {
+		if err = l.file.Sync(); err != nil {
+			return fmt.Errorf("sync xa log error: %v", err)
+		}
+	}
+	return nil
+}
+
+// compact rewrite log file with pending decisions only
+func (l *XALog) compact() error {
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, entry := range l.pending {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		n, err := tmp.Write(append(data, '\n'))
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		size += int64(n)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+	if err = os.Rename(tmpPath, l.path); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	l.file.Close()
+	l.file = f
+	l.size = size
+	return nil
+}
+
+// Close close decision log file
+func (l *XALog) Close() {
+	l.closeOnce.Do(func() {
+		l.Lock()
+		defer l.Unlock()
+		if l.file != nil {
+			l.file.Close()
+			l.file = nil
+		}
+	})
+}
+
+// getXALogDir return xa decision log dir in proxy config
+func getXALogDir(cfg *models.Proxy) string {
+	if cfg.XALogPath != "" {
+		return cfg.XALogPath
+	}
+	return filepath.Join(cfg.LogPath, xaLogDir)
+}
+
+// getXAProxyID return a short id of proxy, the id must be stable across restarts so that prepared
+// branches of this proxy can be recognized by recovery. Use xa_proxy_id in config if set, otherwise
+// the id is generated on first start and saved in xa log dir, it does not change with hostname.
+func getXAProxyID(cfg *models.Proxy, dir string) (string, error) {
+	if cfg.XAProxyID != "" {
+		if !xaProxyIDPattern.MatchString(cfg.XAProxyID) {
+			return "", fmt.Errorf("invalid xa_proxy_id: %s, must be at most 16 letters, digits or underscores", cfg.XAProxyID)
+		}
+		return cfg.XAProxyID, nil
+	}
+
+	path := filepath.Join(dir, xaProxyIDFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		proxyID := strings.TrimSpace(string(data))
+		if !xaProxyIDPattern.MatchString(proxyID) {
+			return "", fmt.Errorf("invalid xa proxy id in %s: %s", path, proxyID)
+		}
+		return proxyID, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("read xa proxy id error: %v", err)
+	}
+
+	b := make([]byte, 4)
+	if _, err = rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate xa proxy id error: %v", err)
+	}
+	proxyID := hex.EncodeToString(b)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("create xa log dir error: %v", err)
+	}
+	if err = os.WriteFile(path, []byte(proxyID+"\n"), 0644); err != nil {
+		return "", fmt.Errorf("save xa proxy id error: %v", err)
+	}
+	return proxyID, nil
+}
+
+// openXALog open decision log in the dir of proxy config
+func openXALog(cfg *models.Proxy) (*XALog, error) {
+	dir := getXALogDir(cfg)
+	proxyID, err := getXAProxyID(cfg, dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewXALog(dir, proxyID)
+}
+
+// getXALog return nil if no namespace has enabled xa since proxy started
+func (m *Manager) getXALog() *XALog {
+	l, _ := m.xaLog.Load().(*XALog)
+	return l
+}
+
+// enableXALog open decision log when xa is enabled by some namespace for the first time, resolve
+// in-doubt branches left by last run and start the periodic recovery.
+func (m *Manager) enableXALog() error {
+	m.xaLogLock.Lock()
+	defer m.xaLogLock.Unlock()
+	if m.getXALog() != nil {
+		return nil
+	}
+	if m.xaCfg == nil {
+		return fmt.Errorf("xa log is not configured")
+	}
+	l, err := openXALog(m.xaCfg)
+	if err != nil {
+		return err
+	}
+	m.xaLog.Store(l)
+	m.recoverXATransactions()
+
+	go func() {
+		t := time.NewTicker(xaRecoverInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-m.GetStatisticManager().closeChan:
+				return
+			case <-t.C:
+				m.recoverXATransactions()
+			}
+		}
+	}()
+	return nil
+}
+
+// recoverXATransactions resolve in-doubt xa branches of this proxy on all namespaces that
+// support xa: branches with commit decision are committed, aborted ones are rolled back.
+func (m *Manager) recoverXATransactions() {
+	l := m.getXALog()
+	if l == nil {
+		return
+	}
+	current, _, _ := m.switchIndex.Get()
+	for name, ns := range m.namespaces[current].GetNamespaces() {
+		if !ns.IsSupportXA() {
+			continue
+		}
+
+		// take the snapshot before XA RECOVER, transactions marked later are resolved in next round
+		inDoubt := l.InDoubtGtrids(name)
+		resolved := true
+		for sliceName, slice := range ns.slices {
+			if err := m.recoverSliceXATransactions(name, slice); err != nil {
+				log.Warn("[ns:%s, %s] recover xa transactions failed, err: %v", name, sliceName, err)
+				resolved = false
+			}
+		}
+
+		// all branches of this namespace are finished, decisions can be dropped
+		if !resolved {
+			continue
+		}
+		for _, gtrid := range inDoubt {
+			if err := l.LogDone(gtrid); err != nil {
+				log.Warn("[ns:%s] mark xa transaction %s done failed, err: %v", name, gtrid, err)
+			}
+		}
+	}
+}
+
+func (m *Manager) recoverSliceXATransactions(namespace string, slice *backend.Slice) error {
+	master := slice.GetMaster()
+	if len(master.ConnPool) == 0 {
+		return fmt.Errorf("master is empty")
+	}
+	dc, err := slice.GetDirectConn(master.ConnPool[0].Addr())
+	if err != nil {
+		return err
+	}
+	defer dc.Close()
+
+	rs, err := dc.Execute("XA RECOVER", 0)
+	if err != nil {
+		return err
+	}
+	if rs.Resultset == nil {
+		return nil
+	}
+
+	var lastErr error
+	for i := 0; i < rs.RowNumber(); i++ {
+		gtridLength, err := rs.GetIntByName(i, "gtrid_length")
+		if err != nil {
+			return err
+		}
+		data, err := rs.GetStringByName(i, "data")
+		if err != nil {
+			return err
+		}
+		if int(gtridLength) > len(data) {
+			continue
+		}
+		gtrid, bqual := strings.Clone(data[:gtridLength]), strings.Clone(data[gtridLength:])
+		action := m.getXALog().recoverAction(gtrid)
+		if action == "" {
+			continue
+		}
+		if _, err = dc.Execute(action+" "+formatXid(gtrid, bqual), 0); err != nil {
+			lastErr = err
+			log.Warn("[ns:%s, %s] %s of in-doubt branch %s failed, err: %v", namespace, slice.GetSliceName(), action, gtrid, err)
+			continue
+		}
+		log.Notice("[ns:%s, %s] %s of in-doubt branch %s", namespace, slice.GetSliceName(), action, gtrid)
+	}
+	return lastErr
+}
+
+func (se *SessionExecutor) isXAEnabled() bool {
+	return se.manager.getXALog() != nil && !se.IsKeepSession() && se.GetNamespace().IsSupportXA()
+}
+
+// startXABranch start xa branch of the session transaction on slice, must be called with txLock held
+func (se *SessionExecutor) startXABranch(pc backend.PooledConnect, sliceName string) error {
+	if se.xa == nil {
+		se.xa = newXATransaction(se.manager.getXALog().NextGtrid())
+	}
+	if _, err := pc.Execute("XA START "+se.xa.xid(sliceName), 0); err != nil {
+		return err
+	}
+	se.xa.addBranch(sliceName)
+	return nil
+}
+
+// commitXA commit xa transaction and recycle branch connections, must be called with txLock held.
+// A transaction with only one branch is committed in one phase, otherwise all branches are
+// prepared and the commit decision is logged before any branch is committed.
+func (se *SessionExecutor) commitXA() (err error) {
+	t := se.xa
+	se.xa = nil
+	defer func() {
+		for sliceName, pc := range se.txConns {
+			if err == nil {
+				se.trackCommitGTIDs(sliceName, pc)
+			}
+			pc.Recycle()
+		}
+	}()
+
+	for sliceName, pc := range se.txConns {
+		if _, err = pc.Execute("XA END "+t.xid(sliceName), 0); err != nil {
+			log.Warn("[ns:%s, %s] xa end %s failed, err: %v", se.namespace, sliceName, t.gtrid, err)
+			se.rollbackXABranches(t)
+			return err
+		}
+	}
+
+	if len(se.txConns) == 1 {
+		for sliceName, pc := range se.txConns {
+			if _, err = pc.Execute("XA COMMIT "+t.xid(sliceName)+" ONE PHASE", 0); err != nil {
+				log.Warn("[ns:%s, %s] xa commit one phase %s failed, err: %v", se.namespace, sliceName, t.gtrid, err)
+				pc.Close()
+			}
+		}
+		return err
+	}
+
+	for sliceName, pc := range se.txConns {
+		if _, err = pc.Execute("XA PREPARE "+t.xid(sliceName), 0); err != nil {
+			log.Warn("[ns:%s, %s] xa prepare %s failed, err: %v", se.namespace, sliceName, t.gtrid, err)
+			se.rollbackXABranches(t)
+			return err
+		}
+	}
+
+	if err = se.manager.getXALog().LogCommit(se.namespace, t); err != nil {
+		log.Warn("[ns:%s] log xa commit decision %s failed, err: %v", se.namespace, t.gtrid, err)
+		se.rollbackXABranches(t)
+		return err
+	}
+
+	// the transaction is committed once the decision is logged, branches failed to commit
+	// are left prepared on backend and will be committed by recovery
+	done := true
+	for sliceName, pc := range se.txConns {
+		if _, e := pc.Execute("XA COMMIT "+t.xid(sliceName), 0); e != nil {
+			log.Warn("[ns:%s, %s] xa commit %s failed, branch is left in-doubt, err: %v", se.namespace, sliceName, t.gtrid, e)
+			pc.Close()
+			done = false
+		}
+	}
+	if !done {
+		se.manager.getXALog().MarkInDoubt(t.gtrid)
+		return nil
+	}
+	if e := se.manager.getXALog().LogDone(t.gtrid); e != nil {
+		log.Warn("[ns:%s] log xa done %s failed, err: %v", se.namespace, t.gtrid, e)
+	}
+	return nil
+}
+
+// rollbackXA rollback xa transaction and recycle branch connections, must be called with txLock held
+func (se *SessionExecutor) rollbackXA() error {
+	t := se.xa
+	se.xa = nil
+	err := se.rollbackXABranches(t)
+	for _, pc := range se.txConns {
+		pc.Recycle()
+	}
+	return err
+}
+
+// rollbackXABranches rollback all branches whatever state they are in, connection of
+// branch failed to rollback is closed, a prepared one will be rolled back by recovery
+func (se *SessionExecutor) rollbackXABranches(t *xaTransaction) (err error) {
+	defer func() {
+		if err != nil {
+			se.manager.getXALog().MarkAborted(se.namespace, t.gtrid)
+		}
+	}()
+	for sliceName, pc := range se.txConns {
+		if pc.IsClosed() {
+			continue
+		}
+		// branch which is not active returns error on xa end, just ignore it
+		_, _ = pc.Execute("XA END "+t.xid(sliceName), 0)
+		if _, e := pc.Execute("XA ROLLBACK "+t.xid(sliceName), 0); e != nil {
+			log.Warn("[ns:%s, %s] xa rollback %s failed, err: %v", se.namespace, sliceName, t.gtrid, e)
+			pc.Close()
+			err = e
+		}
+	}
+	return err
+}
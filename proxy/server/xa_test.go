@@ -0,0 +1,229 @@
+// Copyright 2024 The Gaea Authors. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/XiaoMi/Gaea/backend"
+	"github.com/XiaoMi/Gaea/models"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXALogDecision(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewXALog(dir, "a1b2c3d4")
+	assert.Nil(t, err)
+
+	gtrid := l.NextGtrid()
+	assert.True(t, l.IsOwnedGtrid(gtrid))
+	assert.False(t, l.IsOwnedGtrid("gaea-ffffffff-1-1"))
+	assert.NotEqual(t, gtrid, l.NextGtrid())
+
+	tx := newXATransaction(gtrid)
+	tx.addBranch("slice-0")
+	tx.addBranch("slice-1")
+	assert.Nil(t, l.LogCommit("ns", tx))
+	assert.True(t, l.IsCommitted(gtrid))
+	l.Close()
+
+	// decision survives restart
+	l, err = NewXALog(dir, "a1b2c3d4")
+	assert.Nil(t, err)
+	assert.True(t, l.IsCommitted(gtrid))
+	assert.Equal(t, []string{gtrid}, l.InDoubtGtrids("ns"))
+	assert.Nil(t, l.LogDone(gtrid))
+	assert.False(t, l.IsCommitted(gtrid))
+	l.Close()
+
+	l, err = NewXALog(dir, "a1b2c3d4")
+	assert.Nil(t, err)
+	assert.False(t, l.IsCommitted(gtrid))
+	l.Close()
+}
+
+func TestXALogSkipBrokenRecord(t *testing.T) {
+	dir := t.TempDir()
+	content := `{"gtrid":"gaea-a1b2c3d4-1-1","namespace":"ns","state":"commit"}` + "\n" + `{"gtrid":"gaea-a1b2c3d4-1-2","names`
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, xaLogFileName), []byte(content), 0644))
+
+	l, err := NewXALog(dir, "a1b2c3d4")
+	assert.Nil(t, err)
+	defer l.Close()
+	assert.True(t, l.IsCommitted("gaea-a1b2c3d4-1-1"))
+	assert.False(t, l.IsCommitted("gaea-a1b2c3d4-1-2"))
+}
+
+func TestXALogRecoverAction(t *testing.T) {
+	dir := t.TempDir()
+	l, err := NewXALog(dir, "a1b2c3d4")
+	assert.Nil(t, err)
+	lastRun := l.NextGtrid()
+	committed := newXATransaction(l.NextGtrid())
+	assert.Nil(t, l.LogCommit("ns", committed))
+	l.Close()
+
+	l, err = NewXALog(dir, "a1b2c3d4")
+	assert.Nil(t, err)
+	defer l.Close()
+	assert.Equal(t, "", l.recoverAction("gaea-ffffffff-1-1"))
+	// branches left by last run
+	assert.Equal(t, "XA ROLLBACK", l.recoverAction(lastRun))
+	assert.Equal(t, "XA COMMIT", l.recoverAction(committed.gtrid))
+
+	// transactions of this run are resolved only after commit or rollback failed
+	committing := newXATransaction(l.NextGtrid())
+	assert.Nil(t, l.LogCommit("ns", committing))
+	assert.Equal(t, "", l.recoverAction(committing.gtrid))
+	l.MarkInDoubt(committing.gtrid)
+	assert.Equal(t, "XA COMMIT", l.recoverAction(committing.gtrid))
+
+	rollingBack := l.NextGtrid()
+	assert.Equal(t, "", l.recoverAction(rollingBack))
+	l.MarkAborted("ns", rollingBack)
+	assert.Equal(t, "XA ROLLBACK", l.recoverAction(rollingBack))
+	assert.ElementsMatch(t, []string{committed.gtrid, committing.gtrid, rollingBack}, l.InDoubtGtrids("ns"))
+
+	for _, gtrid := range l.InDoubtGtrids("ns") {
+		assert.Nil(t, l.LogDone(gtrid))
+	}
+	assert.Empty(t, l.InDoubtGtrids("ns"))
+}
+
+func TestGetXAProxyID(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "xa")
+	proxyID, err := getXAProxyID(&models.Proxy{}, dir)
+	assert.Nil(t, err)
+	assert.Regexp(t, "^[0-9a-f]{8}$", proxyID)
+
+	// the generated id is reused after restart
+	again, err := getXAProxyID(&models.Proxy{}, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, proxyID, again)
+
+	configured, err := getXAProxyID(&models.Proxy{XAProxyID: "proxy_01"}, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, "proxy_01", configured)
+	_, err = getXAProxyID(&models.Proxy{XAProxyID: "proxy-01"}, dir)
+	assert.NotNil(t, err)
+}
+
+func TestEnableXALogFailed(t *testing.T) {
+	m := &Manager{xaCfg: &models.Proxy{XALogPath: "/proc/gaea-xa"}}
+	assert.Nil(t, m.getXALog())
+	assert.NotNil(t, m.enableXALog())
+	assert.Nil(t, m.getXALog())
+}
+
+func TestFormatXid(t *testing.T) {
+	assert.Equal(t, "X'67616561',X'736c6963652d30'", formatXid("gaea", "slice-0"))
+}
+
+func newXATestExecutor(t *testing.T, conns map[string]backend.PooledConnect) (*SessionExecutor, *XALog) {
+	l, err := NewXALog(t.TempDir(), "a1b2c3d4")
+	assert.Nil(t, err)
+	m := &Manager{}
+	m.xaLog.Store(l)
+	se := &SessionExecutor{
+		manager:   m,
+		namespace: "test_xa",
+		txConns:   conns,
+		xa:        newXATransaction(l.NextGtrid()),
+		gtids:     newGTIDTracker(),
+	}
+	for sliceName := range conns {
+		se.xa.addBranch(sliceName)
+	}
+	return se, l
+}
+
+func TestCommitXATwoPhase(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	conns := make(map[string]backend.PooledConnect)
+	for _, sliceName := range []string{"slice-0", "slice-1"} {
+		pc := backend.NewMockPooledConnect(ctrl)
+		conns[sliceName] = pc
+	}
+	se, l := newXATestExecutor(t, conns)
+	defer l.Close()
+	gtrid := se.xa.gtrid
+
+	for sliceName, c := range conns {
+		pc := c.(*backend.MockPooledConnect)
+		xid := formatXid(gtrid, sliceName)
+		gomock.InOrder(
+			pc.EXPECT().Execute("XA END "+xid, 0).Return(nil, nil),
+			pc.EXPECT().Execute("XA PREPARE "+xid, 0).Return(nil, nil),
+			pc.EXPECT().Execute("XA COMMIT "+xid, 0).Return(nil, nil),
+			pc.EXPECT().Recycle(),
+		)
+	}
+
+	assert.Nil(t, se.commitXA())
+	assert.Nil(t, se.xa)
+	assert.False(t, l.IsCommitted(gtrid))
+}
+
+func TestCommitXAOnePhase(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	pc := backend.NewMockPooledConnect(ctrl)
+	se, l := newXATestExecutor(t, map[string]backend.PooledConnect{"slice-0": pc})
+	defer l.Close()
+	xid := formatXid(se.xa.gtrid, "slice-0")
+
+	gomock.InOrder(
+		pc.EXPECT().Execute("XA END "+xid, 0).Return(nil, nil),
+		pc.EXPECT().Execute("XA COMMIT "+xid+" ONE PHASE", 0).Return(nil, nil),
+		pc.EXPECT().Recycle(),
+	)
+	assert.Nil(t, se.commitXA())
+}
+
+func TestCommitXAPrepareFailed(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	okConn := backend.NewMockPooledConnect(ctrl)
+	failConn := backend.NewMockPooledConnect(ctrl)
+	se, l := newXATestExecutor(t, map[string]backend.PooledConnect{"slice-0": okConn, "slice-1": failConn})
+	defer l.Close()
+	gtrid := se.xa.gtrid
+	okXid, failXid := formatXid(gtrid, "slice-0"), formatXid(gtrid, "slice-1")
+
+	// prepare of slice-0 may not be executed, it depends on the order of map iteration
+	okConn.EXPECT().Execute("XA END "+okXid, 0).Return(nil, nil).Times(2)
+	okConn.EXPECT().Execute("XA PREPARE "+okXid, 0).Return(nil, nil).MaxTimes(1)
+	okConn.EXPECT().Execute("XA ROLLBACK "+okXid, 0).Return(nil, nil)
+	okConn.EXPECT().IsClosed().Return(false)
+	okConn.EXPECT().Recycle()
+
+	failConn.EXPECT().Execute("XA END "+failXid, 0).Return(nil, nil).Times(2)
+	failConn.EXPECT().Execute("XA PREPARE "+failXid, 0).Return(nil, fmt.Errorf("prepare error"))
+	failConn.EXPECT().Execute("XA ROLLBACK "+failXid, 0).Return(nil, nil)
+	failConn.EXPECT().IsClosed().Return(false)
+	failConn.EXPECT().Recycle()
+
+	assert.NotNil(t, se.commitXA())
+	// nothing is committed, so no decision is left
+	assert.False(t, l.IsCommitted(gtrid))
+}
@@ -23,6 +23,17 @@ type RequestContext struct {
 	fingerprint    string
 	fingerprintMD5 string
 	defaultSlice   string
+
+	maxResultSize       int
+	maxDistinctMemory   int
+	maxInsertSelectRows int
+
+	inTransaction         bool
+	supportUpdateShardKey bool
+	maxUpdateShardKeyRows int
+	maxSubqueryInValues   int
+	ddlResume             bool
+	routeHint             string // SQL中的GAEA_ROUTE或GAEA_BROADCAST hint, 记录到general log
 }
 
 // NewRequestContext return request scopre context
@@ -77,3 +88,75 @@ func (reqCtx *RequestContext) GetDefaultSlice() string {
 func (reqCtx *RequestContext) SetDefaultSlice(value string) {
 	reqCtx.defaultSlice = value
 }
+
+func (reqCtx *RequestContext) GetMaxResultSize() int {
+	return reqCtx.maxResultSize
+}
+
+func (reqCtx *RequestContext) SetMaxResultSize(value int) {
+	reqCtx.maxResultSize = value
+}
+
+func (reqCtx *RequestContext) GetMaxDistinctMemory() int {
+	return reqCtx.maxDistinctMemory
+}
+
+func (reqCtx *RequestContext) SetMaxDistinctMemory(value int) {
+	reqCtx.maxDistinctMemory = value
+}
+
+func (reqCtx *RequestContext) GetMaxInsertSelectRows() int {
+	return reqCtx.maxInsertSelectRows
+}
+
+func (reqCtx *RequestContext) SetMaxInsertSelectRows(value int) {
+	reqCtx.maxInsertSelectRows = value
+}
+
+func (reqCtx *RequestContext) IsInTransaction() bool {
+	return reqCtx.inTransaction
+}
+
+func (reqCtx *RequestContext) SetInTransaction(value bool) {
+	reqCtx.inTransaction = value
+}
+
+func (reqCtx *RequestContext) IsSupportUpdateShardKey() bool {
+	return reqCtx.supportUpdateShardKey
+}
+
+func (reqCtx *RequestContext) SetSupportUpdateShardKey(value bool) {
+	reqCtx.supportUpdateShardKey = value
+}
+
+func (reqCtx *RequestContext) GetMaxUpdateShardKeyRows() int {
+	return reqCtx.maxUpdateShardKeyRows
+}
+
+func (reqCtx *RequestContext) SetMaxUpdateShardKeyRows(value int) {
+	reqCtx.maxUpdateShardKeyRows = value
+}
+
+func (reqCtx *RequestContext) GetMaxSubqueryInValues() int {
+	return reqCtx.maxSubqueryInValues
+}
+
+func (reqCtx *RequestContext) SetMaxSubqueryInValues(value int) {
+	reqCtx.maxSubqueryInValues = value
+}
+
+func (reqCtx *RequestContext) IsDDLResume() bool {
+	return reqCtx.ddlResume
+}
+
+func (reqCtx *RequestContext) SetDDLResume(value bool) {
+	reqCtx.ddlResume = value
+}
+
+func (reqCtx *RequestContext) GetRouteHint() string {
+	return reqCtx.routeHint
+}
+
+func (reqCtx *RequestContext) SetRouteHint(value string) {
+	reqCtx.routeHint = value
+}